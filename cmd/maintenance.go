@@ -0,0 +1,157 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var maintenanceUrl string
+var maintenanceUser string
+var maintenancePass string
+var maintenanceStart string
+var maintenanceEnd string
+var maintenanceDuration time.Duration
+var maintenanceMessage string
+var maintenanceAll bool
+
+// maintenanceCmd represents the maintenance command
+var maintenanceCmd = &cobra.Command{
+	Use:   "maintenance",
+	Short: "Enters or leaves maintenance of a running booster-web server",
+	Long: `Enters or leaves maintenance of a running booster-web server.
+
+During maintenance, new analyses are refused, running analyses go on and
+results stay available. Upcoming maintenance windows are announced on
+all pages.
+
+The server is reached at --url (default: http://localhost:<http.port>), with
+the admin credentials of the configuration file (authentication.user and
+authentication.password), or given with --user and --password.
+`,
+}
+
+var maintenanceStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Prints the current and upcoming maintenance windows",
+	Run: func(cmd *cobra.Command, args []string) {
+		maintenanceRequest(http.MethodGet, nil)
+	},
+}
+
+var maintenanceEnterCmd = &cobra.Command{
+	Use:   "enter",
+	Short: "Enters maintenance, now or at --start",
+	Long: `Enters maintenance, now or at --start.
+
+Dates are given in RFC3339 format, e.g. 2021-06-01T08:00:00+02:00.
+Without --end or --duration, maintenance lasts until it is left.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		var window server.MaintenanceWindow
+		window.Message = maintenanceMessage
+		if maintenanceStart != "" {
+			if window.Start, err = time.Parse(time.RFC3339, maintenanceStart); err != nil {
+				exitError(err)
+			}
+		} else {
+			window.Start = time.Now()
+		}
+		if maintenanceEnd != "" {
+			var end time.Time
+			if end, err = time.Parse(time.RFC3339, maintenanceEnd); err != nil {
+				exitError(err)
+			}
+			window.End = &end
+		} else if maintenanceDuration > 0 {
+			end := window.Start.Add(maintenanceDuration)
+			window.End = &end
+		}
+		maintenanceRequest(http.MethodPost, &window)
+	},
+}
+
+var maintenanceLeaveCmd = &cobra.Command{
+	Use:   "leave",
+	Short: "Leaves the maintenance in progress",
+	Run: func(cmd *cobra.Command, args []string) {
+		maintenanceRequest(http.MethodDelete, nil)
+	},
+}
+
+func maintenanceRequest(method string, window *server.MaintenanceWindow) {
+	url := maintenanceUrl
+	if url == "" {
+		port := viper.GetInt("http.port")
+		if port == 0 {
+			port = server.HTTP_PORT_DEFAULT
+		}
+		url = fmt.Sprintf("http://localhost:%d", port)
+	}
+	user := maintenanceUser
+	if user == "" {
+		user = viper.GetString("authentication.user")
+	}
+	pass := maintenancePass
+	if pass == "" {
+		pass = viper.GetString("authentication.password")
+	}
+
+	status, err := server.MaintenanceRequest(url, user, pass, method, window, maintenanceAll)
+	if err != nil {
+		exitError(err)
+	}
+	out, _ := json.MarshalIndent(status, "", "  ")
+	fmt.Println(string(out))
+}
+
+func exitError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func init() {
+	maintenanceCmd.PersistentFlags().StringVar(&maintenanceUrl, "url", "", "Url of the booster-web server (default: http://localhost:<http.port>)")
+	maintenanceCmd.PersistentFlags().StringVar(&maintenanceUser, "user", "", "Admin user (default: authentication.user)")
+	maintenanceCmd.PersistentFlags().StringVar(&maintenancePass, "password", "", "Admin password (default: authentication.password)")
+	maintenanceEnterCmd.Flags().StringVar(&maintenanceStart, "start", "", "Start of the maintenance, RFC3339 date (default: now)")
+	maintenanceEnterCmd.Flags().StringVar(&maintenanceEnd, "end", "", "Scheduled end of the maintenance, RFC3339 date")
+	maintenanceEnterCmd.Flags().DurationVar(&maintenanceDuration, "duration", 0, "Scheduled duration of the maintenance, e.g. 2h (if --end is not given)")
+	maintenanceEnterCmd.Flags().StringVar(&maintenanceMessage, "message", "", "Reason of the maintenance, displayed to the users")
+	maintenanceLeaveCmd.Flags().BoolVar(&maintenanceAll, "all", false, "Also cancels the upcoming maintenance windows")
+
+	maintenanceCmd.AddCommand(maintenanceStatusCmd)
+	maintenanceCmd.AddCommand(maintenanceEnterCmd)
+	maintenanceCmd.AddCommand(maintenanceLeaveCmd)
+	RootCmd.AddCommand(maintenanceCmd)
+}
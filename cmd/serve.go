@@ -0,0 +1,52 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package cmd
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Starts the booster-web server",
+	Long: `Starts the booster-web server (same as running booster-web without command).
+
+With runners.type="distributed", the server only stores the analyses, that
+are run by booster-web worker processes.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rand.Seed(time.Now().UnixNano())
+		server.InitServer(viper.GetViper())
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+}
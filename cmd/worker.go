@@ -0,0 +1,69 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/evolbioinfo/booster-web/processor"
+	"github.com/evolbioinfo/booster-web/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// workerCmd represents the worker command
+var workerCmd = &cobra.Command{
+	Use:   processor.WORKER_COMMAND,
+	Short: "Runs analyses of a distributed booster-web server",
+	Long: `Runs analyses of a distributed booster-web server.
+
+The worker claims the analyses stored by a server with runners.type="distributed"
+in the shared mysql database, and runs them with its local tools.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		server.InitWorker(viper.GetViper())
+	},
+}
+
+// jobCmd runs a single booster job, read on stdin, and writes its
+// progress and results on stdout. It is started by the local processor
+// when runners.isolation="worker", and is not meant to be run by hand.
+var jobCmd = &cobra.Command{
+	Use:    processor.WORKER_JOB_COMMAND,
+	Short:  "Runs a booster job in a separate process",
+	Long:   `Runs a booster job in a separate process`,
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := processor.RunWorker(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	workerCmd.AddCommand(jobCmd)
+	RootCmd.AddCommand(workerCmd)
+}
@@ -0,0 +1,286 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+// Package comparison compares the supports of two finished analyses
+// run on the same dataset (e.g. FastTree vs. PhyML-SMS, or FBP vs. TBE)
+package comparison
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/gotree/io/newick"
+	"github.com/evolbioinfo/gotree/tree"
+)
+
+const (
+	ALGORITHM_TBE = "tbe"
+	ALGORITHM_FBP = "fbp"
+
+	CUTOFF_DEFAULT = 0.7 // Default support cutoff for a branch to be considered well supported
+)
+
+// A branch (bipartition) of one or both reference trees
+type BranchComparison struct {
+	Taxa     []string `json:"taxa"`     // Taxa of the lightest side of the bipartition
+	Support1 float64  `json:"support1"` // Support of the branch in the first tree (-1 if absent)
+	Support2 float64  `json:"support2"` // Support of the branch in the second tree (-1 if absent)
+	Diff     float64  `json:"diff"`     // Support1-Support2 (only if the branch is in both trees)
+}
+
+type ComparisonInformation struct {
+	Id1             string              `json:"id1"`
+	Id2             string              `json:"id2"`
+	RunName1        string              `json:"runname1"`
+	RunName2        string              `json:"runname2"`
+	Workflow1       string              `json:"workflow1"`
+	Workflow2       string              `json:"workflow2"`
+	Algorithm1      string              `json:"algorithm1"`     // tbe or fbp
+	Algorithm2      string              `json:"algorithm2"`     // tbe or fbp
+	Cutoff          float64             `json:"cutoff"`         // Support cutoff used to define well supported branches
+	NbTips          int                 `json:"nbtips"`         // Number of tips of the trees
+	RFDistance      int                 `json:"rfdistance"`     // Robinson-Foulds distance between the two reference trees
+	NormRFDistance  float64             `json:"normrfdistance"` // RF distance divided by the max possible RF distance
+	SameTopology    bool                `json:"sametopology"`   // True if RFDistance==0
+	SupportDiffs    []*BranchComparison `json:"supportdiffs"`   // Per branch support differences (only if same topology)
+	OnlyWellIn1     []*BranchComparison `json:"onlywellin1"`    // Branches well supported in tree 1 but not in tree 2
+	OnlyWellIn2     []*BranchComparison `json:"onlywellin2"`    // Branches well supported in tree 2 but not in tree 1
+	MeanAbsDiff     float64             `json:"meanabsdiff"`    // Mean absolute support difference over common branches
+	CommonBranches  int                 `json:"commonbranches"` // Number of internal branches common to both trees
+	Tanglegram      template.URL        `json:"tanglegram"`     // Base64 representation of the SVG tanglegram, as a safe template URL
+	tanglegramBytes []byte
+}
+
+// A non trivial branch of a tree, with its support
+type split struct {
+	edge    *tree.Edge
+	support float64
+}
+
+// Compares supports of analysis a1 computed with algorithm algo1 (tbe|fbp)
+// and supports of analysis a2 computed with algorithm algo2 (tbe|fbp).
+//
+// Both analyses must be finished, and their reference trees must
+// have the same set of tips.
+func Compare(a1, a2 *model.Analysis, algo1, algo2 string, cutoff float64) (c *ComparisonInformation, err error) {
+	var t1, t2 *tree.Tree
+	var splits1, splits2 []*split
+	var index1, index2 *tree.EdgeIndex
+
+	if t1, err = supportTree(a1, algo1); err != nil {
+		return
+	}
+	if t2, err = supportTree(a2, algo2); err != nil {
+		return
+	}
+	if err = t1.CompareTipIndexes(t2); err != nil {
+		err = errors.New("Reference trees do not have the same tip names: " + err.Error())
+		return
+	}
+
+	// Tip indexes of the bitsets follow the alphabetical order of the tips
+	tips := t1.AllTipNames()
+	sort.Strings(tips)
+
+	if splits1, index1, err = treeSplits(t1, len(tips)); err != nil {
+		return
+	}
+	if splits2, index2, err = treeSplits(t2, len(tips)); err != nil {
+		return
+	}
+
+	c = &ComparisonInformation{
+		Id1:          a1.Id,
+		Id2:          a2.Id,
+		RunName1:     a1.RunName,
+		RunName2:     a2.RunName,
+		Workflow1:    a1.WorkflowStr(),
+		Workflow2:    a2.WorkflowStr(),
+		Algorithm1:   algo1,
+		Algorithm2:   algo2,
+		Cutoff:       cutoff,
+		NbTips:       len(tips),
+		SupportDiffs: make([]*BranchComparison, 0),
+		OnlyWellIn1:  make([]*BranchComparison, 0),
+		OnlyWellIn2:  make([]*BranchComparison, 0),
+	}
+
+	sumdiff := 0.0
+	for _, s1 := range splits1 {
+		v, ok := index2.Value(s1.edge)
+		if !ok {
+			c.RFDistance++
+			if s1.support >= cutoff {
+				c.OnlyWellIn1 = append(c.OnlyWellIn1, &BranchComparison{Taxa: splitTaxa(s1.edge, tips), Support1: s1.support, Support2: -1})
+			}
+			continue
+		}
+		s2 := splits2[v.Count]
+		c.CommonBranches++
+		b := &BranchComparison{Taxa: splitTaxa(s1.edge, tips), Support1: s1.support, Support2: s2.support, Diff: s1.support - s2.support}
+		c.SupportDiffs = append(c.SupportDiffs, b)
+		if b.Diff < 0 {
+			sumdiff -= b.Diff
+		} else {
+			sumdiff += b.Diff
+		}
+		if s1.support >= cutoff && s2.support < cutoff {
+			c.OnlyWellIn1 = append(c.OnlyWellIn1, b)
+		} else if s2.support >= cutoff && s1.support < cutoff {
+			c.OnlyWellIn2 = append(c.OnlyWellIn2, b)
+		}
+	}
+	for _, s2 := range splits2 {
+		if _, ok := index1.Value(s2.edge); !ok {
+			c.RFDistance++
+			if s2.support >= cutoff {
+				c.OnlyWellIn2 = append(c.OnlyWellIn2, &BranchComparison{Taxa: splitTaxa(s2.edge, tips), Support1: -1, Support2: s2.support})
+			}
+		}
+	}
+
+	c.SameTopology = (c.RFDistance == 0)
+	if !c.SameTopology {
+		// Per branch differences are only reported for identical topologies
+		c.SupportDiffs = make([]*BranchComparison, 0)
+	}
+	if c.CommonBranches > 0 {
+		c.MeanAbsDiff = sumdiff / float64(c.CommonBranches)
+	}
+	if maxrf := 2 * (len(tips) - 3); maxrf > 0 {
+		c.NormRFDistance = float64(c.RFDistance) / float64(maxrf)
+	}
+
+	sortBranches(c.SupportDiffs)
+	sortBranches(c.OnlyWellIn1)
+	sortBranches(c.OnlyWellIn2)
+
+	c.tanglegramBytes = Tanglegram(t1, t2, fmt.Sprintf("%s (%s)", label(a1), strings.ToUpper(algo1)), fmt.Sprintf("%s (%s)", label(a2), strings.ToUpper(algo2)), cutoff)
+	c.Tanglegram = template.URL("data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(c.tanglegramBytes))
+	return
+}
+
+// Returns the raw SVG tanglegram of the comparison
+func (c *ComparisonInformation) TanglegramSvg() []byte {
+	return c.tanglegramBytes
+}
+
+// Parses the support tree of the analysis corresponding to the given algorithm
+func supportTree(a *model.Analysis, algo string) (t *tree.Tree, err error) {
+	var nw string
+
+	if a.Status != model.STATUS_FINISHED {
+		err = fmt.Errorf("Cannot compare a non finished analysis (%s), status : %s", a.Id, a.StatusStr())
+		return
+	}
+	switch algo {
+	case ALGORITHM_TBE:
+		nw = a.TbeNormTree
+	case ALGORITHM_FBP:
+		nw = a.FbpTree
+	default:
+		err = fmt.Errorf("Unknown support algorithm: %s", algo)
+		return
+	}
+	if nw == "" {
+		err = fmt.Errorf("Analysis %s does not have a %s support tree", a.Id, strings.ToUpper(algo))
+		return
+	}
+	if t, err = newick.NewParser(strings.NewReader(nw)).Parse(); err != nil {
+		return
+	}
+	t.ReinitIndexes()
+	return
+}
+
+// Returns the non trivial branches of the tree, and their index by
+// bipartition (the Count of the index is the position in splits).
+//
+// The two edges around the root of a rooted tree define the same
+// bipartition: the best supported one is kept.
+func treeSplits(t *tree.Tree, nbtips int) (splits []*split, index *tree.EdgeIndex, err error) {
+	edges := t.InternalEdges()
+	splits = make([]*split, 0, len(edges))
+	index = tree.NewEdgeIndex(uint64(2*len(edges)+1), 0.75)
+	for _, e := range edges {
+		// Trivial split (may happen at the root of rooted trees)
+		if n := int(e.Bitset().Count()); n <= 1 || n >= nbtips-1 {
+			continue
+		}
+		support := e.Support()
+		if support == tree.NIL_SUPPORT {
+			support = 0
+		}
+		if v, ok := index.Value(e); ok {
+			if splits[v.Count].support < support {
+				splits[v.Count] = &split{e, support}
+			}
+			continue
+		}
+		if err = index.PutEdgeValue(e, len(splits), e.Length()); err != nil {
+			return
+		}
+		splits = append(splits, &split{e, support})
+	}
+	return
+}
+
+// Returns the taxa of the side of the edge that does not contain
+// the first taxon (in alphabetical order)
+func splitTaxa(e *tree.Edge, sortedtips []string) (taxa []string) {
+	b := e.Bitset()
+	first := b.Test(0)
+	taxa = make([]string, 0)
+	for i, n := range sortedtips {
+		if b.Test(uint(i)) != first {
+			taxa = append(taxa, n)
+		}
+	}
+	return
+}
+
+// Sorts branches by decreasing absolute support difference
+func sortBranches(branches []*BranchComparison) {
+	sort.Slice(branches, func(i, j int) bool {
+		di, dj := branches[i].Support1-branches[i].Support2, branches[j].Support1-branches[j].Support2
+		if di < 0 {
+			di = -di
+		}
+		if dj < 0 {
+			dj = -dj
+		}
+		return di > dj
+	})
+}
+
+func label(a *model.Analysis) string {
+	if a.RunName != "" {
+		return a.RunName
+	}
+	return a.WorkflowStr()
+}
@@ -0,0 +1,206 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package comparison
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+
+	"github.com/evolbioinfo/gotree/tree"
+)
+
+const (
+	tangleWidth     = 1000.0
+	tangleMargin    = 20.0
+	tangleTreeWidth = 280.0
+	tangleTipSpace  = 14.0
+	tangleHeader    = 40.0
+)
+
+// Node coordinates of a tree drawn in a rectangular layout
+type tanglePos struct {
+	x, y float64
+}
+
+// Draws two trees face to face (tree 1 on the left, tree 2 on the right),
+// and links identical taxa with lines. Branches with support >= cutoff are
+// drawn in bold red.
+//
+// Children of tree 2 are reordered to follow as much as possible the
+// order of the tips of tree 1, in order to limit line crossings.
+func Tanglegram(t1, t2 *tree.Tree, title1, title2 string, cutoff float64) []byte {
+	var buf bytes.Buffer
+
+	order1 := make(map[string]int)
+	tips1 := orderedTips(t1.Root(), nil, nil, nil)
+	for i, n := range tips1 {
+		order1[n.Name()] = i
+	}
+	tips2 := orderedTips(t2.Root(), nil, nil, order1)
+
+	height := tangleHeader + tangleTipSpace*float64(len(tips1)) + tangleMargin
+	fmt.Fprintf(&buf, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\" viewBox=\"0 0 %.0f %.0f\">\n", tangleWidth, height, tangleWidth, height)
+	fmt.Fprintf(&buf, "<rect width=\"100%%\" height=\"100%%\" fill=\"white\"/>\n")
+	fmt.Fprintf(&buf, "<text x=\"%.1f\" y=\"20\" font-family=\"sans-serif\" font-size=\"14\" font-weight=\"bold\">%s</text>\n", tangleMargin, html.EscapeString(title1))
+	fmt.Fprintf(&buf, "<text x=\"%.1f\" y=\"20\" font-family=\"sans-serif\" font-size=\"14\" font-weight=\"bold\" text-anchor=\"end\">%s</text>\n", tangleWidth-tangleMargin, html.EscapeString(title2))
+
+	pos1 := layoutTree(t1, tips1, tangleMargin, tangleMargin+tangleTreeWidth)
+	pos2 := layoutTree(t2, tips2, tangleWidth-tangleMargin, tangleWidth-tangleMargin-tangleTreeWidth)
+
+	drawTree(&buf, t1.Root(), nil, pos1, cutoff)
+	drawTree(&buf, t2.Root(), nil, pos2, cutoff)
+
+	labelx1 := tangleMargin + tangleTreeWidth + 5
+	labelx2 := tangleWidth - tangleMargin - tangleTreeWidth - 5
+	ys2 := make(map[string]float64)
+	for _, n := range tips2 {
+		ys2[n.Name()] = pos2[n].y
+		fmt.Fprintf(&buf, "<text x=\"%.1f\" y=\"%.1f\" font-family=\"sans-serif\" font-size=\"10\" text-anchor=\"end\" dominant-baseline=\"middle\">%s</text>\n", labelx2, pos2[n].y, html.EscapeString(n.Name()))
+	}
+	for _, n := range tips1 {
+		y1 := pos1[n].y
+		fmt.Fprintf(&buf, "<text x=\"%.1f\" y=\"%.1f\" font-family=\"sans-serif\" font-size=\"10\" dominant-baseline=\"middle\">%s</text>\n", labelx1, y1, html.EscapeString(n.Name()))
+		fmt.Fprintf(&buf, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"#999999\" stroke-width=\"0.5\"/>\n", labelx1+120, y1, labelx2-120, ys2[n.Name()])
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
+
+// Returns the tips of the subtree rooted at cur in traversal order.
+//
+// If order is not nil, children are visited by increasing
+// average order of their tips.
+func orderedTips(cur, prev *tree.Node, tips []*tree.Node, order map[string]int) []*tree.Node {
+	if cur.Tip() {
+		return append(tips, cur)
+	}
+	children := make([]*tree.Node, 0, len(cur.Neigh()))
+	for _, n := range cur.Neigh() {
+		if n != prev {
+			children = append(children, n)
+		}
+	}
+	if order != nil {
+		mean := make(map[*tree.Node]float64)
+		for _, c := range children {
+			sub := orderedTips(c, cur, nil, nil)
+			sum := 0.0
+			for _, t := range sub {
+				sum += float64(order[t.Name()])
+			}
+			mean[c] = sum / float64(len(sub))
+		}
+		sort.SliceStable(children, func(i, j int) bool { return mean[children[i]] < mean[children[j]] })
+	}
+	for _, c := range children {
+		tips = orderedTips(c, cur, tips, order)
+	}
+	return tips
+}
+
+// Computes node positions: tips are evenly spaced vertically in the given order,
+// and x coordinates go from xroot (root) to xtips (farthest tip).
+// Branch lengths are used if all defined, otherwise the tree is drawn as a cladogram.
+func layoutTree(t *tree.Tree, tips []*tree.Node, xroot, xtips float64) (pos map[*tree.Node]*tanglePos) {
+	pos = make(map[*tree.Node]*tanglePos)
+	uselengths := true
+	for _, e := range t.Edges() {
+		if e.Length() == tree.NIL_LENGTH {
+			uselengths = false
+			break
+		}
+	}
+	for i, n := range tips {
+		pos[n] = &tanglePos{y: tangleHeader + tangleTipSpace*(float64(i)+0.5)}
+	}
+	depths := make(map[*tree.Node]float64)
+	maxdepth := nodeDepths(t.Root(), nil, 0, uselengths, depths)
+	ypositions(t.Root(), nil, pos)
+	if maxdepth == 0 {
+		maxdepth = 1
+	}
+	for n, d := range depths {
+		pos[n].x = xroot + (xtips-xroot)*d/maxdepth
+	}
+	return
+}
+
+// Computes the depth of every node and returns the maximum depth
+func nodeDepths(cur, prev *tree.Node, depth float64, uselengths bool, depths map[*tree.Node]float64) (max float64) {
+	depths[cur] = depth
+	max = depth
+	for i, n := range cur.Neigh() {
+		if n == prev {
+			continue
+		}
+		l := 1.0
+		if uselengths {
+			l = cur.Edges()[i].Length()
+		}
+		max = math.Max(max, nodeDepths(n, cur, depth+l, uselengths, depths))
+	}
+	return
+}
+
+// Internal nodes are vertically placed in the middle of their children
+func ypositions(cur, prev *tree.Node, pos map[*tree.Node]*tanglePos) float64 {
+	if cur.Tip() {
+		return pos[cur].y
+	}
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, n := range cur.Neigh() {
+		if n != prev {
+			y := ypositions(n, cur, pos)
+			min = math.Min(min, y)
+			max = math.Max(max, y)
+		}
+	}
+	pos[cur] = &tanglePos{y: (min + max) / 2.0}
+	return pos[cur].y
+}
+
+func drawTree(buf *bytes.Buffer, cur, prev *tree.Node, pos map[*tree.Node]*tanglePos, cutoff float64) {
+	p := pos[cur]
+	miny, maxy := p.y, p.y
+	for i, n := range cur.Neigh() {
+		if n == prev {
+			continue
+		}
+		c := pos[n]
+		miny = math.Min(miny, c.y)
+		maxy = math.Max(maxy, c.y)
+		color, width := "black", 1.0
+		if s := cur.Edges()[i].Support(); !n.Tip() && s != tree.NIL_SUPPORT && s >= cutoff {
+			color, width = "#d62728", 2.0
+		}
+		fmt.Fprintf(buf, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"%s\" stroke-width=\"%.1f\"/>\n", p.x, c.y, c.x, c.y, color, width)
+		drawTree(buf, n, cur, pos, cutoff)
+	}
+	if maxy > miny {
+		fmt.Fprintf(buf, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"black\" stroke-width=\"1\"/>\n", p.x, miny, p.x, maxy)
+	}
+}
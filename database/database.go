@@ -24,11 +24,18 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package database
 
 import (
+	"errors"
 	"time"
 
 	"github.com/evolbioinfo/booster-web/model"
 )
 
+// Error returned when the requested analysis is not in the database
+var ErrAnalysisNotFound = errors.New("Analysis does not exist")
+
+// Error returned when a worker does not hold the lease on an analysis anymore
+var ErrLeaseLost = errors.New("Analysis is not held by the worker anymore")
+
 type BoosterwebDB interface {
 	GetAnalysis(id string) (*model.Analysis, error)
 	UpdateAnalysis(*model.Analysis) error
@@ -39,4 +46,11 @@ type BoosterwebDB interface {
 	GetRunningAnalyses() (analyses []*model.Analysis, err error)
 	GetAnalysesPerDay() (perDay map[time.Time]int, err error) // Number of analyses per day
 	GetAnalysesStats() (pendingJobs, runningJobs, finishedJobs, canceledJobs, errorJobs, timeoutJobs int, avgJobsPerDay float64, err error)
+
+	// Leases of the analyses run by booster-web workers (distributed processor)
+	ClaimAnalysis(processor, worker string, lease time.Duration) (a *model.Analysis, err error) // Pending analysis of the processor now held by the worker (nil if none)
+	RenewLease(id, worker string, lease time.Duration) error                                    // Extends the lease of the worker on the analysis
+	UpdateLeasedAnalysis(a *model.Analysis, worker string) error                                // Saves the analysis if the worker still holds it, keeping its lease
+	ReleaseLeases(processor, worker string) (n int, err error)                                  // Puts the unfinished analyses of the worker back in the queue of the processor
+	RequeueExpiredLeases(processor string) (n int, err error)                                   // Puts the unfinished analyses with an expired lease back in the queue of the processor
 }
@@ -24,7 +24,6 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package database
 
 import (
-	"errors"
 	"log"
 	"sync"
 	"time"
@@ -59,7 +58,7 @@ func (db *MemoryBoosterWebDB) GetAnalysis(id string) (a *model.Analysis, err err
 	var ok bool
 	a, ok = db.allanalyses[id]
 	if !ok {
-		err = errors.New("Analysis does not exist")
+		err = ErrAnalysisNotFound
 	}
 	return
 }
@@ -155,3 +154,78 @@ func (db *MemoryBoosterWebDB) GetAnalysesStats() (pendingJobs, runningJobs, fini
 
 	return
 }
+
+func (db *MemoryBoosterWebDB) ClaimAnalysis(processor, worker string, lease time.Duration) (a *model.Analysis, err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, an := range db.allanalyses {
+		if an.Status == model.STATUS_PENDING && an.Processor == processor && an.Worker == "" {
+			an.Worker = worker
+			an.LeaseExpires = time.Now().Add(lease).Unix()
+			return an, nil
+		}
+	}
+	return nil, nil
+}
+
+func (db *MemoryBoosterWebDB) RenewLease(id, worker string, lease time.Duration) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	a, ok := db.allanalyses[id]
+	if !ok {
+		return ErrAnalysisNotFound
+	}
+	if a.Worker != worker {
+		return ErrLeaseLost
+	}
+	a.LeaseExpires = time.Now().Add(lease).Unix()
+	return nil
+}
+
+func (db *MemoryBoosterWebDB) UpdateLeasedAnalysis(a *model.Analysis, worker string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	stored, ok := db.allanalyses[a.Id]
+	if !ok || stored.Worker != worker {
+		return ErrLeaseLost
+	}
+	log.Print("In memory database : Update analysis " + a.Id + " of worker " + worker)
+	// The lease is only extended by RenewLease
+	leased := *a
+	leased.Worker = worker
+	leased.LeaseExpires = stored.LeaseExpires
+	db.allanalyses[a.Id] = &leased
+	return nil
+}
+
+func (db *MemoryBoosterWebDB) ReleaseLeases(processor, worker string) (n int, err error) {
+	return db.requeue(processor, "Queued again after the stop of its worker", func(a *model.Analysis) bool {
+		return a.Worker == worker
+	}), nil
+}
+
+func (db *MemoryBoosterWebDB) RequeueExpiredLeases(processor string) (n int, err error) {
+	now := time.Now().Unix()
+	return db.requeue(processor, "Queued again after the loss of its worker", func(a *model.Analysis) bool {
+		return a.Worker != "" && a.LeaseExpires < now
+	}), nil
+}
+
+// Puts the unfinished analyses matching the condition back in the queue of the processor
+func (db *MemoryBoosterWebDB) requeue(processor, message string, cond func(a *model.Analysis) bool) (n int) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, a := range db.allanalyses {
+		if (a.Status == model.STATUS_PENDING || a.Status == model.STATUS_RUNNING) && cond(a) {
+			a.Status = model.STATUS_PENDING
+			a.Worker = ""
+			a.LeaseExpires = 0
+			a.Processor = processor
+			a.Nboot = 0
+			a.StartRunning = ""
+			a.Message = message
+			n++
+		}
+	}
+	return
+}
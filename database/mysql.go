@@ -24,6 +24,7 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package database
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -56,20 +57,41 @@ type dbanalysis struct {
 	workflow      int    `mysql-type:"int" mysql-default:"-1"`                          // workflow to launch if alignfile!="" : 8: PhyML-SMS, 9: FastTRee
 	alignnbseq    int    `mysql-type:"int" mysql-default:"-1"`                          // Number of sequences in the given alignment
 	alignlength   int    `mysql-type:"int" mysql-default:"-1"`                          // Length of the given alignment
+	aligner       string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Aligner run on the given unaligned sequences
+	trimmer       string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Trimming tool run after the aligner
+	rawlength     int    `mysql-type:"int" mysql-default:"0"`                           // Length of the alignment before trimming
+	namemap       string `mysql-type:"longtext"`                                        // Json mapping between original and cleaned sequence names
+	wfoptions     string `mysql-type:"longtext"`                                        // Json workflow options chosen by the user
 	reffile       string `mysql-type:"blob"`                                            // reference tree file
 	bootfile      string `mysql-type:"blob"`                                            // boot tree file
 	fbptree       string `mysql-type:"longtext"`                                        // tree with fbp supports
 	tbenormtree   string `mysql-type:"longtext"`                                        // tree with normalized tbe supports
 	tberawtree    string `mysql-type:"longtext"`                                        // tree with raw tbe supports in the form <id|avg_dist|depth> as branch names
 	tbelogs       string `mysql-type:"longtext"`                                        // tbe log file
+	workflowlogs  string `mysql-type:"longtext"`                                        // outputs of local tree inference tools
 	status        int    `mysql-type:"int" mysql-default:"-1"`                          // Status of the analysis
 	jobid         string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Galaxy or local Job id
 	galaxyhistory string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Galaxy History
+	invocation    string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Galaxy workflow invocation
+	galaxybackend string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Galaxy server running the job
+	processor     string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Processor running the job: local or galaxy
+	worker        string `mysql-type:"varchar(100)" mysql-default:"''"`                 // booster-web worker holding the job
+	lease         int64  `mysql-type:"bigint" mysql-default:"0"`                        // Unix time at which the lease of the worker expires
+	reftips       int    `mysql-type:"int" mysql-default:"0"`                           // Number of tips of the given reference tree
+	boottrees     int    `mysql-type:"int" mysql-default:"0"`                           // Number of given bootstrap trees
+	attempts      string `mysql-type:"longtext"`                                        // Json failed attempts to run the analysis
+	resubfrom     string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Analysis whose inputs were resubmitted in this analysis
+	resubas       string `mysql-type:"varchar(100)" mysql-default:"''"`                 // Last analysis in which the inputs of this analysis were resubmitted
+	partialtrees  int    `mysql-type:"int" mysql-default:"0"`                           // Number of bootstrap trees of partial supports after a timeout
+	warning       string `mysql-type:"longtext"`                                        // Warning about the results
+	wfsteps       string `mysql-type:"longtext"`                                        // Json status of the galaxy workflow steps
 	message       string `mysql-type:"longtext"`                                        // Optional message
 	nboot         int    `mysql-type:"int" mysql-default:"0"`                           // number of bootstrap trees
 	startpending  string `mysql-type:"varchar(100)" mysql-default:"''"`                 // date of job being submited
 	startrunning  string `mysql-type:"varchar(100)" mysql-default:"''"`                 // date of job being running
 	end           string `mysql-type:"varchar(100)" mysql-default:"''"`                 // date of job finished
+
+	aligngaps float64 `mysql-type:"double" mysql-default:"0"` // Proportion of gaps in the alignment
 }
 
 /* Returns a new database */
@@ -108,7 +130,7 @@ func (db *MySQLBoosterwebDB) GetAnalysis(id string) (*model.Analysis, error) {
 	if db.db == nil {
 		return nil, errors.New("Database not opened")
 	}
-	rows, err := db.db.Query("SELECT id,runname,email,seqalign,nbootrep,alignfile,alignalphabet,workflow,alignnbseq,alignlength,reffile,bootfile,fbptree,tbenormtree,tberawtree,tbelogs,status,jobid,galaxyhistory,message,nboot,startpending,startrunning,end FROM analysis WHERE id = ?", id)
+	rows, err := db.db.Query("SELECT id,runname,email,seqalign,nbootrep,alignfile,alignalphabet,workflow,alignnbseq,alignlength,COALESCE(aligner,''),COALESCE(trimmer,''),COALESCE(rawlength,0),COALESCE(aligngaps,0),COALESCE(namemap,''),COALESCE(wfoptions,''),reffile,bootfile,fbptree,tbenormtree,tberawtree,tbelogs,COALESCE(workflowlogs,''),status,jobid,galaxyhistory,COALESCE(invocation,''),COALESCE(galaxybackend,''),COALESCE(processor,''),COALESCE(worker,''),COALESCE(lease,0),COALESCE(reftips,0),COALESCE(boottrees,0),COALESCE(attempts,''),COALESCE(resubfrom,''),COALESCE(resubas,''),COALESCE(partialtrees,0),COALESCE(warning,''),COALESCE(wfsteps,''),message,nboot,startpending,startrunning,end FROM analysis WHERE id = ?", id)
 	if err != nil {
 		return nil, err
 	}
@@ -117,13 +139,13 @@ func (db *MySQLBoosterwebDB) GetAnalysis(id string) (*model.Analysis, error) {
 	dban := dbanalysis{}
 	if rows.Next() {
 		if err := rows.Scan(&dban.id, &dban.runname, &dban.email, &dban.seqalign, &dban.nbootrep,
-			&dban.alignfile, &dban.alignalphabet, &dban.workflow, &dban.alignnbseq, &dban.alignlength, &dban.reffile, &dban.bootfile,
-			&dban.fbptree, &dban.tbenormtree, &dban.tberawtree, &dban.tbelogs, &dban.status, &dban.jobid, &dban.galaxyhistory,
+			&dban.alignfile, &dban.alignalphabet, &dban.workflow, &dban.alignnbseq, &dban.alignlength, &dban.aligner, &dban.trimmer, &dban.rawlength, &dban.aligngaps, &dban.namemap, &dban.wfoptions, &dban.reffile, &dban.bootfile,
+			&dban.fbptree, &dban.tbenormtree, &dban.tberawtree, &dban.tbelogs, &dban.workflowlogs, &dban.status, &dban.jobid, &dban.galaxyhistory, &dban.invocation, &dban.galaxybackend, &dban.processor, &dban.worker, &dban.lease, &dban.reftips, &dban.boottrees, &dban.attempts, &dban.resubfrom, &dban.resubas, &dban.partialtrees, &dban.warning, &dban.wfsteps,
 			&dban.message, &dban.nboot, &dban.startpending, &dban.startrunning, &dban.end); err != nil {
 			return nil, err
 		}
 	} else {
-		return nil, errors.New("Analysis does not exist")
+		return nil, ErrAnalysisNotFound
 	}
 
 	if err := rows.Err(); err != nil {
@@ -131,30 +153,50 @@ func (db *MySQLBoosterwebDB) GetAnalysis(id string) (*model.Analysis, error) {
 	}
 
 	a := &model.Analysis{
-		Id:            dban.id,
-		RunName:       dban.runname,
-		EMail:         dban.email,
-		SeqAlign:      dban.seqalign,
-		NbootRep:      dban.nbootrep,
-		Alignfile:     dban.alignfile,
-		AlignAlphabet: dban.alignalphabet,
-		Workflow:      dban.workflow,
-		AlignNbSeq:    dban.alignnbseq,
-		AlignLength:   dban.alignlength,
-		Reffile:       dban.reffile,
-		Bootfile:      dban.bootfile,
-		FbpTree:       dban.fbptree,
-		TbeNormTree:   dban.tbenormtree,
-		TbeRawTree:    dban.tberawtree,
-		TbeLogs:       dban.tbelogs,
-		Status:        dban.status,
-		JobId:         dban.jobid,
-		GalaxyHistory: dban.galaxyhistory,
-		Message:       dban.message,
-		Nboot:         dban.nboot,
-		StartPending:  dban.startpending,
-		StartRunning:  dban.startrunning,
-		End:           dban.end,
+		Id:              dban.id,
+		RunName:         dban.runname,
+		EMail:           dban.email,
+		SeqAlign:        dban.seqalign,
+		NbootRep:        dban.nbootrep,
+		Alignfile:       dban.alignfile,
+		AlignAlphabet:   dban.alignalphabet,
+		Workflow:        dban.workflow,
+		AlignNbSeq:      dban.alignnbseq,
+		AlignLength:     dban.alignlength,
+		Aligner:         dban.aligner,
+		Trimmer:         dban.trimmer,
+		AlignRawLength:  dban.rawlength,
+		AlignGaps:       dban.aligngaps,
+		NameMap:         decodeStringMap(dban.namemap),
+		Options:         decodeStringMap(dban.wfoptions),
+		Reffile:         dban.reffile,
+		Bootfile:        dban.bootfile,
+		FbpTree:         dban.fbptree,
+		TbeNormTree:     dban.tbenormtree,
+		TbeRawTree:      dban.tberawtree,
+		TbeLogs:         dban.tbelogs,
+		WorkflowLogs:    dban.workflowlogs,
+		Status:          dban.status,
+		JobId:           dban.jobid,
+		GalaxyHistory:   dban.galaxyhistory,
+		InvocationId:    dban.invocation,
+		GalaxyBackend:   dban.galaxybackend,
+		Processor:       dban.processor,
+		Worker:          dban.worker,
+		LeaseExpires:    dban.lease,
+		RefTips:         dban.reftips,
+		BootTrees:       dban.boottrees,
+		Attempts:        decodeAttempts(dban.attempts),
+		ResubmittedFrom: dban.resubfrom,
+		ResubmittedAs:   dban.resubas,
+		PartialTrees:    dban.partialtrees,
+		Warning:         dban.warning,
+		Steps:           decodeSteps(dban.wfsteps),
+		Message:         dban.message,
+		Nboot:           dban.nboot,
+		StartPending:    dban.startpending,
+		StartRunning:    dban.startrunning,
+		End:             dban.end,
 	}
 
 	return a, nil
@@ -168,8 +210,8 @@ func (db *MySQLBoosterwebDB) GetRunningAnalyses() (analyses []*model.Analysis, e
 	analyses = make([]*model.Analysis, 0)
 	var rows *sql.Rows
 	query := `SELECT id,runname, email,seqalign,nbootrep,alignfile,
-                         alignalphabet,workflow,alignnbseq,alignlength,reffile,bootfile,
-                         fbptree,tbenormtree,tberawtree,tbelogs,status,jobid,galaxyhistory,
+                         alignalphabet,workflow,alignnbseq,alignlength,COALESCE(aligner,''),COALESCE(trimmer,''),COALESCE(rawlength,0),COALESCE(aligngaps,0),COALESCE(namemap,''),COALESCE(wfoptions,''),reffile,bootfile,
+                         fbptree,tbenormtree,tberawtree,tbelogs,COALESCE(workflowlogs,''),status,jobid,galaxyhistory,COALESCE(invocation,''),COALESCE(galaxybackend,''),COALESCE(processor,''),COALESCE(worker,''),COALESCE(lease,0),COALESCE(reftips,0),COALESCE(boottrees,0),COALESCE(attempts,''),COALESCE(resubfrom,''),COALESCE(resubas,''),COALESCE(partialtrees,0),COALESCE(warning,''),COALESCE(wfsteps,''),
                          message,nboot,startpending,startrunning,end 
                   FROM analysis 
                   WHERE status=0 or status=1`
@@ -181,8 +223,8 @@ func (db *MySQLBoosterwebDB) GetRunningAnalyses() (analyses []*model.Analysis, e
 	dban := dbanalysis{}
 	for rows.Next() {
 		if err = rows.Scan(&dban.id, &dban.runname, &dban.email, &dban.seqalign, &dban.nbootrep,
-			&dban.alignfile, &dban.alignalphabet, &dban.workflow, &dban.alignnbseq, &dban.alignlength, &dban.reffile, &dban.bootfile,
-			&dban.fbptree, &dban.tbenormtree, &dban.tberawtree, &dban.tbelogs, &dban.status, &dban.jobid, &dban.galaxyhistory,
+			&dban.alignfile, &dban.alignalphabet, &dban.workflow, &dban.alignnbseq, &dban.alignlength, &dban.aligner, &dban.trimmer, &dban.rawlength, &dban.aligngaps, &dban.namemap, &dban.wfoptions, &dban.reffile, &dban.bootfile,
+			&dban.fbptree, &dban.tbenormtree, &dban.tberawtree, &dban.tbelogs, &dban.workflowlogs, &dban.status, &dban.jobid, &dban.galaxyhistory, &dban.invocation, &dban.galaxybackend, &dban.processor, &dban.worker, &dban.lease, &dban.reftips, &dban.boottrees, &dban.attempts, &dban.resubfrom, &dban.resubas, &dban.partialtrees, &dban.warning, &dban.wfsteps,
 			&dban.message, &dban.nboot, &dban.startpending, &dban.startrunning, &dban.end); err != nil {
 			return
 		}
@@ -191,30 +233,50 @@ func (db *MySQLBoosterwebDB) GetRunningAnalyses() (analyses []*model.Analysis, e
 		}
 
 		a := &model.Analysis{
-			Id:            dban.id,
-			RunName:       dban.runname,
-			EMail:         dban.email,
-			SeqAlign:      dban.seqalign,
-			NbootRep:      dban.nbootrep,
-			Alignfile:     dban.alignfile,
-			AlignAlphabet: dban.alignalphabet,
-			Workflow:      dban.workflow,
-			AlignNbSeq:    dban.alignnbseq,
-			AlignLength:   dban.alignlength,
-			Reffile:       dban.reffile,
-			Bootfile:      dban.bootfile,
-			FbpTree:       dban.fbptree,
-			TbeNormTree:   dban.tbenormtree,
-			TbeRawTree:    dban.tberawtree,
-			TbeLogs:       dban.tbelogs,
-			Status:        dban.status,
-			JobId:         dban.jobid,
-			GalaxyHistory: dban.galaxyhistory,
-			Message:       dban.message,
-			Nboot:         dban.nboot,
-			StartPending:  dban.startpending,
-			StartRunning:  dban.startrunning,
-			End:           dban.end,
+			Id:              dban.id,
+			RunName:         dban.runname,
+			EMail:           dban.email,
+			SeqAlign:        dban.seqalign,
+			NbootRep:        dban.nbootrep,
+			Alignfile:       dban.alignfile,
+			AlignAlphabet:   dban.alignalphabet,
+			Workflow:        dban.workflow,
+			AlignNbSeq:      dban.alignnbseq,
+			AlignLength:     dban.alignlength,
+			Aligner:         dban.aligner,
+			Trimmer:         dban.trimmer,
+			AlignRawLength:  dban.rawlength,
+			AlignGaps:       dban.aligngaps,
+			NameMap:         decodeStringMap(dban.namemap),
+			Options:         decodeStringMap(dban.wfoptions),
+			Reffile:         dban.reffile,
+			Bootfile:        dban.bootfile,
+			FbpTree:         dban.fbptree,
+			TbeNormTree:     dban.tbenormtree,
+			TbeRawTree:      dban.tberawtree,
+			TbeLogs:         dban.tbelogs,
+			WorkflowLogs:    dban.workflowlogs,
+			Status:          dban.status,
+			JobId:           dban.jobid,
+			GalaxyHistory:   dban.galaxyhistory,
+			InvocationId:    dban.invocation,
+			GalaxyBackend:   dban.galaxybackend,
+			Processor:       dban.processor,
+			Worker:          dban.worker,
+			LeaseExpires:    dban.lease,
+			RefTips:         dban.reftips,
+			BootTrees:       dban.boottrees,
+			Attempts:        decodeAttempts(dban.attempts),
+			ResubmittedFrom: dban.resubfrom,
+			ResubmittedAs:   dban.resubas,
+			PartialTrees:    dban.partialtrees,
+			Warning:         dban.warning,
+			Steps:           decodeSteps(dban.wfsteps),
+			Message:         dban.message,
+			Nboot:           dban.nboot,
+			StartPending:    dban.startpending,
+			StartRunning:    dban.startrunning,
+			End:             dban.end,
 		}
 		analyses = append(analyses, a)
 	}
@@ -229,15 +291,41 @@ func (db *MySQLBoosterwebDB) UpdateAnalysis(a *model.Analysis) error {
 	if db.db == nil {
 		return errors.New("Database not opened")
 	}
+	return saveAnalysis(db.db, a)
+}
+
+// Runs queries on the database, or in a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Inserts or updates the analysis
+func saveAnalysis(db execer, a *model.Analysis) error {
+	namemap, err := json.Marshal(a.NameMap)
+	if err != nil {
+		return err
+	}
+	wfoptions, err := json.Marshal(a.Options)
+	if err != nil {
+		return err
+	}
+	wfsteps, err := json.Marshal(a.Steps)
+	if err != nil {
+		return err
+	}
+	attempts, err := json.Marshal(a.Attempts)
+	if err != nil {
+		return err
+	}
 	query := `INSERT INTO analysis 
-                    (id, runname, email, seqalign, nbootrep, alignfile, alignalphabet,workflow, alignnbseq, alignlength, reffile, bootfile, fbptree,tbenormtree, tberawtree, tbelogs, status, jobid, galaxyhistory, message, nboot, startpending, startrunning , end) 
-                  VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) 
+                    (id, runname, email, seqalign, nbootrep, alignfile, alignalphabet,workflow, alignnbseq, alignlength, aligner, trimmer, rawlength, aligngaps, namemap, wfoptions, reffile, bootfile, fbptree,tbenormtree, tberawtree, tbelogs, workflowlogs, status, jobid, galaxyhistory, invocation, galaxybackend, processor, worker, lease, reftips, boottrees, attempts, resubfrom, resubas, partialtrees, warning, wfsteps, message, nboot, startpending, startrunning , end) 
+                  VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) 
                   ON DUPLICATE KEY UPDATE runname=values(runname), alignfile=values(alignfile),alignalphabet=values(alignalphabet),fbptree=values(fbptree), 
-                                          tbenormtree=values(tbenormtree), tberawtree=values(tberawtree), tbelogs=values(tbelogs), 
-                                          status=values(status),jobid=values(jobid),galaxyhistory=values(galaxyhistory),workflow=values(workflow), 
-                                          alignnbseq=values(alignnbseq), alignLength=values(alignLength), message=values(message), nboot=values(nboot),
+                                          tbenormtree=values(tbenormtree), tberawtree=values(tberawtree), tbelogs=values(tbelogs), workflowlogs=values(workflowlogs), 
+                                          status=values(status),jobid=values(jobid),galaxyhistory=values(galaxyhistory),invocation=values(invocation),galaxybackend=values(galaxybackend),processor=values(processor),worker=values(worker),lease=values(lease),reftips=values(reftips),boottrees=values(boottrees),attempts=values(attempts),resubfrom=values(resubfrom),resubas=values(resubas),partialtrees=values(partialtrees),warning=values(warning),wfsteps=values(wfsteps),workflow=values(workflow), 
+                                          alignnbseq=values(alignnbseq), alignLength=values(alignLength), aligner=values(aligner), trimmer=values(trimmer), rawlength=values(rawlength), aligngaps=values(aligngaps), namemap=values(namemap), wfoptions=values(wfoptions), message=values(message), nboot=values(nboot),
                                           startpending=values(startpending), startrunning=values(startrunning), end=values(end)`
-	_, err := db.db.Exec(
+	_, err = db.Exec(
 		query,
 		a.Id,
 		a.RunName,
@@ -249,15 +337,35 @@ func (db *MySQLBoosterwebDB) UpdateAnalysis(a *model.Analysis) error {
 		a.Workflow,
 		a.AlignNbSeq,
 		a.AlignLength,
+		a.Aligner,
+		a.Trimmer,
+		a.AlignRawLength,
+		a.AlignGaps,
+		string(namemap),
+		string(wfoptions),
 		a.Reffile,
 		a.Bootfile,
 		a.FbpTree,
 		a.TbeNormTree,
 		a.TbeRawTree,
 		a.TbeLogs,
+		a.WorkflowLogs,
 		a.Status,
 		a.JobId,
 		a.GalaxyHistory,
+		a.InvocationId,
+		a.GalaxyBackend,
+		a.Processor,
+		a.Worker,
+		a.LeaseExpires,
+		a.RefTips,
+		a.BootTrees,
+		string(attempts),
+		a.ResubmittedFrom,
+		a.ResubmittedAs,
+		a.PartialTrees,
+		a.Warning,
+		string(wfsteps),
 		a.Message,
 		a.Nboot,
 		a.StartPending,
@@ -354,7 +462,7 @@ func (db *MySQLBoosterwebDB) DeleteOldAnalyses(days int) (err error) {
 		return errors.New("Database not opened")
 	}
 
-	query := `UPDATE analysis set alignfile='',fbptree='', tbenormtree='', tberawtree='',tbelogs='',status=6 where status<>0 and status<>1 and STR_TO_DATE(replace(replace(end,"CET",""),"CEST",""), '%a, %d %b %Y %H:%i:%S')<DATE_SUB(CURDATE(), INTERVAL `
+	query := `UPDATE analysis set alignfile='',fbptree='', tbenormtree='', tberawtree='',tbelogs='',workflowlogs='',status=6 where status<>0 and status<>1 and STR_TO_DATE(replace(replace(end,"CET",""),"CEST",""), '%a, %d %b %Y %H:%i:%S')<DATE_SUB(CURDATE(), INTERVAL `
 	query += fmt.Sprintf("%d", days) + " DAY);"
 
 	_, err = db.db.Exec(query)
@@ -459,3 +567,151 @@ func (db *MySQLBoosterwebDB) GetAnalysesStats() (pendingJobs, runningJobs, finis
 
 	return
 }
+
+// Decodes the json status of galaxy workflow steps stored in the database
+func decodeSteps(content string) (steps []model.WorkflowStep) {
+	steps = make([]model.WorkflowStep, 0)
+	if content == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(content), &steps); err != nil {
+		log.Print("Error while decoding workflow steps: " + err.Error())
+	}
+	return
+}
+
+// Decodes the json failed attempts of an analysis stored in the database
+func decodeAttempts(content string) (attempts []model.Attempt) {
+	attempts = make([]model.Attempt, 0)
+	if content == "" || content == "null" {
+		return
+	}
+	if err := json.Unmarshal([]byte(content), &attempts); err != nil {
+		log.Print("Error while decoding attempts: " + err.Error())
+	}
+	return
+}
+
+// Decodes a json map stored in the database (name mapping, workflow options)
+func decodeStringMap(content string) (m map[string]string) {
+	m = make(map[string]string)
+	if content == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(content), &m); err != nil {
+		log.Print("Error while decoding json map: " + err.Error())
+	}
+	return
+}
+
+// Claims one pending analysis of the processor that is not held by
+// any worker. The row is locked while the lease is taken.
+func (db *MySQLBoosterwebDB) ClaimAnalysis(processor, worker string, lease time.Duration) (a *model.Analysis, err error) {
+	var tx *sql.Tx
+	var res sql.Result
+	var id string
+	var n int64
+
+	if db.db == nil {
+		return nil, errors.New("Database not opened")
+	}
+	if tx, err = db.db.Begin(); err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT id FROM analysis WHERE status=0 AND processor=? AND worker='' LIMIT 1 FOR UPDATE", processor).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	if res, err = tx.Exec("UPDATE analysis SET worker=?, lease=? WHERE id=? AND worker=''", worker, time.Now().Add(lease).Unix(), id); err != nil {
+		return
+	}
+	if n, err = res.RowsAffected(); err != nil || n != 1 {
+		// Claimed by another worker in the meantime
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return db.GetAnalysis(id)
+}
+
+func (db *MySQLBoosterwebDB) RenewLease(id, worker string, lease time.Duration) (err error) {
+	var res sql.Result
+	var n int64
+
+	if db.db == nil {
+		return errors.New("Database not opened")
+	}
+	if res, err = db.db.Exec("UPDATE analysis SET lease=? WHERE id=? AND worker=?", time.Now().Add(lease).Unix(), id, worker); err != nil {
+		return
+	}
+	if n, err = res.RowsAffected(); err == nil && n == 0 {
+		// The lease value may be unchanged within the same second
+		var owner string
+		if err = db.db.QueryRow("SELECT worker FROM analysis WHERE id=?", id).Scan(&owner); err == nil && owner != worker {
+			err = ErrLeaseLost
+		}
+	}
+	return
+}
+
+// Saves the analysis if the worker still holds it. The row is locked
+// so that the lease cannot be taken by another worker meanwhile.
+func (db *MySQLBoosterwebDB) UpdateLeasedAnalysis(a *model.Analysis, worker string) (err error) {
+	var tx *sql.Tx
+	var owner string
+	var lease int64
+
+	if db.db == nil {
+		return errors.New("Database not opened")
+	}
+	if tx, err = db.db.Begin(); err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT worker, lease FROM analysis WHERE id=? FOR UPDATE", a.Id).Scan(&owner, &lease)
+	if err == sql.ErrNoRows || (err == nil && owner != worker) {
+		return ErrLeaseLost
+	} else if err != nil {
+		return
+	}
+	// The lease is only extended by RenewLease
+	leased := *a
+	leased.Worker = worker
+	leased.LeaseExpires = lease
+	if err = saveAnalysis(tx, &leased); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (db *MySQLBoosterwebDB) ReleaseLeases(processor, worker string) (n int, err error) {
+	if db.db == nil {
+		return 0, errors.New("Database not opened")
+	}
+	return db.requeue("worker=?", processor, "Queued again after the stop of its worker", worker)
+}
+
+func (db *MySQLBoosterwebDB) RequeueExpiredLeases(processor string) (n int, err error) {
+	if db.db == nil {
+		return 0, errors.New("Database not opened")
+	}
+	return db.requeue("worker<>'' AND lease<?", processor, "Queued again after the loss of its worker", time.Now().Unix())
+}
+
+// Puts the unfinished analyses matching the condition back in the queue of the processor
+func (db *MySQLBoosterwebDB) requeue(cond, processor, message string, args ...interface{}) (n int, err error) {
+	var res sql.Result
+	var rows int64
+	query := "UPDATE analysis SET status=0, worker='', lease=0, processor=?, nboot=0, startrunning='', message=? WHERE (status=0 OR status=1) AND " + cond
+	if res, err = db.db.Exec(query, append([]interface{}{processor, message}, args...)...); err != nil {
+		return
+	}
+	rows, err = res.RowsAffected()
+	return int(rows), err
+}
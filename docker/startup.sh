@@ -7,5 +7,16 @@ cat /home/booster/booster-web.toml.template | envsubst > /home/booster/booster-w
 cat /home/booster/booster-web.toml >&2
 
 /home/booster/booster-web --config /home/booster/booster-web.toml &
+BOOSTER_PID=$!
 
-nginx -g 'daemon off;';
+# booster-web drains its running jobs on SIGTERM, nginx is stopped afterwards
+stop() {
+    kill -TERM $BOOSTER_PID
+    wait $BOOSTER_PID
+    nginx -s quit
+    exit 0
+}
+trap stop TERM INT
+
+nginx -g 'daemon off;' &
+wait $!
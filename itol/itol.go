@@ -0,0 +1,277 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+// Package itol generates iTOL (https://itol.embl.de) annotation datasets
+// for the results of an analysis, so that users can load them in their
+// own iTOL account without going through the server-wide iTOL upload.
+package itol
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/render"
+	"github.com/evolbioinfo/gotree/io/newick"
+	"github.com/evolbioinfo/gotree/tree"
+)
+
+const (
+	ALGORITHM_TBE = "tbe"
+	ALGORITHM_FBP = "fbp"
+
+	CUTOFF_DEFAULT = 0.7 // Default support cutoff of the binary datasets
+)
+
+// An iTOL dataset file
+type Dataset struct {
+	Name    string // File name
+	Content string // Content of the iTOL annotation file
+}
+
+// Generates the tree with the supports of the given algorithm (tbe|fbp)
+// and the iTOL annotation datasets of the analysis:
+//   - A color strip of the supports: each tip is colored according to the
+//     support of the smallest clade containing it;
+//   - Two binary datasets marking branches with a support >= cutoff
+//     and branches with a support < cutoff;
+//   - A bar chart of the taxon instability scores (from the TBE logs), if available.
+func Annotations(a *model.Analysis, algorithm string, cutoff float64) (nw string, datasets []Dataset, err error) {
+	var t *tree.Tree
+	var instab map[string]float64
+
+	if a.Status != model.STATUS_FINISHED && a.Status != model.STATUS_TIMEOUT {
+		err = fmt.Errorf("Analysis is not finished, status : %s", a.StatusStr())
+		return
+	}
+
+	toexport := a.TbeNormTree
+	label := "TBE"
+	switch algorithm {
+	case ALGORITHM_TBE:
+	case ALGORITHM_FBP:
+		toexport = a.FbpTree
+		label = "FBP"
+	default:
+		err = fmt.Errorf("Unknown support algorithm: %s", algorithm)
+		return
+	}
+	if toexport == "" {
+		err = fmt.Errorf("Analysis %s does not have a %s support tree", a.Id, label)
+		return
+	}
+	if t, err = newick.NewParser(strings.NewReader(toexport)).Parse(); err != nil {
+		return
+	}
+	t.ReinitIndexes()
+	t.ClearPvalues()
+	nw = t.Newick()
+
+	datasets = []Dataset{
+		{fmt.Sprintf("%s_support_colorstrip.txt", algorithm), colorStrip(t, label)},
+		{fmt.Sprintf("%s_supported_branches.txt", algorithm), binary(t, fmt.Sprintf("%s support >= %.2f", label, cutoff), "#1a9641", cutoff, true)},
+		{fmt.Sprintf("%s_unsupported_branches.txt", algorithm), binary(t, fmt.Sprintf("%s support < %.2f", label, cutoff), "#d7191c", cutoff, false)},
+	}
+
+	if instab, err = TaxonInstability(a.TbeLogs); err != nil {
+		return
+	}
+	if len(instab) > 0 {
+		datasets = append(datasets, Dataset{"taxon_instability.txt", simpleBar(instab, "Taxon instability")})
+	}
+	return
+}
+
+// Writes a zip archive containing the tree with supports
+// and all the iTOL annotation datasets of the analysis
+func WriteZip(w io.Writer, a *model.Analysis, algorithm string, cutoff float64) (err error) {
+	var nw string
+	var datasets []Dataset
+	var f io.Writer
+
+	if nw, datasets, err = Annotations(a, algorithm, cutoff); err != nil {
+		return
+	}
+
+	z := zip.NewWriter(w)
+	if f, err = z.Create(fmt.Sprintf("%s_tree.nw", algorithm)); err != nil {
+		return
+	}
+	if _, err = io.WriteString(f, nw+"\n"); err != nil {
+		return
+	}
+	for _, d := range datasets {
+		if f, err = z.Create(d.Name); err != nil {
+			return
+		}
+		if _, err = io.WriteString(f, d.Content); err != nil {
+			return
+		}
+	}
+	return z.Close()
+}
+
+// Parses the taxon instability scores of the TBE logs
+// (section starting with "Taxon : Instability" or "Taxon : tIndex")
+func TaxonInstability(logs string) (instab map[string]float64, err error) {
+	instab = make(map[string]float64)
+	insection := false
+	sc := bufio.NewScanner(strings.NewReader(logs))
+	sc.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "Taxon : Instability" || line == "Taxon : tIndex" {
+			insection = true
+			continue
+		}
+		if !insection {
+			continue
+		}
+		// Taxon names may contain spaces: the score is the last field
+		sep := strings.LastIndexAny(line, " \t")
+		if sep < 0 {
+			break
+		}
+		v, e := strconv.ParseFloat(line[sep+1:], 64)
+		if e != nil {
+			break
+		}
+		instab[strings.TrimSpace(line[:sep])] = v
+	}
+	err = sc.Err()
+	return
+}
+
+// Each tip is colored according to the support of the smallest clade containing it
+func colorStrip(t *tree.Tree, label string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "DATASET_COLORSTRIP\nSEPARATOR TAB\nDATASET_LABEL\t%s support\nCOLOR\t#1a9641\n", label)
+	fmt.Fprintf(&b, "LEGEND_TITLE\t%s support\n", label)
+	fmt.Fprintf(&b, "LEGEND_SHAPES\t1\t1\t1\t1\t1\n")
+	b.WriteString("LEGEND_COLORS")
+	for _, s := range []float64{0, 0.25, 0.5, 0.75, 1} {
+		fmt.Fprintf(&b, "\t%s", hexColor(render.SupportColor(s)))
+	}
+	b.WriteString("\nLEGEND_LABELS\t0\t0.25\t0.5\t0.75\t1\nDATA\n")
+
+	for _, tip := range t.Tips() {
+		s := cladeSupport(tip)
+		if s == tree.NIL_SUPPORT {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%.3f\n", tip.Name(), hexColor(render.SupportColor(s)), s)
+	}
+	return b.String()
+}
+
+// Marks internal branches having a support >= cutoff (above=true)
+// or < cutoff (above=false).
+//
+// Branches are identified by the last common ancestor of two of their tips.
+func binary(t *tree.Tree, label, col string, cutoff float64, above bool) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "DATASET_BINARY\nSEPARATOR TAB\nDATASET_LABEL\t%s\nCOLOR\t%s\n", label, col)
+	fmt.Fprintf(&b, "FIELD_SHAPES\t2\nFIELD_LABELS\t%s\nFIELD_COLORS\t%s\nDATA\n", label, col)
+
+	for _, e := range t.Edges() {
+		if e.Right().Tip() || e.Support() == tree.NIL_SUPPORT {
+			continue
+		}
+		if (e.Support() >= cutoff) != above {
+			continue
+		}
+		if id, ok := lcaId(e.Right(), e.Left()); ok {
+			fmt.Fprintf(&b, "%s\t1\n", id)
+		}
+	}
+	return b.String()
+}
+
+// Bar chart of the given values per taxon
+func simpleBar(values map[string]float64, label string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "DATASET_SIMPLEBAR\nSEPARATOR TAB\nDATASET_LABEL\t%s\nCOLOR\t#2b83ba\nDATA\n", label)
+	names := make([]string, 0, len(values))
+	for n := range values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(&b, "%s\t%f\n", n, values[n])
+	}
+	return b.String()
+}
+
+// Support of the branch above the parent of the given tip
+func cladeSupport(tip *tree.Node) float64 {
+	if len(tip.Neigh()) == 0 {
+		return tree.NIL_SUPPORT
+	}
+	parent := tip.Neigh()[0]
+	for i, n := range parent.Neigh() {
+		if e := parent.Edges()[i]; e.Right() == parent && !n.Tip() {
+			return e.Support()
+		}
+	}
+	return tree.NIL_SUPPORT
+}
+
+// iTOL identifier of the node cur (coming from prev): "tip1|tip2",
+// with tip1 and tip2 taken in two different child clades
+func lcaId(cur, prev *tree.Node) (id string, ok bool) {
+	tips := make([]string, 0, 2)
+	for _, n := range cur.Neigh() {
+		if n != prev {
+			tips = append(tips, firstTip(n, cur))
+		}
+		if len(tips) == 2 {
+			return strings.Join(tips, "|"), true
+		}
+	}
+	return "", false
+}
+
+func firstTip(cur, prev *tree.Node) string {
+	if cur.Tip() {
+		return cur.Name()
+	}
+	for _, n := range cur.Neigh() {
+		if n != prev {
+			return firstTip(n, cur)
+		}
+	}
+	return ""
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
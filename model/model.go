@@ -30,6 +30,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -46,11 +48,55 @@ const (
 	WORKFLOW_NIL       = -1
 	WORKFLOW_PHYML_SMS = 8
 	WORKFLOW_FASTTREE  = 9
+	WORKFLOW_IQTREE    = 10
+	WORKFLOW_RAXMLNG   = 11
 
 	ALIGN_AMINOACIDS = 0
 	ALIGN_NUCLEOTIDS = 1
+
+	// Tools run on unaligned sequences before inferring the trees
+	ALIGNER_MAFFT  = "mafft"
+	ALIGNER_MUSCLE = "muscle"
+	TRIMMER_TRIMAL = "trimal"
+	TRIMMER_BMGE   = "bmge"
+
+	// Processors running the analyses
+	PROCESSOR_LOCAL  = "local"
+	PROCESSOR_GALAXY = "galaxy"
+	PROCESSOR_SLURM  = "slurm"
+	// Analyses waiting in the database for a booster-web worker
+	PROCESSOR_DISTRIBUTED = "distributed"
+
+	// Failure classes of the attempts to run an analysis
+	FAILURE_API     = "api"     // Errors of the galaxy api (submission or monitoring)
+	FAILURE_JOB     = "job"     // Galaxy job in error state
+	FAILURE_TIMEOUT = "timeout" // Job longer than runners.timeout
 )
 
+// If true, DelTemp keeps the input files of the analyses,
+// so that they can be resubmitted
+var KeepInputs bool
+
+// Step of a Galaxy workflow invocation
+type WorkflowStep struct {
+	Index   int    `json:"index"`             // Index of the step in the workflow
+	Label   string `json:"label"`             // Label of the step (or tool id)
+	State   string `json:"state"`             // State of the galaxy job of the step
+	JobId   string `json:"jobid,omitempty"`   // Galaxy job of the step (alignment steps launched by booster-web)
+	Dataset string `json:"dataset,omitempty"` // Galaxy output dataset of the step (alignment steps launched by booster-web)
+}
+
+// Failed attempt to run an analysis
+type Attempt struct {
+	Failure   string `json:"failure"`           // Failure class: api, job or timeout
+	Processor string `json:"processor"`         // Processor that ran the attempt
+	Backend   string `json:"backend,omitempty"` // Galaxy server that ran the attempt
+	Status    int    `json:"status"`            // Status of the analysis at the end of the attempt
+	Message   string `json:"message"`           // Error message of the attempt
+	Start     string `json:"start"`             // Attempt start time
+	End       string `json:"end"`               // Attempt end time
+}
+
 type Analysis struct {
 	Id      string `json:"id"`      // sha256 sum of reftree and boottree files
 	RunName string `json:"runname"` // Optional user given name of the run
@@ -61,9 +107,17 @@ type Analysis struct {
 	NbootRep      int    `json:"nbootrep"`  // Number of bootstrap replicates given by the user to build the bootstrap trees
 	Alignfile     string `json:"align"`     // Alignment result file returned by galaxy workflow if users gave a input sequence file
 	AlignAlphabet int    `json:"alphabet"`  // Alignment alphabet: 0: aa | 1 : nt
-	Workflow      int    `json:"workflow"`  // The galaxy workflow that has been run. 8:PHYML-SMS, 9: FASTTREE
+	Workflow      int    `json:"workflow"`  // The galaxy workflow that has been run. 8:PHYML-SMS, 9: FASTTREE, 10: IQ-TREE, 11: RAxML-NG
 	AlignNbSeq    int    `json:"nbseqs"`    // Number of sequences in the given alignment
 	AlignLength   int    `json:"length"`    // Length of the given alignment
+	Aligner       string `json:"aligner"`   // Aligner (mafft|muscle) run on the given unaligned sequences, empty if already aligned
+	Trimmer       string `json:"trimmer"`   // Trimming tool (trimal|bmge) run after the aligner, empty if none
+
+	AlignRawLength int     `json:"rawlength"` // Length of the alignment before trimming (0 if not trimmed)
+	AlignGaps      float64 `json:"gaps"`      // Proportion of gaps in the alignment
+
+	NameMap map[string]string `json:"namemap"` // Original sequence names => names cleaned for the workflow tools
+	Options map[string]string `json:"options"` // Workflow options chosen by the user (model, moves, etc.)
 
 	Reffile       string `json:"reftreefile"`  // reftree original file path
 	Bootfile      string `json:"boottreefile"` // bootstrap original file path
@@ -71,14 +125,32 @@ type Analysis struct {
 	TbeNormTree   string `json:"tbenormtree"`  // resulting newick tree with support
 	TbeRawTree    string `json:"tberawtree"`   // result tree with raw <id|avg_dist|depth> as branch names
 	TbeLogs       string `json:"tbelogs"`      // log file
+	WorkflowLogs  string `json:"workflowlogs"` // Outputs of the tree inference tools (local processor)
 	Status        int    `json:"status"`       // status code of the analysis
 	JobId         string `json:jobid`          // Galaxy or Local JobId
 	GalaxyHistory string `json:galaxyhistory`  // Galaxy History
+	InvocationId  string `json:"invocation"`   // Galaxy workflow invocation id (if launched as a galaxy workflow)
 	Message       string `json:"message"`      // error message if any
 	Nboot         int    `json:"nboot"`        // number of trees that have been processed
 	StartPending  string `json:"startpending"` // Analysis queue time
 	StartRunning  string `json:"startrunning"` // Analysis Start running time
 	End           string `json:"end"`          // Analysis End time
+
+	Steps []WorkflowStep `json:"steps"` // Status of the galaxy workflow steps (if launched as a galaxy workflow)
+
+	GalaxyBackend string `json:"galaxybackend,omitempty"` // Name of the galaxy server running the job (galaxy processor)
+	Processor     string `json:"processor,omitempty"`     // Processor running the job: local, galaxy or slurm
+	Worker        string `json:"worker,omitempty"`        // booster-web worker holding the job (distributed processor)
+	LeaseExpires  int64  `json:"-"`                       // Unix time at which the lease of the worker on the job expires
+	RefTips       int    `json:"reftips,omitempty"`       // Number of tips of the given reference tree
+	BootTrees     int    `json:"boottrees,omitempty"`     // Number of given bootstrap trees
+
+	Attempts        []Attempt `json:"attempts,omitempty"`        // Failed attempts to run the analysis, retried by the processor
+	ResubmittedFrom string    `json:"resubmittedfrom,omitempty"` // Analysis whose inputs were resubmitted in this analysis
+	ResubmittedAs   string    `json:"resubmittedas,omitempty"`   // Last analysis in which the inputs of this analysis were resubmitted
+
+	PartialTrees int    `json:"partialtrees,omitempty"` // Number of bootstrap trees the supports are computed on, if the analysis timed out (0: all trees)
+	Warning      string `json:"warning,omitempty"`      // Warning about the results, e.g. approximate supports after a timeout
 }
 
 func NewAnalysis() (a *Analysis) {
@@ -88,6 +160,10 @@ func NewAnalysis() (a *Analysis) {
 		SeqAlign:      "",
 		NbootRep:      0,
 		Alignfile:     "",
+		Aligner:       "",
+		Trimmer:       "",
+		NameMap:       make(map[string]string),
+		Options:       make(map[string]string),
 		Workflow:      WORKFLOW_NIL,
 		Reffile:       "",
 		Bootfile:      "",
@@ -95,9 +171,14 @@ func NewAnalysis() (a *Analysis) {
 		TbeNormTree:   "",
 		TbeRawTree:    "",
 		TbeLogs:       "",
+		WorkflowLogs:  "",
 		Status:        STATUS_NOT_EXISTS,
 		JobId:         "",
 		GalaxyHistory: "",
+		InvocationId:  "",
+		GalaxyBackend: "",
+		Processor:     "",
+		Steps:         make([]WorkflowStep, 0),
 		Message:       "",
 		Nboot:         0,
 		StartPending:  "",
@@ -107,6 +188,33 @@ func NewAnalysis() (a *Analysis) {
 	return
 }
 
+// Returns the reverse name mapping: cleaned names => original names,
+// only for names that have been modified during cleaning
+func (a *Analysis) OriginalNames() (names map[string]string) {
+	names = make(map[string]string)
+	for orig, clean := range a.NameMap {
+		if orig != clean {
+			names[clean] = orig
+		}
+	}
+	return
+}
+
+// Returns the workflow options as "name=value" pairs sorted by name,
+// separated by ", "
+func (a *Analysis) OptionsStr() string {
+	names := make([]string, 0, len(a.Options))
+	for name := range a.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + a.Options[name]
+	}
+	return strings.Join(pairs, ", ")
+}
+
 func (a *Analysis) StatusStr() (st string) {
 	switch a.Status {
 	case STATUS_NOT_EXISTS:
@@ -131,33 +239,89 @@ func (a *Analysis) StatusStr() (st string) {
 	return
 }
 
+// Names of the known workflows, key: workflow id
+// (see the workflow registry, which may add workflows from the configuration)
+var workflowNames = map[int]string{
+	WORKFLOW_PHYML_SMS: "PhyML-SMS",
+	WORKFLOW_FASTTREE:  "FastTree",
+	WORKFLOW_IQTREE:    "IQ-TREE",
+	WORKFLOW_RAXMLNG:   "RAxML-NG",
+}
+
+// Registers the name of a workflow, so that analyses
+// can be displayed and created with it.
+//
+// Must be called at initialization, before any analysis is created.
+func RegisterWorkflow(id int, name string) {
+	workflowNames[id] = name
+}
+
+// Names of the alignment and trimming tools, key: tool key
+var alignToolNames = map[string]string{
+	ALIGNER_MAFFT:  "MAFFT",
+	ALIGNER_MUSCLE: "MUSCLE",
+	TRIMMER_TRIMAL: "trimAl",
+	TRIMMER_BMGE:   "BMGE",
+}
+
+// Returns true if the given key is a known aligner
+func IsAligner(tool string) bool {
+	return tool == ALIGNER_MAFFT || tool == ALIGNER_MUSCLE
+}
+
+// Returns true if the given key is a known trimming tool
+func IsTrimmer(tool string) bool {
+	return tool == TRIMMER_TRIMAL || tool == TRIMMER_BMGE
+}
+
+// Returns the name of the alignment or trimming tool
+func AlignToolName(tool string) string {
+	if name, ok := alignToolNames[tool]; ok {
+		return name
+	}
+	return tool
+}
+
+func (a *Analysis) AlignerStr() string {
+	return AlignToolName(a.Aligner)
+}
+
+func (a *Analysis) TrimmerStr() string {
+	return AlignToolName(a.Trimmer)
+}
+
+// Returns the proportion of gaps in the alignment, in percent
+func (a *Analysis) AlignGapsStr() string {
+	return fmt.Sprintf("%.1f%%", a.AlignGaps*100)
+}
+
 func (a *Analysis) WorkflowStr() string {
-	switch a.Workflow {
-	case WORKFLOW_PHYML_SMS:
-		return "PhyML-SMS"
-	case WORKFLOW_FASTTREE:
-		return "FastTree"
-	case WORKFLOW_NIL:
+	if a.Workflow == WORKFLOW_NIL {
 		return "Bootstrap alone"
-	default:
-		return "Unknown"
 	}
+	if name, ok := workflowNames[a.Workflow]; ok {
+		return name
+	}
+	return "Unknown"
 }
 
 func WorkflowConst(workflow string) (w int, err error) {
-	switch workflow {
-	case "PhyML-SMS":
-		w = WORKFLOW_PHYML_SMS
-	case "FastTree":
-		w = WORKFLOW_FASTTREE
-	default:
-		err = errors.New(fmt.Sprintf("Phylogenetic workflow does not exist: %s", workflow))
+	for id, name := range workflowNames {
+		if name == workflow {
+			w = id
+			return
+		}
 	}
+	err = errors.New(fmt.Sprintf("Phylogenetic workflow does not exist: %s", workflow))
 	return
 }
 
+// Deletes the input files of the analysis, unless KeepInputs is set
 func (a *Analysis) DelTemp() {
 	var dir string
+	if KeepInputs {
+		return
+	}
 	if a.SeqAlign != "" {
 		if err := os.Remove(a.SeqAlign); err != nil {
 			log.Print(err)
@@ -184,6 +348,15 @@ func (a *Analysis) DelTemp() {
 	}
 }
 
+// Returns true if the analysis has ended, and may be resubmitted
+func (a *Analysis) Ended() bool {
+	switch a.Status {
+	case STATUS_FINISHED, STATUS_ERROR, STATUS_CANCELED, STATUS_TIMEOUT:
+		return true
+	}
+	return false
+}
+
 // Returns the run time of the analysis from the start pending time
 // If end date is not filled yet, takes now(). If some dates have
 // format issues: returns "?"
@@ -34,6 +34,7 @@ import (
 	"time"
 
 	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/processor"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
@@ -49,6 +50,8 @@ type MonitorInformation struct {
 	ErrorJobs     int          `json:"errorjobs"`
 	TimeoutJobs   int          `json:"timeoutjobs"`
 	AvgJobsPerDay float64      `json:"avgjobsperday"`
+
+	Histories *processor.HistoryUsage `json:"histories,omitempty"` // Usage of galaxy histories, if the processor is galaxy
 }
 
 func Monitor(db database.BoosterwebDB) (m *MonitorInformation, err error) {
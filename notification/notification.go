@@ -29,12 +29,14 @@ import (
 	"fmt"
 	"net/smtp"
 	"regexp"
+
+	"github.com/evolbioinfo/booster-web/workflow"
 )
 
 var emailRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
 type Notifier interface {
-	Notify(status string, analysisId string, runName string, workflow string, email string) error
+	Notify(status string, analysisId string, runName string, workflow string, options string, email string) error
 }
 
 type EmailNotifier struct {
@@ -44,11 +46,14 @@ type EmailNotifier struct {
 	pass      string // smtp password
 	sender    string // Sender Email
 	resulturl string // url to the result page
+
+	workflows *workflow.Registry // For workflow citations
 }
 type NullNotifier struct {
 }
 
-func NewEmailNotifier(smtp string, port int, user, pass, sender, resultpage string) (notifier *EmailNotifier) {
+// Citations of the tools of the workflows are taken from the given registry
+func NewEmailNotifier(smtp string, port int, user, pass, sender, resultpage string, workflows *workflow.Registry) (notifier *EmailNotifier) {
 	return &EmailNotifier{
 		server:    smtp,
 		port:      port,
@@ -56,6 +61,7 @@ func NewEmailNotifier(smtp string, port int, user, pass, sender, resultpage stri
 		pass:      pass,
 		sender:    sender,
 		resulturl: resultpage,
+		workflows: workflows,
 	}
 }
 
@@ -63,22 +69,30 @@ func NewNullNotifier() (notifier *NullNotifier) {
 	return &NullNotifier{}
 }
 
-func (n *NullNotifier) Notify(status string, analysisId string, runName string, workflow string, email string) (err error) {
+func (n *NullNotifier) Notify(status string, analysisId string, runName string, workflow string, options string, email string) (err error) {
 	return
 }
 
-// Workflow may be FastTree or PhyML-SMS
-func (n *EmailNotifier) Notify(status string, analysisId string, runName string, workflow string, email string) (err error) {
+// Workflow is the name of a workflow of the registry (e.g. FastTree or PhyML-SMS),
+// and options the workflow options chosen by the user ("name=value, ...")
+func (n *EmailNotifier) Notify(status string, analysisId string, runName string, workflow string, options string, email string) (err error) {
 	// Connect to the remote SMTP server.
 	if email != "" && n.server != "" && n.user != "" && n.pass != "" && n.sender != "" && validateEmail(email) {
 		ref := "Lemoine, F., Domelevo-Entfellner, J.-B., Wilkinson, E., Correia, D., Davila Felipe, M., De Oliveira, T., Gascuel, O. (2018). Renewing Felsenstein's Phylogenetic Bootstrap in the Era of Big Data, Nature 556, 452-45."
 		jobstr := "Booster[1]"
-		if workflow == "PhyML-SMS" {
-			ref = "[1] Lefort, V., Longueville, J. E., & Gascuel, O. (2017). SMS: Smart Model Selection in PhyML. Molecular Biology and Evolution.\n[2] " + ref
-			jobstr = "PhyML-SMS[1]+Booster[2]"
-		} else if workflow == "FastTree" {
-			ref = "[1] Price, M. N., Dehal, P. S., & Arkin, A. P. (2009). FastTree: computing large minimum evolution trees with profiles instead of a distance matrix. Molecular biology and evolution, 26(7), 1641-1650.\n[2] " + ref
-			jobstr = "FastTree[1]+Booster[2]"
+		if w, ok := n.workflow(workflow); ok && len(w.Citations) > 0 {
+			refs := ""
+			jobstr = ""
+			for i, c := range w.Citations {
+				tool := w.Name
+				if i < len(w.Tools) {
+					tool = w.Tools[i]
+				}
+				refs += fmt.Sprintf("[%d] %s\n", i+1, c)
+				jobstr += fmt.Sprintf("%s[%d]+", tool, i+1)
+			}
+			ref = fmt.Sprintf("%s[%d] %s", refs, len(w.Citations)+1, ref)
+			jobstr += fmt.Sprintf("Booster[%d]", len(w.Citations)+1)
 		} else {
 			ref = "[1] " + ref
 		}
@@ -87,9 +101,13 @@ func (n *EmailNotifier) Notify(status string, analysisId string, runName string,
 		if runName != "" {
 			runnamestr = fmt.Sprintf(" (run name: %s) ", runName)
 		}
+		optionsstr := ""
+		if options != "" {
+			optionsstr = fmt.Sprintf("Workflow options: %s\n", options)
+		}
 
 		auth := smtp.PlainAuth("", n.user, n.pass, n.server)
-		body := fmt.Sprintf("Dear booster-web user, \n\nYour job %s%sis done (status : '%s').\nResults are available at the following page:\n%s/%s\n\nBest regards,\n\nThe BOOSTER-WEB team\nEvolutionary Biology Unit - USR 3756 Institut Pasteur - CNRS\nhttps://research.pasteur.fr/en/team/evolutionary-bioinformatics\n\n%s", jobstr, runnamestr, status, n.resulturl, analysisId, ref)
+		body := fmt.Sprintf("Dear booster-web user, \n\nYour job %s%sis done (status : '%s').\n%sResults are available at the following page:\n%s/%s\n\nBest regards,\n\nThe BOOSTER-WEB team\nEvolutionary Biology Unit - USR 3756 Institut Pasteur - CNRS\nhttps://research.pasteur.fr/en/team/evolutionary-bioinformatics\n\n%s", jobstr, runnamestr, status, optionsstr, n.resulturl, analysisId, ref)
 		msg := fmt.Sprintf("From: %s\nTo: %s\nSubject: booster-web results\n\n%s", n.sender, email, body)
 
 		err = smtp.SendMail(fmt.Sprintf("%s:%d", n.server, n.port), auth, n.sender, []string{email}, []byte(msg))
@@ -97,6 +115,13 @@ func (n *EmailNotifier) Notify(status string, analysisId string, runName string,
 	return
 }
 
+func (n *EmailNotifier) workflow(name string) (w *workflow.Workflow, ok bool) {
+	if n.workflows == nil {
+		return nil, false
+	}
+	return n.workflows.ByName(name)
+}
+
 func validateEmail(email string) bool {
 	return emailRegexp.MatchString(email)
 }
@@ -0,0 +1,59 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/goalign/align"
+	"github.com/evolbioinfo/goalign/io/fasta"
+)
+
+// Stores the alignment analyzed by the workflow in the analysis (Fasta),
+// with its statistics: number of sequences, length, alphabet and
+// proportion of gaps
+func SetAlignment(a *model.Analysis, al align.Alignment) {
+	a.Alignfile = fasta.WriteAlignment(al)
+	a.AlignAlphabet = al.Alphabet()
+	a.AlignNbSeq = al.NbSequences()
+	a.AlignLength = al.Length()
+	a.AlignGaps = gapProportion(al)
+}
+
+// Proportion of gaps in the alignment
+func gapProportion(al align.Alignment) float64 {
+	gaps, total := 0, 0
+	al.Iterate(func(name string, sequence string) bool {
+		for _, c := range sequence {
+			if c == '-' {
+				gaps++
+			}
+			total++
+		}
+		return false
+	})
+	if total == 0 {
+		return 0
+	}
+	return float64(gaps) / float64(total)
+}
@@ -0,0 +1,327 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+const (
+	DISTRIBUTED_LEASE_DEFAULT     = 2 * time.Minute  // Duration of the lease of a worker on a job
+	DISTRIBUTED_HEARTBEAT_DEFAULT = 30 * time.Second // Time between two renewals of the leases
+	DISTRIBUTED_POLL_DEFAULT      = 5 * time.Second  // Time between two claims of pending jobs
+)
+
+// The distributed processor only stores the analyses as pending in the
+// database. They are claimed and run by booster-web worker processes
+// (see DistributedWorker), sharing the database and the input files.
+//
+// Analyses of workers whose lease expired are put back in the queue.
+type DistributedProcessor struct {
+	db    database.BoosterwebDB
+	lease time.Duration
+}
+
+// Initializes the distributed processor, and starts looking
+// for expired leases
+func (p *DistributedProcessor) InitProcessor(lease time.Duration, db database.BoosterwebDB) {
+	p.db = db
+	if lease <= 0 {
+		lease = DISTRIBUTED_LEASE_DEFAULT
+	}
+	p.lease = lease
+
+	log.Print("Init distributed processor")
+	log.Print(fmt.Sprintf("Worker lease: %v", lease))
+
+	go func() {
+		for {
+			if n, err := p.db.RequeueExpiredLeases(model.PROCESSOR_DISTRIBUTED); err != nil {
+				log.Print("Error while looking for lost workers: " + err.Error())
+			} else if n > 0 {
+				log.Print(fmt.Sprintf("%d analyses of lost workers queued again", n))
+			}
+			time.Sleep(p.lease / 2)
+		}
+	}()
+}
+
+// Stores the analysis as pending in the database: input files are
+// kept for the worker that will claim it
+func (p *DistributedProcessor) LaunchAnalysis(a *model.Analysis) (err error) {
+	a.Processor = model.PROCESSOR_DISTRIBUTED
+	a.Status = model.STATUS_PENDING
+	a.Worker = ""
+	a.LeaseExpires = 0
+	return p.db.UpdateAnalysis(a)
+}
+
+// Analyses are run by the workers, that stay up when the server stops
+func (p *DistributedProcessor) CancelAnalyses() (err error) {
+	return
+}
+
+// Analyses are stored in the database, and run by the workers
+func (p *DistributedProcessor) Drain(period time.Duration) (err error) {
+	return
+}
+
+// A DistributedWorker claims pending analyses of the distributed processor
+// from the database, and runs them with a local processor.
+//
+// The worker holds a lease on each claimed analysis, renewed until the
+// end of the analysis. If the lease is lost, the analysis is stopped and
+// dropped by the local processor, that saves the analyses through a
+// database given by NewLeasedDB.
+type DistributedWorker struct {
+	Name      string        // Name of the worker, unique among workers
+	Lease     time.Duration // Duration of the leases
+	Heartbeat time.Duration // Time between two renewals of the leases
+	Poll      time.Duration // Time between two claims of pending analyses
+	Capacity  int           // Max number of analyses held at the same time
+
+	db      database.BoosterwebDB
+	proc    *LocalProcessor
+	lock    sync.Mutex
+	claimed map[string]time.Time // Expiry of the leases of the analyses held by the worker, key: analysis id
+}
+
+// Database of the local processor of a worker: analyses are
+// saved only while the worker holds their lease
+type leasedDB struct {
+	database.BoosterwebDB
+	worker string
+}
+
+// Returns a database saving the analyses only while the given
+// worker holds their lease
+func NewLeasedDB(db database.BoosterwebDB, worker string) database.BoosterwebDB {
+	return &leasedDB{BoosterwebDB: db, worker: worker}
+}
+
+func (db *leasedDB) UpdateAnalysis(a *model.Analysis) error {
+	return db.UpdateLeasedAnalysis(a, db.worker)
+}
+
+// Initializes the worker, running the claimed analyses on the given
+// (initialized) local processor, and starts claiming analyses
+func (w *DistributedWorker) InitWorker(proc *LocalProcessor, db database.BoosterwebDB) {
+	w.proc = proc
+	w.db = db
+	w.claimed = make(map[string]time.Time)
+	if w.Lease <= 0 {
+		w.Lease = DISTRIBUTED_LEASE_DEFAULT
+	}
+	if w.Heartbeat <= 0 {
+		w.Heartbeat = DISTRIBUTED_HEARTBEAT_DEFAULT
+	}
+	if w.Heartbeat >= w.Lease {
+		log.Fatal("The heartbeat of the worker must be shorter than its lease")
+	}
+	if w.Poll <= 0 {
+		w.Poll = DISTRIBUTED_POLL_DEFAULT
+	}
+	if w.Capacity <= 0 {
+		w.Capacity = proc.nbrunners
+	}
+
+	log.Print("Init distributed worker " + w.Name)
+	log.Print(fmt.Sprintf("Lease: %v, heartbeat: %v", w.Lease, w.Heartbeat))
+	log.Print(fmt.Sprintf("Capacity: %d", w.Capacity))
+
+	go w.renewLeases()
+	go w.claimAnalyses()
+}
+
+// Puts the unfinished analyses of the worker back in the queue,
+// so that other workers take them without waiting for the lease
+// to expire
+func (w *DistributedWorker) Stop() (err error) {
+	var n int
+	if n, err = w.db.ReleaseLeases(model.PROCESSOR_DISTRIBUTED, w.Name); err == nil {
+		log.Print(fmt.Sprintf("Worker %s stopped, %d analyses queued again", w.Name, n))
+	}
+	return
+}
+
+// Claims pending analyses while the worker has free capacity
+func (w *DistributedWorker) claimAnalyses() {
+	for {
+		w.forgetFinished()
+		for w.nbClaimed() < w.Capacity {
+			// The lease taken by the database expires later
+			expires := time.Now().Add(w.Lease)
+			a, err := w.db.ClaimAnalysis(model.PROCESSOR_DISTRIBUTED, w.Name, w.Lease)
+			if err != nil {
+				log.Print("Error while claiming analyses: " + err.Error())
+				break
+			}
+			if a == nil {
+				break
+			}
+			log.Print(fmt.Sprintf("Worker %s: claimed analysis %s", w.Name, a.Id))
+			if err = w.proc.LaunchAnalysis(a); err != nil {
+				a.Status = model.STATUS_ERROR
+				a.End = time.Now().Format(time.RFC1123)
+				a.Message = err.Error()
+				if err = w.db.UpdateAnalysis(a); err != nil {
+					log.Print(err)
+				}
+				continue
+			}
+			// Held by the local processor until it is finished
+			w.lock.Lock()
+			w.claimed[a.Id] = expires
+			w.lock.Unlock()
+		}
+		time.Sleep(w.Poll)
+	}
+}
+
+func (w *DistributedWorker) renewLeases() {
+	for {
+		time.Sleep(w.Heartbeat)
+		w.renew()
+	}
+}
+
+// Extends the leases of the analyses that are not finished. Analyses whose
+// lease is lost are stopped: another worker may run them.
+func (w *DistributedWorker) renew() {
+	w.forgetFinished()
+	for id, expires := range w.leases() {
+		renewed := time.Now().Add(w.Lease)
+		err := w.db.RenewLease(id, w.Name, w.Lease)
+		if err == nil {
+			w.setLease(id, renewed)
+			continue
+		}
+		// The lease is still held if the database could not be reached
+		if !errors.Is(err, database.ErrLeaseLost) && time.Now().Before(expires) {
+			log.Print(fmt.Sprintf("Worker %s: cannot renew the lease on analysis %s: %s", w.Name, id, err.Error()))
+			continue
+		}
+		log.Print(fmt.Sprintf("Worker %s: lease on analysis %s lost, stopping it: %s", w.Name, id, err.Error()))
+		w.proc.dropJob(id)
+		w.lock.Lock()
+		delete(w.claimed, id)
+		w.lock.Unlock()
+	}
+}
+
+// Forgets the analyses that are not held by the local processor anymore
+func (w *DistributedWorker) forgetFinished() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for id := range w.claimed {
+		if !w.proc.holds(id) {
+			delete(w.claimed, id)
+		}
+	}
+}
+
+// Returns the expiry of the leases held by the worker
+func (w *DistributedWorker) leases() map[string]time.Time {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	leases := make(map[string]time.Time, len(w.claimed))
+	for id, expires := range w.claimed {
+		leases[id] = expires
+	}
+	return leases
+}
+
+func (w *DistributedWorker) setLease(id string, expires time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.claimed[id]; ok {
+		w.claimed[id] = expires
+	}
+}
+
+func (w *DistributedWorker) nbClaimed() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.claimed)
+}
+
+// Holds the analysis, queued or running, until its results are saved
+func (p *LocalProcessor) hold(a *model.Analysis) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.held[a.Id] = true
+}
+
+func (p *LocalProcessor) release(a *model.Analysis) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.held, a.Id)
+}
+
+// Returns true if the analysis is queued or running
+func (p *LocalProcessor) holds(id string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.held[id]
+}
+
+// Stops the held analysis, that will not be saved nor notified: used by
+// distributed workers that lost the lease on the analysis. Queued
+// analyses are dropped when they are dequeued.
+func (p *LocalProcessor) dropJob(id string) {
+	p.lock.Lock()
+	if !p.held[id] {
+		p.lock.Unlock()
+		return
+	}
+	p.dropped[id] = true
+	delete(p.held, id)
+	stop := p.stops[id]
+	p.lock.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+func (p *LocalProcessor) isDropped(a *model.Analysis) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.dropped[a.Id]
+}
+
+// Forgets the dropped analysis. Returns false if it was not dropped.
+func (p *LocalProcessor) forgetDropped(a *model.Analysis) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dropped := p.dropped[a.Id]
+	delete(p.dropped, a.Id)
+	return dropped
+}
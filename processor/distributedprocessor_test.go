@@ -0,0 +1,146 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+// Stores a pending analysis of the distributed processor,
+// and claims it for the worker
+func claimedAnalysis(t *testing.T, db database.BoosterwebDB, worker string) *model.Analysis {
+	t.Helper()
+	a := model.NewAnalysis()
+	a.Id = "leased"
+	a.Processor = model.PROCESSOR_DISTRIBUTED
+	a.Status = model.STATUS_PENDING
+	if err := db.UpdateAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := db.ClaimAnalysis(model.PROCESSOR_DISTRIBUTED, worker, time.Minute)
+	if err != nil || claimed == nil {
+		t.Fatalf("Analysis not claimed: %v", err)
+	}
+	// As read from the database by the worker
+	c := *claimed
+	return &c
+}
+
+// Returns a local processor holding the analysis, as if it were running
+func holdingProcessor(a *model.Analysis, stop func()) *LocalProcessor {
+	p := &LocalProcessor{
+		runningJobs: make(map[string]*model.Analysis),
+		stops:       make(map[string]func()),
+		held:        make(map[string]bool),
+		dropped:     make(map[string]bool),
+	}
+	p.hold(a)
+	p.stops[a.Id] = stop
+	return p
+}
+
+func TestLeasedDBFencing(t *testing.T) {
+	db := testMemoryDB(t)
+	a := claimedAnalysis(t, db, "w1")
+	lease := a.LeaseExpires
+	leased := NewLeasedDB(db, "w1")
+
+	a.Status = model.STATUS_RUNNING
+	a.LeaseExpires = 0
+	if err := leased.UpdateAnalysis(a); err != nil {
+		t.Fatalf("Update by the lease holder refused: %v", err)
+	}
+	stored, _ := db.GetAnalysis(a.Id)
+	if stored.Status != model.STATUS_RUNNING || stored.Worker != "w1" || stored.LeaseExpires != lease {
+		t.Errorf("Unexpected stored analysis: status %d, worker %s, lease %d (expected %d)", stored.Status, stored.Worker, stored.LeaseExpires, lease)
+	}
+
+	// The lease is taken back, e.g. after its expiry
+	if _, err := db.ReleaseLeases(model.PROCESSOR_DISTRIBUTED, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	a.Status = model.STATUS_FINISHED
+	if err := leased.UpdateAnalysis(a); !errors.Is(err, database.ErrLeaseLost) {
+		t.Fatalf("Expected lost lease error, got %v", err)
+	}
+	if stored, _ = db.GetAnalysis(a.Id); stored.Status != model.STATUS_PENDING {
+		t.Errorf("Analysis saved without its lease: status %d", stored.Status)
+	}
+}
+
+func TestWorkerLeaseLost(t *testing.T) {
+	db := testMemoryDB(t)
+	a := claimedAnalysis(t, db, "w1")
+	stopped := false
+	p := holdingProcessor(a, func() { stopped = true })
+	w := &DistributedWorker{Name: "w1", Lease: time.Minute, db: NewLeasedDB(db, "w1"), proc: p}
+	w.claimed = map[string]time.Time{a.Id: time.Now().Add(w.Lease)}
+
+	// Renewed while held
+	w.renew()
+	if stopped || w.nbClaimed() != 1 {
+		t.Fatal("Analysis stopped while its lease is held")
+	}
+
+	if _, err := db.ReleaseLeases(model.PROCESSOR_DISTRIBUTED, "w1"); err != nil {
+		t.Fatal(err)
+	}
+	w.renew()
+	if !stopped {
+		t.Error("Analysis not stopped after the loss of its lease")
+	}
+	if w.nbClaimed() != 0 || p.holds(a.Id) {
+		t.Error("Analysis still held after the loss of its lease")
+	}
+	if !p.isDropped(a) || p.retryJob(a, model.FAILURE_TIMEOUT) {
+		t.Error("Dropped analysis should not be retried")
+	}
+
+	// Dropped analyses dequeued again are not run
+	p.endJob(a)
+	if p.startJob(a, func() {}) || !p.forgetDropped(a) {
+		t.Error("Dropped analysis started again")
+	}
+}
+
+func TestWorkerForgetsFinished(t *testing.T) {
+	db := testMemoryDB(t)
+	a := claimedAnalysis(t, db, "w1")
+	p := holdingProcessor(a, func() {})
+	w := &DistributedWorker{Name: "w1", Lease: time.Minute, db: NewLeasedDB(db, "w1"), proc: p}
+	w.claimed = map[string]time.Time{a.Id: time.Now().Add(w.Lease)}
+
+	a.Status = model.STATUS_FINISHED
+	p.active++
+	p.endJob(a)
+	w.renew()
+	if w.nbClaimed() != 0 {
+		t.Error("Finished analysis still claimed")
+	}
+}
@@ -0,0 +1,164 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+const (
+	SHUTDOWN_MESSAGE   = "Canceled at server shutdown"
+	DRAIN_CANCEL_DELAY = 30 * time.Second // Max time given to canceled jobs to save their results
+)
+
+// Marks the analysis, not started yet, as canceled by the server shutdown
+func cancelShutdown(a *model.Analysis, db database.BoosterwebDB) {
+	a.Status = model.STATUS_CANCELED
+	a.End = time.Now().Format(time.RFC1123)
+	a.Message = SHUTDOWN_MESSAGE
+	if err := db.UpdateAnalysis(a); err != nil {
+		log.Print(err)
+	}
+	a.DelTemp()
+}
+
+// Cancels the analyses waiting in the queue
+func cancelQueued(queue chan *model.Analysis, db database.BoosterwebDB) {
+	for {
+		select {
+		case a := <-queue:
+			cancelShutdown(a, db)
+		default:
+			return
+		}
+	}
+}
+
+// Stops running new jobs, and lets the running jobs finish during at most
+// period. Jobs still running after period are canceled: supports computed
+// so far are kept as partial results.
+//
+// Queued jobs are canceled.
+func (p *LocalProcessor) Drain(period time.Duration) (err error) {
+	p.lock.Lock()
+	p.draining = true
+	p.lock.Unlock()
+	cancelQueued(p.queue, p.db)
+	p.lock.Lock()
+	for id := range p.held {
+		if _, ok := p.stops[id]; !ok {
+			delete(p.held, id)
+		}
+	}
+	p.lock.Unlock()
+
+	log.Print(fmt.Sprintf("Waiting for %d running local jobs (at most %v)", p.activeJobs(), period))
+	if p.waitJobs(period) {
+		return
+	}
+
+	p.lock.RLock()
+	for id, stop := range p.stops {
+		log.Print("Stopping job : " + id)
+		stop()
+	}
+	p.lock.RUnlock()
+	if p.waitJobs(DRAIN_CANCEL_DELAY) {
+		return
+	}
+	return p.CancelAnalyses()
+}
+
+// Registers a new job, unless the processor is draining
+// or the job was dropped
+func (p *LocalProcessor) startJob(a *model.Analysis, stop func()) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.draining || p.dropped[a.Id] {
+		delete(p.held, a.Id)
+		return false
+	}
+	p.active++
+	p.stops[a.Id] = stop
+	return true
+}
+
+// Unregisters a job, once its results are saved. Retried
+// jobs, pending again, are still held.
+func (p *LocalProcessor) endJob(a *model.Analysis) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.active--
+	delete(p.stops, a.Id)
+	if a.Status != model.STATUS_PENDING {
+		delete(p.held, a.Id)
+		delete(p.dropped, a.Id)
+	}
+}
+
+func (p *LocalProcessor) activeJobs() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.active
+}
+
+func (p *LocalProcessor) isDraining() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.draining
+}
+
+// Waits for the end of all jobs during at most period.
+// Returns false if jobs are still running.
+func (p *LocalProcessor) waitJobs(period time.Duration) bool {
+	deadline := time.Now().Add(period)
+	for p.activeJobs() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+	return true
+}
+
+// Marks the analysis interrupted by the end of the drain period as
+// canceled, keeping its partial results. Returns false if the processor
+// is not draining.
+func (p *LocalProcessor) cancelDrained(a *model.Analysis) bool {
+	if !p.isDraining() {
+		return false
+	}
+	a.Status = model.STATUS_CANCELED
+	a.Message = SHUTDOWN_MESSAGE
+	if a.PartialTrees > 0 {
+		a.Message = fmt.Sprintf("%s: supports computed on the first %d bootstrap trees", SHUTDOWN_MESSAGE, a.PartialTrees)
+		a.Warning = fmt.Sprintf("The analysis was interrupted by a server shutdown: FBP and TBE supports are computed on the first %d bootstrap trees only, and are approximate", a.PartialTrees)
+	}
+	return true
+}
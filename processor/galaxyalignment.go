@@ -0,0 +1,189 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/goalign/align"
+	autils "github.com/evolbioinfo/goalign/io/utils"
+)
+
+// Galaxy tool run on unaligned sequences (aligner) or
+// on an alignment (trimmer) before inferring the trees
+type GalaxyAlignTool struct {
+	Id         string            // Galaxy tool id
+	Input      string            // Name of the sequence input of the tool
+	Output     string            // Name of the alignment output of the tool
+	Parameters map[string]string // Additional parameters given to the tool
+}
+
+// Default input and output names of the alignment and trimming tools
+// (tools of the galaxy toolshed)
+var defaultGalaxyAlignTools = map[string]GalaxyAlignTool{
+	model.ALIGNER_MAFFT:  {Input: "inputSequences", Output: "outputAlignment"},
+	model.ALIGNER_MUSCLE: {Input: "input", Output: "output"},
+	model.TRIMMER_TRIMAL: {Input: "in", Output: "trimmed_output"},
+	model.TRIMMER_BMGE:   {Input: "input", Output: "output"},
+}
+
+// Registers a galaxy alignment or trimming tool, key being one of
+// model.ALIGNER_* or model.TRIMMER_*. Input and output names not given
+// are set to the defaults of the tool.
+//
+// Must be called before InitProcessor.
+func (p *GalaxyProcessor) SetAlignmentTool(key string, tool GalaxyAlignTool) {
+	if p.aligntools == nil {
+		p.aligntools = make(map[string]GalaxyAlignTool)
+	}
+	def := defaultGalaxyAlignTools[key]
+	if tool.Input == "" {
+		tool.Input = def.Input
+	}
+	if tool.Output == "" {
+		tool.Output = def.Output
+	}
+	p.aligntools[key] = tool
+}
+
+// Returns the keys of the alignment and trimming tools available on at least one galaxy server
+func (p *GalaxyProcessor) AlignmentTools() (tools []string) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	tools = make([]string, 0, len(p.availtools))
+	for key := range p.availtools {
+		tools = append(tools, key)
+	}
+	sort.Strings(tools)
+	return
+}
+
+// Launches the aligner and the trimmer of the analysis on the uploaded
+// sequences, and returns the id of the resulting alignment dataset.
+//
+// Galaxy jobs are chained: each job waits for the output of the previous one.
+// Each job is recorded as a step of the analysis.
+func (p *GalaxyProcessor) submitAlignment(a *model.Analysis, seqid string) (alignid string, err error) {
+	alignid = seqid
+	b := p.backend(a)
+	for _, key := range []string{a.Aligner, a.Trimmer} {
+		if key == "" {
+			continue
+		}
+		tool, ok := b.aligntool(key)
+		if !ok {
+			err = fmt.Errorf("%s is not available on galaxy server %s", model.AlignToolName(key), b.Name)
+			return
+		}
+
+		var outputs map[string]string
+		var jobs []string
+		tl := b.galaxy.NewToolLauncher(a.GalaxyHistory, tool.Id)
+		tl.AddFileInput(tool.Input, alignid, "hda")
+		for name, value := range tool.Parameters {
+			tl.AddParameter(name, value)
+		}
+		if outputs, jobs, err = b.galaxy.LaunchTool(tl); err != nil {
+			log.Print("Error while launching " + model.AlignToolName(key) + ": " + err.Error())
+			return
+		}
+		if len(jobs) != 1 {
+			err = errors.New("Galaxy error: No jobs in the list")
+			log.Print(err.Error())
+			return
+		}
+		if alignid, ok = outputs[tool.Output]; !ok {
+			err = fmt.Errorf("Galaxy error: no output %s for %s", tool.Output, model.AlignToolName(key))
+			log.Print(err.Error())
+			return
+		}
+		a.Steps = append(a.Steps, model.WorkflowStep{
+			Index:   len(a.Steps),
+			Label:   model.AlignToolName(key),
+			State:   "new",
+			JobId:   jobs[0],
+			Dataset: alignid,
+		})
+		p.db.UpdateAnalysis(a)
+	}
+	return
+}
+
+// Updates the states of the galaxy jobs of the steps of the analysis,
+// the state of the main job being jobstate
+func (p *GalaxyProcessor) checkSteps(a *model.Analysis, jobstate string) (err error) {
+	for i, s := range a.Steps {
+		if s.JobId == a.JobId {
+			a.Steps[i].State = jobstate
+			continue
+		}
+		if s.State == "ok" {
+			continue
+		}
+		if a.Steps[i].State, _, err = p.backend(a).galaxy.CheckJob(s.JobId); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Downloads the alignment produced by the alignment steps of the analysis,
+// and stores it with its statistics
+func (p *GalaxyProcessor) downloadAlignment(a *model.Analysis) (err error) {
+	var content []byte
+	var al align.Alignment
+
+	datasets := make([]string, 0, 2)
+	for _, s := range a.Steps {
+		if s.Dataset != "" {
+			datasets = append(datasets, s.Dataset)
+		}
+	}
+	if len(datasets) == 0 {
+		return
+	}
+
+	for i, id := range datasets {
+		if content, err = p.backend(a).galaxy.DownloadFile(a.GalaxyHistory, id); err != nil {
+			log.Print("Error while downloading alignment: " + err.Error())
+			return
+		}
+		if al, _, err = autils.ParseAlignmentAuto(bufio.NewReader(bytes.NewReader(content)), false); err != nil {
+			log.Print("Error while reading alignment: " + err.Error())
+			return
+		}
+		if i == 0 && len(datasets) > 1 {
+			// Alignment before trimming
+			a.AlignRawLength = al.Length()
+		}
+	}
+	SetAlignment(a, al)
+	return
+}
@@ -0,0 +1,403 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/workflow"
+	"github.com/fredericlemoine/golaxy"
+)
+
+const (
+	GALAXY_BACKEND_DEFAULT = "galaxy" // Name of the galaxy server when a single one is configured (galaxy.url)
+	GALAXY_TOOL_BOOSTER    = "booster"
+)
+
+// Galaxy server on which jobs may be launched
+type GalaxyBackend struct {
+	Name     string            // Name of the server, stored in the analyses it runs
+	Url      string            // Url of the server
+	ApiKey   string            // Api key on the server
+	Capacity int               // Max number of jobs running at the same time on the server (0: queue size)
+	Tools    map[string]string // Tool or galaxy workflow ids on this server overriding the default ones, key: "booster", workflow key, or alignment tool key
+}
+
+// A galaxy server and the tools found on it
+type galaxyBackend struct {
+	GalaxyBackend
+	galaxy          *golaxy.Galaxy  // Connection to Galaxy
+	client          *http.Client    // Client of the galaxy api requests not handled by golaxy
+	requestattempts int             // Number of attempts of galaxy api requests
+	breaker         *circuitBreaker // Stops monitoring and submissions when the server is down
+
+	lock       sync.RWMutex
+	ready      bool                       // If the tools have been found on the server
+	boosterid  string                     // Galaxy ID of booster tool
+	workflows  map[int]*workflow.Workflow // Workflows available on this server, with their tool ids
+	aligntools map[string]GalaxyAlignTool // Alignment and trimming tools available on this server
+}
+
+// Adds a galaxy server on which jobs may be launched. If no server
+// is added, the url and key given to InitProcessor are used.
+//
+// Must be called before InitProcessor.
+func (p *GalaxyProcessor) AddBackend(b GalaxyBackend) {
+	p.backendconf = append(p.backendconf, b)
+}
+
+// Returns the id of the given tool on the server: the id given in
+// the server configuration, or def otherwise
+func (b *galaxyBackend) toolId(key, def string) string {
+	if id, ok := b.Tools[key]; ok && id != "" {
+		return id
+	}
+	return def
+}
+
+// Searches the booster tool, the workflows and the alignment tools on the server.
+// Workflows and alignment tools that are not found are not available on this server.
+func (b *galaxyBackend) init(boosterid string, workflows []*workflow.Workflow, aligntools map[string]GalaxyAlignTool) (err error) {
+	var tool golaxy.ToolInfo
+
+	log.Print(fmt.Sprintf("[%s] Searching Booster tool : %s", b.Name, b.toolId(GALAXY_TOOL_BOOSTER, boosterid)))
+	if tool, err = b.galaxy.GetToolById(b.toolId(GALAXY_TOOL_BOOSTER, boosterid)); err != nil {
+		return
+	}
+	booster := tool.Id
+	log.Print(fmt.Sprintf("[%s] Booster galaxy tool id: %s", b.Name, booster))
+
+	// Searches the workflows with given ids (checks that they exist)
+	wfs := make(map[int]*workflow.Workflow)
+	for _, w := range workflows {
+		gw := *w
+		if w.GalaxyWorkflow != "" {
+			var name string
+			gw.GalaxyWorkflow = b.toolId(w.Key, w.GalaxyWorkflow)
+			if name, err = b.checkGalaxyWorkflow(gw.GalaxyWorkflow); err != nil {
+				log.Print(fmt.Sprintf("[%s] %s workflow not available: %s", b.Name, w.Name, err.Error()))
+				continue
+			}
+			wfs[gw.Id] = &gw
+			log.Print(fmt.Sprintf("[%s] %s galaxy workflow id: %s (%s)", b.Name, gw.Name, gw.GalaxyWorkflow, name))
+			continue
+		}
+		if gw.GalaxyTool = b.toolId(w.Key, w.GalaxyTool); gw.GalaxyTool == "" {
+			log.Print(fmt.Sprintf("[%s] %s workflow not available on galaxy", b.Name, w.Name))
+			continue
+		}
+		if tool, err = b.galaxy.GetToolById(gw.GalaxyTool); err != nil {
+			log.Print(fmt.Sprintf("[%s] %s workflow not available: %s", b.Name, w.Name, err.Error()))
+			continue
+		}
+		gw.GalaxyTool = tool.Id
+		wfs[gw.Id] = &gw
+		log.Print(fmt.Sprintf("[%s] %s galaxy tool id: %s", b.Name, gw.Name, gw.GalaxyTool))
+	}
+
+	// Searches the alignment and trimming tools
+	tools := make(map[string]GalaxyAlignTool)
+	for key, t := range aligntools {
+		if tool, err = b.galaxy.GetToolById(b.toolId(key, t.Id)); err != nil {
+			log.Print(fmt.Sprintf("[%s] %s not available: %s", b.Name, model.AlignToolName(key), err.Error()))
+			continue
+		}
+		t.Id = tool.Id
+		tools[key] = t
+		log.Print(fmt.Sprintf("[%s] %s galaxy tool id: %s", b.Name, model.AlignToolName(key), t.Id))
+	}
+	err = nil
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.boosterid = booster
+	b.workflows = wfs
+	b.aligntools = tools
+	b.ready = true
+	return
+}
+
+func (b *galaxyBackend) isReady() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.ready
+}
+
+func (b *galaxyBackend) booster() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.boosterid
+}
+
+// Returns the workflow with its tool ids on this server
+func (b *galaxyBackend) workflow(id int) (w *workflow.Workflow, ok bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	w, ok = b.workflows[id]
+	return
+}
+
+// Returns the alignment or trimming tool with its id on this server
+func (b *galaxyBackend) aligntool(key string) (t GalaxyAlignTool, ok bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	t, ok = b.aligntools[key]
+	return
+}
+
+// Returns true if all the tools needed by the analysis are on this server
+func (b *galaxyBackend) supports(a *model.Analysis) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if !b.ready {
+		return false
+	}
+	if a.SeqAlign == "" {
+		return true
+	}
+	if _, ok := b.workflows[a.Workflow]; !ok {
+		return false
+	}
+	for _, key := range []string{a.Aligner, a.Trimmer} {
+		if _, ok := b.aligntools[key]; key != "" && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Connects to the galaxy servers and searches the tools on each of them.
+//
+// Servers that cannot be reached are retried periodically. Workflows and
+// alignment tools available on the processor are the ones found on at least
+// one server.
+func (p *GalaxyProcessor) initBackends(url, apikey, boosterid string, workflows []*workflow.Workflow, requestattempts int) {
+	if len(p.backendconf) == 0 {
+		p.backendconf = []GalaxyBackend{{Name: GALAXY_BACKEND_DEFAULT, Url: url, ApiKey: apikey}}
+	}
+	p.monitorconf.setDefaults()
+
+	p.backends = make([]*galaxyBackend, 0, len(p.backendconf))
+	for _, conf := range p.backendconf {
+		if conf.Capacity <= 0 {
+			conf.Capacity = p.queuesize
+		}
+		b := &galaxyBackend{
+			GalaxyBackend:   conf,
+			galaxy:          golaxy.NewGalaxy(conf.Url, conf.ApiKey, true),
+			client:          newGalaxyClient(),
+			requestattempts: requestattempts,
+			breaker:         &circuitBreaker{name: conf.Name, threshold: p.monitorconf.BreakerThreshold, cooldown: p.monitorconf.BreakerCooldown},
+		}
+		b.galaxy.SetNbRequestAttempts(requestattempts)
+		log.Print(fmt.Sprintf("Galaxy server %s: %s (capacity %d)", b.Name, b.Url, b.Capacity))
+		if err := b.init(boosterid, workflows, p.aligntools); err != nil {
+			log.Print(fmt.Sprintf("Galaxy server %s not available, will be retried: %s", b.Name, err.Error()))
+		}
+		p.backends = append(p.backends, b)
+	}
+
+	if p.updateAvailable() == 0 {
+		log.Fatal("No galaxy server available")
+	}
+
+	// Servers not available at startup are retried: their workflows
+	// and tools are available once they are found
+	go func() {
+		for !p.isStopping() {
+			time.Sleep(p.monitorconf.BreakerCooldown)
+			for _, b := range p.backends {
+				if b.isReady() {
+					continue
+				}
+				if err := b.init(boosterid, workflows, p.aligntools); err != nil {
+					log.Print(fmt.Sprintf("Galaxy server %s still not available: %s", b.Name, err.Error()))
+				} else {
+					log.Print(fmt.Sprintf("Galaxy server %s is now available", b.Name))
+					p.updateAvailable()
+				}
+			}
+		}
+	}()
+}
+
+// Computes the workflows and the alignment tools available on at least one
+// ready galaxy server, and returns the number of ready servers
+func (p *GalaxyProcessor) updateAvailable() (ready int) {
+	workflows := make(map[int]*workflow.Workflow)
+	tools := make(map[string]bool)
+	for _, b := range p.backends {
+		if !b.isReady() {
+			continue
+		}
+		ready++
+		b.lock.RLock()
+		for id, w := range b.workflows {
+			if _, ok := workflows[id]; !ok {
+				workflows[id] = w
+			}
+		}
+		for key := range b.aligntools {
+			tools[key] = true
+		}
+		b.lock.RUnlock()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.workflows = workflows
+	p.availtools = tools
+	return
+}
+
+// Returns the definition of a workflow available on at least one galaxy server
+func (p *GalaxyProcessor) workflow(id int) (w *workflow.Workflow, ok bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	w, ok = p.workflows[id]
+	return
+}
+
+// Returns the galaxy server running the analysis.
+//
+// Analyses launched before several servers were configured
+// run on the first one.
+func (p *GalaxyProcessor) backend(a *model.Analysis) *galaxyBackend {
+	for _, b := range p.backends {
+		if b.Name == a.GalaxyBackend {
+			return b
+		}
+	}
+	if a.GalaxyBackend != "" {
+		log.Print(fmt.Sprintf("Galaxy server %s of analysis %s is not configured anymore, using %s", a.GalaxyBackend, a.Id, p.backends[0].Name))
+	}
+	return p.backends[0]
+}
+
+// Returns the number of running jobs on each galaxy server
+func (p *GalaxyProcessor) backendLoads() (loads map[string]int) {
+	loads = make(map[string]int)
+	for _, a := range p.allRunningJobs() {
+		loads[p.backend(a).Name]++
+	}
+	return
+}
+
+// Selects the galaxy server on which to launch the analysis: among the servers
+// having the needed tools and not already tried, the least loaded one that is
+// up and has free capacity. full is true if servers were not selected
+// only because they have no free capacity.
+func (p *GalaxyProcessor) selectBackend(a *model.Analysis, tried map[string]bool) (selected *galaxyBackend, full bool) {
+	loads := p.backendLoads()
+	candidates := make([]*galaxyBackend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if !tried[b.Name] && b.supports(a) {
+			candidates = append(candidates, b)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return float64(loads[candidates[i].Name])/float64(candidates[i].Capacity) < float64(loads[candidates[j].Name])/float64(candidates[j].Capacity)
+	})
+	for _, b := range candidates {
+		if loads[b.Name] >= b.Capacity {
+			full = true
+			continue
+		}
+		if b.breaker.allow() {
+			return b, false
+		}
+	}
+	return
+}
+
+// Launches the analysis on a galaxy server.
+//
+// If the submission fails on the selected server, the server is considered
+// failing and the analysis is submitted to the next one. If all the servers
+// having the needed tools are full, waits for a server to have free capacity.
+func (p *GalaxyProcessor) submitToBackends(a *model.Analysis) (err error) {
+	if err = p.checkAnalysis(a); err != nil {
+		return
+	}
+
+	tried := make(map[string]bool)
+	waiting := false
+	for !p.isStopping() {
+		b, full := p.selectBackend(a, tried)
+		if b == nil && full {
+			if !waiting {
+				log.Print(fmt.Sprintf("All galaxy servers are full, analysis %s is waiting", a.Id))
+				a.Message = "Waiting for a free galaxy server"
+				p.db.UpdateAnalysis(a)
+				waiting = true
+			}
+			time.Sleep(p.monitorconf.Interval)
+			continue
+		}
+		if b == nil {
+			break
+		}
+
+		log.Print(fmt.Sprintf("Launching analysis %s on galaxy server %s", a.Id, b.Name))
+		a.GalaxyBackend = b.Name
+		if err = p.submitToGalaxy(a); err == nil {
+			b.breaker.success()
+			return
+		}
+		log.Print(fmt.Sprintf("Error while launching analysis %s on galaxy server %s: %s", a.Id, b.Name, err.Error()))
+		b.breaker.failure()
+		p.resetSubmission(b, a)
+		tried[b.Name] = true
+	}
+
+	if p.isStopping() {
+		err = errors.New("Booster server is stopping, please try again in a few minutes")
+	} else if err == nil {
+		err = &transientError{errors.New("No galaxy server is available for this analysis, please try again in a few minutes")}
+	} else {
+		err = &transientError{err}
+	}
+	return
+}
+
+// Removes what the failed submission created on the galaxy server,
+// so that the analysis can be launched on another one
+func (p *GalaxyProcessor) resetSubmission(b *galaxyBackend, a *model.Analysis) {
+	if a.GalaxyHistory != "" {
+		p.deleteHistory(b, a.GalaxyHistory)
+	}
+	a.GalaxyBackend = ""
+	a.GalaxyHistory = ""
+	a.JobId = ""
+	a.InvocationId = ""
+	a.Steps = make([]model.WorkflowStep, 0)
+	p.db.UpdateAnalysis(a)
+}
@@ -0,0 +1,283 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+const (
+	GALAXY_HISTORY_NAME = "Booster History" // Name of the histories created by booster-web (followed by the analysis id)
+	GALAXY_HISTORY_TAG  = "booster-web"     // Tag of the histories created by booster-web
+	GALAXY_ANALYSIS_TAG = "analysis:"       // Tag of the histories giving the analysis id
+
+	GALAXY_CLEANUP_INTERVAL_DEFAULT  = 1 * time.Hour
+	GALAXY_CLEANUP_ORPHANAGE_DEFAULT = 24 * time.Hour
+)
+
+// Usage of galaxy histories by booster-web, as seen
+// by the last reconciliation
+type HistoryUsage struct {
+	Histories        int    `json:"histories"`        // Number of booster-web histories on galaxy (not purged)
+	Active           int    `json:"active"`           // Histories of pending or running analyses
+	Orphans          int    `json:"orphans"`          // Histories of other analyses, not purged yet
+	Size             int64  `json:"size"`             // Total size of the histories in bytes
+	Purged           int    `json:"purged"`           // Number of histories purged since the server started
+	PendingDeletions int    `json:"pendingdeletions"` // Histories whose deletion failed and will be retried
+	LastCheck        string `json:"lastcheck"`        // Time of the last reconciliation
+	LastError        string `json:"lasterror"`        // Error of the last reconciliation, if any
+}
+
+// Returns the size of the histories in a human readable form
+func (u HistoryUsage) SizeStr() string {
+	size := float64(u.Size)
+	for _, unit := range []string{"B", "KB", "MB", "GB"} {
+		if size < 1024 {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return fmt.Sprintf("%.1f TB", size)
+}
+
+// History as listed by the galaxy api
+type galaxyHistory struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	Tags       []string `json:"tags"`
+	UpdateTime string   `json:"update_time"`
+	Size       int64    `json:"size"`
+	Deleted    bool     `json:"deleted"`
+	Purged     bool     `json:"purged"`
+}
+
+// History on a galaxy server
+type historyRef struct {
+	backend string
+	id      string
+}
+
+// Histories created by booster-web on galaxy, whose
+// deletion is guaranteed by the reconciler
+type historyCleaner struct {
+	lock    sync.Mutex
+	pending map[historyRef]int // Histories whose deletion failed, value: number of attempts
+	usage   HistoryUsage
+}
+
+// Creates a new history for the analysis on its galaxy server, named and
+// tagged with the analysis id, so that it can be found by the reconciler
+func (p *GalaxyProcessor) createHistory(a *model.Analysis) (err error) {
+	var id string
+	b := p.backend(a)
+	history, err := b.galaxy.CreateHistory(GALAXY_HISTORY_NAME + " " + a.Id)
+	if err != nil {
+		return
+	}
+	id = history.Id
+	a.GalaxyHistory = id
+	p.db.UpdateAnalysis(a)
+
+	tags := map[string][]string{"tags": {GALAXY_HISTORY_TAG, GALAXY_ANALYSIS_TAG + a.Id}}
+	if err = b.galaxyRequest("PUT", "/api/histories/"+id, tags, nil); err != nil {
+		// The history is still found by its name
+		log.Print("Error while tagging history " + id + ": " + err.Error())
+		err = nil
+	}
+	return
+}
+
+// Deletes and purges the given history of the galaxy server. If the
+// deletion fails, it is retried by the reconciler.
+func (p *GalaxyProcessor) deleteHistory(b *galaxyBackend, id string) {
+	ref := historyRef{backend: b.Name, id: id}
+	if err := b.galaxyRequest("DELETE", "/api/histories/"+id+"?purge=true", map[string]bool{"purge": true}, nil); err != nil {
+		log.Print("Error while deleting history " + id + " on " + b.Name + " (will be retried): " + err.Error())
+		p.cleaner.lock.Lock()
+		p.cleaner.pending[ref]++
+		p.cleaner.lock.Unlock()
+		return
+	}
+	p.cleaner.lock.Lock()
+	delete(p.cleaner.pending, ref)
+	p.cleaner.usage.Purged++
+	p.cleaner.lock.Unlock()
+}
+
+// Returns the usage of galaxy histories, as seen by the last reconciliation
+func (p *GalaxyProcessor) HistoryUsage() HistoryUsage {
+	p.cleaner.lock.Lock()
+	defer p.cleaner.lock.Unlock()
+	u := p.cleaner.usage
+	u.PendingDeletions = len(p.cleaner.pending)
+	return u
+}
+
+// Creates a new go routine that periodically reconciles the histories
+// present on the galaxy servers with the analyses: histories of analyses that are not
+// running anymore (or unknown), and older than the orphan age, are purged.
+// Failed deletions are retried.
+func (p *GalaxyProcessor) initHistoryReconciler() {
+	conf := &p.monitorconf
+	if conf.CleanupInterval <= 0 {
+		conf.CleanupInterval = GALAXY_CLEANUP_INTERVAL_DEFAULT
+	}
+	if conf.OrphanAge <= 0 {
+		conf.OrphanAge = GALAXY_CLEANUP_ORPHANAGE_DEFAULT
+	}
+	log.Print(fmt.Sprintf("History reconciler: interval %s, orphan age %s", conf.CleanupInterval, conf.OrphanAge))
+
+	go func() {
+		for !p.isStopping() {
+			p.reconcileHistories()
+			time.Sleep(conf.CleanupInterval)
+		}
+	}()
+}
+
+// Lists booster-web histories on the galaxy servers, purges orphans
+// and retries failed deletions, and updates the history usage
+func (p *GalaxyProcessor) reconcileHistories() {
+	// Failed deletions first
+	p.cleaner.lock.Lock()
+	pending := make([]historyRef, 0, len(p.cleaner.pending))
+	for ref := range p.cleaner.pending {
+		pending = append(pending, ref)
+	}
+	p.cleaner.lock.Unlock()
+	for _, ref := range pending {
+		for _, b := range p.backends {
+			if b.Name == ref.backend {
+				p.deleteHistory(b, ref.id)
+			}
+		}
+	}
+
+	// Histories of running jobs
+	active := make(map[historyRef]bool)
+	for _, a := range p.allRunningJobs() {
+		if a.GalaxyHistory != "" {
+			active[historyRef{backend: p.backend(a).Name, id: a.GalaxyHistory}] = true
+		}
+	}
+
+	usage := HistoryUsage{LastCheck: time.Now().Format(time.RFC1123)}
+	errs := make([]string, 0)
+	for _, b := range p.backends {
+		if err := p.reconcileBackendHistories(b, active, &usage); err != nil {
+			log.Print("Error while listing galaxy histories on " + b.Name + ": " + err.Error())
+			errs = append(errs, b.Name+": "+err.Error())
+		}
+	}
+	usage.LastError = strings.Join(errs, "; ")
+
+	p.cleaner.lock.Lock()
+	defer p.cleaner.lock.Unlock()
+	usage.Purged = p.cleaner.usage.Purged
+	p.cleaner.usage = usage
+}
+
+// Reconciles the histories of a single galaxy server, and
+// adds them to the usage
+func (p *GalaxyProcessor) reconcileBackendHistories(b *galaxyBackend, active map[historyRef]bool, usage *HistoryUsage) (err error) {
+	var histories []galaxyHistory
+
+	if err = b.galaxyRequest("GET", "/api/histories?keys=id,name,tags,update_time,size,deleted,purged", nil, &histories); err != nil {
+		return
+	}
+
+	for _, h := range histories {
+		analysis, ok := boosterHistory(h)
+		if !ok || h.Purged {
+			continue
+		}
+		usage.Histories++
+		usage.Size += h.Size
+		if active[historyRef{backend: b.Name, id: h.Id}] || p.analysisRunning(analysis) {
+			usage.Active++
+			continue
+		}
+		usage.Orphans++
+		// Histories whose age is unknown are kept
+		updated, e := time.Parse("2006-01-02T15:04:05.999999", h.UpdateTime)
+		if e != nil {
+			log.Print(fmt.Sprintf("Orphan galaxy history %s on %s kept, unknown update time %q: %v", h.Id, b.Name, h.UpdateTime, e))
+			continue
+		}
+		if time.Since(updated) < p.monitorconf.OrphanAge {
+			continue
+		}
+		log.Print(fmt.Sprintf("Purging orphan galaxy history %s on %s (analysis %s)", h.Id, b.Name, analysis))
+		p.deleteHistory(b, h.Id)
+	}
+	return
+}
+
+// Returns true if the analysis with the given id is pending or running,
+// or if it cannot be read from the database: only the histories of
+// missing or ended analyses are purged
+func (p *GalaxyProcessor) analysisRunning(id string) bool {
+	if id == "" {
+		return false
+	}
+	a, err := p.db.GetAnalysis(id)
+	if errors.Is(err, database.ErrAnalysisNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Print(fmt.Sprintf("Cannot read analysis %s, its galaxy history is kept: %v", id, err))
+		return true
+	}
+	if a == nil {
+		return false
+	}
+	return !a.Ended()
+}
+
+// Returns true if the history has been created by booster-web,
+// with the id of its analysis (may be empty for old histories)
+func boosterHistory(h galaxyHistory) (analysis string, ok bool) {
+	for _, t := range h.Tags {
+		if t == GALAXY_HISTORY_TAG {
+			ok = true
+		} else if strings.HasPrefix(t, GALAXY_ANALYSIS_TAG) {
+			analysis = strings.TrimPrefix(t, GALAXY_ANALYSIS_TAG)
+		}
+	}
+	if strings.HasPrefix(h.Name, GALAXY_HISTORY_NAME) {
+		ok = true
+		if analysis == "" {
+			analysis = strings.TrimSpace(strings.TrimPrefix(h.Name, GALAXY_HISTORY_NAME))
+		}
+	}
+	return
+}
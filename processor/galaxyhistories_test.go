@@ -0,0 +1,91 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/processor/galaxytest"
+)
+
+// Memory database failing to read the given analyses
+type unreadableDB struct {
+	*database.MemoryBoosterWebDB
+	unreadable map[string]bool
+}
+
+func (db *unreadableDB) GetAnalysis(id string) (*model.Analysis, error) {
+	if db.unreadable[id] {
+		return nil, errors.New("database unavailable")
+	}
+	return db.MemoryBoosterWebDB.GetAnalysis(id)
+}
+
+func TestReconcileOrphanHistories(t *testing.T) {
+	srv := galaxytest.NewServer(testGalaxyKey)
+	defer srv.Close()
+	p, _ := monitoredGalaxyProcessor(t, srv, MonitorConfig{OrphanAge: time.Hour})
+	db := &unreadableDB{MemoryBoosterWebDB: testMemoryDB(t), unreadable: map[string]bool{"unreadable": true}}
+	p.db = db
+	for id, status := range map[string]int{"running": model.STATUS_RUNNING, "finished": model.STATUS_FINISHED} {
+		a := model.NewAnalysis()
+		a.Id = id
+		a.Status = status
+		if err := db.UpdateAnalysis(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	history := func(analysis string, updated time.Time) string {
+		return srv.AddHistory(GALAXY_HISTORY_NAME+" "+analysis, []string{GALAXY_HISTORY_TAG, GALAXY_ANALYSIS_TAG + analysis}, updated)
+	}
+	purged := []string{history("finished", old), history("missing", old)}
+	kept := []string{
+		history("running", old),
+		history("unreadable", old),
+		history("recent", time.Now()),
+		history("undated", time.Time{}),
+	}
+
+	p.reconcileHistories()
+
+	for _, id := range purged {
+		if h, _ := srv.History(id); !h.Purged {
+			t.Errorf("History %s of an ended or missing analysis not purged", h.Name)
+		}
+	}
+	for _, id := range kept {
+		if h, _ := srv.History(id); h.Deleted || h.Purged {
+			t.Errorf("History %s purged", h.Name)
+		}
+	}
+	if u := p.HistoryUsage(); u.Histories != 6 || u.Active != 2 || u.Orphans != 4 || u.Purged != 2 {
+		t.Errorf("Unexpected history usage: %+v", u)
+	}
+}
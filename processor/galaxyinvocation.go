@@ -0,0 +1,343 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	goio "io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/workflow"
+)
+
+// Galaxy workflows (multi-step) are invoked through the galaxy
+// REST api (/api/workflows and /api/invocations)
+
+type galaxyInvocationStep struct {
+	OrderIndex int             `json:"order_index"`
+	StepId     string          `json:"workflow_step_id"`
+	Label      string          `json:"workflow_step_label"`
+	State      string          `json:"state"`
+	JobId      string          `json:"job_id"`
+	Jobs       []galaxyStepJob `json:"jobs"` // All the jobs of the step, several for collection mapped steps
+}
+
+type galaxyStepJob struct {
+	Id string `json:"id"`
+}
+
+type galaxyDataset struct {
+	Id     string `json:"id"`
+	Src    string `json:"src"`
+	StepId string `json:"workflow_step_id"`
+}
+
+type galaxyInvocation struct {
+	Id         string                   `json:"id"`
+	State      string                   `json:"state"`
+	Steps      []galaxyInvocationStep   `json:"steps"`
+	Inputs     map[string]galaxyDataset `json:"inputs"`                // Dataset inputs, with their workflow step
+	Parameters map[string]galaxyDataset `json:"input_step_parameters"` // Parameter inputs, with their workflow step
+	Outputs    map[string]galaxyDataset `json:"outputs"`
+}
+
+type galaxyWorkflowInfo struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Returns the http client of the galaxy api requests of a server: its
+// connections are kept alive and reused between requests
+func newGalaxyClient() *http.Client {
+	return &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// Sends a request to the galaxy api of the server and decodes the json answer
+// into answer (if not nil). The request is tried b.requestattempts times.
+func (b *galaxyBackend) galaxyRequest(method, path string, body interface{}, answer interface{}) (err error) {
+	var data []byte
+	var req *http.Request
+	var resp *http.Response
+	var content []byte
+
+	if body != nil {
+		if data, err = json.Marshal(body); err != nil {
+			return
+		}
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	url := strings.TrimRight(b.Url, "/") + path + sep + "key=" + b.ApiKey
+
+	attempts := b.requestattempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	for i := 0; i < attempts; i++ {
+		var reader goio.Reader
+		if data != nil {
+			reader = bytes.NewReader(data)
+		}
+		if req, err = http.NewRequest(method, url, reader); err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if resp, err = b.client.Do(req); err != nil {
+			log.Print(fmt.Sprintf("Galaxy request %s %s failed (attempt %d/%d): %s", method, path, i+1, attempts, err.Error()))
+			time.Sleep(time.Duration(i+1) * time.Second)
+			continue
+		}
+		content, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("Galaxy request %s %s: %s", method, path, resp.Status)
+			log.Print(err.Error())
+			time.Sleep(time.Duration(i+1) * time.Second)
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			err = fmt.Errorf("Galaxy request %s %s: %s: %s", method, path, resp.Status, string(content))
+			return
+		}
+		if answer != nil {
+			err = json.Unmarshal(content, answer)
+		}
+		return
+	}
+	return
+}
+
+// Checks that the galaxy workflow with the given id exists
+// and returns its name
+func (b *galaxyBackend) checkGalaxyWorkflow(id string) (name string, err error) {
+	var info galaxyWorkflowInfo
+	if err = b.galaxyRequest("GET", "/api/workflows/"+id, nil, &info); err != nil {
+		return
+	}
+	name = info.Name
+	return
+}
+
+// Invokes the galaxy workflow on the given alignment, in the history of the analysis.
+//
+// Workflow parameters "<step>:<name>" are given to the corresponding steps.
+func (p *GalaxyProcessor) submitInvocation(a *model.Analysis, w *workflow.Workflow, alignfileid string) (err error) {
+	var params map[string]string
+	var invocation galaxyInvocation
+
+	if params, err = w.GalaxyParameters(a); err != nil {
+		return
+	}
+
+	stepparams := make(map[string]map[string]string)
+	for name, value := range params {
+		cols := strings.SplitN(name, ":", 2)
+		if _, ok := stepparams[cols[0]]; !ok {
+			stepparams[cols[0]] = make(map[string]string)
+		}
+		stepparams[cols[0]][cols[1]] = value
+	}
+
+	body := map[string]interface{}{
+		"history_id": a.GalaxyHistory,
+		"inputs_by":  "name",
+		"inputs": map[string]galaxyDataset{
+			w.InputLabel: galaxyDataset{Id: alignfileid, Src: "hda"},
+		},
+		"parameters":            stepparams,
+		"parameters_normalized": true,
+	}
+
+	if err = p.backend(a).galaxyRequest("POST", "/api/workflows/"+w.GalaxyWorkflow+"/invocations", body, &invocation); err != nil {
+		log.Print("Error while invoking " + w.Name + " galaxy workflow: " + err.Error())
+		return
+	}
+	if invocation.Id == "" {
+		err = errors.New("Galaxy error: No invocation id returned")
+		log.Print(err.Error())
+		return
+	}
+
+	a.InvocationId = invocation.Id
+	p.db.UpdateAnalysis(a)
+	return
+}
+
+// Checks the state of the galaxy workflow invocation of the analysis.
+//
+// The state of each step is updated in the analysis (a.Steps), and a global
+// state is computed, as for a single galaxy job: "ok" if all steps are ok, "error" if
+// one of the steps failed, "running" if one of the steps is running, "queued"
+// otherwise. Steps other than inputs are not ok until all their jobs are
+// ok: steps not scheduled yet have no job, and collection mapped steps
+// have several jobs. Returned files are the labeled outputs of the workflow.
+//
+// If the workflow has an alignment output, it is downloaded when
+// the invocation is finished.
+func (p *GalaxyProcessor) checkInvocation(a *model.Analysis) (state string, files map[string]string, err error) {
+	var invocation galaxyInvocation
+
+	b := p.backend(a)
+	if err = b.galaxyRequest("GET", "/api/invocations/"+a.InvocationId+"?step_details=true", nil, &invocation); err != nil {
+		return
+	}
+
+	// Input steps do not have jobs
+	inputs := make(map[string]bool)
+	for _, d := range invocation.Inputs {
+		inputs[d.StepId] = true
+	}
+	for _, d := range invocation.Parameters {
+		inputs[d.StepId] = true
+	}
+
+	steps := make([]model.WorkflowStep, 0, len(invocation.Steps))
+	nbok, nbrunning, nberror := 0, 0, 0
+	for _, s := range invocation.Steps {
+		if inputs[s.StepId] {
+			continue
+		}
+		var jobstate string
+		if jobstate, err = b.stepState(s); err != nil {
+			return
+		}
+		label := s.Label
+		if label == "" {
+			label = fmt.Sprintf("Step %d", s.OrderIndex)
+		}
+		steps = append(steps, model.WorkflowStep{Index: s.OrderIndex, Label: label, State: jobstate})
+		switch jobstate {
+		case "ok":
+			nbok++
+		case "running":
+			nbrunning++
+		case "error", "deleted", "paused":
+			nberror++
+		}
+	}
+	a.Steps = steps
+
+	files = make(map[string]string)
+	for label, d := range invocation.Outputs {
+		files[label] = d.Id
+	}
+
+	switch {
+	case invocation.State == "failed" || invocation.State == "cancelled" || nberror > 0:
+		state = "error"
+	case invocation.State == "scheduled" && len(steps) > 0 && nbok == len(steps):
+		state = "ok"
+	case nbrunning > 0 || nbok > 0:
+		state = "running"
+	default:
+		state = "queued"
+	}
+
+	if state == "ok" {
+		if w, ok := p.workflow(a.Workflow); ok && w.Outputs.Alignment != "" {
+			var content []byte
+			if id, ok := files[w.Outputs.Alignment]; !ok {
+				log.Print("Alignment output " + w.Outputs.Alignment + " not found in invocation " + a.InvocationId)
+			} else if content, err = b.galaxy.DownloadFile(a.GalaxyHistory, id); err != nil {
+				log.Print("Error while downloading workflow alignment: " + err.Error())
+				err = nil
+			} else {
+				a.Alignfile = string(content)
+			}
+		}
+	}
+	return
+}
+
+// Returns the state of the jobs of an invocation step: "queued" if it
+// has no job yet, otherwise "error" if one of its jobs failed, "running"
+// if one of them is running, "ok" if all of them are ok, or the state
+// of its first job that is not ok
+func (b *galaxyBackend) stepState(s galaxyInvocationStep) (state string, err error) {
+	jobs := make([]string, 0, len(s.Jobs)+1)
+	if s.JobId != "" {
+		jobs = append(jobs, s.JobId)
+	} else {
+		for _, j := range s.Jobs {
+			jobs = append(jobs, j.Id)
+		}
+	}
+	if len(jobs) == 0 {
+		return "queued", nil
+	}
+
+	state = "ok"
+	for _, id := range jobs {
+		var jobstate string
+		if jobstate, _, err = b.galaxy.CheckJob(id); err != nil {
+			return
+		}
+		switch {
+		case jobstate == "error" || jobstate == "deleted" || jobstate == "paused":
+			return jobstate, nil
+		case jobstate == "running":
+			state = "running"
+		case jobstate != "ok" && state == "ok":
+			state = jobstate
+		}
+	}
+	return
+}
+
+// Returns a message describing the current step of the workflow:
+// the first step that is not finished (empty if all steps are finished).
+func currentStepMessage(steps []model.WorkflowStep) string {
+	for i, s := range steps {
+		if s.State != "ok" {
+			return fmt.Sprintf("Step %d/%d (%s): %s", i+1, len(steps), s.Label, s.State)
+		}
+	}
+	return ""
+}
+
+// Cancels the galaxy workflow invocation of the analysis
+func (p *GalaxyProcessor) cancelInvocation(a *model.Analysis) (err error) {
+	return p.backend(a).galaxyRequest("DELETE", "/api/invocations/"+a.InvocationId, nil, nil)
+}
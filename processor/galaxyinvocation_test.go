@@ -0,0 +1,79 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"testing"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/processor/galaxytest"
+)
+
+func TestInvocationState(t *testing.T) {
+	srv := galaxytest.NewServer(testGalaxyKey)
+	defer srv.Close()
+	srv.AddTool(GALAXY_TOOL_BOOSTER, testBoosterOutputs)
+	srv.AddTool("done", nil, "ok")
+	srv.AddTool("busy", nil, "running")
+	srv.AddTool("failed", nil, "error")
+	p, _ := monitoredGalaxyProcessor(t, srv, MonitorConfig{})
+
+	for _, test := range []struct {
+		name  string
+		state string // State of the invocation
+		steps [][]string
+		want  string
+		nbok  int
+	}{
+		{"no step yet", "scheduled", nil, "queued", 0},
+		{"step not scheduled", "scheduled", [][]string{{"done"}, {}}, "running", 1},
+		{"mapped step running", "scheduled", [][]string{{"done"}, {"done", "busy"}}, "running", 1},
+		{"mapped step failed", "scheduled", [][]string{{"done"}, {"done", "failed"}}, "error", 1},
+		{"all steps ok", "scheduled", [][]string{{"done"}, {"done", "done"}}, "ok", 2},
+		{"invocation failed", "failed", [][]string{{"done"}}, "error", 1},
+	} {
+		a := model.NewAnalysis()
+		a.Id = test.name
+		a.InvocationId = srv.AddInvocation("history", test.state, test.steps...)
+		state, _, err := p.checkInvocation(a)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if state != test.want {
+			t.Errorf("%s: expected state %s, got %s", test.name, test.want, state)
+		}
+		if len(a.Steps) != len(test.steps) {
+			t.Errorf("%s: expected %d steps (inputs excluded), got %d", test.name, len(test.steps), len(a.Steps))
+		}
+		nbok := 0
+		for _, s := range a.Steps {
+			if s.State == "ok" {
+				nbok++
+			}
+		}
+		if nbok != test.nbok {
+			t.Errorf("%s: expected %d steps ok, got %d", test.name, test.nbok, nbok)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+const (
+	GALAXY_MONITOR_WORKERS_DEFAULT     = 4
+	GALAXY_MONITOR_INTERVAL_DEFAULT    = 10 * time.Second
+	GALAXY_MONITOR_MAXBACKOFF_DEFAULT  = 5 * time.Minute
+	GALAXY_MONITOR_GRACEPERIOD_DEFAULT = 30 * time.Minute
+	GALAXY_MONITOR_THRESHOLD_DEFAULT   = 5 // Consecutive galaxy api failures before opening the circuit breaker
+	GALAXY_MONITOR_COOLDOWN_DEFAULT    = 1 * time.Minute
+)
+
+// Configuration of the monitoring of galaxy jobs and histories.
+// Zero values are replaced by defaults.
+type MonitorConfig struct {
+	Workers          int           // Max number of jobs checked concurrently
+	Interval         time.Duration // Time between two checks of a job
+	MaxBackoff       time.Duration // Max time between two checks of a job after galaxy api failures
+	GracePeriod      time.Duration // A job is in error if galaxy api failures last longer than this period
+	BreakerThreshold int           // Number of consecutive galaxy api failures that stops all checks on a server
+	BreakerCooldown  time.Duration // Time during which checks are stopped after BreakerThreshold failures
+	CleanupInterval  time.Duration // Time between two reconciliations of galaxy histories
+	OrphanAge        time.Duration // Histories of finished analyses are purged after this time
+}
+
+// Error while checking a job that may not be definitive (galaxy
+// unreachable, unknown job state, etc.): the job is checked again later
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+// Monitoring state of a single job
+type jobMonitor struct {
+	next         time.Time // Next time the job must be checked
+	failures     int       // Number of consecutive transient failures
+	firstFailure time.Time // Time of the first of these failures
+}
+
+// Stops checking jobs on a galaxy server that seems down: after threshold
+// consecutive failures, checks are stopped during cooldown. Then a single check
+// is allowed, that closes the breaker if it succeeds, or opens it again otherwise.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	name      string // Name of the galaxy server
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Returns true if a galaxy request may be sent
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	// Half open: one probe
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures >= b.threshold {
+		log.Print(fmt.Sprintf("Galaxy server %s is reachable again, resuming job monitoring", b.name))
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Print(fmt.Sprintf("Galaxy server %s seems down (%d consecutive failures), job monitoring and submissions paused for %s", b.name, b.failures, b.cooldown))
+	}
+}
+
+// Sets the configuration of the job monitor.
+//
+// Must be called before InitProcessor.
+func (p *GalaxyProcessor) SetMonitorConfig(conf MonitorConfig) {
+	p.monitorconf = conf
+}
+
+// Replaces zero values of the monitor configuration by defaults
+func (c *MonitorConfig) setDefaults() {
+	if c.Workers <= 0 {
+		c.Workers = GALAXY_MONITOR_WORKERS_DEFAULT
+	}
+	if c.Interval <= 0 {
+		c.Interval = GALAXY_MONITOR_INTERVAL_DEFAULT
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = GALAXY_MONITOR_MAXBACKOFF_DEFAULT
+	}
+	if c.MaxBackoff < c.Interval {
+		c.MaxBackoff = c.Interval
+	}
+	if c.GracePeriod <= 0 {
+		c.GracePeriod = GALAXY_MONITOR_GRACEPERIOD_DEFAULT
+	}
+	if c.BreakerThreshold <= 0 {
+		c.BreakerThreshold = GALAXY_MONITOR_THRESHOLD_DEFAULT
+	}
+	if c.BreakerCooldown <= 0 {
+		c.BreakerCooldown = GALAXY_MONITOR_COOLDOWN_DEFAULT
+	}
+}
+
+// Creates a new Go routine that monitors running jobs.
+//
+// At each round, the jobs that are due are checked concurrently by at most
+// Workers go routines. A job whose check fails with a transient error is checked
+// again after an exponential backoff, and is set in error only if failures
+// last longer than the grace period.
+func (p *GalaxyProcessor) initJobMonitor() {
+	conf := &p.monitorconf
+	conf.setDefaults()
+	p.monitors = make(map[string]*jobMonitor)
+
+	log.Print(fmt.Sprintf("Job monitor: %d workers, interval %s, max backoff %s, grace period %s", conf.Workers, conf.Interval, conf.MaxBackoff, conf.GracePeriod))
+
+	jobs := make(chan *model.Analysis)
+	var round sync.WaitGroup
+	for i := 0; i < conf.Workers; i++ {
+		go func() {
+			for job := range jobs {
+				p.monitorJob(job)
+				round.Done()
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for !p.isStopping() {
+			for _, job := range p.dueJobs() {
+				if !p.backend(job).breaker.allow() {
+					continue
+				}
+				round.Add(1)
+				jobs <- job
+			}
+			// All the checks of the round are finished before the next one,
+			// so that a job is never checked twice at the same time
+			round.Wait()
+			time.Sleep(1 * time.Second)
+		}
+	}()
+}
+
+// Returns the running jobs that must be checked now
+func (p *GalaxyProcessor) dueJobs() (due []*model.Analysis) {
+	now := time.Now()
+	due = make([]*model.Analysis, 0)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, job := range p.runningJobs {
+		m, ok := p.monitors[job.Id]
+		if !ok {
+			m = &jobMonitor{next: now}
+			p.monitors[job.Id] = m
+		}
+		if !now.Before(m.next) {
+			due = append(due, job)
+		}
+	}
+	return
+}
+
+// Returns the monitoring state of the job
+func (p *GalaxyProcessor) jobMonitor(job *model.Analysis) *jobMonitor {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	m, ok := p.monitors[job.Id]
+	if !ok {
+		m = &jobMonitor{next: time.Now()}
+		p.monitors[job.Id] = m
+	}
+	return m
+}
+
+// Checks the state of the job on galaxy, and downloads the
+// results if it is finished
+func (p *GalaxyProcessor) monitorJob(job *model.Analysis) {
+	conf := p.monitorconf
+	b := p.backend(job)
+	m := p.jobMonitor(job)
+	now := time.Now()
+
+	state, fbptreeid, tbenormtreeid, tberawtreeid, tbelogid, err := p.checkJob(job)
+	if err == nil && state == "ok" {
+		// Results are downloaded before the history is deleted:
+		// a failed download is retried until the grace period
+		if err = p.downloadResults(job, fbptreeid, tbenormtreeid, tberawtreeid, tbelogid); err != nil {
+			err = &transientError{err}
+		}
+	}
+
+	if terr, ok := err.(*transientError); ok {
+		b.breaker.failure()
+		if m.failures == 0 {
+			m.firstFailure = now
+		}
+		m.failures++
+		if now.Sub(m.firstFailure) > conf.GracePeriod {
+			job.Status = model.STATUS_ERROR
+			job.End = now.Format(time.RFC1123)
+			job.Message = fmt.Sprintf("Job could not be checked on galaxy for more than %s: %s", conf.GracePeriod, terr.Error())
+			log.Print(fmt.Sprintf("Job %s: %s", job.Id, job.Message))
+			if !p.retryJob(job, model.FAILURE_API) {
+				p.finishJob(job)
+			}
+		} else if t, _ := job.TimedOut(time.Duration(p.timeout) * time.Second); t {
+			p.timeoutJob(job)
+		} else {
+			// Exponential backoff
+			backoff := conf.Interval
+			for i := 1; i < m.failures && backoff < conf.MaxBackoff; i++ {
+				backoff *= 2
+			}
+			if backoff > conf.MaxBackoff {
+				backoff = conf.MaxBackoff
+			}
+			m.next = now.Add(backoff)
+			log.Print(fmt.Sprintf("Error while checking job %s (%d failures, next check in %s): %s", job.Id, m.failures, backoff, terr.Error()))
+		}
+		return
+	}
+	if err != nil {
+		// The job cannot be followed on galaxy (e.g. no job id):
+		// galaxy answered, but this is not a success
+		job.Status = model.STATUS_ERROR
+		job.End = now.Format(time.RFC1123)
+		job.Message = err.Error()
+		log.Print(fmt.Sprintf("Job %s: %s", job.Id, job.Message))
+		if !p.retryJob(job, model.FAILURE_JOB) {
+			p.finishJob(job)
+		}
+		return
+	}
+
+	b.breaker.success()
+	m.failures = 0
+	m.next = now.Add(conf.Interval)
+
+	if state == "error" || job.Status == model.STATUS_ERROR {
+		if job.End == "" {
+			job.End = now.Format(time.RFC1123)
+		}
+		if !p.retryJob(job, model.FAILURE_JOB) {
+			p.finishJob(job)
+		}
+	} else if state == "ok" {
+		job.Status = model.STATUS_FINISHED
+		log.Print(fmt.Sprintf("Job %s finished successfully", job.Id))
+		p.finishJob(job)
+	} else if t, _ := job.TimedOut(time.Duration(p.timeout) * time.Second); t {
+		p.timeoutJob(job)
+	} else if err = p.db.UpdateAnalysis(job); err != nil {
+		log.Print(fmt.Sprintf("Problem updating job %s: %s", job.Id, err.Error()))
+	}
+}
+
+// Cancels the job after a timeout
+func (p *GalaxyProcessor) timeoutJob(job *model.Analysis) {
+	job.Status = model.STATUS_TIMEOUT
+	job.End = time.Now().Format(time.RFC1123)
+	job.Message = "Time out: Job canceled"
+	log.Print(fmt.Sprintf("Job %s timedout", job.Id))
+	if !p.retryJob(job, model.FAILURE_TIMEOUT) {
+		p.finishJob(job)
+	}
+}
+
+// Removes the finished job from the running jobs, saves it
+// and notifies the user
+func (p *GalaxyProcessor) finishJob(job *model.Analysis) {
+	var err error
+
+	p.rmRunningJob(job)
+	p.lock.Lock()
+	delete(p.monitors, job.Id)
+	p.lock.Unlock()
+
+	if err = p.db.UpdateAnalysis(job); err != nil {
+		log.Print(fmt.Sprintf("Problem updating job %s: %s", job.Id, err.Error()))
+	}
+	if err = p.notifier.Notify(job.StatusStr(), job.Id, job.RunName, job.WorkflowStr(), job.OptionsStr(), job.EMail); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/processor/galaxytest"
+)
+
+const testGalaxyKey = "testkey"
+
+// Outputs of the fake booster galaxy tool
+var testBoosterOutputs = map[string]string{
+	"fbp_tree":      "((A,B)0.5,C,D);",
+	"tbe_norm_tree": "((A,B)0.75,C,D);",
+	"tbe_raw_tree":  "((A,B)0.25,C,D);",
+	"tbe_log":       "BOOSTER Support\nTaxon : tIndex\nA : 0.5\n",
+}
+
+// Notifier recording the notified analyses
+type testNotifier struct {
+	notified chan string // Ids of the notified analyses
+}
+
+func newTestNotifier() *testNotifier {
+	return &testNotifier{notified: make(chan string, 100)}
+}
+
+func (n *testNotifier) Notify(status, analysisId, runName, workflow, options, email string) error {
+	n.notified <- analysisId
+	return nil
+}
+
+// Waits for the notification of the analysis
+func (n *testNotifier) wait(t *testing.T, id string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case notified := <-n.notified:
+			if notified == id {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Analysis %s not notified after %s", id, timeout)
+		}
+	}
+}
+
+// Returns true if an analysis has been notified
+func (n *testNotifier) any() bool {
+	select {
+	case <-n.notified:
+		return true
+	default:
+		return false
+	}
+}
+
+func testMemoryDB(t *testing.T) *database.MemoryBoosterWebDB {
+	t.Helper()
+	db := database.NewMemoryBoosterWebDB()
+	if err := db.InitDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Returns a galaxy processor connected to srv, whose go routines are not
+// started: jobs are checked by calling monitorJob
+func monitoredGalaxyProcessor(t *testing.T, srv *galaxytest.Server, conf MonitorConfig) (*GalaxyProcessor, *testNotifier) {
+	t.Helper()
+	notifier := newTestNotifier()
+	p := &GalaxyProcessor{}
+	p.SetMonitorConfig(conf)
+	p.db = testMemoryDB(t)
+	p.notifier = notifier
+	p.runningJobs = make(map[string]*model.Analysis)
+	p.monitors = make(map[string]*jobMonitor)
+	p.cleaner = &historyCleaner{pending: make(map[historyRef]int)}
+	p.queuesize = 10
+	p.initBackends(srv.URL, testGalaxyKey, GALAXY_TOOL_BOOSTER, nil, 1)
+	t.Cleanup(func() { p.Drain(0) })
+	return p, notifier
+}
+
+// Launches booster on the test trees on the galaxy server of the processor
+func submitGalaxyJob(t *testing.T, p *GalaxyProcessor, id string) *model.Analysis {
+	t.Helper()
+	dir := t.TempDir()
+	a := model.NewAnalysis()
+	a.Id = id
+	a.Status = model.STATUS_PENDING
+	a.StartPending = time.Now().Format(time.RFC1123)
+	a.Reffile = filepath.Join(dir, "ref.nw")
+	a.Bootfile = filepath.Join(dir, "boot.nw")
+	if err := ioutil.WriteFile(a.Reffile, []byte(testRefTree), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(a.Bootfile, []byte(testBootTree), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.submitToBackends(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.JobId == "" {
+		t.Fatal("No galaxy job id")
+	}
+	p.newRunningJob(a)
+	return a
+}
+
+func TestMonitorBackoff(t *testing.T) {
+	srv := galaxytest.NewServer(testGalaxyKey)
+	defer srv.Close()
+	srv.AddTool(GALAXY_TOOL_BOOSTER, testBoosterOutputs, "running")
+	p, notifier := monitoredGalaxyProcessor(t, srv, MonitorConfig{Interval: time.Second, MaxBackoff: 4 * time.Second, GracePeriod: time.Hour, BreakerThreshold: 100})
+	a := submitGalaxyJob(t, p, "backoff")
+
+	srv.Fail("/api/jobs", 500, 4)
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		before := time.Now()
+		p.monitorJob(a)
+		m := p.jobMonitor(a)
+		if m.failures != i+1 {
+			t.Errorf("Check %d: expected %d failures, got %d", i+1, i+1, m.failures)
+		}
+		if backoff := m.next.Sub(before); backoff < expected || backoff > expected+500*time.Millisecond {
+			t.Errorf("Check %d: expected a backoff of %s, got %s", i+1, expected, backoff)
+		}
+		if a.Status == model.STATUS_ERROR {
+			t.Fatalf("Check %d: job in error during the grace period: %s", i+1, a.Message)
+		}
+	}
+
+	// Galaxy answers again: back to the normal interval
+	before := time.Now()
+	p.monitorJob(a)
+	m := p.jobMonitor(a)
+	if m.failures != 0 {
+		t.Errorf("Expected failures to be reset, got %d", m.failures)
+	}
+	if backoff := m.next.Sub(before); backoff < time.Second || backoff > 1500*time.Millisecond {
+		t.Errorf("Expected the next check in %s, got %s", time.Second, backoff)
+	}
+	if a.Status != model.STATUS_RUNNING {
+		t.Errorf("Expected job to be running, got status %s", a.StatusStr())
+	}
+	if notifier.any() {
+		t.Error("Running job should not be notified")
+	}
+}
+
+func TestMonitorCircuitBreaker(t *testing.T) {
+	cooldown := 200 * time.Millisecond
+	srv := galaxytest.NewServer(testGalaxyKey)
+	defer srv.Close()
+	srv.AddTool(GALAXY_TOOL_BOOSTER, testBoosterOutputs, "running")
+	p, _ := monitoredGalaxyProcessor(t, srv, MonitorConfig{Interval: 10 * time.Millisecond, GracePeriod: time.Hour, BreakerThreshold: 3, BreakerCooldown: cooldown})
+	a := submitGalaxyJob(t, p, "breaker")
+	b := p.backend(a).breaker
+
+	srv.SetDown(true)
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatalf("Breaker opened after %d failures, threshold is 3", i)
+		}
+		p.monitorJob(a)
+	}
+	if b.allow() {
+		t.Fatal("Breaker should be open after 3 failures")
+	}
+
+	// After the cooldown, a single probe is allowed, that opens it again if it fails
+	time.Sleep(cooldown + 50*time.Millisecond)
+	if !b.allow() {
+		t.Fatal("Breaker should allow a probe after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("Breaker should allow a single probe")
+	}
+	p.monitorJob(a)
+	if b.allow() {
+		t.Fatal("Breaker should be open again after a failed probe")
+	}
+
+	// A successful probe closes it
+	time.Sleep(cooldown + 50*time.Millisecond)
+	srv.SetDown(false)
+	if !b.allow() {
+		t.Fatal("Breaker should allow a probe after the cooldown")
+	}
+	p.monitorJob(a)
+	if !b.allow() || !b.allow() {
+		t.Fatal("Breaker should be closed after a successful probe")
+	}
+	if a.Status != model.STATUS_RUNNING {
+		t.Errorf("Expected job to be running, got status %s", a.StatusStr())
+	}
+}
+
+func TestMonitorGracePeriod(t *testing.T) {
+	grace := 300 * time.Millisecond
+	srv := galaxytest.NewServer(testGalaxyKey)
+	defer srv.Close()
+	srv.AddTool(GALAXY_TOOL_BOOSTER, testBoosterOutputs, "running")
+	p, notifier := monitoredGalaxyProcessor(t, srv, MonitorConfig{Interval: 10 * time.Millisecond, GracePeriod: grace, BreakerThreshold: 100})
+	a := submitGalaxyJob(t, p, "grace")
+
+	srv.SetDown(true)
+	p.monitorJob(a)
+	if a.Status == model.STATUS_ERROR || a.Status == model.STATUS_TIMEOUT {
+		t.Fatalf("Job should still be monitored during the grace period, got status %s", a.StatusStr())
+	}
+	if len(p.allRunningJobs()) != 1 {
+		t.Fatal("Job should still be running during the grace period")
+	}
+
+	time.Sleep(grace + 100*time.Millisecond)
+	p.monitorJob(a)
+	if a.Status != model.STATUS_ERROR {
+		t.Fatalf("Expected job in error after the grace period, got status %s", a.StatusStr())
+	}
+	if !strings.HasPrefix(a.Message, "Job could not be checked on galaxy") {
+		t.Errorf("Unexpected message: %s", a.Message)
+	}
+	if len(p.allRunningJobs()) != 0 {
+		t.Error("Job in error should not be running anymore")
+	}
+	notifier.wait(t, a.Id, time.Second)
+}
+
+func TestMonitorTimeoutDuringGracePeriod(t *testing.T) {
+	srv := galaxytest.NewServer(testGalaxyKey)
+	defer srv.Close()
+	srv.AddTool(GALAXY_TOOL_BOOSTER, testBoosterOutputs, "running")
+	p, notifier := monitoredGalaxyProcessor(t, srv, MonitorConfig{Interval: 10 * time.Millisecond, GracePeriod: time.Hour, BreakerThreshold: 100})
+	p.timeout = 60
+	a := submitGalaxyJob(t, p, "timeout")
+
+	// Not timed out yet: a failed check only delays the next one
+	srv.SetDown(true)
+	p.monitorJob(a)
+	if a.Status == model.STATUS_TIMEOUT || a.Status == model.STATUS_ERROR {
+		t.Fatalf("Job should still be monitored, got status %s", a.StatusStr())
+	}
+
+	// Timed out: the job is canceled even if galaxy cannot be reached
+	a.StartPending = time.Now().Add(-time.Hour).Format(time.RFC1123)
+	p.monitorJob(a)
+	if a.Status != model.STATUS_TIMEOUT {
+		t.Fatalf("Expected job to be timed out, got status %s", a.StatusStr())
+	}
+	if a.Message != "Time out: Job canceled" {
+		t.Errorf("Unexpected message: %s", a.Message)
+	}
+	if len(p.allRunningJobs()) != 0 {
+		t.Error("Timed out job should not be running anymore")
+	}
+	notifier.wait(t, a.Id, time.Second)
+}
+
+func TestMonitorJobError(t *testing.T) {
+	srv := galaxytest.NewServer(testGalaxyKey)
+	defer srv.Close()
+	srv.AddTool(GALAXY_TOOL_BOOSTER, testBoosterOutputs, "running")
+	p, notifier := monitoredGalaxyProcessor(t, srv, MonitorConfig{Interval: 10 * time.Millisecond, GracePeriod: time.Hour, BreakerThreshold: 1, BreakerCooldown: time.Hour})
+	a := submitGalaxyJob(t, p, "nojobid")
+	b := p.backend(a).breaker
+
+	// Galaxy is unavailable, then the job cannot be followed anymore
+	srv.SetDown(true)
+	p.monitorJob(a)
+	srv.SetDown(false)
+	a.JobId = ""
+	p.monitorJob(a)
+	if a.Status != model.STATUS_ERROR {
+		t.Fatalf("Expected job in error, got status %s", a.StatusStr())
+	}
+	if !strings.HasPrefix(a.Message, "Galaxy Job ID not already assigned") {
+		t.Errorf("Unexpected message: %s", a.Message)
+	}
+	if len(p.allRunningJobs()) != 0 {
+		t.Error("Job in error should not be running anymore")
+	}
+	if b.allow() {
+		t.Error("Job error recorded as a breaker success")
+	}
+	notifier.wait(t, a.Id, time.Second)
+}
@@ -29,6 +29,7 @@ import (
 	"log"
 	"math"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -36,34 +37,50 @@ import (
 	"github.com/evolbioinfo/booster-web/database"
 	"github.com/evolbioinfo/booster-web/model"
 	"github.com/evolbioinfo/booster-web/notification"
-	"github.com/evolbioinfo/goalign/align"
+	"github.com/evolbioinfo/booster-web/workflow"
 	"github.com/evolbioinfo/gotree/io/newick"
 	"github.com/evolbioinfo/gotree/tree"
-	"github.com/fredericlemoine/golaxy"
 )
 
+// Names of the output datasets of the booster tool
+var boosterOutputs = workflow.Outputs{
+	FbpTree:     "fbp_tree",
+	TbeNormTree: "tbe_norm_tree",
+	TbeRawTree:  "tbe_raw_tree",
+	TbeLogs:     "tbe_log",
+}
+
 // The Galaxy processor launches jobs on a remote galaxy server
 //
 // It can launch only booster if analysis input files are
 type GalaxyProcessor struct {
 	runningJobs map[string]*model.Analysis // All running jobs key:job id, value:Job
 
-	galaxy     *golaxy.Galaxy        // Connection to Galaxy
-	queue      chan *model.Analysis  // Queue of analyses
-	boosterid  string                // Galaxy ID of booster tool
-	phymlid    string                // Galaxy ID of phyml Workflow
-	fasttreeid string                // Galaxy ID of fasttree Workflow
-	db         database.BoosterwebDB // Connection to database to save results
-	notifier   notification.Notifier // For email notifications
-	lock       sync.RWMutex          // Lock to modify running jobs
-	timeout    int                   // Timeout in seconds: jobs are timedout after this time
-	memlimit   int                   // Memory limit for jobs in Bytes. If jobs are estimated to consume more, they are not launched
-	queuesize  int                   // Max queue size
-	stopping   bool                  // If the server is stopping
+	backendconf []GalaxyBackend  // Configured galaxy servers
+	backends    []*galaxyBackend // Galaxy servers on which jobs are launched
+
+	queue     chan *model.Analysis       // Queue of analyses
+	workflows map[int]*workflow.Workflow // Workflows available on at least one galaxy server, key: workflow id (guarded by lock)
+	db        database.BoosterwebDB      // Connection to database to save results
+	notifier  notification.Notifier      // For email notifications
+	lock      sync.RWMutex               // Lock to modify running jobs
+	timeout   int                        // Timeout in seconds: jobs are timedout after this time
+	memlimit  int                        // Memory limit for jobs in Bytes. If jobs are estimated to consume more, they are not launched
+	queuesize int                        // Max queue size
+	stopping  bool                       // If the server is stopping (guarded by lock)
+
+	aligntools map[string]GalaxyAlignTool // Configured alignment and trimming tools, key: tool key
+	availtools map[string]bool            // Alignment and trimming tools available on at least one galaxy server (guarded by lock)
+
+	monitorconf MonitorConfig          // Configuration of the job monitor
+	monitors    map[string]*jobMonitor // Monitoring state of the running jobs, key: analysis id
+	retries     retryPolicies          // Retry policies per failure class
+	cleaner     *historyCleaner        // Guarantees the deletion of galaxy histories
 }
 
 // It will add the Analysis to the Queue and store it in the database
 func (p *GalaxyProcessor) LaunchAnalysis(a *model.Analysis) (err error) {
+	a.Processor = model.PROCESSOR_GALAXY
 	if err = p.db.UpdateAnalysis(a); err != nil {
 		return
 	}
@@ -91,20 +108,15 @@ func (p *GalaxyProcessor) LaunchAnalysis(a *model.Analysis) (err error) {
 }
 
 // Initializes the Galaxy Processor
-func (p *GalaxyProcessor) InitProcessor(url, apikey, boosterid, phymlid, fasttreeid string, galaxyrequestattempts int, db database.BoosterwebDB, notifier notification.Notifier, queuesize, timeout, memlimit int) {
-
-	var tool golaxy.ToolInfo
-	var err error
-
-	p.stopping = false
+//
+// Jobs are launched on the galaxy servers added with AddBackend, or on the
+// server at url otherwise. Only workflows with a galaxy tool or a galaxy
+// workflow id found on at least one server are available.
+func (p *GalaxyProcessor) InitProcessor(url, apikey, boosterid string, workflows []*workflow.Workflow, galaxyrequestattempts int, db database.BoosterwebDB, notifier notification.Notifier, queuesize, timeout, memlimit int) {
 	p.notifier = notifier
 	p.db = db
 	p.runningJobs = make(map[string]*model.Analysis)
-	p.galaxy = golaxy.NewGalaxy(url, apikey, true)
-	p.galaxy.SetNbRequestAttempts(galaxyrequestattempts)
-	p.boosterid = boosterid
-	p.phymlid = phymlid
-	p.fasttreeid = fasttreeid
+	p.cleaner = &historyCleaner{pending: make(map[historyRef]int)}
 	p.timeout = timeout
 	p.memlimit = memlimit
 
@@ -122,29 +134,9 @@ func (p *GalaxyProcessor) InitProcessor(url, apikey, boosterid, phymlid, fasttre
 	log.Print(fmt.Sprintf("Job timeout: %d", p.timeout))
 	log.Print(fmt.Sprintf("Job mem limit: %d", p.memlimit))
 	log.Print(fmt.Sprintf("Queue size: %d", queuesize))
-	log.Print(fmt.Sprintf("Searching Booster tool : %s", boosterid))
-	if tool, err = p.galaxy.GetToolById(boosterid); err != nil {
-		log.Fatal(err)
-	}
-	p.boosterid = tool.Id
-
-	log.Print(fmt.Sprintf("Booster galaxy tool id: %s", p.boosterid))
-
-	// Searches the PhyML-SMS workflow with given id (checks that it exists)
-	if tool, err = p.galaxy.GetToolById(phymlid); err != nil {
-		log.Fatal("Error while getting phyml workflow id: " + err.Error())
-	}
-	p.phymlid = tool.Id
-
-	log.Print(fmt.Sprintf("PhyML-SMS galaxy tool id: %s", p.phymlid))
-
-	// Searches the FastTree workflow with given id (checks that it exists)
-	if tool, err = p.galaxy.GetToolById(fasttreeid); err != nil {
-		log.Fatal("Error while getting fasttree workflow id: " + err.Error())
-	}
-	p.fasttreeid = tool.Id
 
-	log.Print(fmt.Sprintf("FastTree galaxy tool id: %s", p.fasttreeid))
+	// Searches the tools on the galaxy servers
+	p.initBackends(url, apikey, boosterid, workflows, galaxyrequestattempts)
 
 	p.queue = make(chan *model.Analysis, queuesize)
 
@@ -154,17 +146,20 @@ func (p *GalaxyProcessor) InitProcessor(url, apikey, boosterid, phymlid, fasttre
 	p.initJobMonitor()
 	// We restore already running jobs on galaxy
 	p.restoreRunningJobs()
+	// We purge histories that are not used anymore
+	p.initHistoryReconciler()
 }
 
 func (p *GalaxyProcessor) submitBooster(a *model.Analysis, reffileid, bootfileid string) (err error) {
 	// We launch the job
 	var jobs []string
 
-	tl := p.galaxy.NewToolLauncher(a.GalaxyHistory, p.boosterid)
+	b := p.backend(a)
+	tl := b.galaxy.NewToolLauncher(a.GalaxyHistory, b.booster())
 	tl.AddFileInput("ref", reffileid, "hda")
 	tl.AddFileInput("boot", bootfileid, "hda")
 
-	_, jobs, err = p.galaxy.LaunchTool(tl)
+	_, jobs, err = b.galaxy.LaunchTool(tl)
 	if err != nil {
 		log.Print("Error while launching booster: " + err.Error())
 		return
@@ -185,27 +180,45 @@ func (p *GalaxyProcessor) checkJob(a *model.Analysis) (state, fbptreeid, tbenorm
 	var files map[string]string
 	var fbptreename, tbenormtreename, tberawtreename, tbelogname string
 
-	// Now check status of galaxy job
-	if a.JobId == "" {
-		err = errors.New("Galaxy Job ID not already assigned for " + a.Id)
-		log.Print(err.Error())
-		return
-	}
+	if a.InvocationId != "" {
+		// Galaxy workflow: state of all the steps
+		if state, files, err = p.checkInvocation(a); err != nil {
+			log.Print("Error while checking " + a.WorkflowStr() + " workflow invocation status : " + err.Error())
+			err = &transientError{err}
+			return
+		}
+	} else {
+		// Now check status of galaxy job
+		if a.JobId == "" {
+			err = errors.New("Galaxy Job ID not already assigned for " + a.Id)
+			log.Print(err.Error())
+			return
+		}
 
-	// Now check status of galaxy job
-	if state, files, err = p.galaxy.CheckJob(a.JobId); err != nil {
-		log.Print("Error while checking " + a.WorkflowStr() + " workflow status : " + err.Error())
-		return
+		// Now check status of galaxy job
+		if state, files, err = p.backend(a).galaxy.CheckJob(a.JobId); err != nil {
+			log.Print("Error while checking " + a.WorkflowStr() + " workflow status : " + err.Error())
+			err = &transientError{err}
+			return
+		}
+		// And of the alignment steps
+		if err = p.checkSteps(a, state); err != nil {
+			log.Print("Error while checking alignment steps status : " + err.Error())
+			err = &transientError{err}
+			return
+		}
 	}
 
-	if a.SeqAlign == "" {
-		fbptreename = "fbp_tree"
-	} else {
-		fbptreename = "out_tree"
+	outputs := boosterOutputs
+	if a.SeqAlign != "" {
+		if w, ok := p.workflow(a.Workflow); ok {
+			outputs = w.Outputs
+		}
 	}
-	tbenormtreename = "tbe_norm_tree"
-	tberawtreename = "tbe_raw_tree"
-	tbelogname = "tbe_log"
+	fbptreename = outputs.FbpTree
+	tbenormtreename = outputs.TbeNormTree
+	tberawtreename = outputs.TbeRawTree
+	tbelogname = outputs.TbeLogs
 
 	switch state {
 	case "ok":
@@ -239,13 +252,13 @@ func (p *GalaxyProcessor) checkJob(a *model.Analysis) (state, fbptreeid, tbenorm
 			state = "error"
 		}
 		a.End = time.Now().Format(time.RFC1123)
-	case "queued":
+	case "queued", "upload":
 		a.Status = model.STATUS_PENDING
 		a.Message = "queued"
 	case "waiting":
 		a.Status = model.STATUS_PENDING
 		a.Message = "waiting"
-	case "running":
+	case "running", "setting_metadata":
 		a.Status = model.STATUS_RUNNING
 		if a.StartRunning == "" {
 			a.StartRunning = time.Now().Format(time.RFC1123)
@@ -254,38 +267,84 @@ func (p *GalaxyProcessor) checkJob(a *model.Analysis) (state, fbptreeid, tbenorm
 	case "new":
 		a.Status = model.STATUS_PENDING
 		a.Message = "New Job"
-	default: // May be "unknown", "deleted", "error" or other...
+	case "error", "deleted", "deleted_new", "paused", "failed", "cancelled":
 		err = errors.New("Job state : " + state)
+		state = "error"
 		a.Status = model.STATUS_ERROR
 		a.Message = "Galaxy Error"
+	default: // May be "unknown" or other...: the job is checked again later
+		err = &transientError{errors.New("Job in unknown state: " + state)}
 		log.Print("Job in unknown state: " + state)
 	}
 
+	if msg := currentStepMessage(a.Steps); msg != "" && a.Status != model.STATUS_FINISHED {
+		a.Message = msg
+	}
+
 	return
 }
 
-func (p *GalaxyProcessor) submitPhyML(a *model.Analysis, alignfileid string) (err error) {
-	var jobs []string
+// Returns true if the analysis can be launched on at least one galaxy server
+func (p *GalaxyProcessor) Supports(a *model.Analysis) bool {
+	if p.checkAnalysis(a) != nil {
+		return false
+	}
+	for _, b := range p.backends {
+		if b.supports(a) {
+			return true
+		}
+	}
+	return false
+}
 
-	tl := p.galaxy.NewToolLauncher(a.GalaxyHistory, p.phymlid)
-	tl.AddFileInput("input_align", alignfileid, "hda")
+// Returns the number of running jobs relative to the
+// capacity of the available galaxy servers
+func (p *GalaxyProcessor) Load() float64 {
+	capacity := 0
+	for _, b := range p.backends {
+		if b.isReady() {
+			capacity += b.Capacity
+		}
+	}
+	if capacity == 0 {
+		return math.Inf(1)
+	}
+	return float64(len(p.allRunningJobs())) / float64(capacity)
+}
 
-	if a.AlignAlphabet == model.ALIGN_AMINOACIDS {
-		tl.AddParameter("sequence|seqtype", "aa")
-	} else if a.AlignAlphabet == model.ALIGN_NUCLEOTIDS {
-		tl.AddParameter("sequence|seqtype", "nt")
-	} else {
-		err = errors.New("Unkown sequence alphabet in alignment")
+// Returns the workflows that can be launched on Galaxy
+func (p *GalaxyProcessor) Workflows() (workflows []int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	workflows = make([]int, 0, len(p.workflows))
+	for id := range p.workflows {
+		workflows = append(workflows, id)
+	}
+	sort.Ints(workflows)
+	return
+}
+
+// Launches the galaxy tool of the workflow on the given alignment,
+// with the parameters of the workflow definition.
+// The workflow holds the tool ids of the galaxy server of the analysis.
+func (p *GalaxyProcessor) submitWorkflow(a *model.Analysis, w *workflow.Workflow, alignfileid string) (err error) {
+	var jobs []string
+	var params map[string]string
+
+	if params, err = w.GalaxyParameters(a); err != nil {
 		return
 	}
-	tl.AddParameter("stat_crit", "aic")
-	tl.AddParameter("move", "SPR")
-	tl.AddParameter("bootstrap|support", "boot")
-	tl.AddParameter("bootstrap|replicates", fmt.Sprintf("%d", a.NbootRep))
 
-	_, jobs, err = p.galaxy.LaunchTool(tl)
+	b := p.backend(a)
+	tl := b.galaxy.NewToolLauncher(a.GalaxyHistory, w.GalaxyTool)
+	tl.AddFileInput(w.InputLabel, alignfileid, "hda")
+	for name, value := range params {
+		tl.AddParameter(name, value)
+	}
+
+	_, jobs, err = b.galaxy.LaunchTool(tl)
 	if err != nil {
-		log.Print("Error while launching PhyML-SMS: " + err.Error())
+		log.Print("Error while launching " + w.Name + ": " + err.Error())
 		return
 	}
 
@@ -299,123 +358,109 @@ func (p *GalaxyProcessor) submitPhyML(a *model.Analysis, alignfileid string) (er
 	return
 }
 
-func (p *GalaxyProcessor) submitFastTree(a *model.Analysis, alignfileid string) (err error) {
-	var jobs []string
-
-	tl := p.galaxy.NewToolLauncher(a.GalaxyHistory, p.fasttreeid)
-	tl.AddFileInput("input_align", alignfileid, "hda")
-
-	if a.AlignAlphabet == model.ALIGN_AMINOACIDS {
-		tl.AddParameter("sequence_type|seqtype", "")
-	} else if a.AlignAlphabet == model.ALIGN_NUCLEOTIDS {
-		tl.AddParameter("sequence_type|seqtype", "-nt")
-	} else {
-		err = errors.New("Unkown sequence alphabet in alignment")
+// Checks that the analysis can be launched on galaxy, before
+// selecting the galaxy server
+func (p *GalaxyProcessor) checkAnalysis(a *model.Analysis) (err error) {
+	if p.isStopping() {
+		err = errors.New("Booster server is stopping, please try again in a few minutes")
+		log.Print("Error while submitting job : " + err.Error())
 		return
 	}
-	tl.AddParameter("sequence_type|modelprot", "-lg")
-	tl.AddParameter("sequence_type|modeldna", "-gtr")
-	tl.AddParameter("gamma", "-gamma")
-	tl.AddParameter("bootstrap|do_bootstrap", "true")
-	tl.AddParameter("bootstrap|replicates", fmt.Sprintf("%d", a.NbootRep))
 
-	_, jobs, err = p.galaxy.LaunchTool(tl)
-	if err != nil {
-		log.Print("Error while launching booster: " + err.Error())
-		return
-	}
+	if a.SeqAlign != "" {
+		if a.Workflow == model.WORKFLOW_NIL {
+			err = errors.New("Phylogenetic workflow to launch is not defined")
+			log.Print("Error while Uploading reference sequence file: " + err.Error())
+			return
+		}
+		w, ok := p.workflow(a.Workflow)
+		if !ok {
+			err = errors.New("Error while launching workflow, unkown workflow")
+			log.Print(err.Error())
+			return
+		}
+		boostermem, boostercpu := estimateBoosterRunStats(a)
+		if mem, cpu, ok := w.Estimate(a); ok && ((p.memlimit > 0 && math.Max(mem, boostermem) > float64(p.memlimit)) || (p.timeout > 0 && cpu+boostercpu > float64(p.timeout))) {
+			err = fmt.Errorf("The given multiple alignment is too large to be analyzed online with %s, please consider using %s locally or using FastTree workflow", w.Name, w.Name)
+			log.Print(fmt.Sprintf("%s: Tree: mem=%.2f,cpu=%2f; Booster: mem=%.2f,cpu=%2f", err.Error(), mem, cpu, boostermem, boostercpu))
+			return
+		}
 
-	if len(jobs) != 1 {
-		log.Print("Galaxy Error: No jobs in the list")
-		err = errors.New("Galaxy error: No jobs in the list")
+		if a.Aligner != "" && (w.GalaxyWorkflow != "" || w.InputFormat == workflow.FORMAT_PHYLIP) {
+			err = fmt.Errorf("Unaligned sequences cannot be analyzed with %s on galaxy, please align them first", w.Name)
+			log.Print(err.Error())
+			return
+		}
+	} else if a.Reffile == "" || a.Bootfile == "" {
+		log.Print("No Reference tree or Bootstrap tree given")
+		err = errors.New("No Reference tree or Bootstrap tree given")
 		return
 	}
-
-	a.JobId = jobs[0]
-	p.db.UpdateAnalysis(a)
 	return
 }
 
+// Launches the analysis on its galaxy server (a.GalaxyBackend),
+// that has all the needed tools
 func (p *GalaxyProcessor) submitToGalaxy(a *model.Analysis) (err error) {
 	var reffileid string
 	var bootfileid string
 	var seqid string
-	var history golaxy.HistoryFullInfo
 
-	if p.stopping {
-		err = errors.New("Booster server is stopping, please try again in a few minutes")
-		log.Print("Error while submitting job : " + err.Error())
-		return
-	}
+	b := p.backend(a)
 
 	// We create an history
-	history, err = p.galaxy.CreateHistory("Booster History")
-	if err != nil {
+	if err = p.createHistory(a); err != nil {
 		log.Print("Error while Creating History: " + err.Error())
 		return
 	}
-	log.Print("History: " + history.Id)
-	a.GalaxyHistory = history.Id
-	p.db.UpdateAnalysis(a)
+	log.Print("History: " + a.GalaxyHistory)
 
 	// If we have a sequence file, then we build the trees from it
 	// and compute supports using the PHYML-SMS oneclick workflow from galaxy
 	if a.SeqAlign != "" {
+		w, ok := b.workflow(a.Workflow)
+		if !ok {
+			err = fmt.Errorf("Workflow not available on galaxy server %s", b.Name)
+			log.Print(err.Error())
+			return
+		}
 
-		if a.Workflow == model.WORKFLOW_NIL {
-			err = errors.New("Phylogenetic workflow to launch is not defined")
+		// The alignment was written in the input format of the workflow by server:newAnalysis function, now we upload it to history
+		// (unaligned sequences are in fasta)
+		if seqid, _, err = b.galaxy.UploadFile(a.GalaxyHistory, a.SeqAlign, w.InputFormat); err != nil {
 			log.Print("Error while Uploading reference sequence file: " + err.Error())
 			return
 		}
-		boostermem, boostercpu := estimateBoosterRunStats(a)
-		if a.Workflow == model.WORKFLOW_PHYML_SMS {
-			if mem, cpu := estimatePhyMLRunStats(a); (p.memlimit > 0 && math.Max(mem, boostermem) > float64(p.memlimit)) || (p.timeout > 0 && cpu+boostercpu > float64(p.timeout)) {
-				err = errors.New("The given multiple alignment is too large to be analyzed online with PhyML-SMS, please consider using PhyML-SMS locally or using FastTree workflow")
-				log.Print(fmt.Sprintf("%s: Tree: mem=%.2f,cpu=%2f; Booster: mem=%.2f,cpu=%2f", err.Error(), mem, cpu, boostermem, boostercpu))
-				return
-			}
-
-			// The alignment was converted to phylip by server:newAnalysis function, now we upload it to history
-			if seqid, _, err = p.galaxy.UploadFile(history.Id, a.SeqAlign, "phylip"); err != nil {
-				log.Print("Error while Uploading reference sequence file: " + err.Error())
-				return
-			}
-			if err = p.submitPhyML(a, seqid); err != nil {
-				log.Print("Error while launching PhyML-SMS workflow : " + err.Error())
-				return
-			}
-		} else if a.Workflow == model.WORKFLOW_FASTTREE {
-			if mem, cpu := estimateFastTreeRunStats(a); (p.timeout > 0 && cpu+boostercpu > float64(p.timeout)) || (p.memlimit > 0 && math.Max(mem, boostermem) > float64(p.memlimit)) {
-				err = errors.New("The given multiple alignment is too large to be analyzed online with FastTree, please consider using FastTree locally")
-				log.Print(fmt.Sprintf("%s: Tree: mem=%.2f,cpu=%2f; Booster: mem=%.2f,cpu=%2f", err.Error(), mem, cpu, boostermem, boostercpu))
-				return
-			}
-
-			// We upload the ref fasta sequence file to history
-			if seqid, _, err = p.galaxy.UploadFile(history.Id, a.SeqAlign, "fasta"); err != nil {
-				log.Print("Error while Uploading reference sequence file: " + err.Error())
+		if a.Aligner != "" {
+			if seqid, err = p.submitAlignment(a, seqid); err != nil {
+				log.Print("Error while launching sequence alignment : " + err.Error())
 				return
 			}
-			if err = p.submitFastTree(a, seqid); err != nil {
-				log.Print("Error while launching FastTree workflow : " + err.Error())
+		}
+		if w.GalaxyWorkflow != "" {
+			if err = p.submitInvocation(a, w, seqid); err != nil {
+				log.Print("Error while invoking " + w.Name + " workflow : " + err.Error())
 				return
 			}
-		} else {
-			err = errors.New("Error while launching workflow, unkown workflow")
-			log.Print(err.Error())
+		} else if err = p.submitWorkflow(a, w, seqid); err != nil {
+			log.Print("Error while launching " + w.Name + " workflow : " + err.Error())
 			return
 		}
-	} else if a.Reffile != "" && a.Bootfile != "" {
+		if len(a.Steps) > 0 {
+			a.Steps = append(a.Steps, model.WorkflowStep{Index: len(a.Steps), Label: w.Name, State: "new", JobId: a.JobId})
+			p.db.UpdateAnalysis(a)
+		}
+	} else {
 		// Otherwise we upload the given ref and boot files
 		// We upload ref tree to history
-		reffileid, _, err = p.galaxy.UploadFile(history.Id, a.Reffile, "nhx")
+		reffileid, _, err = b.galaxy.UploadFile(a.GalaxyHistory, a.Reffile, "nhx")
 		if err != nil {
 			log.Print("Error while Uploading ref tree file: " + err.Error())
 			return
 		}
 
 		// We upload boot tree to history
-		bootfileid, _, err = p.galaxy.UploadFile(history.Id, a.Bootfile, "nhx")
+		bootfileid, _, err = b.galaxy.UploadFile(a.GalaxyHistory, a.Bootfile, "nhx")
 		if err != nil {
 			log.Print("Error while Uploading boot tree file: " + err.Error())
 			return
@@ -425,10 +470,6 @@ func (p *GalaxyProcessor) submitToGalaxy(a *model.Analysis) (err error) {
 			log.Print("Error while launching Booster galaxy tool : " + err.Error())
 			return
 		}
-	} else {
-		log.Print("No Reference tree or Bootstrap tree given")
-		err = errors.New("No Reference tree or Bootstrap tree given")
-		return
 	}
 
 	return
@@ -444,13 +485,19 @@ func (p *GalaxyProcessor) newRunningJob(a *model.Analysis) {
 }
 
 func (p *GalaxyProcessor) rmRunningJob(a *model.Analysis) {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-	// we delete the history
+	// we cancel the remaining steps of the workflow
+	if a.InvocationId != "" && a.Status != model.STATUS_FINISHED {
+		if err := p.cancelInvocation(a); err != nil {
+			log.Print("Error while cancelling invocation " + a.InvocationId + ": " + err.Error())
+		}
+	}
+	// we delete the history (retried by the reconciler if it fails)
 	if a.GalaxyHistory != "" {
-		p.galaxy.DeleteHistory(a.GalaxyHistory)
+		p.deleteHistory(p.backend(a), a.GalaxyHistory)
 	}
 	// And delete the job from the running jobs
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	delete(p.runningJobs, a.Id)
 }
 
@@ -465,7 +512,7 @@ func (p *GalaxyProcessor) allRunningJobs() []*model.Analysis {
 }
 
 func (p *GalaxyProcessor) CancelAnalyses() (err error) {
-	p.stopping = true
+	p.setStopping()
 	for _, a := range p.allRunningJobs() {
 		log.Print("Cancelling job : " + a.Id)
 		a.Status = model.STATUS_CANCELED
@@ -479,22 +526,48 @@ func (p *GalaxyProcessor) CancelAnalyses() (err error) {
 	return
 }
 
+// Stops launching queued jobs: running galaxy jobs go on, and are
+// restored when the server restarts.
+func (p *GalaxyProcessor) Drain(period time.Duration) (err error) {
+	p.setStopping()
+	cancelQueued(p.queue, p.db)
+	return
+}
+
+func (p *GalaxyProcessor) setStopping() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stopping = true
+}
+
+func (p *GalaxyProcessor) isStopping() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.stopping
+}
+
 // Creates a new go routine that waits for
 // new jobs in the queue and launches them on Galaxy
 func (p *GalaxyProcessor) initJobLauncher() {
 	go func() {
 		for a := range p.queue {
-			if p.stopping {
-				break
+			// Analyses queued while the server is stopping
+			if p.isStopping() {
+				cancelShutdown(a, p.db)
+				continue
 			}
 			log.Print(fmt.Sprintf("New analysis : id=%s", a.Id))
-			err := p.submitToGalaxy(a)
+			err := p.submitToBackends(a)
 			p.newRunningJob(a)
 			if err != nil {
 				log.Print("Error while submitting to galaxy: " + err.Error())
 				a.Status = model.STATUS_ERROR
 				a.End = time.Now().Format(time.RFC1123)
 				a.Message = err.Error()
+				// Galaxy servers failing or unavailable
+				if _, ok := err.(*transientError); ok && p.retryJob(a, model.FAILURE_API) {
+					continue
+				}
 				p.rmRunningJob(a)
 				if err = p.db.UpdateAnalysis(a); err != nil {
 					log.Print("Problem updating job: " + err.Error())
@@ -504,122 +577,87 @@ func (p *GalaxyProcessor) initJobLauncher() {
 	}()
 }
 
-// Creates a new Go routine that monitors running jobs
-func (p *GalaxyProcessor) initJobMonitor() {
-	go func() {
-		var state, fbptreeid, tbenormtreeid, tberawtreeid, tbelogid string
-		var err error
-		for !p.stopping {
-			for _, job := range p.allRunningJobs() {
-				state, fbptreeid, tbenormtreeid, tberawtreeid, tbelogid, err = p.checkJob(job)
-
-				if state == "error" || job.Status == model.STATUS_ERROR {
-					p.rmRunningJob(job)
-					if err = p.notifier.Notify(job.StatusStr(), job.Id, job.RunName, job.WorkflowStr(), job.EMail); err != nil {
-						log.Print(err)
-					}
-				} else if state == "ok" {
-					if err = p.downloadResults(job, fbptreeid, tbenormtreeid, tberawtreeid, tbelogid); err != nil {
-						job.Status = model.STATUS_ERROR
-						job.Message = err.Error()
-						log.Print(err)
-					} else {
-						job.Status = model.STATUS_FINISHED
-						log.Print(fmt.Sprintf("Job %s finished successfully", job.Id))
-					}
-					p.rmRunningJob(job)
-					if err = p.notifier.Notify(job.StatusStr(), job.Id, job.RunName, job.WorkflowStr(), job.EMail); err != nil {
-						log.Print(err)
-					}
-				} else if t, _ := job.TimedOut(time.Duration(p.timeout) * time.Second); t {
-					err = errors.New("Job timedout")
-					job.Status = model.STATUS_TIMEOUT
-					job.Message = "Time out: Job canceled"
-					log.Print(fmt.Sprintf("Job %s timedout", job.Id))
-					p.rmRunningJob(job)
-					if err = p.notifier.Notify(job.StatusStr(), job.Id, job.RunName, job.WorkflowStr(), job.EMail); err != nil {
-						log.Print(err)
-					}
-				} else if err != nil {
-					log.Print(fmt.Sprintf("Error while checking job %s : %s", job.Id, err))
-					time.Sleep(30 * time.Second)
-					continue
-				}
-
-				if err = p.db.UpdateAnalysis(job); err != nil {
-					log.Print(fmt.Sprintf("Problem updating job %s: %s", job.Id, err.Error()))
-				}
-				time.Sleep(1 * time.Second)
-			}
-			time.Sleep(10 * time.Second)
-		}
-	}()
-}
-
 func (p *GalaxyProcessor) restoreRunningJobs() {
 	an, err := p.db.GetRunningAnalyses()
 	if err != nil {
 		log.Print(err.Error())
 	} else {
-		log.Print(fmt.Sprintf("Restoring %d Galaxy jobs", len(an)))
+		nb, queued := 0, 0
 		for _, a := range an {
+			// Jobs of other processors (routing processor)
+			if a.Processor != "" && a.Processor != model.PROCESSOR_GALAXY {
+				continue
+			}
+			// Not submitted to galaxy yet, e.g. waiting for a retry
+			// when the server stopped: queued again
+			if a.Status == model.STATUS_PENDING && a.JobId == "" && a.InvocationId == "" {
+				select {
+				case p.queue <- a:
+					queued++
+				default:
+					cancelRetry(a, p.db, p.notifier)
+				}
+				continue
+			}
 			p.newRunningJob(a)
+			nb++
 		}
+		log.Print(fmt.Sprintf("Restoring %d Galaxy jobs, %d queued again", nb, queued))
 	}
 }
 
 func (p *GalaxyProcessor) downloadResults(a *model.Analysis, fbptreeid, tbenormtreeid, tberawtreeid, tbelogid string) (err error) {
 	var outcontent []byte
 
+	b := p.backend(a)
+
+	// We download the alignment built from unaligned sequences
+	if a.Aligner != "" {
+		if err = p.downloadAlignment(a); err != nil {
+			return
+		}
+	}
+
 	// We download resulting files
-	if outcontent, err = p.galaxy.DownloadFile(a.GalaxyHistory, fbptreeid); err != nil {
+	if outcontent, err = b.galaxy.DownloadFile(a.GalaxyHistory, fbptreeid); err != nil {
 		log.Print("Error while downloading fbp tree file: " + err.Error())
 	}
 	a.FbpTree = string(outcontent)
 
-	// We scale branch supports from [0,nbootrep] to [0,1] for phyml
-	if a.Workflow == model.WORKFLOW_PHYML_SMS {
+	// We scale branch supports to [0,1] (e.g. from [0,nbootrep] for phyml)
+	scale := 1.0
+	if w, ok := p.workflow(a.Workflow); ok && a.SeqAlign != "" {
+		scale = w.SupportFactor(a)
+	}
+	if scale != 1.0 {
 		var t *tree.Tree
 		if t, err = newick.NewParser(strings.NewReader(a.FbpTree)).Parse(); err != nil {
-			log.Print("Error while scaling phyml branch supports to [0,1]: " + err.Error())
+			log.Print("Error while scaling " + a.WorkflowStr() + " branch supports to [0,1]: " + err.Error())
 			return
 		} else {
-			t.ScaleSupports(1.0 / float64(a.NbootRep))
+			t.ScaleSupports(scale)
 			a.FbpTree = t.Newick()
 		}
 	}
 
-	if outcontent, err = p.galaxy.DownloadFile(a.GalaxyHistory, tbenormtreeid); err != nil {
+	if outcontent, err = b.galaxy.DownloadFile(a.GalaxyHistory, tbenormtreeid); err != nil {
 		log.Print("Error while downloading support file: " + err.Error())
 		return
 	}
 	a.TbeNormTree = string(outcontent)
 
-	if outcontent, err = p.galaxy.DownloadFile(a.GalaxyHistory, tberawtreeid); err != nil {
+	if outcontent, err = b.galaxy.DownloadFile(a.GalaxyHistory, tberawtreeid); err != nil {
 		log.Print("Error while downloading avg dist tree file: " + err.Error())
 		return
 	}
 	a.TbeRawTree = string(outcontent)
 
-	if outcontent, err = p.galaxy.DownloadFile(a.GalaxyHistory, tbelogid); err != nil {
+	if outcontent, err = b.galaxy.DownloadFile(a.GalaxyHistory, tbelogid); err != nil {
 		log.Print("Error while downloading log file: " + err.Error())
 		return
 	}
 	a.TbeLogs = cleanTBELogs(string(outcontent))
-	return
-}
-
-func estimateFastTreeRunStats(a *model.Analysis) (mem, time float64) {
-	alphabetsize := 4.0
-	if a.AlignAlphabet == align.AMINOACIDS {
-		alphabetsize = 20.0
-	}
-
-	time = 0.5071 +
-		0.00000006141*math.Pow(float64(a.AlignNbSeq), 1.5)*math.Log(float64(a.AlignNbSeq))*float64(a.AlignLength)*alphabetsize
-	mem = 2872 +
-		0.003412*(math.Pow(float64(a.AlignNbSeq), 1.5)+float64(a.AlignNbSeq)*float64(a.AlignLength)*alphabetsize)
-	time *= float64(a.NbootRep)
+	restoreOriginalNames(a)
 	return
 }
 
@@ -633,33 +671,35 @@ func cleanTBELogs(log string) (cleanlog string) {
 	return
 }
 
-func estimatePhyMLRunStats(a *model.Analysis) (mem, time float64) {
-	alphabetweight := 0.0
-	if a.AlignAlphabet == align.AMINOACIDS {
-		alphabetweight = 1.1
-	}
-
-	time = 3.526 + 30.18*alphabetweight +
-		0.00002227*float64(a.AlignNbSeq*a.AlignNbSeq*a.AlignLength) +
-		0.00006672*alphabetweight*float64(a.AlignNbSeq*a.AlignNbSeq*a.AlignLength)
-	mem = 3352.7636 -
-		884.7005*alphabetweight +
-		158.6359*float64(a.AlignNbSeq) -
-		5.0467*float64(a.AlignLength) +
-		81.0603*float64(a.AlignNbSeq)*alphabetweight -
-		51.2838*float64(a.AlignLength)*alphabetweight +
-		0.3754*float64(a.AlignLength*a.AlignNbSeq) +
-		1.7922*float64(a.AlignLength*a.AlignNbSeq)*alphabetweight
-
-	time *= float64(a.NbootRep)
-	return
+func estimateBoosterRunStats(a *model.Analysis) (mem, time float64) {
+	return boosterRunStats(a.AlignNbSeq, a.NbootRep, 0)
 }
 
-func estimateBoosterRunStats(a *model.Analysis) (mem, time float64) {
+const BOOT_TREE_TIP_MEMORY = 512 // Estimated memory (Bytes) of the nodes and edges of a bootstrap tree, per tip
+
+// Estimates the memory and the time of a booster run
+// on nbboot bootstrap trees with nbtips tips.
+//
+// jobthreads is the number of threads of a local run (0: booster
+// tool of galaxy): local runs copy the bootstrap trees given to FBP
+// (see supportRun.dispatch), at most 2*supportThreads(jobthreads)
+// copies being in the channel or processed at the same time.
+func boosterRunStats(nbtips, nbboot, jobthreads int) (mem, time float64) {
 	time = math.Pow(-1.370621+
-		0.002035*float64(a.AlignNbSeq), 2.0)
+		0.002035*float64(nbtips), 2.0)
 	mem = math.Pow(4865.453+
-		9.197*float64(a.AlignNbSeq), 2)
-	time *= float64(a.NbootRep)
+		9.197*float64(nbtips), 2)
+	time *= float64(nbboot)
+	if jobthreads > 0 {
+		copies := math.Min(float64(2*supportThreads(jobthreads)), float64(nbboot))
+		mem += copies * bootTreeMemory(nbtips)
+	}
 	return
 }
+
+// Estimates the memory of a bootstrap tree with nbtips tips,
+// with the bitsets of its edges computed by FBP and TBE
+func bootTreeMemory(nbtips int) float64 {
+	n := float64(nbtips)
+	return n*BOOT_TREE_TIP_MEMORY + 2*n*n/8
+}
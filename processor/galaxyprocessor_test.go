@@ -0,0 +1,359 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/processor/galaxytest"
+	"github.com/evolbioinfo/booster-web/workflow"
+	"github.com/evolbioinfo/gotree/io/newick"
+)
+
+// Max time for a job to go through its galaxy states
+// (the job monitor checks jobs every second at most)
+const testGalaxyWait = 30 * time.Second
+
+// Memory database returning given analyses as running, as the
+// mysql database returns its pending and running analyses
+type runningDB struct {
+	*database.MemoryBoosterWebDB
+	running []*model.Analysis
+}
+
+func (db *runningDB) GetRunningAnalyses() ([]*model.Analysis, error) {
+	return db.running, nil
+}
+
+// Memory database recording the statuses of the saved analyses
+type recordingDB struct {
+	*database.MemoryBoosterWebDB
+	statuses chan int
+}
+
+func (db *recordingDB) UpdateAnalysis(a *model.Analysis) error {
+	db.statuses <- a.Status
+	return db.MemoryBoosterWebDB.UpdateAnalysis(a)
+}
+
+// Starts a fake galaxy server having the booster tool, whose jobs go
+// through the given states
+func testGalaxyServer(t *testing.T, states ...string) *galaxytest.Server {
+	t.Helper()
+	srv := galaxytest.NewServer(testGalaxyKey)
+	t.Cleanup(srv.Close)
+	srv.AddTool(GALAXY_TOOL_BOOSTER, testBoosterOutputs, states...)
+	return srv
+}
+
+// Returns a started galaxy processor connected to srv
+func startedGalaxyProcessor(t *testing.T, srv *galaxytest.Server, db database.BoosterwebDB, workflows []*workflow.Workflow, timeout int) (*GalaxyProcessor, *testNotifier) {
+	t.Helper()
+	notifier := newTestNotifier()
+	p := &GalaxyProcessor{}
+	p.SetMonitorConfig(MonitorConfig{Interval: 50 * time.Millisecond, BreakerThreshold: 100})
+	p.InitProcessor(srv.URL, testGalaxyKey, GALAXY_TOOL_BOOSTER, workflows, 1, db, notifier, 10, timeout, 0)
+	t.Cleanup(func() { p.Drain(0) })
+	return p, notifier
+}
+
+// Returns a pending analysis of the test trees
+func treesAnalysis(t *testing.T, id string) *model.Analysis {
+	t.Helper()
+	dir := t.TempDir()
+	a := model.NewAnalysis()
+	a.Id = id
+	a.Status = model.STATUS_PENDING
+	a.StartPending = time.Now().Format(time.RFC1123)
+	a.Reffile = filepath.Join(dir, "ref.nw")
+	a.Bootfile = filepath.Join(dir, "boot.nw")
+	if err := ioutil.WriteFile(a.Reffile, []byte(testRefTree), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(a.Bootfile, []byte(testBootTree), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestGalaxySubmission(t *testing.T) {
+	srv := testGalaxyServer(t, "queued", "running", "ok")
+	p, notifier := startedGalaxyProcessor(t, srv, testMemoryDB(t), nil, 0)
+
+	a := treesAnalysis(t, "submission")
+	if err := p.LaunchAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+	notifier.wait(t, a.Id, testGalaxyWait)
+
+	if a.Status != model.STATUS_FINISHED {
+		t.Fatalf("Expected finished job, got status %s: %s", a.StatusStr(), a.Message)
+	}
+	if a.Processor != model.PROCESSOR_GALAXY || a.GalaxyBackend != GALAXY_BACKEND_DEFAULT {
+		t.Errorf("Unexpected processor %s or galaxy server %s", a.Processor, a.GalaxyBackend)
+	}
+	job, ok := srv.Job(a.JobId)
+	if !ok || job.ToolId != GALAXY_TOOL_BOOSTER {
+		t.Fatalf("Booster job %s not launched on galaxy", a.JobId)
+	}
+	if job.HistoryId != a.GalaxyHistory {
+		t.Errorf("Job launched in history %s instead of %s", job.HistoryId, a.GalaxyHistory)
+	}
+	if a.FbpTree != testBoosterOutputs["fbp_tree"] || a.TbeNormTree != testBoosterOutputs["tbe_norm_tree"] || a.TbeRawTree != testBoosterOutputs["tbe_raw_tree"] {
+		t.Errorf("Unexpected result trees: %s, %s, %s", a.FbpTree, a.TbeNormTree, a.TbeRawTree)
+	}
+	if !strings.Contains(a.TbeLogs, "Taxon : Instability") {
+		t.Errorf("Unexpected booster logs: %s", a.TbeLogs)
+	}
+	if h, ok := srv.History(a.GalaxyHistory); !ok || !h.Deleted || !h.Purged {
+		t.Error("History of the finished job not purged")
+	}
+	if len(p.allRunningJobs()) != 0 {
+		t.Error("Finished job still running")
+	}
+}
+
+func TestGalaxyTimeout(t *testing.T) {
+	srv := testGalaxyServer(t, "running")
+	p, notifier := startedGalaxyProcessor(t, srv, testMemoryDB(t), nil, 1)
+
+	a := treesAnalysis(t, "timeout")
+	if err := p.LaunchAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+	notifier.wait(t, a.Id, testGalaxyWait)
+
+	if a.Status != model.STATUS_TIMEOUT {
+		t.Fatalf("Expected timed out job, got status %s: %s", a.StatusStr(), a.Message)
+	}
+	if a.Message != "Time out: Job canceled" {
+		t.Errorf("Unexpected message: %s", a.Message)
+	}
+	if h, ok := srv.History(a.GalaxyHistory); !ok || !h.Deleted {
+		t.Error("History of the timed out job not deleted")
+	}
+}
+
+func TestGalaxyJobError(t *testing.T) {
+	srv := testGalaxyServer(t, "running", "error")
+	p, notifier := startedGalaxyProcessor(t, srv, testMemoryDB(t), nil, 0)
+
+	a := treesAnalysis(t, "error")
+	if err := p.LaunchAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+	notifier.wait(t, a.Id, testGalaxyWait)
+
+	if a.Status != model.STATUS_ERROR {
+		t.Fatalf("Expected job in error, got status %s: %s", a.StatusStr(), a.Message)
+	}
+	if a.Message != "Galaxy Error" {
+		t.Errorf("Unexpected message: %s", a.Message)
+	}
+	if a.FbpTree != "" {
+		t.Errorf("Results of a job in error should not be downloaded: %s", a.FbpTree)
+	}
+}
+
+func TestGalaxyPhyMLSupports(t *testing.T) {
+	srv := testGalaxyServer(t)
+	srv.AddTool("phyml_sms", map[string]string{
+		"out_tree":      "((A,B)50,(C,D)50);",
+		"tbe_norm_tree": testBoosterOutputs["tbe_norm_tree"],
+		"tbe_raw_tree":  testBoosterOutputs["tbe_raw_tree"],
+		"tbe_log":       testBoosterOutputs["tbe_log"],
+	}, "running", "ok")
+	phyml := &workflow.Workflow{
+		Key:          "phymlsms",
+		Id:           model.WORKFLOW_PHYML_SMS,
+		Name:         "PhyML-SMS",
+		GalaxyTool:   "phyml_sms",
+		InputLabel:   "input",
+		InputFormat:  workflow.FORMAT_PHYLIP,
+		Parameters:   map[string]string{"bootstrap|replicates": "{{.NbootRep}}"},
+		Outputs:      workflow.Outputs{FbpTree: "out_tree", TbeNormTree: "tbe_norm_tree", TbeRawTree: "tbe_raw_tree", TbeLogs: "tbe_log"},
+		SupportScale: workflow.SCALE_NBOOTREP,
+	}
+	p, notifier := startedGalaxyProcessor(t, srv, testMemoryDB(t), []*workflow.Workflow{phyml}, 0)
+
+	dir := t.TempDir()
+	a := model.NewAnalysis()
+	a.Id = "phyml"
+	a.Status = model.STATUS_PENDING
+	a.StartPending = time.Now().Format(time.RFC1123)
+	a.Workflow = model.WORKFLOW_PHYML_SMS
+	a.NbootRep = 100
+	a.AlignAlphabet = model.ALIGN_NUCLEOTIDS
+	a.AlignNbSeq = 4
+	a.AlignLength = 10
+	a.SeqAlign = filepath.Join(dir, "align.phy")
+	if err := ioutil.WriteFile(a.SeqAlign, []byte(" 4 10\nA ACGTACGTAC\nB ACGTACGTTC\nC ACGAACGTAC\nD TCGTACGTAC\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.LaunchAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+	notifier.wait(t, a.Id, testGalaxyWait)
+
+	if a.Status != model.STATUS_FINISHED {
+		t.Fatalf("Expected finished job, got status %s: %s", a.StatusStr(), a.Message)
+	}
+	if job, ok := srv.Job(a.JobId); !ok || job.ToolId != "phyml_sms" {
+		t.Fatalf("PhyML-SMS job %s not launched on galaxy", a.JobId)
+	}
+	// Supports in [0,nbootrep] are rescaled to [0,1]
+	tr, err := newick.NewParser(strings.NewReader(a.FbpTree)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range tr.InternalEdges() {
+		if math.Abs(e.Support()-0.5) > 1e-6 {
+			t.Errorf("Expected rescaled support 0.5, got %f in %s", e.Support(), a.FbpTree)
+		}
+	}
+}
+
+func TestGalaxyLateBackend(t *testing.T) {
+	first := testGalaxyServer(t)
+	late := testGalaxyServer(t)
+	late.AddTool("phyml_sms", testBoosterOutputs)
+	late.AddTool("mafft_tool", map[string]string{"outputAlignment": ">A\nACGT\n"})
+	late.SetDown(true)
+	phyml := &workflow.Workflow{Key: "phymlsms", Id: model.WORKFLOW_PHYML_SMS, Name: "PhyML-SMS", GalaxyTool: "phyml_sms"}
+
+	p := &GalaxyProcessor{}
+	p.SetMonitorConfig(MonitorConfig{Interval: 50 * time.Millisecond, BreakerThreshold: 100, BreakerCooldown: 50 * time.Millisecond})
+	p.AddBackend(GalaxyBackend{Name: "first", Url: first.URL, ApiKey: testGalaxyKey})
+	p.AddBackend(GalaxyBackend{Name: "late", Url: late.URL, ApiKey: testGalaxyKey})
+	p.SetAlignmentTool(model.ALIGNER_MAFFT, GalaxyAlignTool{Id: "mafft_tool"})
+	p.InitProcessor("", "", GALAXY_TOOL_BOOSTER, []*workflow.Workflow{phyml}, 1, testMemoryDB(t), newTestNotifier(), 10, 0, 0)
+	t.Cleanup(func() { p.Drain(0) })
+
+	if len(p.Workflows()) != 0 || len(p.AlignmentTools()) != 0 {
+		t.Fatalf("Unexpected workflows %v and tools %v before the late server is available", p.Workflows(), p.AlignmentTools())
+	}
+
+	late.SetDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Workflows()) == 0 || len(p.AlignmentTools()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Workflows %v and tools %v of the late server not available", p.Workflows(), p.AlignmentTools())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if wfs := p.Workflows(); len(wfs) != 1 || wfs[0] != model.WORKFLOW_PHYML_SMS {
+		t.Errorf("Unexpected workflows %v", wfs)
+	}
+	if tools := p.AlignmentTools(); len(tools) != 1 || tools[0] != model.ALIGNER_MAFFT {
+		t.Errorf("Unexpected alignment tools %v", tools)
+	}
+}
+
+func TestGalaxyRestoreRunningJobs(t *testing.T) {
+	srv := testGalaxyServer(t, "running")
+
+	// Job launched on galaxy before the restart
+	previous, _ := monitoredGalaxyProcessor(t, srv, MonitorConfig{})
+	launched := submitGalaxyJob(t, previous, "restored")
+	previous.Drain(0)
+	srv.SetJobStates(launched.JobId, "running", "ok")
+
+	// As read from the database after the restart
+	restored := *launched
+	restored.Processor = model.PROCESSOR_GALAXY
+	restored.Status = model.STATUS_RUNNING
+	other := treesAnalysis(t, "other")
+	other.Processor = "local"
+	other.Status = model.STATUS_RUNNING
+	db := &runningDB{MemoryBoosterWebDB: testMemoryDB(t), running: []*model.Analysis{&restored, other}}
+
+	p, notifier := startedGalaxyProcessor(t, srv, db, nil, 0)
+	notifier.wait(t, restored.Id, testGalaxyWait)
+
+	if restored.Status != model.STATUS_FINISHED {
+		t.Fatalf("Expected restored job to finish, got status %s: %s", restored.StatusStr(), restored.Message)
+	}
+	if restored.FbpTree != testBoosterOutputs["fbp_tree"] {
+		t.Errorf("Results of the restored job not downloaded: %s", restored.FbpTree)
+	}
+	if running := p.allRunningJobs(); len(running) != 0 {
+		t.Errorf("Expected no running job, got %d (jobs of other processors must not be restored)", len(running))
+	}
+	if other.Status != model.STATUS_RUNNING {
+		t.Errorf("Job of another processor modified: %s", other.StatusStr())
+	}
+}
+
+func TestGalaxyRestoreQueuesRetries(t *testing.T) {
+	srv := testGalaxyServer(t, "running", "ok")
+
+	// Waiting for a retry when the server stopped
+	retried := treesAnalysis(t, "retried")
+	retried.Processor = model.PROCESSOR_GALAXY
+	retried.Attempts = []model.Attempt{{Failure: model.FAILURE_API, Status: model.STATUS_ERROR, Message: "Galaxy unavailable"}}
+	db := &runningDB{MemoryBoosterWebDB: testMemoryDB(t), running: []*model.Analysis{retried}}
+
+	_, notifier := startedGalaxyProcessor(t, srv, db, nil, 0)
+	notifier.wait(t, retried.Id, testGalaxyWait)
+
+	if retried.Status != model.STATUS_FINISHED {
+		t.Fatalf("Expected the restored retry to be submitted and to finish, got status %s: %s", retried.StatusStr(), retried.Message)
+	}
+	if jobs := srv.Jobs(); len(jobs) != 1 {
+		t.Errorf("Expected one galaxy job, got %d", len(jobs))
+	}
+}
+
+func TestGalaxyDrainCancelsQueued(t *testing.T) {
+	srv := testGalaxyServer(t)
+	db := &recordingDB{MemoryBoosterWebDB: testMemoryDB(t), statuses: make(chan int, 100)}
+	p, _ := startedGalaxyProcessor(t, srv, db, nil, 0)
+
+	if err := p.Drain(0); err != nil {
+		t.Fatal(err)
+	}
+	a := treesAnalysis(t, "drained")
+	if err := p.LaunchAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for canceled := false; !canceled; {
+		select {
+		case status := <-db.statuses:
+			canceled = status == model.STATUS_CANCELED
+		case <-deadline:
+			t.Fatal("Analysis queued while stopping not canceled")
+		}
+	}
+	if jobs := srv.Jobs(); len(jobs) != 0 {
+		t.Errorf("Analysis queued while stopping launched on galaxy: %d jobs", len(jobs))
+	}
+}
@@ -0,0 +1,682 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+// Package galaxytest provides a fake Galaxy server, implementing the subset
+// of the Galaxy API used by the galaxy processor (through golaxy, and for
+// galaxy workflow invocations), so that the processor can be exercised
+// without a live Galaxy instance:
+//
+//	srv := galaxytest.NewServer("apikey")
+//	defer srv.Close()
+//	srv.AddTool("booster", map[string]string{"fbp_tree": "(a,b,(c,d)1);", ...}, "queued", "running", "ok")
+//	proc.InitProcessor(srv.URL, "apikey", "booster", ...)
+//
+// Jobs follow scriptable state transitions: each time a job is shown, it
+// moves to the next state of its script (the last state is kept). Failures
+// of the api may be injected with Fail and SetDown.
+package galaxytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tool installed on the fake server
+type Tool struct {
+	Id      string
+	Name    string
+	Version string
+	Outputs map[string]string // Contents of the output datasets of the jobs, key: output name
+	States  []string          // State transitions of the jobs launched with this tool
+}
+
+// Galaxy workflow installed on the fake server
+type Workflow struct {
+	Id      string
+	Name    string
+	Steps   []string          // Tool of each step (one job per step)
+	Outputs map[string]string // Contents of the outputs of the invocations, key: output label
+}
+
+// Job launched on the fake server
+type Job struct {
+	Id        string
+	ToolId    string
+	HistoryId string
+	Inputs    map[string]interface{} // Inputs given at launch
+	States    []string               // Remaining state transitions
+	State     string                 // Current state
+	Outputs   map[string]string      // Output datasets, key: output name, value: dataset id
+}
+
+// History of the fake server
+type History struct {
+	Id         string
+	Name       string
+	Tags       []string
+	UpdateTime time.Time
+	Deleted    bool
+	Purged     bool
+}
+
+// Invocation of a galaxy workflow
+type Invocation struct {
+	Id         string
+	WorkflowId string
+	HistoryId  string
+	State      string
+	Steps      [][]string        // Jobs of each tool step: several for collection mapped steps, none for steps not scheduled yet
+	Outputs    map[string]string // Output datasets, key: output label, value: dataset id
+	Parameters map[string]interface{}
+}
+
+type dataset struct {
+	id      string
+	history string
+	content []byte
+}
+
+// Fake Galaxy server
+type Server struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	apikey      string
+	nextid      int
+	tools       map[string]*Tool
+	workflows   map[string]*Workflow
+	histories   map[string]*History
+	jobs        map[string]*Job
+	datasets    map[string]*dataset
+	invocations map[string]*Invocation
+	failures    []failure
+	down        bool
+	requests    int
+}
+
+// Failure injected in the next requests
+type failure struct {
+	prefix string // Path prefix of the requests that fail
+	status int    // Http status returned
+	count  int    // Number of requests that still fail
+}
+
+// Starts a new fake galaxy server. Requests must give the api key
+// as the "key" parameter (any key is accepted if apikey is empty).
+func NewServer(apikey string) (s *Server) {
+	s = &Server{
+		apikey:      apikey,
+		tools:       make(map[string]*Tool),
+		workflows:   make(map[string]*Workflow),
+		histories:   make(map[string]*History),
+		jobs:        make(map[string]*Job),
+		datasets:    make(map[string]*dataset),
+		invocations: make(map[string]*Invocation),
+		failures:    make([]failure, 0),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return
+}
+
+// Installs a tool. Jobs launched with it go through the given states
+// (default: "ok" directly) and produce the given outputs.
+func (s *Server) AddTool(id string, outputs map[string]string, states ...string) *Tool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(states) == 0 {
+		states = []string{"ok"}
+	}
+	t := &Tool{Id: id, Name: id, Version: "1.0", Outputs: outputs, States: states}
+	s.tools[id] = t
+	return t
+}
+
+// Installs a galaxy workflow, whose steps are run with the given tools
+func (s *Server) AddWorkflow(id, name string, outputs map[string]string, steps ...string) *Workflow {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w := &Workflow{Id: id, Name: name, Steps: steps, Outputs: outputs}
+	s.workflows[id] = w
+	return w
+}
+
+// Adds an invocation of a workflow in the history: steps give the tools
+// of the jobs of each step, several for collection mapped steps, none for
+// steps not scheduled yet. Returns the invocation id.
+func (s *Server) AddInvocation(history, state string, steps ...[]string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	inv := &Invocation{Id: s.newId(), HistoryId: history, State: state, Steps: make([][]string, 0, len(steps)), Outputs: make(map[string]string)}
+	for _, tools := range steps {
+		jobs := make([]string, 0, len(tools))
+		for _, tid := range tools {
+			jobs = append(jobs, s.newJob(s.tools[tid], history, nil).Id)
+		}
+		inv.Steps = append(inv.Steps, jobs)
+	}
+	s.invocations[inv.Id] = inv
+	return inv.Id
+}
+
+// Replaces the remaining state transitions of the job
+func (s *Server) SetJobStates(jobid string, states ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if j, ok := s.jobs[jobid]; ok {
+		j.States = states
+	}
+}
+
+// The next count requests whose path starts with prefix ("" for all)
+// fail with the given http status
+func (s *Server) Fail(prefix string, status, count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = append(s.failures, failure{prefix: prefix, status: status, count: count})
+}
+
+// While down, all requests fail with 503 Service Unavailable
+func (s *Server) SetDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+// Returns the job with the given id
+func (s *Server) Job(id string) (j Job, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var jp *Job
+	if jp, ok = s.jobs[id]; ok {
+		j = *jp
+	}
+	return
+}
+
+// Returns all the jobs launched on the server
+func (s *Server) Jobs() (jobs []Job) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	jobs = make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	return
+}
+
+// Returns the history with the given id
+func (s *Server) History(id string) (h History, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var hp *History
+	if hp, ok = s.histories[id]; ok {
+		h = *hp
+	}
+	return
+}
+
+// Adds a history, e.g. left over by a previous run, last updated at the given time
+func (s *Server) AddHistory(name string, tags []string, updated time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h := &History{Id: s.newId(), Name: name, Tags: tags, UpdateTime: updated}
+	s.histories[h.Id] = h
+	return h.Id
+}
+
+// Returns the content of the dataset with the given id
+func (s *Server) Dataset(id string) (content string, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var d *dataset
+	if d, ok = s.datasets[id]; ok {
+		content = string(d.content)
+	}
+	return
+}
+
+// Returns the number of requests received
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+func (s *Server) newId() string {
+	s.nextid++
+	return fmt.Sprintf("%016x", s.nextid)
+}
+
+func (s *Server) newDataset(history string, content []byte) string {
+	d := &dataset{id: s.newId(), history: history, content: content}
+	s.datasets[d.id] = d
+	return d.id
+}
+
+// Creates a job of the tool, with its output datasets
+func (s *Server) newJob(t *Tool, history string, inputs map[string]interface{}) *Job {
+	j := &Job{
+		Id:        s.newId(),
+		ToolId:    t.Id,
+		HistoryId: history,
+		Inputs:    inputs,
+		States:    append([]string{}, t.States...),
+		State:     "new",
+		Outputs:   make(map[string]string),
+	}
+	for name, content := range t.Outputs {
+		j.Outputs[name] = s.newDataset(history, []byte(content))
+	}
+	s.jobs[j.Id] = j
+	return j
+}
+
+// Moves the job to its next state
+func (j *Job) next() {
+	if len(j.States) > 0 {
+		j.State = j.States[0]
+		j.States = j.States[1:]
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests++
+	if s.down {
+		http.Error(w, "Galaxy is down", http.StatusServiceUnavailable)
+		return
+	}
+	for i := range s.failures {
+		f := &s.failures[i]
+		if f.count > 0 && strings.HasPrefix(r.URL.Path, f.prefix) {
+			f.count--
+			http.Error(w, "Injected failure", f.status)
+			return
+		}
+	}
+	if s.apikey != "" && r.URL.Query().Get("key") != s.apikey {
+		writeError(w, http.StatusForbidden, "Provided API key is not valid.")
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "api" {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	switch path[1] {
+	case "tools":
+		s.handleTools(w, r, path[2:])
+	case "histories":
+		s.handleHistories(w, r, path[2:])
+	case "jobs":
+		s.handleJobs(w, r, path[2:])
+	case "datasets":
+		s.handleDatasets(w, r, path[2:])
+	case "workflows":
+		s.handleWorkflows(w, r, path[2:])
+	case "invocations":
+		s.handleInvocations(w, r, path[2:])
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// GET /api/tools/{id}, POST /api/tools (tool launch and upload)
+func (s *Server) handleTools(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case r.Method == http.MethodGet && len(path) == 1:
+		t, ok := s.tools[path[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Tool not found: "+path[0])
+			return
+		}
+		writeJSON(w, map[string]interface{}{"id": t.Id, "name": t.Name, "version": t.Version})
+	case r.Method == http.MethodPost && len(path) == 0:
+		var payload struct {
+			HistoryId string                 `json:"history_id"`
+			ToolId    string                 `json:"tool_id"`
+			Inputs    map[string]interface{} `json:"inputs"`
+		}
+		var content []byte
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			// Upload: fields given in the multipart form, inputs being json encoded
+			if err := r.ParseMultipartForm(32 << 20); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			payload.HistoryId = r.FormValue("history_id")
+			payload.ToolId = r.FormValue("tool_id")
+			json.Unmarshal([]byte(r.FormValue("inputs")), &payload.Inputs)
+			for name := range r.MultipartForm.File {
+				if f, _, err := r.FormFile(name); err == nil {
+					content, _ = ioutil.ReadAll(f)
+					f.Close()
+				}
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := s.histories[payload.HistoryId]; !ok {
+			writeError(w, http.StatusBadRequest, "History not found: "+payload.HistoryId)
+			return
+		}
+		if payload.ToolId == "upload1" || payload.ToolId == "" {
+			id := s.newDataset(payload.HistoryId, content)
+			job := &Job{Id: s.newId(), ToolId: "upload1", HistoryId: payload.HistoryId, Inputs: payload.Inputs, State: "ok", Outputs: map[string]string{"output0": id}}
+			s.jobs[job.Id] = job
+			writeJSON(w, map[string]interface{}{
+				"outputs": []map[string]interface{}{{"id": id, "output_name": "output0", "name": "upload", "hid": 1}},
+				"jobs":    []map[string]interface{}{{"id": job.Id, "tool_id": "upload1", "state": job.State}},
+			})
+			return
+		}
+		t, ok := s.tools[payload.ToolId]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Tool not found: "+payload.ToolId)
+			return
+		}
+		j := s.newJob(t, payload.HistoryId, payload.Inputs)
+		outputs := make([]map[string]interface{}, 0, len(j.Outputs))
+		for name, id := range j.Outputs {
+			outputs = append(outputs, map[string]interface{}{"id": id, "output_name": name, "name": name})
+		}
+		writeJSON(w, map[string]interface{}{
+			"outputs": outputs,
+			"jobs":    []map[string]interface{}{{"id": j.Id, "tool_id": t.Id, "state": j.State}},
+		})
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// POST /api/histories, GET /api/histories, PUT|DELETE /api/histories/{id},
+// GET /api/histories/{id}/contents/{dataset}[/display]
+func (s *Server) handleHistories(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case r.Method == http.MethodPost && len(path) == 0:
+		var payload struct {
+			Name string `json:"name"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload.Name == "" {
+			payload.Name = r.FormValue("name")
+		}
+		h := &History{Id: s.newId(), Name: payload.Name, UpdateTime: time.Now()}
+		s.histories[h.Id] = h
+		writeJSON(w, s.historyJSON(h))
+	case r.Method == http.MethodGet && len(path) == 0:
+		list := make([]map[string]interface{}, 0, len(s.histories))
+		for _, h := range s.histories {
+			if !h.Deleted || r.FormValue("deleted") == "true" {
+				list = append(list, s.historyJSON(h))
+			}
+		}
+		writeJSON(w, list)
+	case r.Method == http.MethodPut && len(path) == 1:
+		h, ok := s.histories[path[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "History not found: "+path[0])
+			return
+		}
+		var payload struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload.Name != "" {
+			h.Name = payload.Name
+		}
+		if payload.Tags != nil {
+			h.Tags = payload.Tags
+		}
+		h.UpdateTime = time.Now()
+		writeJSON(w, s.historyJSON(h))
+	case r.Method == http.MethodGet && len(path) == 1:
+		h, ok := s.histories[path[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "History not found: "+path[0])
+			return
+		}
+		writeJSON(w, s.historyJSON(h))
+	case r.Method == http.MethodDelete && len(path) == 1:
+		h, ok := s.histories[path[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "History not found: "+path[0])
+			return
+		}
+		h.Deleted = true
+		h.Purged = r.FormValue("purge") == "true"
+		writeJSON(w, s.historyJSON(h))
+	case r.Method == http.MethodGet && len(path) >= 3 && path[1] == "contents":
+		d, ok := s.datasets[path[2]]
+		if !ok || d.history != path[0] {
+			writeError(w, http.StatusNotFound, "Dataset not found: "+path[2])
+			return
+		}
+		if len(path) == 4 && path[3] == "display" {
+			w.Write(d.content)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"id": d.id, "history_id": d.history, "state": "ok", "file_size": len(d.content)})
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// GET /api/jobs/{id}: the job moves to its next state
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request, path []string) {
+	if r.Method != http.MethodGet || len(path) != 1 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	j, ok := s.jobs[path[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Job not found: "+path[0])
+		return
+	}
+	j.next()
+	outputs := make(map[string]interface{})
+	for name, id := range j.Outputs {
+		outputs[name] = map[string]string{"id": id, "src": "hda"}
+	}
+	writeJSON(w, map[string]interface{}{
+		"id":         j.Id,
+		"tool_id":    j.ToolId,
+		"history_id": j.HistoryId,
+		"state":      j.State,
+		"inputs":     j.Inputs,
+		"outputs":    outputs,
+	})
+}
+
+// GET /api/datasets/{id}[/display]
+func (s *Server) handleDatasets(w http.ResponseWriter, r *http.Request, path []string) {
+	if r.Method != http.MethodGet || len(path) == 0 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	d, ok := s.datasets[path[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Dataset not found: "+path[0])
+		return
+	}
+	if len(path) == 2 && path[1] == "display" {
+		w.Write(d.content)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"id": d.id, "history_id": d.history, "state": "ok", "file_size": len(d.content)})
+}
+
+// GET /api/workflows/{id}, POST /api/workflows/{id}/invocations
+func (s *Server) handleWorkflows(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) == 0 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	wf, ok := s.workflows[path[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Workflow not found: "+path[0])
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && len(path) == 1:
+		writeJSON(w, map[string]interface{}{"id": wf.Id, "name": wf.Name})
+	case r.Method == http.MethodPost && len(path) == 2 && path[1] == "invocations":
+		var payload struct {
+			HistoryId  string                 `json:"history_id"`
+			Parameters map[string]interface{} `json:"parameters"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		inv := &Invocation{
+			Id:         s.newId(),
+			WorkflowId: wf.Id,
+			HistoryId:  payload.HistoryId,
+			State:      "scheduled",
+			Steps:      make([][]string, 0, len(wf.Steps)),
+			Outputs:    make(map[string]string),
+			Parameters: payload.Parameters,
+		}
+		for _, tid := range wf.Steps {
+			t, ok := s.tools[tid]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "Tool not found: "+tid)
+				return
+			}
+			inv.Steps = append(inv.Steps, []string{s.newJob(t, payload.HistoryId, nil).Id})
+		}
+		for label, content := range wf.Outputs {
+			inv.Outputs[label] = s.newDataset(payload.HistoryId, []byte(content))
+		}
+		s.invocations[inv.Id] = inv
+		writeJSON(w, map[string]interface{}{"id": inv.Id, "state": inv.State, "workflow_id": wf.Id, "history_id": inv.HistoryId})
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// GET /api/invocations/{id}, DELETE /api/invocations/{id}
+func (s *Server) handleInvocations(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) != 1 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	inv, ok := s.invocations[path[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Invocation not found: "+path[0])
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		steps := make([]map[string]interface{}, 0, len(inv.Steps)+1)
+		// Input step, without job
+		steps = append(steps, map[string]interface{}{"order_index": 0, "workflow_step_id": "step0", "workflow_step_label": "input", "state": "scheduled", "job_id": nil})
+		inputs := map[string]interface{}{"0": map[string]string{"id": "input", "src": "hda", "workflow_step_id": "step0"}}
+		for i, jobs := range inv.Steps {
+			step := map[string]interface{}{
+				"order_index":      i + 1,
+				"workflow_step_id": fmt.Sprintf("step%d", i+1),
+				"state":            "new",
+				"job_id":           nil,
+			}
+			if len(jobs) > 0 {
+				step["state"] = "scheduled"
+				step["workflow_step_label"] = s.jobs[jobs[0]].ToolId
+			}
+			// Collection mapped steps have no single job
+			if len(jobs) == 1 {
+				step["job_id"] = jobs[0]
+			}
+			if r.FormValue("step_details") == "true" {
+				details := make([]map[string]string, 0, len(jobs))
+				for _, jid := range jobs {
+					details = append(details, map[string]string{"id": jid, "state": s.jobs[jid].State})
+				}
+				step["jobs"] = details
+			}
+			steps = append(steps, step)
+		}
+		outputs := make(map[string]interface{})
+		for label, id := range inv.Outputs {
+			outputs[label] = map[string]string{"id": id, "src": "hda"}
+		}
+		writeJSON(w, map[string]interface{}{"id": inv.Id, "state": inv.State, "steps": steps, "inputs": inputs, "outputs": outputs})
+	case http.MethodDelete:
+		inv.State = "cancelled"
+		writeJSON(w, map[string]interface{}{"id": inv.Id, "state": inv.State})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) historyJSON(h *History) map[string]interface{} {
+	var size int
+	if !h.Purged {
+		for _, d := range s.datasets {
+			if d.history == h.Id {
+				size += len(d.content)
+			}
+		}
+	}
+	tags := h.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	// Zero update times are sent empty, as unknown
+	updated := ""
+	if !h.UpdateTime.IsZero() {
+		updated = h.UpdateTime.UTC().Format("2006-01-02T15:04:05.999999")
+	}
+	return map[string]interface{}{
+		"id":          h.Id,
+		"name":        h.Name,
+		"tags":        tags,
+		"update_time": updated,
+		"size":        size,
+		"deleted":     h.Deleted,
+		"purged":      h.Purged,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"err_msg": message, "err_code": status})
+}
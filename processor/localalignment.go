@@ -0,0 +1,235 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"context"
+	"fmt"
+	goio "io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/goalign/align"
+	"github.com/evolbioinfo/goalign/io/fasta"
+)
+
+// Aligns unaligned sequences, or trims an alignment, using a local tool
+type AlignmentTool interface {
+	// Name of the tool
+	Name() string
+	// Runs the tool on the Fasta file in, and writes the resulting
+	// alignment to out (Fasta), working in workdir with at most threads cpus.
+	// Outputs of the tool are written to logs.
+	//
+	// The tool is killed when ctx is done.
+	Run(ctx context.Context, a *model.Analysis, in, out, workdir string, threads int, logs goio.Writer) error
+}
+
+// Runs MAFFT with automatic selection of the strategy (--auto)
+type MafftAligner struct {
+	Path string // Path to the mafft executable
+}
+
+// Runs MUSCLE (version 5 command line)
+type MuscleAligner struct {
+	Path string // Path to the muscle executable
+}
+
+// Runs trimAl with automatic selection of the trimming method (-automated1)
+type TrimAlTrimmer struct {
+	Path string // Path to the trimal executable
+}
+
+// Runs BMGE with default parameters
+type BMGETrimmer struct {
+	Path string // Path to the bmge executable
+}
+
+// Registers a local alignment or trimming tool, key being one of
+// model.ALIGNER_* or model.TRIMMER_*.
+//
+// Must be called before InitProcessor.
+func (p *LocalProcessor) SetAlignmentTool(key string, tool AlignmentTool) {
+	if p.aligntools == nil {
+		p.aligntools = make(map[string]AlignmentTool)
+	}
+	p.aligntools[key] = tool
+}
+
+// Returns the keys of the alignment and trimming tools available locally
+func (p *LocalProcessor) AlignmentTools() (tools []string) {
+	tools = make([]string, 0, len(p.aligntools))
+	for key := range p.aligntools {
+		tools = append(tools, key)
+	}
+	sort.Strings(tools)
+	return
+}
+
+// Checks that the aligner and the trimmer of the analysis are available
+func (p *LocalProcessor) checkAlignmentTools(a *model.Analysis) (err error) {
+	for _, key := range []string{a.Aligner, a.Trimmer} {
+		if _, ok := p.aligntools[key]; key != "" && !ok {
+			err = fmt.Errorf("%s is not available on this server", model.AlignToolName(key))
+			return
+		}
+	}
+	return
+}
+
+func (m *MafftAligner) Name() string {
+	return "MAFFT"
+}
+
+func (m *MafftAligner) Run(ctx context.Context, a *model.Analysis, in, out, workdir string, threads int, logs goio.Writer) error {
+	if threads < 1 {
+		threads = 1
+	}
+	// MAFFT writes the alignment on its standard output
+	return runToolOutput(ctx, logs, out, workdir, m.Path, "--auto", "--thread", fmt.Sprintf("%d", threads), in)
+}
+
+func (m *MuscleAligner) Name() string {
+	return "MUSCLE"
+}
+
+func (m *MuscleAligner) Run(ctx context.Context, a *model.Analysis, in, out, workdir string, threads int, logs goio.Writer) error {
+	if threads < 1 {
+		threads = 1
+	}
+	return runTool(ctx, logs, workdir, nil, m.Path, "-align", in, "-output", out, "-threads", fmt.Sprintf("%d", threads))
+}
+
+func (t *TrimAlTrimmer) Name() string {
+	return "trimAl"
+}
+
+func (t *TrimAlTrimmer) Run(ctx context.Context, a *model.Analysis, in, out, workdir string, threads int, logs goio.Writer) error {
+	return runTool(ctx, logs, workdir, nil, t.Path, "-in", in, "-out", out, "-automated1", "-fasta")
+}
+
+func (b *BMGETrimmer) Name() string {
+	return "BMGE"
+}
+
+func (b *BMGETrimmer) Run(ctx context.Context, a *model.Analysis, in, out, workdir string, threads int, logs goio.Writer) error {
+	seqtype := "AA"
+	if a.AlignAlphabet == model.ALIGN_NUCLEOTIDS {
+		seqtype = "DNA"
+	}
+	return runTool(ctx, logs, workdir, nil, b.Path, "-i", in, "-t", seqtype, "-of", out)
+}
+
+// Runs the given tool and writes its standard output to the out file,
+// and its error output to logs
+func runToolOutput(ctx context.Context, logs goio.Writer, out, workdir string, path string, args ...string) (err error) {
+	var f *os.File
+
+	if f, err = os.Create(out); err != nil {
+		return
+	}
+	defer f.Close()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Dir = workdir
+	cmd.Stdout = f
+	cmd.Stderr = logs
+	fmt.Fprintf(logs, "$ %s %s > %s\n", filepath.Base(path), strings.Join(args, " "), filepath.Base(out))
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			err = fmt.Errorf("%s failed: %v", filepath.Base(path), err)
+		}
+	}
+	return
+}
+
+// Aligns the input sequences of the analysis (a.SeqAlign) with its aligner,
+// and trims the alignment if a trimming tool is given.
+//
+// The resulting alignment replaces the input sequences (Fasta), and is
+// stored in the analysis with its statistics. Outputs of the tools
+// are kept in a.WorkflowLogs.
+func (p *LocalProcessor) alignSequences(ctx context.Context, a *model.Analysis, jobthreads int) (err error) {
+	var workdir string
+	var al align.Alignment
+
+	aligner, ok := p.aligntools[a.Aligner]
+	if !ok {
+		return fmt.Errorf("%s is not available on this server", a.AlignerStr())
+	}
+	if workdir, err = ioutil.TempDir("", a.Id+"_alignment"); err != nil {
+		return
+	}
+	defer os.RemoveAll(workdir)
+
+	logs := newTailBuffer(WORKFLOW_LOGS_MAX)
+	defer func() { a.WorkflowLogs = logs.String() }()
+
+	a.Message = fmt.Sprintf("Aligning %d sequences with %s", a.AlignNbSeq, aligner.Name())
+	p.db.UpdateAnalysis(a)
+
+	output := filepath.Join(workdir, "aligned.fa")
+	if err = aligner.Run(ctx, a, a.SeqAlign, output, workdir, jobthreads, logs); err != nil {
+		return
+	}
+
+	if a.Trimmer != "" {
+		trimmer, ok := p.aligntools[a.Trimmer]
+		if !ok {
+			return fmt.Errorf("%s is not available on this server", a.TrimmerStr())
+		}
+		if al, err = readAlignment(output); err != nil {
+			return fmt.Errorf("Alignment produced by %s cannot be read: %v", aligner.Name(), err)
+		}
+		a.AlignRawLength = al.Length()
+
+		a.Message = fmt.Sprintf("Trimming the alignment (%d sites) with %s", al.Length(), trimmer.Name())
+		p.db.UpdateAnalysis(a)
+
+		input := output
+		output = filepath.Join(workdir, "trimmed.fa")
+		if err = trimmer.Run(ctx, a, input, output, workdir, jobthreads, logs); err != nil {
+			return
+		}
+	}
+
+	if al, err = readAlignment(output); err != nil {
+		return fmt.Errorf("Alignment cannot be read: %v", err)
+	}
+	if al.Length() == 0 {
+		return fmt.Errorf("The alignment is empty after trimming with %s", a.TrimmerStr())
+	}
+	SetAlignment(a, al)
+
+	// The alignment replaces the input sequences
+	err = ioutil.WriteFile(a.SeqAlign, []byte(fasta.WriteAlignment(al)), 0666)
+	return
+}
@@ -0,0 +1,491 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	goio "io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/goalign/align"
+	autils "github.com/evolbioinfo/goalign/io/utils"
+)
+
+const (
+	TOOL_FASTTREE = "fasttree"
+	TOOL_PHYML    = "phyml"
+	TOOL_IQTREE   = "iqtree"
+	TOOL_RAXMLNG  = "raxmlng"
+
+	WORKFLOW_LOGS_MAX = 1 << 20 // Max size of tree inference logs kept in the analysis (last bytes)
+)
+
+// Infers reference and bootstrap trees from the input alignment of an analysis,
+// using a local phylogenetic tool
+type TreeInferer interface {
+	// Name of the tool
+	Name() string
+	// Infers the reference tree and a.NbootRep bootstrap trees from a.SeqAlign,
+	// working in workdir, with at most threads cpus. Outputs of the tool are
+	// written to logs. Returns the path of the reference tree file
+	// and of the bootstrap trees file (Newick).
+	//
+	// The tool is killed when ctx is done.
+	InferTrees(ctx context.Context, a *model.Analysis, workdir string, threads int, logs goio.Writer) (reftree, boottrees string, err error)
+}
+
+// Runs FastTree on the input alignment for the reference tree, and
+// on bootstrap replicates generated by resampling alignment sites.
+//
+// Replicates are inferred in parallel (one FastTree process per thread).
+type FastTreeInferer struct {
+	Path string // Path to the FastTree executable
+}
+
+// Runs PhyML with its own non parametric bootstrap
+// (GTR+G for nucleotides, LG+G for amino acids, with
+// the moves and number of gamma categories given in options).
+type PhyMLInferer struct {
+	Path string // Path to the PhyML executable
+}
+
+// Runs IQ-TREE with model selection (ModelFinder, by default)
+// and its own non parametric bootstrap
+type IQTreeInferer struct {
+	Path string // Path to the iqtree (or iqtree2) executable
+}
+
+// Runs RAxML-NG tree search and bootstrap (--all)
+// (GTR+G4 for nucleotides, LG+G4 for amino acids by default).
+type RAxMLNGInferer struct {
+	Path string // Path to the raxml-ng executable
+}
+
+// Looks for the first given executable available (absolute path or in PATH)
+func FindTool(candidates ...string) (path string, err error) {
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if path, err = exec.LookPath(c); err == nil {
+			return
+		}
+	}
+	return "", fmt.Errorf("None of the executables %s found", strings.Join(candidates, ", "))
+}
+
+func (f *FastTreeInferer) Name() string {
+	return "FastTree"
+}
+
+func (f *FastTreeInferer) InferTrees(ctx context.Context, a *model.Analysis, workdir string, threads int, logs goio.Writer) (reftree, boottrees string, err error) {
+	var al align.Alignment
+	var options []string
+
+	if al, err = readAlignment(a.SeqAlign); err != nil {
+		return
+	}
+	if al.Alphabet() == align.NUCLEOTIDS {
+		options = []string{"-nt"}
+		if option(a, "dnamodel", "gtr") == "gtr" {
+			options = append(options, "-gtr")
+		}
+	} else if m := option(a, "protmodel", "lg"); m != "jtt" {
+		options = append(options, "-"+m)
+	}
+	if option(a, "gamma", "true") == "true" {
+		options = append(options, "-gamma")
+	}
+	if option(a, "moves", "nni+spr") == "nni" {
+		options = append(options, "-spr", "0")
+	}
+	// Each FastTree process is single threaded (if FastTreeMP), replicates are run in parallel
+	env := append(os.Environ(), "OMP_NUM_THREADS=1")
+	if threads < 1 {
+		threads = 1
+	}
+
+	reftree = filepath.Join(workdir, "ref.nw")
+	args := append(append([]string{}, options...), "-out", reftree, a.SeqAlign)
+	if err = runTool(ctx, logs, workdir, env, f.Path, args...); err != nil {
+		return
+	}
+
+	// Bootstrap replicates
+	rnd := rand.New(rand.NewSource(seed(a.Id)))
+	replicates := make(chan int, a.NbootRep)
+	for i := 0; i < a.NbootRep; i++ {
+		if err = writeBootstrapReplicate(al, rnd, filepath.Join(workdir, fmt.Sprintf("boot_%d.fa", i))); err != nil {
+			return
+		}
+		replicates <- i
+	}
+	close(replicates)
+
+	var wg sync.WaitGroup
+	var errlock sync.Mutex
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range replicates {
+				in := filepath.Join(workdir, fmt.Sprintf("boot_%d.fa", i))
+				out := filepath.Join(workdir, fmt.Sprintf("boot_%d.nw", i))
+				args := append(append([]string{}, options...), "-nosupport", "-out", out, in)
+				if e := runTool(ctx, logs, workdir, env, f.Path, args...); e != nil {
+					errlock.Lock()
+					if err == nil {
+						err = e
+					}
+					errlock.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return
+	}
+
+	boottrees = filepath.Join(workdir, "boot.nw")
+	bootfiles := make([]string, a.NbootRep)
+	for i := range bootfiles {
+		bootfiles[i] = filepath.Join(workdir, fmt.Sprintf("boot_%d.nw", i))
+	}
+	err = concatFiles(boottrees, bootfiles...)
+	return
+}
+
+func (p *PhyMLInferer) Name() string {
+	return "PhyML"
+}
+
+func (p *PhyMLInferer) InferTrees(ctx context.Context, a *model.Analysis, workdir string, threads int, logs goio.Writer) (reftree, boottrees string, err error) {
+	var al align.Alignment
+
+	if al, err = readAlignment(a.SeqAlign); err != nil {
+		return
+	}
+	// PhyML needs a phylip alignment, and writes outputs next to it
+	input := filepath.Join(workdir, "align.phy")
+	if err = writePhylip(al, input); err != nil {
+		return
+	}
+	datatype, submodel := "nt", "GTR"
+	if al.Alphabet() != align.NUCLEOTIDS {
+		datatype, submodel = "aa", "LG"
+	}
+	if err = runTool(ctx, logs, workdir, nil, p.Path,
+		"-i", input, "-d", datatype, "-m", submodel, "-a", "e", "-c", option(a, "gamma", "4"), "-s", option(a, "moves", "SPR"),
+		"-b", fmt.Sprintf("%d", a.NbootRep), "-r_seed", fmt.Sprintf("%d", seed(a.Id)%1000000),
+		"--no_memory_check", "--quiet"); err != nil {
+		return
+	}
+	reftree = input + "_phyml_tree.txt"
+	boottrees = input + "_phyml_boot_trees.txt"
+	return
+}
+
+func (i *IQTreeInferer) Name() string {
+	return "IQ-TREE"
+}
+
+func (i *IQTreeInferer) InferTrees(ctx context.Context, a *model.Analysis, workdir string, threads int, logs goio.Writer) (reftree, boottrees string, err error) {
+	if threads < 1 {
+		threads = 1
+	}
+	prefix := filepath.Join(workdir, "iqtree")
+	submodel := substitutionModel(a, "MFP", "MFP")
+	args := []string{"-s", a.SeqAlign, "-m", submodel, "-b", fmt.Sprintf("%d", a.NbootRep),
+		"-nt", fmt.Sprintf("%d", threads), "-seed", fmt.Sprintf("%d", seed(a.Id)%1000000),
+		"-pre", prefix, "-quiet", "-redo"}
+	if submodel == "MFP" {
+		args = append(args, "-merit", option(a, "criterion", "BIC"))
+	}
+	if err = runTool(ctx, logs, workdir, nil, i.Path, args...); err != nil {
+		return
+	}
+	reftree = prefix + ".treefile"
+	boottrees = prefix + ".boottrees"
+	return
+}
+
+func (r *RAxMLNGInferer) Name() string {
+	return "RAxML-NG"
+}
+
+func (r *RAxMLNGInferer) InferTrees(ctx context.Context, a *model.Analysis, workdir string, threads int, logs goio.Writer) (reftree, boottrees string, err error) {
+	if threads < 1 {
+		threads = 1
+	}
+	submodel := substitutionModel(a, "GTR", "LG")
+	prefix := filepath.Join(workdir, "raxmlng")
+	if err = runTool(ctx, logs, workdir, nil, r.Path,
+		"--all", "--msa", a.SeqAlign, "--model", submodel, "--bs-trees", fmt.Sprintf("%d", a.NbootRep),
+		"--threads", fmt.Sprintf("%d", threads), "--seed", fmt.Sprintf("%d", seed(a.Id)%1000000),
+		"--prefix", prefix, "--redo"); err != nil {
+		return
+	}
+	reftree = prefix + ".raxml.bestTree"
+	boottrees = prefix + ".raxml.bootstraps"
+	return
+}
+
+// Returns the value of the workflow option, or def if not given
+func option(a *model.Analysis, name, def string) string {
+	if v, ok := a.Options[name]; ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Substitution model from dnamodel, protmodel and gamma
+// options (e.g. GTR+G4), gamma is not added to MFP (ModelFinder)
+func substitutionModel(a *model.Analysis, dnadef, protdef string) (m string) {
+	if a.AlignAlphabet == model.ALIGN_AMINOACIDS {
+		m = option(a, "protmodel", protdef)
+	} else {
+		m = option(a, "dnamodel", dnadef)
+	}
+	if g := option(a, "gamma", "4"); m != "MFP" && g != "none" {
+		m += "+G" + g
+	}
+	return
+}
+
+// Checks that the options of the analysis can be used
+// by local tools
+func checkLocalOptions(a *model.Analysis) (err error) {
+	if a.Options["bootstrap"] == "parametric" {
+		err = errors.New("Parametric bootstrap is not available on this server")
+	}
+	return
+}
+
+// Runs the given tool and writes its standard and error outputs to logs
+func runTool(ctx context.Context, logs goio.Writer, workdir string, env []string, path string, args ...string) (err error) {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Dir = workdir
+	cmd.Env = env
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	fmt.Fprintf(logs, "$ %s %s\n", filepath.Base(path), strings.Join(args, " "))
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else {
+			err = fmt.Errorf("%s failed: %v", filepath.Base(path), err)
+		}
+	}
+	return
+}
+
+func readAlignment(file string) (al align.Alignment, err error) {
+	var f goio.Closer
+	var r *bufio.Reader
+
+	if f, r, err = autils.GetReader(file); err != nil {
+		return
+	}
+	defer f.Close()
+	al, _, err = autils.ParseAlignmentAuto(r, false)
+	return
+}
+
+// Writes a bootstrap replicate of the alignment (sites sampled with replacement), in Fasta
+func writeBootstrapReplicate(al align.Alignment, rnd *rand.Rand, file string) (err error) {
+	var f *os.File
+
+	length := al.Length()
+	sites := make([]int, length)
+	for i := range sites {
+		sites[i] = rnd.Intn(length)
+	}
+	if f, err = os.Create(file); err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	seq := make([]byte, length)
+	for i := 0; i < al.NbSequences(); i++ {
+		name, _ := al.GetSequenceNameById(i)
+		s, _ := al.GetSequenceById(i)
+		for j, site := range sites {
+			seq[j] = s[site]
+		}
+		fmt.Fprintf(w, ">%s\n%s\n", name, seq)
+	}
+	return w.Flush()
+}
+
+// Writes the alignment in sequential relaxed phylip format
+func writePhylip(al align.Alignment, file string) (err error) {
+	var f *os.File
+
+	if f, err = os.Create(file); err != nil {
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%d %d\n", al.NbSequences(), al.Length())
+	for i := 0; i < al.NbSequences(); i++ {
+		name, _ := al.GetSequenceNameById(i)
+		s, _ := al.GetSequenceById(i)
+		fmt.Fprintf(w, "%s  %s\n", name, s)
+	}
+	return w.Flush()
+}
+
+func concatFiles(out string, in ...string) (err error) {
+	var f *os.File
+	var content []byte
+
+	if f, err = os.Create(out); err != nil {
+		return
+	}
+	defer f.Close()
+	for _, file := range in {
+		if content, err = ioutil.ReadFile(file); err != nil {
+			return
+		}
+		if _, err = f.Write(content); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Copies the file src to dst
+func copyFile(src, dst string) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.Create(dst); err != nil {
+		return
+	}
+	if _, err = goio.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
+
+// Deterministic seed computed from the analysis id
+func seed(id string) int64 {
+	var s int64 = 17
+	for _, c := range id {
+		s = s*31 + int64(c)
+	}
+	if s < 0 {
+		s = -s
+	}
+	return s
+}
+
+// Keeps the last max bytes written to it
+type tailBuffer struct {
+	lock      sync.Mutex
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max, buf: make([]byte, 0)}
+}
+
+func (t *tailBuffer) Write(p []byte) (n int, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+		t.truncated = true
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.truncated {
+		return "[...]\n" + string(t.buf)
+	}
+	return string(t.buf)
+}
+
+// Infers reference and bootstrap trees of the analysis with the tree inferer
+// registered for its workflow. Resulting trees are copied next to the input
+// alignment and set as a.Reffile and a.Bootfile.
+func (p *LocalProcessor) inferTrees(ctx context.Context, a *model.Analysis, jobthreads int) (err error) {
+	var workdir, reftree, boottrees string
+
+	inferer, ok := p.inferers[a.Workflow]
+	if !ok {
+		return fmt.Errorf("No local tool available for workflow %s", a.WorkflowStr())
+	}
+	if workdir, err = ioutil.TempDir("", a.Id+"_inference"); err != nil {
+		return
+	}
+	defer os.RemoveAll(workdir)
+
+	// Logs follow the outputs of the alignment tools, if any
+	logs := newTailBuffer(WORKFLOW_LOGS_MAX)
+	logs.Write([]byte(a.WorkflowLogs))
+	a.Message = fmt.Sprintf("Inferring reference and %d bootstrap trees with %s", a.NbootRep, inferer.Name())
+	p.db.UpdateAnalysis(a)
+
+	reftree, boottrees, err = inferer.InferTrees(ctx, a, workdir, jobthreads, logs)
+	a.WorkflowLogs = logs.String()
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Dir(a.SeqAlign)
+	a.Reffile = filepath.Join(dir, "ref.nw")
+	a.Bootfile = filepath.Join(dir, "boot.nw")
+	if err = copyFile(reftree, a.Reffile); err != nil {
+		return
+	}
+	if err = copyFile(boottrees, a.Bootfile); err != nil {
+		return
+	}
+	if fi, e := os.Stat(a.Bootfile); e != nil || fi.Size() == 0 {
+		return errors.New(inferer.Name() + " did not produce any bootstrap tree")
+	}
+	return
+}
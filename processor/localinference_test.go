@@ -0,0 +1,265 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+const (
+	testRefTree  = "((A:1,B:1):1,C:1,D:1);\n"
+	testBootTree = "((A:1,C:1):1,B:1,D:1);\n"
+)
+
+// Writes an executable shell script named name in dir, which appends its
+// arguments to the args file of dir and runs body. Returns its path.
+func stubTool(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub tools are shell scripts")
+	}
+	path := filepath.Join(dir, name)
+	script := "#!/bin/sh\necho \"$@\" >> " + filepath.Join(dir, "args") + "\n" + body + "\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns the command lines received by the stub tools of dir
+func stubArgs(t *testing.T, dir string) []string {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+// Returns an analysis of workflow on a nucleotide alignment of 4 sequences,
+// and a local processor inferring its trees with inferer
+func inferenceAnalysis(t *testing.T, dir string, workflow int, inferer TreeInferer) (*LocalProcessor, *model.Analysis) {
+	t.Helper()
+	input := filepath.Join(dir, "input")
+	if err := os.Mkdir(input, 0755); err != nil {
+		t.Fatal(err)
+	}
+	seqs := ">A\nACGTACGTAC\n>B\nACGTACGTTC\n>C\nACGAACGTAC\n>D\nTCGTACGTAC\n"
+	if err := ioutil.WriteFile(filepath.Join(input, "align.fa"), []byte(seqs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db := database.NewMemoryBoosterWebDB()
+	db.InitDatabase()
+	p := &LocalProcessor{db: db}
+	p.SetTreeInferer(workflow, inferer)
+
+	a := model.NewAnalysis()
+	a.Id = "inference"
+	a.Workflow = workflow
+	a.SeqAlign = filepath.Join(input, "align.fa")
+	a.AlignAlphabet = model.ALIGN_NUCLEOTIDS
+	a.NbootRep = 3
+	a.Options = make(map[string]string)
+	return p, a
+}
+
+func readTestFile(t *testing.T, file string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestFastTreeInferTrees(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fasttree")
+	defer os.RemoveAll(dir)
+	path := stubTool(t, dir, "fasttree", `
+out=""; support="`+testRefTree+`"
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -out) out="$2"; shift ;;
+    -nosupport) support="`+testBootTree+`" ;;
+  esac
+  shift
+done
+printf "$support" > "$out"`)
+	p, a := inferenceAnalysis(t, dir, model.WORKFLOW_FASTTREE, &FastTreeInferer{Path: path})
+
+	if err := p.inferTrees(context.Background(), a, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	args := stubArgs(t, dir)
+	if len(args) != 4 {
+		t.Fatalf("Expected 1 reference + 3 bootstrap FastTree runs, got %d: %v", len(args), args)
+	}
+	if !strings.HasPrefix(args[0], "-nt -gtr -gamma -out ") || !strings.HasSuffix(args[0], " "+a.SeqAlign) {
+		t.Errorf("Wrong reference tree command line: %s", args[0])
+	}
+	for _, l := range args[1:] {
+		if !strings.HasPrefix(l, "-nt -gtr -gamma -nosupport -out ") || !strings.Contains(l, "boot_") {
+			t.Errorf("Wrong bootstrap tree command line: %s", l)
+		}
+	}
+	if ref := readTestFile(t, a.Reffile); ref != testRefTree {
+		t.Errorf("Wrong reference tree: %s", ref)
+	}
+	if boot := readTestFile(t, a.Bootfile); boot != strings.Repeat(testBootTree, 3) {
+		t.Errorf("Wrong bootstrap trees: %s", boot)
+	}
+	if !strings.Contains(a.WorkflowLogs, "$ fasttree -nt -gtr -gamma -out") {
+		t.Errorf("Command lines not logged: %s", a.WorkflowLogs)
+	}
+}
+
+func TestPhyMLInferTrees(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "phyml")
+	defer os.RemoveAll(dir)
+	path := stubTool(t, dir, "phyml", `
+printf "`+testRefTree+`" > "$2_phyml_tree.txt"
+printf "`+testBootTree+testBootTree+testBootTree+`" > "$2_phyml_boot_trees.txt"`)
+	p, a := inferenceAnalysis(t, dir, model.WORKFLOW_PHYML_SMS, &PhyMLInferer{Path: path})
+	a.Options["moves"] = "NNI"
+
+	if err := p.inferTrees(context.Background(), a, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	args := stubArgs(t, dir)
+	if len(args) != 1 {
+		t.Fatalf("Expected 1 PhyML run, got %d: %v", len(args), args)
+	}
+	if !strings.HasPrefix(args[0], "-i ") || !strings.Contains(args[0], "align.phy -d nt -m GTR -a e -c 4 -s NNI -b 3 -r_seed ") ||
+		!strings.HasSuffix(args[0], " --no_memory_check --quiet") {
+		t.Errorf("Wrong PhyML command line: %s", args[0])
+	}
+	if ref := readTestFile(t, a.Reffile); ref != testRefTree {
+		t.Errorf("Wrong reference tree: %s", ref)
+	}
+	if boot := readTestFile(t, a.Bootfile); boot != strings.Repeat(testBootTree, 3) {
+		t.Errorf("Wrong bootstrap trees: %s", boot)
+	}
+}
+
+func TestIQTreeInferTrees(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iqtree")
+	defer os.RemoveAll(dir)
+	path := stubTool(t, dir, "iqtree", `
+pre=""
+while [ $# -gt 0 ]; do
+  if [ "$1" = "-pre" ]; then pre="$2"; fi
+  shift
+done
+printf "`+testRefTree+`" > "$pre.treefile"
+printf "`+testBootTree+testBootTree+testBootTree+`" > "$pre.boottrees"`)
+	p, a := inferenceAnalysis(t, dir, model.WORKFLOW_IQTREE, &IQTreeInferer{Path: path})
+
+	if err := p.inferTrees(context.Background(), a, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	args := stubArgs(t, dir)
+	if len(args) != 1 {
+		t.Fatalf("Expected 1 IQ-TREE run, got %d: %v", len(args), args)
+	}
+	if !strings.HasPrefix(args[0], "-s "+a.SeqAlign+" -m MFP -b 3 -nt 2 -seed ") ||
+		!strings.HasSuffix(args[0], " -quiet -redo -merit BIC") {
+		t.Errorf("Wrong IQ-TREE command line: %s", args[0])
+	}
+	if ref := readTestFile(t, a.Reffile); ref != testRefTree {
+		t.Errorf("Wrong reference tree: %s", ref)
+	}
+	if boot := readTestFile(t, a.Bootfile); boot != strings.Repeat(testBootTree, 3) {
+		t.Errorf("Wrong bootstrap trees: %s", boot)
+	}
+}
+
+func TestInferTreesToolError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iqtree")
+	defer os.RemoveAll(dir)
+	path := stubTool(t, dir, "iqtree", `echo "ERROR: bad alignment" >&2; exit 2`)
+	p, a := inferenceAnalysis(t, dir, model.WORKFLOW_IQTREE, &IQTreeInferer{Path: path})
+
+	err := p.inferTrees(context.Background(), a, 1)
+	if err == nil || !strings.Contains(err.Error(), "iqtree failed") {
+		t.Fatalf("Expected an iqtree error, got %v", err)
+	}
+	if !strings.Contains(a.WorkflowLogs, "ERROR: bad alignment") {
+		t.Errorf("Tool error output not logged: %s", a.WorkflowLogs)
+	}
+}
+
+func TestInferTreesNoBootstrapTree(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "phyml")
+	defer os.RemoveAll(dir)
+	path := stubTool(t, dir, "phyml", `
+printf "`+testRefTree+`" > "$2_phyml_tree.txt"
+: > "$2_phyml_boot_trees.txt"`)
+	p, a := inferenceAnalysis(t, dir, model.WORKFLOW_PHYML_SMS, &PhyMLInferer{Path: path})
+
+	err := p.inferTrees(context.Background(), a, 1)
+	if err == nil || !strings.Contains(err.Error(), "did not produce any bootstrap tree") {
+		t.Fatalf("Expected a missing bootstrap trees error, got %v", err)
+	}
+}
+
+func TestInferTreesTimeout(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "iqtree")
+	defer os.RemoveAll(dir)
+	path := stubTool(t, dir, "iqtree", `exec sleep 10`)
+	p, a := inferenceAnalysis(t, dir, model.WORKFLOW_IQTREE, &IQTreeInferer{Path: path})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.inferTrees(ctx, a, 1); err != context.DeadlineExceeded {
+		t.Fatalf("Expected a deadline exceeded error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Tool not killed at timeout")
+	}
+}
+
+func TestInferTreesNoTool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "notool")
+	defer os.RemoveAll(dir)
+	p, a := inferenceAnalysis(t, dir, model.WORKFLOW_IQTREE, &IQTreeInferer{Path: "iqtree"})
+	a.Workflow = model.WORKFLOW_RAXMLNG
+
+	if err := p.inferTrees(context.Background(), a, 1); err == nil {
+		t.Fatal("Expected an error for a workflow without local tool")
+	}
+}
@@ -25,13 +25,14 @@ package processor
 
 import (
 	"bufio"
-	"errors"
+	"context"
 	"fmt"
 	goio "io"
 	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
+	"sort"
 	"sync"
 	"time"
 
@@ -57,18 +58,91 @@ type LocalProcessor struct {
 	db          database.BoosterwebDB
 	notifier    notification.Notifier
 	lock        sync.RWMutex
+	inferers    map[int]TreeInferer      // Local tree inference tool per workflow
+	aligntools  map[string]AlignmentTool // Local alignment and trimming tools, key: tool key
+	nbrunners   int                      // Number of parallel runners
+	worker      *WorkerConfig            // If not nil, support is computed in worker subprocesses
+	timeout     int                      // Job timeout in seconds (0: unlimited)
+	jobthreads  int                      // Number of threads per job
+	memlimit    int64                    // Max estimated memory of a job in Bytes (0: unlimited)
+	memtotal    int64                    // Memory shared by the runners in Bytes (0: not tracked)
+	memused     int64                    // Estimated memory of the running jobs
+	memcond     *sync.Cond               // Signaled when memory is released
+	retries     retryPolicies            // Retry policies per failure class
+	draining    bool                     // If the server is stopping: queued jobs are not run
+	active      int                      // Number of jobs started and not saved yet
+	stops       map[string]func()        // Stops the running jobs, key: analysis id
+	held        map[string]bool          // Queued and running analyses, until their results are saved, key: analysis id
+	dropped     map[string]bool          // Analyses dropped by a distributed worker that lost their lease, key: analysis id
+}
+
+// Registers the tool used to infer trees for the given workflow.
+//
+// Must be called before InitProcessor.
+func (p *LocalProcessor) SetTreeInferer(workflow int, inferer TreeInferer) {
+	if p.inferers == nil {
+		p.inferers = make(map[int]TreeInferer)
+	}
+	p.inferers[workflow] = inferer
+}
+
+// Returns true if at least one workflow can infer trees locally
+func (p *LocalProcessor) CanInferTrees() bool {
+	return len(p.inferers) > 0
+}
+
+// Returns the workflows that can be run locally
+func (p *LocalProcessor) Workflows() (workflows []int) {
+	workflows = make([]int, 0, len(p.inferers))
+	for w := range p.inferers {
+		workflows = append(workflows, w)
+	}
+	sort.Ints(workflows)
+	return
+}
+
+// Returns true if the analysis can be run locally: the workflow, the
+// options, and the alignment tools of the analysis are available
+func (p *LocalProcessor) Supports(a *model.Analysis) bool {
+	if _, ok := p.inferers[a.Workflow]; a.SeqAlign != "" && !ok {
+		return false
+	}
+	return checkLocalOptions(a) == nil && p.checkAlignmentTools(a) == nil && p.checkResources(a) == nil
+}
+
+// Returns the number of running and queued jobs per runner
+func (p *LocalProcessor) Load() float64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return float64(len(p.runningJobs)+len(p.queue)) / float64(p.nbrunners)
 }
 
 func (p *LocalProcessor) LaunchAnalysis(a *model.Analysis) (err error) {
-	if a.SeqAlign != "" {
-		err = errors.New("Local processor cannot infer trees, sequence alignment file won't be analyzed")
+	a.Processor = model.PROCESSOR_LOCAL
+	if _, ok := p.inferers[a.Workflow]; a.SeqAlign != "" && !ok {
+		err = fmt.Errorf("Local processor cannot infer trees with workflow %s, sequence alignment file won't be analyzed", a.WorkflowStr())
+		a.DelTemp()
+		return
+	}
+	if err = checkLocalOptions(a); err != nil {
+		a.DelTemp()
+		return
+	}
+	if err = p.checkAlignmentTools(a); err != nil {
+		a.DelTemp()
+		return
+	}
+	if err = p.checkResources(a); err != nil {
+		log.Print(fmt.Sprintf("Analysis %s refused: %s", a.Id, err.Error()))
 		a.DelTemp()
 		return
 	}
+	p.hold(a)
 	select {
 	case p.queue <- a: // Put a in the channel unless it is full
 	default:
 		//Channel full. Discarding value
+		p.release(a)
 		a.Status = model.STATUS_CANCELED
 		a.End = time.Now().Format(time.RFC1123)
 		a.Message = "Computing queue is full, please try again in a few minutes"
@@ -85,14 +159,21 @@ func (p *LocalProcessor) InitProcessor(nbrunners, queuesize, timeout, jobthreads
 	p.db = db
 	p.notifier = notifier
 	p.runningJobs = make(map[string]*model.Analysis)
+	p.stops = make(map[string]func())
+	p.held = make(map[string]bool)
+	p.dropped = make(map[string]bool)
 
 	if jobthreads == 0 {
 		jobthreads = RUNNERS_JOBTHREADS_DEFAULT
 	}
+	p.jobthreads = jobthreads
+	p.timeout = timeout
+	p.initMemory()
 
 	if nbrunners == 0 {
 		nbrunners = RUNNERS_NBRUNNERS_DEFAULT
 	}
+	p.nbrunners = nbrunners
 	if (nbrunners*jobthreads + 1) > maxcpus {
 		log.Fatal(fmt.Sprintf("Your system does not have enough cpus to run the http server + %d bootstrap runners with each %d threads", nbrunners, jobthreads))
 	}
@@ -119,9 +200,27 @@ func (p *LocalProcessor) InitProcessor(nbrunners, queuesize, timeout, jobthreads
 		go func(cpu int) {
 
 			for a := range p.queue {
-				sup := support.NewSupporter()
+				sup := newSupportRun()
+				ctx, cancel := context.WithCancel(context.Background())
+				if !p.startJob(a, func() { sup.Cancel(); cancel() }) {
+					cancel()
+					// Dropped analyses are run by another worker
+					if !p.forgetDropped(a) {
+						cancelShutdown(a, p.db)
+					}
+					continue
+				}
 				log.Print(fmt.Sprintf("CPU=%d | New analysis, id=%s", cpu, a.Id))
 
+				// Waits for other jobs to release enough memory
+				reserved := p.reserveMemory(a)
+				if p.isDraining() {
+					p.releaseMemory(reserved)
+					cancel()
+					cancelShutdown(a, p.db)
+					p.endJob(a)
+					continue
+				}
 				a.Status = model.STATUS_RUNNING
 				a.StartRunning = time.Now().Format(time.RFC1123)
 
@@ -129,6 +228,9 @@ func (p *LocalProcessor) InitProcessor(nbrunners, queuesize, timeout, jobthreads
 				er := p.db.UpdateAnalysis(a)
 				if er != nil {
 					io.LogError(er)
+					p.releaseMemory(reserved)
+					cancel()
+					p.endJob(a)
 					continue
 				}
 				p.newRunningJob(a)
@@ -137,29 +239,36 @@ func (p *LocalProcessor) InitProcessor(nbrunners, queuesize, timeout, jobthreads
 				go func() {
 					defer wg.Done()
 
-					var err error
-					if err = p.computeSupport(sup, a, jobthreads); err != nil {
-						io.LogError(err)
-						a.Message = err.Error()
-						a.Status = model.STATUS_ERROR
+					// Retried analyses are queued again with their inputs
+					if p.runSteps(ctx, sup, a, jobthreads) {
+						return
+					}
+					// Dropped analyses are saved by the worker holding them
+					if p.isDropped(a) {
+						p.rmRunningJob(a)
 						return
 					}
 
-					if err = p.db.UpdateAnalysis(a); err != nil {
-						io.LogError(er)
+					// Trees inferred from cleaned sequence names
+					restoreOriginalNames(a)
+					if err := p.db.UpdateAnalysis(a); err != nil {
+						io.LogError(err)
 					}
 
 					p.rmRunningJob(a)
 
 					a.DelTemp()
-					if err = p.notifier.Notify(a.StatusStr(), a.Id, a.RunName, a.WorkflowStr(), a.EMail); err != nil {
+					if err := p.notifier.Notify(a.StatusStr(), a.Id, a.RunName, a.WorkflowStr(), a.OptionsStr(), a.EMail); err != nil {
 						io.LogError(err)
 					}
 				}()
 
 				go func() {
 					for {
-						a.Nboot = sup.Progress()
+						// Progress of worker subprocesses is read from their outputs
+						if p.worker == nil {
+							a.Nboot = sup.Progress()
+						}
 						p.db.UpdateAnalysis(a)
 						if finished {
 							break
@@ -173,19 +282,78 @@ func (p *LocalProcessor) InitProcessor(nbrunners, queuesize, timeout, jobthreads
 						time.Sleep(time.Duration(timeout) * time.Second)
 						if !finished {
 							sup.Cancel()
+							cancel()
 						}
 					}()
 				}
 				wg.Wait()
-				a.Nboot = sup.Progress()
+				cancel()
+				p.releaseMemory(reserved)
+				// Retried analyses are pending again
+				if p.worker == nil && a.Status != model.STATUS_PENDING {
+					a.Nboot = sup.Progress()
+				}
 				p.db.UpdateAnalysis(a)
 				finished = true
+				p.endJob(a)
 			}
 			log.Print(fmt.Sprintf("CPU %d : End", cpu))
 		}(cpu)
 	}
 }
 
+// Runs the alignment, tree inference and support steps of the analysis,
+// and sets its final status. Returns true if the analysis is queued again
+// by its retry policy, false if it ended.
+func (p *LocalProcessor) runSteps(ctx context.Context, sup *supportRun, a *model.Analysis, jobthreads int) (retried bool) {
+	var err error
+	if a.SeqAlign != "" && a.Aligner != "" {
+		if err = p.alignSequences(ctx, a, jobthreads); err != nil {
+			return p.stepFailed(ctx, a, err, "Sequence alignment canceled after timeout")
+		}
+	}
+	if a.SeqAlign != "" {
+		if err = p.inferTrees(ctx, a, jobthreads); err != nil {
+			return p.stepFailed(ctx, a, err, "Tree inference canceled after timeout")
+		}
+	}
+	if p.worker != nil {
+		err = p.computeSupportInWorker(ctx, a, jobthreads)
+	} else {
+		err = computeSupport(sup, a, jobthreads, p.updateAnalysis)
+	}
+	if err != nil {
+		io.LogError(err)
+		a.Message = err.Error()
+		a.Status = model.STATUS_ERROR
+		return false
+	}
+	// Jobs stopped by a server shutdown are not retried, nor jobs with
+	// supports computed on partial results: a new attempt with the same
+	// timeout would not get further
+	return a.Status == model.STATUS_TIMEOUT && a.PartialTrees == 0 && !p.cancelDrained(a) && p.retryJob(a, model.FAILURE_TIMEOUT)
+}
+
+// Sets the status of an analysis whose step failed with err: canceled
+// by a server shutdown, timed out (timeoutmsg) or in error. Timed out
+// analyses are retried if their retry policy allows it: returns true in
+// this case.
+func (p *LocalProcessor) stepFailed(ctx context.Context, a *model.Analysis, err error, timeoutmsg string) (retried bool) {
+	io.LogError(err)
+	a.End = time.Now().Format(time.RFC1123)
+	if ctx.Err() == nil {
+		a.Message = err.Error()
+		a.Status = model.STATUS_ERROR
+		return false
+	}
+	if p.cancelDrained(a) {
+		return false
+	}
+	a.Message = timeoutmsg
+	a.Status = model.STATUS_TIMEOUT
+	return p.retryJob(a, model.FAILURE_TIMEOUT)
+}
+
 /**
 Keep a trace of currently running jobs
 In order to cancel them when the server stops
@@ -227,15 +395,30 @@ func (p *LocalProcessor) CancelAnalyses() (err error) {
 	return
 }
 
-func (p *LocalProcessor) computeSupport(sup *support.Supporter, a *model.Analysis, jobThreads int) (err error) {
-	var refTree *tree.Tree
+func (p *LocalProcessor) updateAnalysis(a *model.Analysis) {
+	p.db.UpdateAnalysis(a)
+}
+
+// Computes FBP and TBE supports of the analysis trees.
+//
+// If the run is canceled (timeout), supports are computed over the
+// bootstrap trees processed so far only, and the analysis is marked
+// as partial.
+//
+// update is called at the end, to save the results
+func computeSupport(run *supportRun, a *model.Analysis, jobThreads int, update func(a *model.Analysis)) (err error) {
+	var fbpTree, tbeTree, raw *tree.Tree
 	var tmpFile *os.File
-	var treeFile, treeFile2 goio.Closer
+	var treeFile goio.Closer
 	var treeReader *bufio.Reader
-	var treeChannel <-chan tree.Trees
 	var dat []byte
+	var fbpErr, tbeErr error
 
-	if refTree, err = utils.ReadTree(a.Reffile, utils.FORMAT_NEWICK); err != nil {
+	if fbpTree, err = utils.ReadTree(a.Reffile, utils.FORMAT_NEWICK); err != nil {
+		io.LogError(err)
+		return
+	}
+	if tbeTree, err = utils.ReadTree(a.Reffile, utils.FORMAT_NEWICK); err != nil {
 		io.LogError(err)
 		return
 	}
@@ -247,7 +430,6 @@ func (p *LocalProcessor) computeSupport(sup *support.Supporter, a *model.Analysi
 		return
 	}
 
-	treeChannel = utils.ReadMultiTrees(treeReader, utils.FORMAT_NEWICK)
 	tmpFile, err = ioutil.TempFile("", "booster_log")
 	defer os.Remove(tmpFile.Name()) // clean up
 	defer tmpFile.Close()
@@ -257,38 +439,50 @@ func (p *LocalProcessor) computeSupport(sup *support.Supporter, a *model.Analysi
 		return
 	}
 
-	err = support.FBP(refTree, treeChannel, jobThreads, sup)
+	threads := supportThreads(jobThreads)
+	fbpTrees := make(chan tree.Trees, threads)
+	tbeTrees := make(chan tree.Trees, threads)
+	go run.dispatch(utils.ReadMultiTrees(treeReader, utils.FORMAT_NEWICK), fbpTrees, tbeTrees)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		fbpErr = support.FBP(fbpTree, fbpTrees, threads, run.fbp)
+		// In case of error, the other step must still receive its trees
+		for range fbpTrees {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		raw, tbeErr = support.TBE(tbeTree, tbeTrees, threads,
+			true, true, true, 0.3, tmpFile, run.tbe)
+		for range tbeTrees {
+		}
+	}()
+	wg.Wait()
+
 	a.End = time.Now().Format(time.RFC1123)
-	if err != nil {
+	if fbpErr != nil {
+		err = fbpErr
 		io.LogError(err)
 		return
 	}
-
-	refTree.ClearPvalues()
-	a.FbpTree = refTree.Newick()
-	if sup.Canceled() {
-		a.Status = model.STATUS_TIMEOUT
-		a.Message = "FBP Canceled during analysis"
-	} else {
-		a.Message = "FBP Finished"
-	}
-
-	p.db.UpdateAnalysis(a)
-
-	treeFile2, treeReader, err = utils.GetReader(a.Bootfile)
-	defer treeFile2.Close()
-	if err != nil {
+	if tbeErr != nil {
+		err = tbeErr
 		io.LogError(err)
 		return
 	}
-	treeChannel = utils.ReadMultiTrees(treeReader, utils.FORMAT_NEWICK)
-	var raw *tree.Tree
-	if raw, err = support.TBE(refTree, treeChannel, jobThreads,
-		true, true, true, 0.3, tmpFile, sup); err != nil {
-		io.LogError(err)
+
+	if run.Canceled() && run.Trees() == 0 {
+		a.Status = model.STATUS_TIMEOUT
+		a.Message = "Time out: no bootstrap tree processed"
+		update(a)
 		return
 	}
 
+	fbpTree.ClearPvalues()
+	a.FbpTree = fbpTree.Newick()
 	// We  print the raw support tree first
 	a.TbeRawTree = raw.Newick()
 
@@ -298,16 +492,18 @@ func (p *LocalProcessor) computeSupport(sup *support.Supporter, a *model.Analysi
 	}
 
 	a.TbeLogs = cleanTBELogs(string(dat))
-	a.TbeNormTree = refTree.Newick()
+	a.TbeNormTree = tbeTree.Newick()
 
-	if sup.Canceled() {
+	if run.Canceled() {
 		a.Status = model.STATUS_TIMEOUT
-		a.Message = a.Message + ", TBE Canceled during analysis"
+		a.PartialTrees = run.Trees()
+		a.Message = "Time out: FBP and TBE computed on partial results"
+		a.Warning = fmt.Sprintf("The analysis timed out: FBP and TBE supports are computed on the first %d bootstrap trees only, and are approximate", a.PartialTrees)
 	} else {
 		a.Status = model.STATUS_FINISHED
-		a.Message = a.Message + ", TBE Finished"
+		a.Message = "FBP Finished, TBE Finished"
 	}
 
-	p.db.UpdateAnalysis(a)
+	update(a)
 	return
 }
@@ -0,0 +1,159 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+// Limits the memory of local jobs, estimated from the size of their trees.
+//
+// memlimit is the max memory of a single job, and memtotal the memory shared
+// by all the runners (0: memory of the system). Jobs that do not fit are
+// refused at submission, and runners wait for enough free memory before
+// starting a job.
+//
+// Must be called before InitProcessor.
+func (p *LocalProcessor) SetMemory(memlimit, memtotal int64) {
+	p.memlimit = memlimit
+	p.memtotal = memtotal
+}
+
+func (p *LocalProcessor) initMemory() {
+	if p.memtotal == 0 {
+		p.memtotal = systemMemory()
+	}
+	p.memcond = sync.NewCond(&sync.Mutex{})
+	log.Print(fmt.Sprintf("Job mem limit: %d", p.memlimit))
+	log.Print(fmt.Sprintf("Runners memory: %d", p.memtotal))
+}
+
+// Estimates the memory (Bytes) and the running time (seconds) of booster
+// on the analysis, from the number of tips and bootstrap trees
+func (p *LocalProcessor) estimateResources(a *model.Analysis) (mem, runtime float64) {
+	nbtips, nbboot := a.RefTips, a.BootTrees
+	if a.SeqAlign != "" {
+		nbtips, nbboot = a.AlignNbSeq, a.NbootRep
+	}
+	threads := p.jobthreads
+	if threads <= 0 {
+		threads = RUNNERS_JOBTHREADS_DEFAULT
+	}
+	mem, cpu := boosterRunStats(nbtips, nbboot, threads)
+	// FBP and TBE are computed simultaneously, each with half of the threads
+	return mem, cpu / float64(2*supportThreads(threads))
+}
+
+// Returns an error if the analysis cannot fit in the memory
+// limits or in the timeout of the local runners
+func (p *LocalProcessor) checkResources(a *model.Analysis) (err error) {
+	mem, runtime := p.estimateResources(a)
+	if p.memlimit > 0 && mem > float64(p.memlimit) {
+		return fmt.Errorf("The analysis would need about %s of memory, more than the %s allowed per job on this server: please give smaller or fewer trees", memoryStr(mem), memoryStr(float64(p.memlimit)))
+	}
+	if p.memtotal > 0 && mem > float64(p.memtotal) {
+		return fmt.Errorf("The analysis would need about %s of memory, more than the %s available on this server: please give smaller or fewer trees", memoryStr(mem), memoryStr(float64(p.memtotal)))
+	}
+	if p.timeout > 0 && runtime > float64(p.timeout) {
+		return fmt.Errorf("The analysis would run for about %v, more than the %v allowed per job on this server: please give smaller or fewer trees", durationStr(runtime), durationStr(float64(p.timeout)))
+	}
+	return
+}
+
+// Waits until the estimated memory of the analysis is free,
+// and returns the reserved memory
+func (p *LocalProcessor) reserveMemory(a *model.Analysis) (reserved int64) {
+	if p.memtotal <= 0 {
+		return 0
+	}
+	mem, _ := p.estimateResources(a)
+	// Restored jobs may have been submitted with other limits
+	reserved = int64(math.Min(mem, float64(p.memtotal)))
+
+	p.memcond.L.Lock()
+	defer p.memcond.L.Unlock()
+	if p.memused+reserved > p.memtotal {
+		log.Print(fmt.Sprintf("Analysis %s waits for %s of free memory", a.Id, memoryStr(float64(reserved))))
+		a.Message = "Waiting for free memory"
+		p.db.UpdateAnalysis(a)
+	}
+	for p.memused+reserved > p.memtotal {
+		p.memcond.Wait()
+	}
+	p.memused += reserved
+	return
+}
+
+func (p *LocalProcessor) releaseMemory(reserved int64) {
+	if reserved == 0 {
+		return
+	}
+	p.memcond.L.Lock()
+	defer p.memcond.L.Unlock()
+	p.memused -= reserved
+	p.memcond.Broadcast()
+}
+
+// Returns the total memory of the system (Linux), 0 if unknown
+func systemMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16318948 kB
+		if cols := strings.Fields(scanner.Text()); len(cols) >= 2 && cols[0] == "MemTotal:" {
+			if kb, err := strconv.ParseInt(cols[1], 10, 64); err == nil {
+				return kb * 1024
+			}
+		}
+	}
+	return 0
+}
+
+func memoryStr(mem float64) string {
+	for _, unit := range []string{"B", "KB", "MB", "GB"} {
+		if mem < 1024 {
+			return fmt.Sprintf("%.1f %s", mem, unit)
+		}
+		mem /= 1024
+	}
+	return fmt.Sprintf("%.1f TB", mem)
+}
+
+func durationStr(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second)
+}
@@ -0,0 +1,102 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"strings"
+
+	"github.com/evolbioinfo/booster-web/io"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/gotree/io/newick"
+)
+
+// Renames tips of the resulting trees and taxa of the TBE logs back to
+// the original sequence names, if they have been cleaned before
+// running the workflow (see Analysis.NameMap)
+func restoreOriginalNames(a *model.Analysis) {
+	names := a.OriginalNames()
+	if len(names) == 0 {
+		return
+	}
+	a.FbpTree = renameNewickTips(a.FbpTree, names)
+	a.TbeNormTree = renameNewickTips(a.TbeNormTree, names)
+	a.TbeRawTree = renameNewickTips(a.TbeRawTree, names)
+	a.TbeLogs = renameLogTaxa(a.TbeLogs, names)
+}
+
+// Renames the tips of the given Newick tree using the names map.
+//
+// Trees that cannot be parsed are returned unchanged.
+func renameNewickTips(nw string, names map[string]string) string {
+	if strings.TrimSpace(nw) == "" {
+		return nw
+	}
+	t, err := newick.NewParser(strings.NewReader(nw)).Parse()
+	if err != nil {
+		io.LogError(err)
+		return nw
+	}
+	// Names that were not cleaned are kept
+	namemap := make(map[string]string)
+	for _, n := range t.Nodes() {
+		if n.Name() == "" {
+			continue
+		}
+		if orig, ok := names[n.Name()]; ok {
+			namemap[n.Name()] = orig
+		} else {
+			namemap[n.Name()] = n.Name()
+		}
+	}
+	if err = t.Rename(namemap); err != nil {
+		io.LogError(err)
+		return nw
+	}
+	return t.Newick()
+}
+
+// Renames taxa of TBE logs using the names map.
+//
+// Taxa are words separated by spaces, tabs, new lines, ',', ';' or ':'.
+// Cleaned names do not contain such characters.
+func renameLogTaxa(logs string, names map[string]string) string {
+	var b strings.Builder
+	b.Grow(len(logs))
+
+	start := 0
+	for i := 0; i <= len(logs); i++ {
+		if i == len(logs) || strings.IndexByte(" \t\r\n,;:", logs[i]) >= 0 {
+			word := logs[start:i]
+			if orig, ok := names[word]; ok {
+				word = orig
+			}
+			b.WriteString(word)
+			if i < len(logs) {
+				b.WriteByte(logs[i])
+			}
+			start = i + 1
+		}
+	}
+	return b.String()
+}
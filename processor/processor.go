@@ -24,10 +24,13 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package processor
 
 import (
+	"time"
+
 	"github.com/evolbioinfo/booster-web/model"
 )
 
 type Processor interface {
 	LaunchAnalysis(a *model.Analysis) error
 	CancelAnalyses() error
+	Drain(period time.Duration) error // Stops launching analyses before the server stops, waiting at most period for running ones
 }
@@ -0,0 +1,203 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/notification"
+)
+
+const (
+	RETRY_BACKOFF_DEFAULT = time.Minute // Delay before the first retry of a failure class
+)
+
+// Retry policy of a failure class (model.FAILURE_*)
+type RetryPolicy struct {
+	Attempts int           // Max number of attempts failing with this class (0 or 1: not retried)
+	Backoff  time.Duration // Delay before the first retry, doubled at each retry
+}
+
+// Retry policies per failure class
+type retryPolicies map[string]RetryPolicy
+
+func (r *retryPolicies) set(class string, policy RetryPolicy) {
+	if *r == nil {
+		*r = make(retryPolicies)
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = RETRY_BACKOFF_DEFAULT
+	}
+	(*r)[class] = policy
+}
+
+// Records the failed attempt in the history of the analysis, and returns
+// the delay before the next attempt. If the policy of the failure class
+// allows another attempt, the analysis is reset to pending.
+func (r retryPolicies) retry(a *model.Analysis, class string) (delay time.Duration, ok bool) {
+	start := a.StartRunning
+	if start == "" {
+		start = a.StartPending
+	}
+	end := a.End
+	if end == "" {
+		end = time.Now().Format(time.RFC1123)
+	}
+	a.Attempts = append(a.Attempts, model.Attempt{
+		Failure:   class,
+		Processor: a.Processor,
+		Backend:   a.GalaxyBackend,
+		Status:    a.Status,
+		Message:   a.Message,
+		Start:     start,
+		End:       end,
+	})
+
+	failures := 0
+	for _, at := range a.Attempts {
+		if at.Failure == class {
+			failures++
+		}
+	}
+	policy := r[class]
+	if failures >= policy.Attempts {
+		return 0, false
+	}
+
+	delay = policy.Backoff
+	for i := 1; i < failures; i++ {
+		delay *= 2
+	}
+	log.Print(fmt.Sprintf("Analysis %s failed (%s), retried in %v (%d/%d)", a.Id, class, delay, failures+1, policy.Attempts))
+
+	a.Status = model.STATUS_PENDING
+	a.Message = fmt.Sprintf("Attempt %d failed (%s), retrying in %v", len(a.Attempts), a.Attempts[len(a.Attempts)-1].Message, delay)
+	a.JobId = ""
+	a.Nboot = 0
+	a.FbpTree = ""
+	a.TbeNormTree = ""
+	a.TbeRawTree = ""
+	a.TbeLogs = ""
+	a.PartialTrees = 0
+	a.Warning = ""
+	a.StartRunning = ""
+	a.End = ""
+	return delay, true
+}
+
+// Sets the retry policy of a failure class: only timeouts
+// (model.FAILURE_TIMEOUT) are retried by the local processor.
+//
+// Must be called before InitProcessor.
+func (p *LocalProcessor) SetRetryPolicy(class string, policy RetryPolicy) {
+	p.retries.set(class, policy)
+}
+
+// Queues the failed analysis again after the delay of its retry
+// policy. Returns false if it must not be retried.
+func (p *LocalProcessor) retryJob(a *model.Analysis, class string) bool {
+	if p.isDropped(a) {
+		return false
+	}
+	delay, ok := p.retries.retry(a, class)
+	if !ok {
+		return false
+	}
+	p.rmRunningJob(a)
+	p.db.UpdateAnalysis(a)
+	go func() {
+		time.Sleep(delay)
+		select {
+		case p.queue <- a:
+		default:
+			p.release(a)
+			// Dropped analyses are run by another worker
+			if !p.forgetDropped(a) {
+				cancelRetry(a, p.db, p.notifier)
+			}
+		}
+	}()
+	return true
+}
+
+// Sets a GalaxyProcessor retry policy: galaxy api errors (model.FAILURE_API),
+// galaxy job errors (model.FAILURE_JOB) and timeouts (model.FAILURE_TIMEOUT).
+//
+// Must be called before InitProcessor.
+func (p *GalaxyProcessor) SetRetryPolicy(class string, policy RetryPolicy) {
+	p.retries.set(class, policy)
+}
+
+// Removes the failed analysis from its galaxy server, and queues it again
+// after the delay of its retry policy. Returns false if it must not be retried.
+func (p *GalaxyProcessor) retryJob(a *model.Analysis, class string) bool {
+	if p.isStopping() {
+		return false
+	}
+	if a.End == "" {
+		a.End = time.Now().Format(time.RFC1123)
+	}
+	delay, ok := p.retries.retry(a, class)
+	if !ok {
+		return false
+	}
+	// Cancels the invocation and deletes the history
+	p.rmRunningJob(a)
+	p.lock.Lock()
+	delete(p.monitors, a.Id)
+	p.lock.Unlock()
+	a.GalaxyBackend = ""
+	a.GalaxyHistory = ""
+	a.InvocationId = ""
+	a.Steps = make([]model.WorkflowStep, 0)
+	p.db.UpdateAnalysis(a)
+	go func() {
+		time.Sleep(delay)
+		select {
+		case p.queue <- a:
+		default:
+			cancelRetry(a, p.db, p.notifier)
+		}
+	}()
+	return true
+}
+
+// Cancels the analysis that could not be queued again
+func cancelRetry(a *model.Analysis, db database.BoosterwebDB, notifier notification.Notifier) {
+	log.Print("Queue is full, cancelling retry of job " + a.Id)
+	a.Status = model.STATUS_CANCELED
+	a.End = time.Now().Format(time.RFC1123)
+	a.Message = "Computing queue is full, the analysis could not be retried"
+	if err := db.UpdateAnalysis(a); err != nil {
+		log.Print(err)
+	}
+	a.DelTemp()
+	if err := notifier.Notify(a.StatusStr(), a.Id, a.RunName, a.WorkflowStr(), a.OptionsStr(), a.EMail); err != nil {
+		log.Print(err)
+	}
+}
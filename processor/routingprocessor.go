@@ -0,0 +1,225 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/workflow"
+)
+
+// Processor to which the routing processor may dispatch analyses
+type RoutedProcessor interface {
+	Processor
+	Supports(a *model.Analysis) bool // If the processor can run the analysis
+	Load() float64                   // Current load of the processor (1: full)
+}
+
+// Rule of the routing processor: analyses matching all the
+// conditions of the rule are launched on its processor.
+// Zero values match all analyses.
+type RoutingRule struct {
+	Processor string  // Name of the processor: model.PROCESSOR_LOCAL or model.PROCESSOR_GALAXY
+	Workflows []int   // Workflows of the analysis (model.WORKFLOW_NIL: booster on given trees)
+	MaxTips   int     // Max number of tips (sequences or tips of the reference tree)
+	MaxBoot   int     // Max number of bootstrap trees (given or to build)
+	MaxMemory float64 // Max estimated memory of the job in Bytes
+	MaxLoad   float64 // Max current load of the processor
+}
+
+// The Routing processor dispatches analyses to a local and a galaxy processor.
+//
+// The rules are evaluated in order, and the analysis is launched on the processor
+// of the first rule that matches and whose processor supports the analysis. If
+// no rule matches, the analysis is launched on the default processor, or on the
+// other one if the default processor does not support it.
+type RoutingProcessor struct {
+	processors  map[string]RoutedProcessor // Processors, key: processor name
+	rules       []RoutingRule              // Routing rules, in order
+	defaultproc string                     // Processor of analyses matching no rule
+	workflows   map[int]*workflow.Workflow // Workflows, for memory estimations
+	db          database.BoosterwebDB      // Connection to database to save the routed analyses
+}
+
+// Adds a processor to which analyses may be dispatched.
+//
+// Must be called before InitProcessor.
+func (p *RoutingProcessor) AddProcessor(name string, proc RoutedProcessor) {
+	if p.processors == nil {
+		p.processors = make(map[string]RoutedProcessor)
+	}
+	p.processors[name] = proc
+}
+
+// Adds a routing rule, evaluated after the rules already added.
+//
+// Must be called before InitProcessor.
+func (p *RoutingProcessor) AddRule(rule RoutingRule) {
+	p.rules = append(p.rules, rule)
+}
+
+// Returns the processors to which analyses are dispatched, key: processor name
+func (p *RoutingProcessor) Processors() map[string]RoutedProcessor {
+	return p.processors
+}
+
+// Initializes the Routing Processor, analyses matching no rule
+// being launched on defaultproc
+func (p *RoutingProcessor) InitProcessor(defaultproc string, workflows []*workflow.Workflow, db database.BoosterwebDB) {
+	p.db = db
+	p.workflows = make(map[int]*workflow.Workflow)
+	for _, w := range workflows {
+		p.workflows[w.Id] = w
+	}
+	if len(p.processors) == 0 {
+		log.Fatal("The routing processor needs at least one processor")
+	}
+	if defaultproc == "" {
+		defaultproc = model.PROCESSOR_GALAXY
+	}
+	if _, ok := p.processors[defaultproc]; !ok {
+		log.Fatal("Unknown default processor: " + defaultproc)
+	}
+	p.defaultproc = defaultproc
+
+	log.Print("Init routing processor")
+	log.Print(fmt.Sprintf("Default processor: %s", p.defaultproc))
+	for i, r := range p.rules {
+		if _, ok := p.processors[r.Processor]; !ok {
+			log.Fatal(fmt.Sprintf("Routing rule %d: unknown processor %s", i+1, r.Processor))
+		}
+		log.Print(fmt.Sprintf("Routing rule %d: %s if workflows=%v, tips<=%d, boot<=%d, memory<=%.0f, load<=%.2f", i+1, r.Processor, r.Workflows, r.MaxTips, r.MaxBoot, r.MaxMemory, r.MaxLoad))
+	}
+}
+
+// Selects the processor of the analysis according to the rules, records
+// it in the analysis, and launches the analysis on it
+func (p *RoutingProcessor) LaunchAnalysis(a *model.Analysis) (err error) {
+	var name string
+	if name, err = p.route(a); err != nil {
+		a.DelTemp()
+		return
+	}
+	log.Print(fmt.Sprintf("Analysis %s routed to %s processor", a.Id, name))
+	a.Processor = name
+	if err = p.db.UpdateAnalysis(a); err != nil {
+		return
+	}
+	return p.processors[name].LaunchAnalysis(a)
+}
+
+// Returns the name of the processor on which to launch the analysis
+func (p *RoutingProcessor) route(a *model.Analysis) (name string, err error) {
+	tips, boot := a.RefTips, a.BootTrees
+	if a.SeqAlign != "" {
+		tips, boot = a.AlignNbSeq, a.NbootRep
+	}
+	mem, _ := boosterRunStats(tips, boot, 0)
+	if w, ok := p.workflows[a.Workflow]; ok && a.SeqAlign != "" {
+		if wmem, _, ok := w.Estimate(a); ok {
+			mem = math.Max(mem, wmem)
+		}
+	}
+
+	for _, r := range p.rules {
+		proc := p.processors[r.Processor]
+		if r.matches(a, tips, boot, mem) && (r.MaxLoad <= 0 || proc.Load() <= r.MaxLoad) && proc.Supports(a) {
+			return r.Processor, nil
+		}
+	}
+
+	if p.processors[p.defaultproc].Supports(a) {
+		return p.defaultproc, nil
+	}
+	// Other processors, in name order
+	names := make([]string, 0, len(p.processors))
+	for n := range p.processors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if p.processors[n].Supports(a) {
+			return n, nil
+		}
+	}
+	err = errors.New("This analysis cannot be run on this server")
+	return
+}
+
+// Returns true if the analysis matches the conditions of the rule
+// (except the load of the processor)
+func (r RoutingRule) matches(a *model.Analysis, tips, boot int, mem float64) bool {
+	if len(r.Workflows) > 0 {
+		found := false
+		for _, w := range r.Workflows {
+			if (a.SeqAlign == "" && w == model.WORKFLOW_NIL) || (a.SeqAlign != "" && w == a.Workflow) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return (r.MaxTips <= 0 || tips <= r.MaxTips) &&
+		(r.MaxBoot <= 0 || boot <= r.MaxBoot) &&
+		(r.MaxMemory <= 0 || mem <= r.MaxMemory)
+}
+
+// Cancels the analyses of all the processors
+func (p *RoutingProcessor) CancelAnalyses() (err error) {
+	for name, proc := range p.processors {
+		if e := proc.CancelAnalyses(); e != nil {
+			log.Print(fmt.Sprintf("Error while cancelling %s analyses: %s", name, e.Error()))
+			err = e
+		}
+	}
+	return
+}
+
+// Drains all the processors at the same time
+func (p *RoutingProcessor) Drain(period time.Duration) (err error) {
+	errs := make(chan error, len(p.processors))
+	for name, proc := range p.processors {
+		go func(name string, proc Processor) {
+			e := proc.Drain(period)
+			if e != nil {
+				log.Print(fmt.Sprintf("Error while draining %s analyses: %s", name, e.Error()))
+			}
+			errs <- e
+		}(name, proc)
+	}
+	for range p.processors {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,70 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+// Processor supporting all analyses, without running them
+type routedTestProcessor struct{}
+
+func (p routedTestProcessor) LaunchAnalysis(a *model.Analysis) error { return nil }
+func (p routedTestProcessor) CancelAnalyses() error                  { return nil }
+func (p routedTestProcessor) Drain(period time.Duration) error       { return nil }
+func (p routedTestProcessor) Supports(a *model.Analysis) bool        { return true }
+func (p routedTestProcessor) Load() float64                          { return 0 }
+
+func TestRouteGivenTrees(t *testing.T) {
+	p := &RoutingProcessor{}
+	p.AddProcessor(model.PROCESSOR_LOCAL, routedTestProcessor{})
+	p.AddProcessor(model.PROCESSOR_GALAXY, routedTestProcessor{})
+	p.AddRule(RoutingRule{Processor: model.PROCESSOR_LOCAL, MaxTips: 100, MaxBoot: 100})
+	p.InitProcessor(model.PROCESSOR_GALAXY, nil, nil)
+
+	// Tree files are not read: the counts recorded at upload are used
+	for _, c := range []struct {
+		tips, boot int
+		expected   string
+	}{
+		{50, 100, model.PROCESSOR_LOCAL},
+		{500, 100, model.PROCESSOR_GALAXY},
+		{50, 1000, model.PROCESSOR_GALAXY},
+	} {
+		a := model.NewAnalysis()
+		a.Reffile = "missing_reftree.nw"
+		a.Bootfile = "missing_boottrees.nw"
+		a.RefTips, a.BootTrees = c.tips, c.boot
+		name, err := p.route(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != c.expected {
+			t.Errorf("Analysis with %d tips and %d trees routed to %s, expected %s", c.tips, c.boot, name, c.expected)
+		}
+	}
+}
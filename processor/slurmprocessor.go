@@ -0,0 +1,612 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	goio "io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/notification"
+	"github.com/evolbioinfo/gotree/io/utils"
+)
+
+const (
+	SLURM_INTERVAL_DEFAULT        = 10 * time.Second
+	SLURM_COMMAND_TIMEOUT_DEFAULT = 60 * time.Second
+
+	// Files of a slurm job, in its directory
+	SLURM_SCRIPT      = "job.sh"
+	SLURM_STDOUT      = "slurm.out"
+	SLURM_STDERR      = "slurm.err"
+	SLURM_REFTREE     = "ref.nw"
+	SLURM_BOOTTREES   = "boot.nw"
+	SLURM_FBPTREE     = "fbp.nw"
+	SLURM_TBENORMTREE = "tbe_norm.nw"
+	SLURM_TBERAWTREE  = "tbe_raw.nw"
+	SLURM_TBELOGS     = "tbe.log"
+)
+
+// Configuration of the slurm processor.
+// Empty commands are looked up in the PATH.
+type SlurmConfig struct {
+	Sbatch    string        // Path to sbatch
+	Squeue    string        // Path to squeue
+	Sacct     string        // Path to sacct
+	Scancel   string        // Path to scancel
+	Booster   string        // Path to the booster executable on the compute nodes
+	WorkDir   string        // Directory shared between the server and the compute nodes
+	Partition string        // Slurm partition (optional)
+	Options   []string      // Additional sbatch options, e.g. "--account=booster"
+	Interval  time.Duration // Time between two checks of the jobs
+	Timeout   time.Duration // Max running time of the slurm commands, e.g. squeue when slurmctld does not answer
+}
+
+// The Slurm processor submits booster jobs to a slurm cluster.
+//
+// Each job is run in its own directory of the shared directory: the input trees
+// are copied there, and the job script runs booster on the compute node. The
+// processor polls squeue (and sacct for finished jobs) to follow the jobs, and
+// collects the outputs from the job directory.
+type SlurmProcessor struct {
+	runningJobs map[string]*model.Analysis // Submitted jobs, key: analysis id
+	queue       chan *model.Analysis       // Analyses waiting to be submitted
+	db          database.BoosterwebDB
+	notifier    notification.Notifier
+	lock        sync.RWMutex
+	conf        SlurmConfig
+	timeout     int  // Job timeout in seconds (0: unlimited)
+	memlimit    int  // Memory limit of jobs in Bytes (0: unlimited)
+	jobthreads  int  // Number of cpus per job
+	queuesize   int  // Max queue size
+	stopping    bool // If the server is stopping (guarded by lock)
+}
+
+// Initializes the Slurm Processor
+func (p *SlurmProcessor) InitProcessor(conf SlurmConfig, queuesize, timeout, memlimit, jobthreads int, db database.BoosterwebDB, notifier notification.Notifier) {
+	p.db = db
+	p.notifier = notifier
+	p.runningJobs = make(map[string]*model.Analysis)
+	p.timeout = timeout
+	p.memlimit = memlimit
+
+	for cmd, path := range map[string]*string{
+		"sbatch":  &conf.Sbatch,
+		"squeue":  &conf.Squeue,
+		"sacct":   &conf.Sacct,
+		"scancel": &conf.Scancel,
+	} {
+		if *path == "" {
+			*path = cmd
+		}
+		if _, err := exec.LookPath(*path); err != nil {
+			log.Fatal(fmt.Sprintf("%s command not found: %s", cmd, err.Error()))
+		}
+	}
+	if conf.Booster == "" {
+		// Looked up on the compute nodes
+		conf.Booster = "booster"
+	}
+	if conf.WorkDir == "" {
+		log.Fatal("A directory shared with the compute nodes must be given to the slurm processor")
+	}
+	if err := os.MkdirAll(conf.WorkDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = SLURM_INTERVAL_DEFAULT
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = SLURM_COMMAND_TIMEOUT_DEFAULT
+	}
+	p.conf = conf
+
+	if jobthreads == 0 {
+		jobthreads = RUNNERS_JOBTHREADS_DEFAULT
+	}
+	p.jobthreads = jobthreads
+	if queuesize == 0 {
+		queuesize = RUNNERS_QUEUESIZE_DEFAULT
+	}
+	if queuesize <= 0 {
+		log.Fatal("The queue size must be set to a value >0")
+	}
+	p.queuesize = queuesize
+
+	log.Print("Init slurm processor")
+	log.Print(fmt.Sprintf("Shared directory: %s", conf.WorkDir))
+	log.Print(fmt.Sprintf("Booster: %s", conf.Booster))
+	log.Print(fmt.Sprintf("Queue size: %d", queuesize))
+	log.Print(fmt.Sprintf("Job timeout: %ds", timeout))
+	log.Print(fmt.Sprintf("Job mem limit: %d", memlimit))
+	log.Print(fmt.Sprintf("Job threads: %d", jobthreads))
+
+	p.queue = make(chan *model.Analysis, queuesize)
+
+	p.initJobSubmitter()
+	p.restoreRunningJobs()
+	p.initJobMonitor()
+}
+
+// Returns true if the analysis can be run on the cluster:
+// only booster on given trees is run on the compute nodes
+func (p *SlurmProcessor) Supports(a *model.Analysis) bool {
+	return a.SeqAlign == "" && a.Reffile != "" && a.Bootfile != ""
+}
+
+// Returns the number of submitted and queued jobs relative to the queue size
+func (p *SlurmProcessor) Load() float64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return float64(len(p.runningJobs)+len(p.queue)) / float64(p.queuesize)
+}
+
+// Adds the analysis to the submission queue and stores it in the database
+func (p *SlurmProcessor) LaunchAnalysis(a *model.Analysis) (err error) {
+	a.Processor = model.PROCESSOR_SLURM
+	if !p.Supports(a) {
+		err = errors.New("Tree inference is not available on this server, please give reference and bootstrap trees")
+		a.DelTemp()
+		return
+	}
+	if err = p.db.UpdateAnalysis(a); err != nil {
+		return
+	}
+	select {
+	case p.queue <- a: // Put a in the channel unless it is full
+	default:
+		log.Print("Queue is full, cancelling job " + a.Id)
+		a.Status = model.STATUS_CANCELED
+		a.End = time.Now().Format(time.RFC1123)
+		a.Message = "Computing queue is full, please try again in a few minutes"
+		err = p.db.UpdateAnalysis(a)
+		a.DelTemp()
+	}
+	return
+}
+
+// Cancels the submitted jobs with scancel
+func (p *SlurmProcessor) CancelAnalyses() (err error) {
+	p.setStopping()
+	for _, a := range p.allRunningJobs() {
+		log.Print("Cancelling job : " + a.Id)
+		if _, e := p.run(p.conf.Scancel, a.JobId); e != nil {
+			log.Print(fmt.Sprintf("Error while cancelling slurm job %s: %s", a.JobId, e.Error()))
+			err = e
+		}
+		a.Status = model.STATUS_CANCELED
+		a.End = time.Now().Format(time.RFC1123)
+		a.Message = "Canceled after a server restart"
+		if e := p.db.UpdateAnalysis(a); e != nil {
+			log.Print(e)
+		}
+		p.rmRunningJob(a)
+	}
+	return
+}
+
+// Stops submitting queued jobs: submitted slurm jobs go on, and are
+// restored when the server restarts.
+func (p *SlurmProcessor) Drain(period time.Duration) (err error) {
+	p.setStopping()
+	cancelQueued(p.queue, p.db)
+	return
+}
+
+func (p *SlurmProcessor) setStopping() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stopping = true
+}
+
+func (p *SlurmProcessor) isStopping() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.stopping
+}
+
+// Creates a new go routine that submits the queued analyses to slurm
+func (p *SlurmProcessor) initJobSubmitter() {
+	go func() {
+		for a := range p.queue {
+			// Analyses queued while the server is stopping
+			if p.isStopping() {
+				cancelShutdown(a, p.db)
+				continue
+			}
+			log.Print(fmt.Sprintf("New analysis : id=%s", a.Id))
+			if err := p.submit(a); err != nil {
+				log.Print("Error while submitting to slurm: " + err.Error())
+				a.Status = model.STATUS_ERROR
+				a.End = time.Now().Format(time.RFC1123)
+				a.Message = err.Error()
+				os.RemoveAll(p.jobDir(a))
+				if err = p.db.UpdateAnalysis(a); err != nil {
+					log.Print("Problem updating job: " + err.Error())
+				}
+				a.DelTemp()
+				continue
+			}
+			p.newRunningJob(a)
+		}
+	}()
+}
+
+// Returns the directory of the job of the analysis in the shared directory
+func (p *SlurmProcessor) jobDir(a *model.Analysis) string {
+	return filepath.Join(p.conf.WorkDir, a.Id)
+}
+
+// Copies the input trees to the job directory, writes
+// the job script and submits it with sbatch
+func (p *SlurmProcessor) submit(a *model.Analysis) (err error) {
+	var out string
+
+	dir := p.jobDir(a)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	// Booster reads uncompressed newick files
+	if err = copyUncompressed(a.Reffile, filepath.Join(dir, SLURM_REFTREE)); err != nil {
+		return
+	}
+	if err = copyUncompressed(a.Bootfile, filepath.Join(dir, SLURM_BOOTTREES)); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, SLURM_SCRIPT), []byte(p.jobScript(a)), 0755); err != nil {
+		return
+	}
+
+	if out, err = p.run(p.conf.Sbatch, "--parsable", filepath.Join(dir, SLURM_SCRIPT)); err != nil {
+		return
+	}
+	// --parsable output: jobid[;cluster]
+	jobid := strings.TrimSpace(strings.SplitN(out, ";", 2)[0])
+	if jobid == "" {
+		return errors.New("sbatch did not return any job id")
+	}
+	a.JobId = jobid
+	a.Status = model.STATUS_PENDING
+	a.Message = "Submitted to the cluster"
+	log.Print(fmt.Sprintf("Analysis %s submitted to slurm: job %s", a.Id, a.JobId))
+	return p.db.UpdateAnalysis(a)
+}
+
+// Returns the job script running booster (FBP and TBE) on the input trees
+func (p *SlurmProcessor) jobScript(a *model.Analysis) string {
+	var b strings.Builder
+	dir := p.jobDir(a)
+
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "#SBATCH --job-name=booster-%s\n", a.Id)
+	fmt.Fprintf(&b, "#SBATCH --output=%s\n", filepath.Join(dir, SLURM_STDOUT))
+	fmt.Fprintf(&b, "#SBATCH --error=%s\n", filepath.Join(dir, SLURM_STDERR))
+	fmt.Fprintf(&b, "#SBATCH --chdir=%s\n", dir)
+	fmt.Fprintf(&b, "#SBATCH --cpus-per-task=%d\n", p.jobthreads)
+	if p.timeout > 0 {
+		fmt.Fprintf(&b, "#SBATCH --time=%d\n", (p.timeout+59)/60)
+	}
+	if p.memlimit > 0 {
+		fmt.Fprintf(&b, "#SBATCH --mem=%dM\n", p.memlimit/(1024*1024))
+	}
+	if p.conf.Partition != "" {
+		fmt.Fprintf(&b, "#SBATCH --partition=%s\n", p.conf.Partition)
+	}
+	for _, o := range p.conf.Options {
+		fmt.Fprintf(&b, "#SBATCH %s\n", o)
+	}
+	b.WriteString("set -e\n")
+	fmt.Fprintf(&b, "%s -a fbp -i %s -b %s -o %s -@ %d -q\n", p.conf.Booster, SLURM_REFTREE, SLURM_BOOTTREES, SLURM_FBPTREE, p.jobthreads)
+	fmt.Fprintf(&b, "%s -a tbe -i %s -b %s -o %s -r %s -S %s -d 0.3 -@ %d -q\n", p.conf.Booster, SLURM_REFTREE, SLURM_BOOTTREES, SLURM_TBENORMTREE, SLURM_TBERAWTREE, SLURM_TBELOGS, p.jobthreads)
+	return b.String()
+}
+
+// Creates a new go routine that periodically checks the
+// states of the submitted jobs
+func (p *SlurmProcessor) initJobMonitor() {
+	go func() {
+		for !p.isStopping() {
+			if jobs := p.allRunningJobs(); len(jobs) > 0 {
+				p.checkJobs(jobs)
+			}
+			time.Sleep(p.conf.Interval)
+		}
+	}()
+}
+
+// Checks the states of the given jobs with squeue, and with sacct
+// for the jobs that are not known by squeue anymore (finished)
+func (p *SlurmProcessor) checkJobs(jobs []*model.Analysis) {
+	var states map[string]string
+	var err error
+
+	ids := make([]string, 0, len(jobs))
+	for _, a := range jobs {
+		ids = append(ids, a.JobId)
+	}
+	if states, err = p.queueStates(ids); err != nil {
+		log.Print("Error while checking slurm jobs with squeue: " + err.Error())
+		return
+	}
+
+	finished := make([]string, 0)
+	for _, id := range ids {
+		if _, ok := states[id]; !ok {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) > 0 {
+		var acct map[string]string
+		if acct, err = p.accountingStates(finished); err != nil {
+			log.Print("Error while checking slurm jobs with sacct: " + err.Error())
+		}
+		for id, s := range acct {
+			states[id] = s
+		}
+	}
+
+	for _, a := range jobs {
+		// Jobs unknown to both commands (e.g. sacct not updated yet)
+		// are checked again later
+		if state, ok := states[a.JobId]; ok {
+			p.updateJob(a, state)
+		}
+	}
+}
+
+// Returns the states of the given jobs known by squeue, key: job id
+func (p *SlurmProcessor) queueStates(ids []string) (states map[string]string, err error) {
+	var out string
+	if out, err = p.run(p.conf.Squeue, "--noheader", "--format=%i %T", "--jobs="+strings.Join(ids, ",")); err != nil {
+		// squeue fails if all the jobs are unknown (finished)
+		if strings.Contains(err.Error(), "Invalid job id") {
+			return make(map[string]string), nil
+		}
+		return
+	}
+	return parseJobStates(out, " "), nil
+}
+
+// Returns the states of the given jobs given by sacct, key: job id
+func (p *SlurmProcessor) accountingStates(ids []string) (states map[string]string, err error) {
+	var out string
+	if out, err = p.run(p.conf.Sacct, "--noheader", "--parsable2", "--allocations", "--format=JobID,State", "--jobs="+strings.Join(ids, ",")); err != nil {
+		return
+	}
+	return parseJobStates(out, "|"), nil
+}
+
+// Parses lines "<jobid><sep><state>", states being upper case
+// (e.g. "CANCELLED by 1000" gives "CANCELLED")
+func parseJobStates(out, sep string) (states map[string]string) {
+	states = make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		cols := strings.SplitN(strings.TrimSpace(line), sep, 2)
+		if len(cols) != 2 || cols[0] == "" {
+			continue
+		}
+		state := strings.Fields(strings.TrimSpace(cols[1]))
+		if len(state) > 0 {
+			states[cols[0]] = strings.TrimSuffix(state[0], "+")
+		}
+	}
+	return
+}
+
+// Updates the analysis from the slurm state of its job, collecting
+// the outputs if the job is completed
+func (p *SlurmProcessor) updateJob(a *model.Analysis, state string) {
+	switch state {
+	case "PENDING", "CONFIGURING", "REQUEUED", "REQUEUE_HOLD", "REQUEUE_FED", "RESIZING", "SUSPENDED":
+		a.Status = model.STATUS_PENDING
+		a.Message = "Queued on the cluster (" + strings.ToLower(state) + ")"
+		p.db.UpdateAnalysis(a)
+		return
+	case "RUNNING", "COMPLETING", "STAGE_OUT", "SIGNALING":
+		a.Status = model.STATUS_RUNNING
+		if a.StartRunning == "" {
+			a.StartRunning = time.Now().Format(time.RFC1123)
+		}
+		a.Message = "Running on the cluster"
+		p.db.UpdateAnalysis(a)
+		return
+	case "COMPLETED":
+		if err := p.collectOutputs(a); err != nil {
+			a.Status = model.STATUS_ERROR
+			a.Message = "Error while reading booster outputs: " + err.Error()
+		} else {
+			a.Status = model.STATUS_FINISHED
+			a.Message = "Finished"
+		}
+	case "TIMEOUT", "DEADLINE":
+		a.Status = model.STATUS_TIMEOUT
+		a.Message = "Time out: Job canceled"
+	case "CANCELLED":
+		a.Status = model.STATUS_CANCELED
+		a.Message = "Job canceled on the cluster"
+	case "OUT_OF_MEMORY":
+		a.Status = model.STATUS_ERROR
+		a.Message = "The job ran out of memory"
+	case "FAILED", "NODE_FAIL", "BOOT_FAIL", "PREEMPTED", "REVOKED":
+		a.Status = model.STATUS_ERROR
+		a.Message = "Job failed on the cluster (" + strings.ToLower(state) + ")" + p.jobErrors(a)
+	default:
+		log.Print(fmt.Sprintf("Slurm job %s of analysis %s in unknown state: %s", a.JobId, a.Id, state))
+		return
+	}
+
+	a.End = time.Now().Format(time.RFC1123)
+	log.Print(fmt.Sprintf("Analysis %s: slurm job %s %s", a.Id, a.JobId, state))
+	p.rmRunningJob(a)
+	if err := os.RemoveAll(p.jobDir(a)); err != nil {
+		log.Print(err)
+	}
+	if err := p.db.UpdateAnalysis(a); err != nil {
+		log.Print(fmt.Sprintf("Problem updating job %s: %s", a.Id, err.Error()))
+	}
+	a.DelTemp()
+	if err := p.notifier.Notify(a.StatusStr(), a.Id, a.RunName, a.WorkflowStr(), a.OptionsStr(), a.EMail); err != nil {
+		log.Print(err)
+	}
+}
+
+// Reads the booster outputs from the job directory
+func (p *SlurmProcessor) collectOutputs(a *model.Analysis) (err error) {
+	var content []byte
+	dir := p.jobDir(a)
+	for file, field := range map[string]*string{
+		SLURM_FBPTREE:     &a.FbpTree,
+		SLURM_TBENORMTREE: &a.TbeNormTree,
+		SLURM_TBERAWTREE:  &a.TbeRawTree,
+		SLURM_TBELOGS:     &a.TbeLogs,
+	} {
+		if content, err = ioutil.ReadFile(filepath.Join(dir, file)); err != nil {
+			return
+		}
+		*field = strings.TrimSpace(string(content))
+	}
+	a.TbeLogs = cleanTBELogs(a.TbeLogs)
+	restoreOriginalNames(a)
+	return
+}
+
+// Returns the last line of the error output of the job (if any),
+// to be added to the error message
+func (p *SlurmProcessor) jobErrors(a *model.Analysis) string {
+	content, err := ioutil.ReadFile(filepath.Join(p.jobDir(a), SLURM_STDERR))
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return ": " + last
+	}
+	return ""
+}
+
+// Restores the jobs submitted before a restart of the server, and
+// queues again the analyses that were not submitted yet
+func (p *SlurmProcessor) restoreRunningJobs() {
+	an, err := p.db.GetRunningAnalyses()
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	nb := 0
+	for _, a := range an {
+		if a.Processor != model.PROCESSOR_SLURM {
+			continue
+		}
+		if a.JobId != "" {
+			p.newRunningJob(a)
+			nb++
+			continue
+		}
+		if _, err = os.Stat(a.Reffile); err == nil {
+			if _, err = os.Stat(a.Bootfile); err == nil {
+				select {
+				case p.queue <- a:
+					continue
+				default:
+				}
+			}
+		}
+		a.Status = model.STATUS_ERROR
+		a.End = time.Now().Format(time.RFC1123)
+		a.Message = "Job lost after a server restart, please submit it again"
+		p.db.UpdateAnalysis(a)
+	}
+	log.Print(fmt.Sprintf("Restoring %d Slurm jobs", nb))
+}
+
+func (p *SlurmProcessor) newRunningJob(a *model.Analysis) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.runningJobs[a.Id] = a
+}
+
+func (p *SlurmProcessor) rmRunningJob(a *model.Analysis) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.runningJobs, a.Id)
+}
+
+func (p *SlurmProcessor) allRunningJobs() []*model.Analysis {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	v := make([]*model.Analysis, 0, len(p.runningJobs))
+	for _, value := range p.runningJobs {
+		v = append(v, value)
+	}
+	return v
+}
+
+// Runs the scheduler command and returns its standard output.
+// The command is killed after the command timeout.
+func (p *SlurmProcessor) run(path string, args ...string) (out string, err error) {
+	var stdout, stderr bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), p.conf.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%s did not answer after %v", filepath.Base(path), p.conf.Timeout)
+			return
+		}
+		err = fmt.Errorf("%s failed: %v: %s", filepath.Base(path), err, strings.TrimSpace(stderr.String()))
+		return
+	}
+	return stdout.String(), nil
+}
+
+// Copies the (possibly gzipped) file src to the uncompressed file dst
+func copyUncompressed(src, dst string) (err error) {
+	var out *os.File
+
+	in, r, err := utils.GetReader(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.Create(dst); err != nil {
+		return
+	}
+	defer out.Close()
+	_, err = goio.Copy(out, r)
+	return
+}
@@ -0,0 +1,274 @@
+//go:build !windows
+// +build !windows
+
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+// Writes an executable stub of a slurm command in dir
+func writeStub(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Writes the output of the squeue or sacct stub
+func setStubOutput(t *testing.T, conf SlurmConfig, name, out string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(conf.Sbatch), name), []byte(out), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the configuration of stub slurm commands: sbatch gives job 42,
+// squeue and sacct print the outputs set with setStubOutput (squeue fails
+// as slurm if it has no job to print)
+func stubSlurmConfig(t *testing.T) SlurmConfig {
+	t.Helper()
+	bin := t.TempDir()
+	conf := SlurmConfig{
+		Sbatch:   writeStub(t, bin, "sbatch", "echo '42;cluster'\n"),
+		Squeue:   writeStub(t, bin, "squeue", "[ -s '"+bin+"/squeue.out' ] && exec cat '"+bin+"/squeue.out'\necho 'slurm_load_jobs error: Invalid job id specified' >&2\nexit 1\n"),
+		Sacct:    writeStub(t, bin, "sacct", "cat '"+bin+"/sacct.out'\n"),
+		Scancel:  writeStub(t, bin, "scancel", "echo \"$@\" >> '"+bin+"/scancel.log'\n"),
+		Booster:  "booster",
+		WorkDir:  t.TempDir(),
+		Interval: 50 * time.Millisecond,
+		Timeout:  5 * time.Second,
+	}
+	setStubOutput(t, conf, "squeue.out", "")
+	setStubOutput(t, conf, "sacct.out", "")
+	return conf
+}
+
+// Returns a slurm processor using the stub commands, whose go routines
+// are not started: jobs are checked by calling checkJobs
+func stubSlurmProcessor(t *testing.T) (*SlurmProcessor, *testNotifier) {
+	t.Helper()
+	notifier := newTestNotifier()
+	p := &SlurmProcessor{
+		runningJobs: make(map[string]*model.Analysis),
+		queue:       make(chan *model.Analysis, 10),
+		db:          testMemoryDB(t),
+		notifier:    notifier,
+		conf:        stubSlurmConfig(t),
+		jobthreads:  1,
+		queuesize:   10,
+	}
+	return p, notifier
+}
+
+// Writes the booster outputs in the directory of the job, as the job
+// script does on the compute node
+func writeSlurmOutputs(t *testing.T, p *SlurmProcessor, a *model.Analysis) {
+	t.Helper()
+	dir := p.jobDir(a)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{
+		SLURM_FBPTREE:     testBoosterOutputs["fbp_tree"],
+		SLURM_TBENORMTREE: testBoosterOutputs["tbe_norm_tree"],
+		SLURM_TBERAWTREE:  testBoosterOutputs["tbe_raw_tree"],
+		SLURM_TBELOGS:     testBoosterOutputs["tbe_log"],
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSlurmJobStates(t *testing.T) {
+	p, _ := stubSlurmProcessor(t)
+	for _, test := range []struct {
+		state   string
+		status  int
+		running bool
+		message string
+	}{
+		{"PENDING", model.STATUS_PENDING, true, "Queued on the cluster (pending)"},
+		{"RUNNING", model.STATUS_RUNNING, true, "Running on the cluster"},
+		{"COMPLETING", model.STATUS_RUNNING, true, "Running on the cluster"},
+		{"TIMEOUT", model.STATUS_TIMEOUT, false, "Time out: Job canceled"},
+		{"CANCELLED", model.STATUS_CANCELED, false, "Job canceled on the cluster"},
+		{"OUT_OF_MEMORY", model.STATUS_ERROR, false, "The job ran out of memory"},
+		{"FAILED", model.STATUS_ERROR, false, "Job failed on the cluster (failed): booster: cannot read trees"},
+		{"COMPLETED", model.STATUS_ERROR, false, "Error while reading booster outputs"},
+	} {
+		a := treesAnalysis(t, "state-"+strings.ToLower(test.state))
+		a.JobId = "42"
+		if err := os.MkdirAll(p.jobDir(a), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(p.jobDir(a), SLURM_STDERR), []byte("booster: starting\nbooster: cannot read trees\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p.newRunningJob(a)
+
+		p.updateJob(a, test.state)
+		if a.Status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.state, test.status, a.Status)
+		}
+		if !strings.HasPrefix(a.Message, test.message) {
+			t.Errorf("%s: unexpected message %q", test.state, a.Message)
+		}
+		if _, running := p.runningJobs[a.Id]; running != test.running {
+			t.Errorf("%s: expected running=%v", test.state, test.running)
+		}
+		if _, err := os.Stat(p.jobDir(a)); test.running == os.IsNotExist(err) {
+			t.Errorf("%s: job directory should be removed only when the job ends", test.state)
+		}
+	}
+
+	// Parsing of squeue and sacct outputs
+	states := parseJobStates("41|CANCELLED by 1000\n42|COMPLETED\n43|RUNNING+\n\n", "|")
+	if states["41"] != "CANCELLED" || states["42"] != "COMPLETED" || states["43"] != "RUNNING" || len(states) != 3 {
+		t.Errorf("Unexpected parsed states: %v", states)
+	}
+}
+
+func TestSlurmSubmitAndCollect(t *testing.T) {
+	p, notifier := stubSlurmProcessor(t)
+	a := treesAnalysis(t, "collected")
+	a.Processor = model.PROCESSOR_SLURM
+	if err := p.submit(a); err != nil {
+		t.Fatal(err)
+	}
+	if a.JobId != "42" {
+		t.Fatalf("Expected slurm job 42, got %q", a.JobId)
+	}
+	script, err := ioutil.ReadFile(filepath.Join(p.jobDir(a), SLURM_SCRIPT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(script), "#SBATCH --cpus-per-task=1") || !strings.Contains(string(script), "booster -a tbe") {
+		t.Errorf("Unexpected job script:\n%s", script)
+	}
+	if ref, _ := ioutil.ReadFile(filepath.Join(p.jobDir(a), SLURM_REFTREE)); string(ref) != testRefTree {
+		t.Errorf("Reference tree not copied to the job directory: %q", ref)
+	}
+	p.newRunningJob(a)
+
+	setStubOutput(t, p.conf, "squeue.out", "42 RUNNING\n")
+	p.checkJobs(p.allRunningJobs())
+	if a.Status != model.STATUS_RUNNING || a.StartRunning == "" {
+		t.Fatalf("Expected running job, got status %s", a.StatusStr())
+	}
+
+	// Finished: not listed by squeue anymore
+	writeSlurmOutputs(t, p, a)
+	setStubOutput(t, p.conf, "squeue.out", "")
+	setStubOutput(t, p.conf, "sacct.out", "42|COMPLETED\n")
+	p.checkJobs(p.allRunningJobs())
+	if a.Status != model.STATUS_FINISHED {
+		t.Fatalf("Expected finished job, got status %s: %s", a.StatusStr(), a.Message)
+	}
+	if a.FbpTree != testBoosterOutputs["fbp_tree"] || a.TbeNormTree != testBoosterOutputs["tbe_norm_tree"] || a.TbeRawTree != testBoosterOutputs["tbe_raw_tree"] {
+		t.Errorf("Unexpected result trees: %s, %s, %s", a.FbpTree, a.TbeNormTree, a.TbeRawTree)
+	}
+	if !strings.Contains(a.TbeLogs, "Taxon : Instability") {
+		t.Errorf("Unexpected booster logs: %s", a.TbeLogs)
+	}
+	if _, err := os.Stat(p.jobDir(a)); !os.IsNotExist(err) {
+		t.Error("Job directory not removed")
+	}
+	if len(p.allRunningJobs()) != 0 {
+		t.Error("Finished job still running")
+	}
+	notifier.wait(t, a.Id, time.Second)
+}
+
+func TestSlurmRestoreRunningJobs(t *testing.T) {
+	conf := stubSlurmConfig(t)
+
+	// Submitted before the restart, and finished since
+	submitted := treesAnalysis(t, "submitted")
+	submitted.Processor = model.PROCESSOR_SLURM
+	submitted.Status = model.STATUS_RUNNING
+	submitted.JobId = "41"
+	// Queued, not submitted yet
+	queued := treesAnalysis(t, "queued")
+	queued.Processor = model.PROCESSOR_SLURM
+	other := treesAnalysis(t, "other")
+	other.Processor = model.PROCESSOR_LOCAL
+	other.Status = model.STATUS_RUNNING
+	db := &runningDB{MemoryBoosterWebDB: testMemoryDB(t), running: []*model.Analysis{submitted, queued, other}}
+
+	setStubOutput(t, conf, "sacct.out", "41|COMPLETED\n42|CANCELLED by 1000\n")
+	writeSlurmOutputs(t, &SlurmProcessor{conf: conf}, submitted)
+	notifier := newTestNotifier()
+	p := &SlurmProcessor{}
+	p.InitProcessor(conf, 10, 0, 0, 1, db, notifier)
+	t.Cleanup(func() { p.Drain(0) })
+
+	notifier.wait(t, submitted.Id, testGalaxyWait)
+	if submitted.Status != model.STATUS_FINISHED || submitted.FbpTree != testBoosterOutputs["fbp_tree"] {
+		t.Errorf("Restored job not collected: status %s, %s", submitted.StatusStr(), submitted.Message)
+	}
+	notifier.wait(t, queued.Id, testGalaxyWait)
+	if queued.JobId != "42" || queued.Status != model.STATUS_CANCELED {
+		t.Errorf("Queued analysis not submitted after the restart: job %q, status %s", queued.JobId, queued.StatusStr())
+	}
+	if other.Status != model.STATUS_RUNNING || other.JobId != "" {
+		t.Error("Analysis of another processor restored")
+	}
+}
+
+func TestSlurmCommandTimeout(t *testing.T) {
+	p, _ := stubSlurmProcessor(t)
+	p.conf.Squeue = writeStub(t, t.TempDir(), "squeue", "exec sleep 30\n")
+	p.conf.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err := p.queueStates([]string{"42"})
+	if err == nil || !strings.Contains(err.Error(), "did not answer") {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("squeue killed after %v, timeout is %v", elapsed, p.conf.Timeout)
+	}
+
+	// The monitor goes on with the next checks
+	a := treesAnalysis(t, "hung")
+	a.JobId = "42"
+	p.newRunningJob(a)
+	p.checkJobs(p.allRunningJobs())
+	if a.Status != model.STATUS_PENDING || len(p.allRunningJobs()) != 1 {
+		t.Errorf("Job modified after a failed check: status %s", a.StatusStr())
+	}
+}
@@ -0,0 +1,126 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"sync"
+
+	"github.com/evolbioinfo/gotree/support"
+	"github.com/evolbioinfo/gotree/tree"
+)
+
+/*
+Progress and cancellation of a support computation.
+
+FBP and TBE are computed simultaneously on the same stream of
+bootstrap trees, each with half of the job threads. Canceling the
+run does not interrupt them: it stops the stream, so that both
+supports are computed and normalized over exactly the same first
+trees.
+*/
+type supportRun struct {
+	fbp      *support.Supporter
+	tbe      *support.Supporter
+	lock     sync.RWMutex
+	canceled bool
+	trees    int // Number of trees given to FBP and TBE
+}
+
+func newSupportRun() *supportRun {
+	return &supportRun{
+		fbp: support.NewSupporter(),
+		tbe: support.NewSupporter(),
+	}
+}
+
+// Stops giving bootstrap trees to FBP and TBE
+func (r *supportRun) Cancel() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.canceled = true
+}
+
+func (r *supportRun) Canceled() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.canceled
+}
+
+// Number of threads of FBP and of TBE, computed simultaneously
+// by a job with jobThreads threads
+func supportThreads(jobThreads int) int {
+	if jobThreads < 2 {
+		return 1
+	}
+	return jobThreads / 2
+}
+
+// Number of bootstrap trees processed by both FBP and TBE
+func (r *supportRun) Progress() int {
+	fbp, tbe := r.fbp.Progress(), r.tbe.Progress()
+	if fbp < tbe {
+		return fbp
+	}
+	return tbe
+}
+
+// Number of bootstrap trees given to FBP and TBE
+func (r *supportRun) Trees() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.trees
+}
+
+// Gives the trees read from in to both fbp and tbe channels,
+// until all the trees are read or the run is canceled.
+//
+// FBP gets copies of the trees: the copies in the fbp channel and
+// being processed by FBP are accounted for by boosterRunStats.
+//
+// Remaining trees are then read in background so that the reader
+// does not stay blocked.
+func (r *supportRun) dispatch(in <-chan tree.Trees, fbp, tbe chan<- tree.Trees) {
+	defer close(fbp)
+	defer close(tbe)
+	for t := range in {
+		if t.Err != nil {
+			fbp <- t
+			tbe <- t
+			break
+		}
+		r.lock.Lock()
+		if r.canceled {
+			r.lock.Unlock()
+			break
+		}
+		r.trees++
+		r.lock.Unlock()
+		fbp <- tree.Trees{Tree: t.Tree.Clone(), Id: t.Id}
+		tbe <- t
+	}
+	go func() {
+		for range in {
+		}
+	}()
+}
@@ -0,0 +1,324 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	goio "io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+const (
+	WORKER_COMMAND           = "worker"         // booster-web worker command
+	WORKER_JOB_COMMAND       = "job"            // Hidden subcommand of the worker command running a single job
+	WORKER_PROGRESS_INTERVAL = 2 * time.Second  // Time between two progress messages
+	WORKER_KILL_DELAY        = 30 * time.Second // Time given to a canceled worker to send partial results
+
+	// Types of messages sent by workers
+	WORKER_MSG_PROGRESS = "progress" // Number of bootstrap trees processed
+	WORKER_MSG_STEP     = "step"     // Results of a finished step (FBP or TBE)
+	WORKER_MSG_DONE     = "done"     // End of the job
+)
+
+// Configuration of the worker subprocesses computing supports
+// out of the web server process
+type WorkerConfig struct {
+	Path     string // Path to the booster-web executable, run with the worker command
+	MemLimit int64  // Memory limit of each worker in Bytes (0: unlimited)
+	Cgroup   string // cgroup (v2) directory in which a group is created per job (optional)
+}
+
+// Job sent to a worker on its standard input
+type WorkerJob struct {
+	Reffile  string `json:"reffile"`
+	Bootfile string `json:"bootfile"`
+	Threads  int    `json:"threads"`
+	MemLimit int64  `json:"memlimit"`
+}
+
+// Message sent by a worker on its standard output, one json object per line
+type WorkerMessage struct {
+	Type        string `json:"type"`
+	Nboot       int    `json:"nboot,omitempty"`
+	Status      int    `json:"status"`
+	Message     string `json:"message,omitempty"`
+	FbpTree     string `json:"fbptree,omitempty"`
+	TbeRawTree  string `json:"tberawtree,omitempty"`
+	TbeNormTree string `json:"tbenormtree,omitempty"`
+	TbeLogs     string `json:"tbelogs,omitempty"`
+	Partial     int    `json:"partialtrees,omitempty"`
+	Warning     string `json:"warning,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Runs booster jobs in worker subprocesses: a job exceeding its memory
+// limit or crashing fails alone without taking the server down.
+//
+// Must be called before InitProcessor.
+func (p *LocalProcessor) SetWorker(conf WorkerConfig) {
+	p.worker = &conf
+}
+
+// Computes the supports of the analysis in a worker subprocess.
+//
+// The worker is asked to stop when ctx is canceled, and is killed if it
+// does not send its partial results in time.
+func (p *LocalProcessor) computeSupportInWorker(ctx context.Context, a *model.Analysis, jobThreads int) (err error) {
+	var job []byte
+	var stdout goio.ReadCloser
+	var stderr bytes.Buffer
+	var done bool
+	var cgroup string
+
+	if job, err = json.Marshal(WorkerJob{
+		Reffile:  a.Reffile,
+		Bootfile: a.Bootfile,
+		Threads:  jobThreads,
+		MemLimit: p.worker.MemLimit,
+	}); err != nil {
+		return
+	}
+
+	cmd := exec.Command(p.worker.Path, WORKER_COMMAND, WORKER_JOB_COMMAND)
+	cmd.Stdin = bytes.NewReader(job)
+	cmd.Stderr = &stderr
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	log.Print(fmt.Sprintf("Analysis %s: worker started, pid=%d", a.Id, cmd.Process.Pid))
+
+	if p.worker.Cgroup != "" {
+		if cgroup, err = joinCgroup(p.worker.Cgroup, a.Id, cmd.Process.Pid, p.worker.MemLimit); err != nil {
+			log.Print(fmt.Sprintf("Analysis %s: cannot use cgroup: %s", a.Id, err.Error()))
+			err = nil
+		} else {
+			defer removeCgroup(cgroup)
+		}
+	}
+
+	exited := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// The worker cancels the computation and sends its partial results
+			if e := cmd.Process.Signal(syscall.SIGTERM); e != nil {
+				cmd.Process.Kill()
+				return
+			}
+			select {
+			case <-exited:
+			case <-time.After(WORKER_KILL_DELAY):
+				cmd.Process.Kill()
+			}
+		case <-exited:
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(stdout))
+	for {
+		var m WorkerMessage
+		if e := dec.Decode(&m); e != nil {
+			break
+		}
+		switch m.Type {
+		case WORKER_MSG_PROGRESS:
+			a.Nboot = m.Nboot
+		case WORKER_MSG_STEP:
+			a.Status = m.Status
+			a.Message = m.Message
+			a.FbpTree = m.FbpTree
+			a.TbeRawTree = m.TbeRawTree
+			a.TbeNormTree = m.TbeNormTree
+			a.TbeLogs = m.TbeLogs
+			a.PartialTrees = m.Partial
+			a.Warning = m.Warning
+			a.End = time.Now().Format(time.RFC1123)
+			p.db.UpdateAnalysis(a)
+		case WORKER_MSG_DONE:
+			a.Nboot = m.Nboot
+			done = true
+			if m.Error != "" {
+				err = errors.New(m.Error)
+			}
+		}
+	}
+	werr := cmd.Wait()
+	close(exited)
+
+	if done {
+		return
+	}
+	a.End = time.Now().Format(time.RFC1123)
+	if ctx.Err() != nil {
+		a.Status = model.STATUS_TIMEOUT
+		a.Message = "Time out: Job canceled"
+		return nil
+	}
+	errlog := lastLine(stderr.String())
+	log.Print(fmt.Sprintf("Analysis %s: worker failed: %v: %s", a.Id, werr, errlog))
+	if (cgroup != "" && cgroupOOMKilled(cgroup)) || strings.Contains(errlog, "out of memory") {
+		return errors.New("The job exceeded its memory limit")
+	}
+	return fmt.Errorf("The job stopped unexpectedly (%v)", werr)
+}
+
+// Runs the job read from in, and writes progress and results to out.
+//
+// Called by the worker command, in its own process: the memory limit
+// and the number of threads apply to the whole process.
+func RunWorker(in goio.Reader, out goio.Writer) (err error) {
+	var job WorkerJob
+	var lock sync.Mutex
+
+	if err = json.NewDecoder(in).Decode(&job); err != nil {
+		return
+	}
+	if job.MemLimit > 0 {
+		if err = setMemoryLimit(job.MemLimit); err != nil {
+			log.Print("Cannot set the memory limit of the worker: " + err.Error())
+			err = nil
+		}
+	}
+	if job.Threads <= 0 {
+		job.Threads = RUNNERS_JOBTHREADS_DEFAULT
+	}
+	runtime.GOMAXPROCS(job.Threads)
+
+	enc := json.NewEncoder(out)
+	send := func(m WorkerMessage) {
+		lock.Lock()
+		defer lock.Unlock()
+		if e := enc.Encode(m); e != nil {
+			log.Print(e)
+		}
+	}
+
+	sup := newSupportRun()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sigs
+		sup.Cancel()
+	}()
+
+	finished := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-finished:
+				return
+			case <-time.After(WORKER_PROGRESS_INTERVAL):
+				send(WorkerMessage{Type: WORKER_MSG_PROGRESS, Nboot: sup.Progress()})
+			}
+		}
+	}()
+
+	a := &model.Analysis{Reffile: job.Reffile, Bootfile: job.Bootfile, Status: model.STATUS_RUNNING}
+	e := computeSupport(sup, a, job.Threads, func(a *model.Analysis) {
+		send(WorkerMessage{
+			Type:        WORKER_MSG_STEP,
+			Status:      a.Status,
+			Message:     a.Message,
+			FbpTree:     a.FbpTree,
+			TbeRawTree:  a.TbeRawTree,
+			TbeNormTree: a.TbeNormTree,
+			TbeLogs:     a.TbeLogs,
+			Partial:     a.PartialTrees,
+			Warning:     a.Warning,
+		})
+	})
+	close(finished)
+
+	m := WorkerMessage{Type: WORKER_MSG_DONE, Nboot: sup.Progress()}
+	if e != nil {
+		m.Error = e.Error()
+	}
+	send(m)
+	return
+}
+
+// Creates the cgroup of the job in the given cgroup v2 directory,
+// limits its memory, and moves the worker process into it
+func joinCgroup(parent, id string, pid int, memlimit int64) (dir string, err error) {
+	dir = filepath.Join(parent, "booster-"+id)
+	if err = os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return
+	}
+	if memlimit > 0 {
+		if err = ioutil.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(memlimit, 10)), 0644); err != nil {
+			removeCgroup(dir)
+			return
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		removeCgroup(dir)
+	}
+	return
+}
+
+// Returns true if a process of the cgroup was killed by the OOM killer
+func cgroupOOMKilled(dir string) bool {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if cols := strings.Fields(line); len(cols) == 2 && cols[0] == "oom_kill" {
+			return cols[1] != "0"
+		}
+	}
+	return false
+}
+
+func removeCgroup(dir string) {
+	if err := os.Remove(dir); err != nil {
+		log.Print(err)
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
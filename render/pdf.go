@@ -0,0 +1,133 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+)
+
+// Canvas writing a single page PDF document, using the
+// standard Helvetica fonts (no font embedding needed).
+type PdfCanvas struct {
+	width, height float64
+	content       bytes.Buffer // page content stream
+}
+
+func NewPdfCanvas(width, height float64) *PdfCanvas {
+	return &PdfCanvas{width: width, height: height}
+}
+
+// PDF coordinates have their origin at the bottom left corner
+func (c *PdfCanvas) y(y float64) float64 {
+	return c.height - y
+}
+
+func (c *PdfCanvas) Line(x1, y1, x2, y2, width float64, col color.RGBA) {
+	fmt.Fprintf(&c.content, "%s RG %.2f w 1 J %.2f %.2f m %.2f %.2f l S\n", pdfColor(col), width, x1, c.y(y1), x2, c.y(y2))
+}
+
+func (c *PdfCanvas) Circle(x, y, r float64, col color.RGBA) {
+	// Circle approximated by 4 bezier curves
+	k := 0.5523 * r
+	cy := c.y(y)
+	fmt.Fprintf(&c.content, "%s rg %.2f %.2f m ", pdfColor(col), x+r, cy)
+	fmt.Fprintf(&c.content, "%.2f %.2f %.2f %.2f %.2f %.2f c ", x+r, cy+k, x+k, cy+r, x, cy+r)
+	fmt.Fprintf(&c.content, "%.2f %.2f %.2f %.2f %.2f %.2f c ", x-k, cy+r, x-r, cy+k, x-r, cy)
+	fmt.Fprintf(&c.content, "%.2f %.2f %.2f %.2f %.2f %.2f c ", x-r, cy-k, x-k, cy-r, x, cy-r)
+	fmt.Fprintf(&c.content, "%.2f %.2f %.2f %.2f %.2f %.2f c f\n", x+k, cy-r, x+r, cy-k, x+r, cy)
+}
+
+func (c *PdfCanvas) Rect(x, y, w, h float64, col color.RGBA) {
+	fmt.Fprintf(&c.content, "%s rg %.2f %.2f %.2f %.2f re f\n", pdfColor(col), x, c.y(y+h), w, h)
+}
+
+func (c *PdfCanvas) Text(x, y, size float64, col color.RGBA, anchor int, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	switch anchor {
+	case ANCHOR_MIDDLE:
+		x -= textWidth(text, size) / 2.0
+	case ANCHOR_END:
+		x -= textWidth(text, size)
+	}
+	fmt.Fprintf(&c.content, "BT %s rg /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", pdfColor(col), font, size, x, c.y(y), pdfEscape(text))
+}
+
+// Writes the whole PDF document: objects, cross reference table and trailer
+func (c *PdfCanvas) Write(w io.Writer) (err error) {
+	var doc bytes.Buffer
+	offsets := make([]int, 0)
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Contents 4 0 R /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> >>", math.Ceil(c.width), math.Ceil(c.height)),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", c.content.Len(), c.content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+
+	doc.WriteString("%PDF-1.4\n")
+	for i, o := range objects {
+		offsets = append(offsets, doc.Len())
+		fmt.Fprintf(&doc, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := doc.Len()
+	fmt.Fprintf(&doc, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&doc, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&doc, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	_, err = w.Write(doc.Bytes())
+	return
+}
+
+func pdfColor(c color.RGBA) string {
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(c.R)/255.0, float64(c.G)/255.0, float64(c.B)/255.0)
+}
+
+// Escapes PDF string special characters, and replaces non ASCII characters
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
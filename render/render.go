@@ -0,0 +1,431 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+// Package render draws trees for publication figures (SVG or PDF),
+// with options not available in gotree drawers: support based
+// branch coloring with a legend, and highlighting of selected taxa.
+package render
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/evolbioinfo/gotree/tree"
+)
+
+const (
+	LAYOUT_NORMAL   = "normal"
+	LAYOUT_CIRCULAR = "circular"
+	LAYOUT_RADIAL   = "radial"
+
+	FORMAT_SVG = "svg"
+	FORMAT_PDF = "pdf"
+
+	ANCHOR_START  = 0
+	ANCHOR_MIDDLE = 1
+	ANCHOR_END    = 2
+
+	fontSize     = 10.0
+	legendHeight = 40.0
+	margin       = 20.0
+)
+
+var (
+	black     = color.RGBA{0, 0, 0, 255}
+	grey      = color.RGBA{150, 150, 150, 255}
+	highlight = color.RGBA{214, 39, 40, 255}
+)
+
+// Drawing options
+type Options struct {
+	Width         float64         // Width of the image in pixels (points for pdf)
+	Height        float64         // Height of the image in pixels (points for pdf)
+	Layout        string          // normal, circular or radial
+	TipNames      bool            // Draw tip names
+	Supports      bool            // Draw support values of internal branches
+	Cutoff        float64         // Internal branches with support >= cutoff are marked (if ColorSupports is false)
+	ColorSupports bool            // Color branches by support and add a legend
+	Highlight     map[string]bool // Tips to highlight
+}
+
+// Low level drawing primitives, implemented for SVG and PDF.
+//
+// Coordinates have their origin at the top left corner.
+type Canvas interface {
+	Line(x1, y1, x2, y2, width float64, c color.RGBA)
+	Circle(x, y, r float64, c color.RGBA)
+	Rect(x, y, w, h float64, c color.RGBA)
+	Text(x, y, size float64, c color.RGBA, anchor int, bold bool, text string)
+	Write(w io.Writer) error
+}
+
+// Node coordinates and angles computed by layouts
+type position struct {
+	x, y   float64
+	angle  float64 // angle of the node (circular & radial layouts)
+	radius float64 // distance to the center (circular layout)
+}
+
+// Draws the tree t to w, in the given format (svg or pdf)
+func Draw(w io.Writer, t *tree.Tree, format string, opts Options) (err error) {
+	var c Canvas
+
+	if opts.Width <= 0 || opts.Height <= 0 {
+		return errors.New("Image dimensions must be > 0")
+	}
+
+	switch format {
+	case FORMAT_SVG:
+		c = NewSvgCanvas(opts.Width, opts.Height)
+	case FORMAT_PDF:
+		c = NewPdfCanvas(opts.Width, opts.Height)
+	default:
+		return fmt.Errorf("Image format not supported: %s", format)
+	}
+
+	if err = DrawTree(c, t, opts); err != nil {
+		return
+	}
+	return c.Write(w)
+}
+
+// Draws the tree t on the given canvas
+func DrawTree(c Canvas, t *tree.Tree, opts Options) (err error) {
+	var pos map[*tree.Node]*position
+	var labelspace float64
+
+	if opts.TipNames {
+		for _, n := range t.Tips() {
+			labelspace = math.Max(labelspace, textWidth(n.Name(), fontSize))
+		}
+		labelspace += 5
+	}
+
+	bottom := opts.Height - margin
+	if opts.ColorSupports {
+		bottom -= legendHeight
+	}
+	x0, y0, x1, y1 := margin, margin, opts.Width-margin, bottom
+
+	switch opts.Layout {
+	case LAYOUT_NORMAL, "":
+		pos = normalLayout(t, x0, y0, x1-labelspace, y1)
+	case LAYOUT_CIRCULAR:
+		pos = circularLayout(t, x0+labelspace, y0+labelspace, x1-labelspace, y1-labelspace)
+	case LAYOUT_RADIAL:
+		pos = radialLayout(t, x0+labelspace, y0+labelspace, x1-labelspace, y1-labelspace)
+	default:
+		return fmt.Errorf("Tree layout not recognized: %s", opts.Layout)
+	}
+
+	drawBranches(c, t.Root(), nil, pos, opts)
+	drawLabels(c, t.Root(), nil, pos, opts)
+	if opts.ColorSupports {
+		drawLegend(c, margin, opts.Height-margin-legendHeight+10)
+	}
+	return
+}
+
+// Color of a branch with the given support in a red (0) - yellow (0.5) - green (1) gradient
+func SupportColor(support float64) color.RGBA {
+	s := math.Max(0, math.Min(1, support))
+	if s < 0.5 {
+		return color.RGBA{215, uint8(48 + s*2*(191-48)), 39, 255}
+	}
+	return color.RGBA{uint8(215 - (s-0.5)*2*(215-26)), uint8(191 - (s-0.5)*2*(191-150)), uint8(39 + (s-0.5)*2*(65-39)), 255}
+}
+
+// Branch lengths of the tree if all are defined, 1 otherwise
+func branchLength(e *tree.Edge, uselengths bool) float64 {
+	if uselengths {
+		return e.Length()
+	}
+	return 1.0
+}
+
+func useLengths(t *tree.Tree) bool {
+	for _, e := range t.Edges() {
+		if e.Length() == tree.NIL_LENGTH {
+			return false
+		}
+	}
+	return true
+}
+
+// Computes node depths (distance to root), and returns the max depth
+func depths(cur, prev *tree.Node, depth float64, uselengths bool, d map[*tree.Node]float64) (max float64) {
+	d[cur] = depth
+	max = depth
+	for i, n := range cur.Neigh() {
+		if n != prev {
+			max = math.Max(max, depths(n, cur, depth+branchLength(cur.Edges()[i], uselengths), uselengths, d))
+		}
+	}
+	return
+}
+
+// Returns the tips in traversal order
+func tipOrder(cur, prev *tree.Node, tips []*tree.Node) []*tree.Node {
+	if cur.Tip() {
+		return append(tips, cur)
+	}
+	for _, n := range cur.Neigh() {
+		if n != prev {
+			tips = tipOrder(n, cur, tips)
+		}
+	}
+	return tips
+}
+
+// Tips evenly spaced along one axis (rank), internal nodes in the middle of their children
+func ranks(cur, prev *tree.Node, r map[*tree.Node]float64) float64 {
+	if cur.Tip() {
+		return r[cur]
+	}
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, n := range cur.Neigh() {
+		if n != prev {
+			v := ranks(n, cur, r)
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+	}
+	r[cur] = (min + max) / 2.0
+	return r[cur]
+}
+
+func normalLayout(t *tree.Tree, x0, y0, x1, y1 float64) (pos map[*tree.Node]*position) {
+	pos = make(map[*tree.Node]*position)
+	d := make(map[*tree.Node]float64)
+	r := make(map[*tree.Node]float64)
+	maxdepth := depths(t.Root(), nil, 0, useLengths(t), d)
+	if maxdepth == 0 {
+		maxdepth = 1
+	}
+	tips := tipOrder(t.Root(), nil, nil)
+	for i, n := range tips {
+		r[n] = float64(i)
+	}
+	ranks(t.Root(), nil, r)
+	step := (y1 - y0) / math.Max(1, float64(len(tips)-1))
+	for n, depth := range d {
+		pos[n] = &position{x: x0 + (x1-x0)*depth/maxdepth, y: y0 + r[n]*step}
+	}
+	return
+}
+
+func circularLayout(t *tree.Tree, x0, y0, x1, y1 float64) (pos map[*tree.Node]*position) {
+	pos = make(map[*tree.Node]*position)
+	d := make(map[*tree.Node]float64)
+	r := make(map[*tree.Node]float64)
+	maxdepth := depths(t.Root(), nil, 0, useLengths(t), d)
+	if maxdepth == 0 {
+		maxdepth = 1
+	}
+	tips := tipOrder(t.Root(), nil, nil)
+	for i, n := range tips {
+		r[n] = float64(i)
+	}
+	ranks(t.Root(), nil, r)
+	cx, cy := (x0+x1)/2.0, (y0+y1)/2.0
+	radius := math.Min(x1-x0, y1-y0) / 2.0
+	for n, depth := range d {
+		a := 2 * math.Pi * r[n] / float64(len(tips))
+		rad := radius * depth / maxdepth
+		pos[n] = &position{x: cx + rad*math.Cos(a), y: cy + rad*math.Sin(a), angle: a, radius: rad}
+	}
+	return
+}
+
+// Equal angle algorithm: each subtree gets an angle proportional to its number of tips
+func radialLayout(t *tree.Tree, x0, y0, x1, y1 float64) (pos map[*tree.Node]*position) {
+	pos = make(map[*tree.Node]*position)
+	uselengths := useLengths(t)
+	ntips := make(map[*tree.Node]int)
+	countTips(t.Root(), nil, ntips)
+	pos[t.Root()] = &position{}
+	radialPositions(t.Root(), nil, 0, 2*math.Pi, ntips, uselengths, pos)
+
+	minx, miny, maxx, maxy := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range pos {
+		minx, maxx = math.Min(minx, p.x), math.Max(maxx, p.x)
+		miny, maxy = math.Min(miny, p.y), math.Max(maxy, p.y)
+	}
+	scale := math.Min((x1-x0)/math.Max(maxx-minx, 1e-9), (y1-y0)/math.Max(maxy-miny, 1e-9))
+	for _, p := range pos {
+		p.x = x0 + (p.x-minx)*scale
+		p.y = y0 + (p.y-miny)*scale
+	}
+	return
+}
+
+func countTips(cur, prev *tree.Node, ntips map[*tree.Node]int) int {
+	if cur.Tip() {
+		ntips[cur] = 1
+		return 1
+	}
+	total := 0
+	for _, n := range cur.Neigh() {
+		if n != prev {
+			total += countTips(n, cur, ntips)
+		}
+	}
+	ntips[cur] = total
+	return total
+}
+
+func radialPositions(cur, prev *tree.Node, start, wedge float64, ntips map[*tree.Node]int, uselengths bool, pos map[*tree.Node]*position) {
+	p := pos[cur]
+	total := float64(ntips[cur])
+	for i, n := range cur.Neigh() {
+		if n == prev {
+			continue
+		}
+		w := wedge * float64(ntips[n]) / total
+		a := start + w/2.0
+		l := branchLength(cur.Edges()[i], uselengths)
+		pos[n] = &position{x: p.x + l*math.Cos(a), y: p.y + l*math.Sin(a), angle: a}
+		radialPositions(n, cur, start, w, ntips, uselengths, pos)
+		start += w
+	}
+}
+
+func drawBranches(c Canvas, cur, prev *tree.Node, pos map[*tree.Node]*position, opts Options) {
+	p := pos[cur]
+	minangle, maxangle := math.Inf(1), math.Inf(-1)
+	miny, maxy := p.y, p.y
+	for i, n := range cur.Neigh() {
+		if n == prev {
+			continue
+		}
+		e := cur.Edges()[i]
+		col, width := black, 1.0
+		if opts.ColorSupports && !n.Tip() && e.Support() != tree.NIL_SUPPORT {
+			col, width = SupportColor(e.Support()), 2.0
+		}
+		if n.Tip() && opts.Highlight[n.Name()] {
+			col, width = highlight, 2.0
+		}
+		cp := pos[n]
+		switch opts.Layout {
+		case LAYOUT_CIRCULAR:
+			// Radial segment from the parent radius to the child
+			rp := p.radius
+			cx, cy := center(p)
+			c.Line(cx+rp*math.Cos(cp.angle), cy+rp*math.Sin(cp.angle), cp.x, cp.y, width, col)
+			minangle = math.Min(minangle, cp.angle)
+			maxangle = math.Max(maxangle, cp.angle)
+		case LAYOUT_RADIAL:
+			c.Line(p.x, p.y, cp.x, cp.y, width, col)
+		default:
+			c.Line(p.x, cp.y, cp.x, cp.y, width, col)
+			miny = math.Min(miny, cp.y)
+			maxy = math.Max(maxy, cp.y)
+		}
+		if !opts.ColorSupports && !n.Tip() && e.Support() != tree.NIL_SUPPORT && e.Support() >= opts.Cutoff {
+			c.Circle(cp.x, cp.y, 2.5, highlight)
+		}
+		drawBranches(c, n, cur, pos, opts)
+	}
+	switch opts.Layout {
+	case LAYOUT_CIRCULAR:
+		if maxangle > minangle {
+			rp := p.radius
+			cx, cy := center(p)
+			steps := int(math.Max(2, (maxangle-minangle)*rp/2))
+			for i := 0; i < steps; i++ {
+				a1 := minangle + (maxangle-minangle)*float64(i)/float64(steps)
+				a2 := minangle + (maxangle-minangle)*float64(i+1)/float64(steps)
+				c.Line(cx+rp*math.Cos(a1), cy+rp*math.Sin(a1), cx+rp*math.Cos(a2), cy+rp*math.Sin(a2), 1.0, black)
+			}
+		}
+	case LAYOUT_RADIAL:
+	default:
+		if maxy > miny {
+			c.Line(p.x, miny, p.x, maxy, 1.0, black)
+		}
+	}
+}
+
+// In the circular layout, all nodes are at their radius from the center,
+// at their angle: we find the center back from any node position
+func center(p *position) (x, y float64) {
+	return p.x - p.radius*math.Cos(p.angle), p.y - p.radius*math.Sin(p.angle)
+}
+
+func drawLabels(c Canvas, cur, prev *tree.Node, pos map[*tree.Node]*position, opts Options) {
+	p := pos[cur]
+	if cur.Tip() {
+		if !opts.TipNames && !opts.Highlight[cur.Name()] {
+			return
+		}
+		col := black
+		bold := false
+		if opts.Highlight[cur.Name()] {
+			col, bold = highlight, true
+		}
+		switch opts.Layout {
+		case LAYOUT_CIRCULAR, LAYOUT_RADIAL:
+			anchor := ANCHOR_START
+			dx := 4 * math.Cos(p.angle)
+			if math.Cos(p.angle) < 0 {
+				anchor = ANCHOR_END
+			}
+			c.Text(p.x+dx, p.y+4*math.Sin(p.angle)+fontSize/3, fontSize, col, anchor, bold, cur.Name())
+		default:
+			c.Text(p.x+4, p.y+fontSize/3, fontSize, col, ANCHOR_START, bold, cur.Name())
+		}
+		return
+	}
+	for i, n := range cur.Neigh() {
+		if n == prev {
+			continue
+		}
+		if e := cur.Edges()[i]; opts.Supports && !n.Tip() && e.Support() != tree.NIL_SUPPORT {
+			np := pos[n]
+			c.Text(np.x-2, np.y-2, fontSize*0.8, grey, ANCHOR_END, false, fmt.Sprintf("%.2f", e.Support()))
+		}
+		drawLabels(c, n, cur, pos, opts)
+	}
+}
+
+func drawLegend(c Canvas, x, y float64) {
+	const nboxes = 20
+	const boxwidth = 10.0
+	c.Text(x, y+8, fontSize, black, ANCHOR_START, false, "Support")
+	x += 50
+	for i := 0; i < nboxes; i++ {
+		c.Rect(x+float64(i)*boxwidth, y, boxwidth, 10, SupportColor(float64(i)/float64(nboxes-1)))
+	}
+	for _, v := range []float64{0, 0.5, 1} {
+		c.Text(x+v*nboxes*boxwidth, y+22, fontSize*0.8, black, ANCHOR_MIDDLE, false, fmt.Sprintf("%.1f", v))
+	}
+}
+
+// Approximate width of a text (average Helvetica glyph width)
+func textWidth(text string, size float64) float64 {
+	return float64(len(text)) * size * 0.55
+}
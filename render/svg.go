@@ -0,0 +1,84 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image/color"
+	"io"
+)
+
+// Canvas writing an SVG image
+type SvgCanvas struct {
+	width, height float64
+	buf           bytes.Buffer
+}
+
+func NewSvgCanvas(width, height float64) *SvgCanvas {
+	c := &SvgCanvas{width: width, height: height}
+	fmt.Fprintf(&c.buf, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%.0f\" height=\"%.0f\" viewBox=\"0 0 %.0f %.0f\">\n", width, height, width, height)
+	fmt.Fprintf(&c.buf, "<rect width=\"100%%\" height=\"100%%\" fill=\"white\"/>\n")
+	return c
+}
+
+func (c *SvgCanvas) Line(x1, y1, x2, y2, width float64, col color.RGBA) {
+	fmt.Fprintf(&c.buf, "<line x1=\"%.2f\" y1=\"%.2f\" x2=\"%.2f\" y2=\"%.2f\" stroke=\"%s\" stroke-width=\"%.1f\" stroke-linecap=\"round\"/>\n", x1, y1, x2, y2, svgColor(col), width)
+}
+
+func (c *SvgCanvas) Circle(x, y, r float64, col color.RGBA) {
+	fmt.Fprintf(&c.buf, "<circle cx=\"%.2f\" cy=\"%.2f\" r=\"%.2f\" fill=\"%s\"/>\n", x, y, r, svgColor(col))
+}
+
+func (c *SvgCanvas) Rect(x, y, w, h float64, col color.RGBA) {
+	fmt.Fprintf(&c.buf, "<rect x=\"%.2f\" y=\"%.2f\" width=\"%.2f\" height=\"%.2f\" fill=\"%s\"/>\n", x, y, w, h, svgColor(col))
+}
+
+func (c *SvgCanvas) Text(x, y, size float64, col color.RGBA, anchor int, bold bool, text string) {
+	anchorstr := "start"
+	switch anchor {
+	case ANCHOR_MIDDLE:
+		anchorstr = "middle"
+	case ANCHOR_END:
+		anchorstr = "end"
+	}
+	weight := "normal"
+	if bold {
+		weight = "bold"
+	}
+	fmt.Fprintf(&c.buf, "<text x=\"%.2f\" y=\"%.2f\" font-family=\"Helvetica,Arial,sans-serif\" font-size=\"%.1f\" font-weight=\"%s\" fill=\"%s\" text-anchor=\"%s\">%s</text>\n", x, y, size, weight, svgColor(col), anchorstr, html.EscapeString(text))
+}
+
+func (c *SvgCanvas) Write(w io.Writer) (err error) {
+	if _, err = w.Write(c.buf.Bytes()); err != nil {
+		return
+	}
+	_, err = io.WriteString(w, "</svg>\n")
+	return
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,301 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/evolbioinfo/booster-web/io"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/monitoring"
+)
+
+const API_V1_PREFIX = "/api/v1"
+
+// Versioned api of booster-web. Errors are returned with the
+// appropriate http status and a json body:
+// {"error": {"code": "<API_ERROR_* code>", "message": "..."}}
+//
+// Endpoints:
+//   - POST   /analyses                       : New analysis (multipart form as /run), 201
+//   - GET    /analyses/{id}                  : Analysis
+//   - POST   /analyses/{id}/resubmit         : New analysis with the inputs of the ended analysis, 201
+//   - GET    /analyses/{id}/image            : Tree image (collapse, layout, algorithm, format + image parameters)
+//   - GET    /analyses/{id}/itol             : iTOL zip archive (algorithm, cutoff)
+//   - GET    /analyses/{id}/compare/{other}  : Comparison of two analyses (algorithm1, algorithm2, cutoff, format)
+//   - POST   /validate                       : Validation report of input files (multipart form as /run)
+//   - GET    /runname                        : Random run name
+//   - GET    /status                         : Server status
+//   - POST   /token                          : Api token, json body {"username": "", "password": ""}
+//   - GET    /monitor                        : Monitoring information (admin)
+//   - GET|POST|DELETE /maintenance          : Maintenance status, enter, leave (admin)
+func newApiV1Router() *apiRouter {
+	rt := newApiRouter(API_V1_PREFIX)
+	rt.handle(http.MethodPost, "/analyses", authApiV1(apiV1SubmitHandler, false))
+	rt.handle(http.MethodGet, "/analyses/{id}", authApiV1(apiV1AnalysisHandler, false))
+	rt.handle(http.MethodPost, "/analyses/{id}/resubmit", authApiV1(apiV1ResubmitHandler, false))
+	rt.handle(http.MethodGet, "/analyses/{id}/image", authApiV1(apiV1ImageHandler, false))
+	rt.handle(http.MethodGet, "/analyses/{id}/itol", authApiV1(apiV1ItolHandler, false))
+	rt.handle(http.MethodGet, "/analyses/{id}/compare/{other}", authApiV1(apiV1CompareHandler, false))
+	rt.handle(http.MethodPost, "/validate", authApiV1(apiV1ValidateHandler, false))
+	rt.handle(http.MethodGet, "/runname", authApiV1(apiV1RunNameHandler, false))
+	rt.handle(http.MethodGet, "/status", authApiV1(apiV1StatusHandler, false))
+	rt.handle(http.MethodPost, "/token", apiV1TokenHandler)
+	rt.handle(http.MethodGet, "/monitor", authApiV1(apiV1MonitorHandler, true))
+	rt.handle(http.MethodGet, "/maintenance", authApiV1(apiV1MaintenanceHandler, true))
+	rt.handle(http.MethodPost, "/maintenance", authApiV1(apiV1EnterMaintenanceHandler, true))
+	rt.handle(http.MethodDelete, "/maintenance", authApiV1(apiV1LeaveMaintenanceHandler, true))
+	return rt
+}
+
+// Returns the value of the query parameter name, or def if not given.
+// If values are given, the value must be one of them.
+func queryParam(r *http.Request, name, def string, values ...string) (string, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	if len(values) == 0 {
+		return v, nil
+	}
+	for _, val := range values {
+		if v == val {
+			return v, nil
+		}
+	}
+	return "", badRequest(fmt.Errorf("Wrong value of parameter %s: %s (must be one of %v)", name, v, values))
+}
+
+// Returns the value of the float query parameter name, or def if not
+// given. The value must be in [min,max].
+func queryFloat(r *http.Request, name string, def, min, max float64) (float64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < min || f > max {
+		return 0, badRequest(fmt.Errorf("Wrong value of parameter %s: %s (must be a number in [%v,%v])", name, v, min, max))
+	}
+	return f, nil
+}
+
+// Writes a 503 error with a Retry-After header, and returns true, if new
+// analyses are refused
+func refuseV1Submission(w http.ResponseWriter) bool {
+	retry, err := submissionRefusal()
+	if err == nil {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	apiV1Error(w, err)
+	return true
+}
+
+func apiV1SubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if refuseV1Submission(w) {
+		return
+	}
+	a, err := submitForm(r)
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	w.Header().Set("Location", API_V1_PREFIX+"/analyses/"+a.Id)
+	apiV1Json(w, http.StatusCreated, a)
+}
+
+func apiV1AnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := getAnalysis(pathParam(r, "id"))
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	apiV1Json(w, http.StatusOK, a)
+}
+
+func apiV1ResubmitHandler(w http.ResponseWriter, r *http.Request) {
+	var a *model.Analysis
+	var err error
+
+	if refuseV1Submission(w) {
+		return
+	}
+	if a, err = resubmitAnalysis(pathParam(r, "id")); err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	w.Header().Set("Location", API_V1_PREFIX+"/analyses/"+a.Id)
+	apiV1Json(w, http.StatusCreated, a)
+}
+
+// Query parameters, in addition to the ones of apiImageHandler:
+// collapse (default 0), layout: radial|circular|normal (default radial),
+// algorithm: tbe|fbp (default tbe), format: svg|png|pdf (default svg)
+func apiV1ImageHandler(w http.ResponseWriter, r *http.Request) {
+	var collapse float64
+	var layout, algorithm, format string
+	var err error
+
+	if collapse, err = queryFloat(r, "collapse", 0, 0, 100); err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	if layout, err = queryParam(r, "layout", "radial", "radial", "circular", "normal"); err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	if algorithm, err = queryParam(r, "algorithm", "tbe", "tbe", "fbp"); err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	if format, err = queryParam(r, "format", "svg", "svg", "png", "pdf"); err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	if err = writeTreeImage(w, r, pathParam(r, "id"), collapse, layout, algorithm, format); err != nil {
+		apiV1Error(w, err)
+	}
+}
+
+// Query parameters: algorithm: tbe|fbp (default tbe), cutoff (default 0.7)
+func apiV1ItolHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	id := pathParam(r, "id")
+	algorithm, err := queryParam(r, "algorithm", "tbe", "tbe", "fbp")
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	if err = itolZip(&buf, r, id, algorithm); err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%s_itol.zip\"", id, algorithm))
+	if _, err = buf.WriteTo(w); err != nil {
+		io.LogError(err)
+	}
+}
+
+// Query parameters: see compareAnalyses, and format: json|svg (default json)
+func apiV1CompareHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := queryParam(r, "format", "json", "json", "svg")
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	c, err := compareAnalyses(r, pathParam(r, "id"), pathParam(r, "other"))
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(c.TanglegramSvg())
+		return
+	}
+	apiV1Json(w, http.StatusOK, c)
+}
+
+func apiV1ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := validateForm(r)
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	apiV1Json(w, http.StatusOK, report)
+}
+
+func apiV1RunNameHandler(w http.ResponseWriter, r *http.Request) {
+	apiV1Json(w, http.StatusOK, struct {
+		RunName string `json:"runname"`
+	}{generateRunName()})
+}
+
+func apiV1StatusHandler(w http.ResponseWriter, r *http.Request) {
+	apiV1Json(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"OK"})
+}
+
+func apiV1TokenHandler(w http.ResponseWriter, r *http.Request) {
+	var auth AuthJson
+	if err := json.NewDecoder(r.Body).Decode(&auth); err != nil {
+		apiV1Error(w, badRequest(err))
+		return
+	}
+	token, err := newApiToken(auth.Username, auth.Password)
+	if err != nil {
+		apiV1Error(w, newRequestError(http.StatusUnauthorized, API_ERROR_UNAUTHORIZED, err))
+		return
+	}
+	apiV1Json(w, http.StatusOK, struct {
+		Token string `json:"token"`
+	}{token})
+}
+
+func apiV1MonitorHandler(w http.ResponseWriter, r *http.Request) {
+	monitorInfo, err := monitoring.Monitor(db)
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	monitorInfo.Histories = historyUsage()
+	apiV1Json(w, http.StatusOK, monitorInfo)
+}
+
+func apiV1MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	apiV1Json(w, http.StatusOK, maintenanceStatus())
+}
+
+// Json body: see apiMaintenanceHandler
+func apiV1EnterMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var win MaintenanceWindow
+	if err := json.NewDecoder(r.Body).Decode(&win); err != nil {
+		apiV1Error(w, badRequest(err))
+		return
+	}
+	if err := enterMaintenance(win); err != nil {
+		apiV1Error(w, badRequest(err))
+		return
+	}
+	apiV1Json(w, http.StatusOK, maintenanceStatus())
+}
+
+// Query parameter: all=true to cancel upcoming windows too
+func apiV1LeaveMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := queryParam(r, "all", "false", "true", "false")
+	if err != nil {
+		apiV1Error(w, err)
+		return
+	}
+	leaveMaintenance(all == "true")
+	apiV1Json(w, http.StatusOK, maintenanceStatus())
+}
@@ -24,6 +24,8 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -36,13 +38,20 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/evolbioinfo/booster-web/comparison"
 	"github.com/evolbioinfo/booster-web/io"
+	"github.com/evolbioinfo/booster-web/itol"
 	"github.com/evolbioinfo/booster-web/model"
 	"github.com/evolbioinfo/booster-web/monitoring"
+	"github.com/evolbioinfo/booster-web/render"
 	"github.com/evolbioinfo/booster-web/templates"
 	"github.com/evolbioinfo/booster-web/utils"
+	"github.com/evolbioinfo/booster-web/validation"
+	"github.com/evolbioinfo/booster-web/workflow"
+	autils "github.com/evolbioinfo/goalign/io/utils"
 	"github.com/evolbioinfo/gotree/draw"
 	"github.com/evolbioinfo/gotree/io/newick"
+	"github.com/evolbioinfo/gotree/tree"
 	"github.com/evolbioinfo/gotree/upload"
 )
 
@@ -62,7 +71,11 @@ type GenericResponse struct {
 // Global informations about server given to different templates
 type GlobalInformation struct {
 	GalaxyProcessor   bool
+	TreeInference     bool
 	EmailNotification bool
+	Workflows         []*workflow.Workflow // Available phylogenetic workflows
+	Aligners          map[string]string    // Available aligners, key: tool key, value: tool name
+	Trimmers          map[string]string    // Available trimming tools, key: tool key, value: tool name
 }
 
 func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
@@ -117,24 +130,14 @@ func helpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-
-	if t, err := getTemplate("maintenance"); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else {
-		if err := t.ExecuteTemplate(w, "layout", nil); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-	}
-}
-
 func monitorHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var monitorInfo *monitoring.MonitorInformation
 
 	if monitorInfo, err = monitoring.Monitor(db); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		monitorInfo.Histories = historyUsage()
 	}
 
 	w.Header().Set("Content-Type", "text/html")
@@ -168,6 +171,44 @@ func viewHandler(w http.ResponseWriter, r *http.Request, id string) {
 	}
 }
 
+// Resubmits the inputs of an ended analysis in a new analysis,
+// and redirects to the new analysis
+func resubmitHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := resubmitAnalysis(id)
+	if err != nil {
+		err = errors.New("Error while resubmitting the analysis: " + err.Error())
+		io.LogError(err)
+		errorHandler(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/view/"+a.Id, http.StatusSeeOther)
+}
+
+// Compares the supports of two analyses
+func compareHandler(w http.ResponseWriter, r *http.Request, id1, id2 string) {
+	var c *comparison.ComparisonInformation
+	var err error
+
+	if c, err = compareAnalyses(r, id1, id2); err != nil {
+		io.LogError(err)
+		errorHandler(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if t, err := getTemplate("compare"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		if err := t.ExecuteTemplate(w, "layout", c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
 // if rawsupports: Then the tree with raw distances and branch ids is uploaded to itol
 // else the normalized support tree is upploaded.
 func itolHandler(w http.ResponseWriter, r *http.Request, id string, rawdistances bool, fbptree bool) {
@@ -178,7 +219,8 @@ func itolHandler(w http.ResponseWriter, r *http.Request, id string, rawdistances
 		return
 	}
 	if a.Status == model.STATUS_FINISHED || a.Status == model.STATUS_TIMEOUT {
-		upld := upload.NewItolUploader(iTOLKey, iTOLProject)
+		key, project := userItolAccount(r)
+		upld := upload.NewItolUploader(key, project)
 		var uptree string
 		if fbptree {
 			uptree = a.FbpTree
@@ -193,7 +235,7 @@ func itolHandler(w http.ResponseWriter, r *http.Request, id string, rawdistances
 			url, _, err := upld.UploadNewick(a.Id, t.Newick())
 			if err != nil {
 				io.LogError(err)
-				errorHandler(w, r, err)
+				errorHandler(w, r, fmt.Errorf("Upload to iTOL failed (%v), iTOL annotation files may still be downloaded from the results page", err))
 				return
 			}
 			http.Redirect(w, r, url, http.StatusSeeOther)
@@ -210,11 +252,41 @@ func itolHandler(w http.ResponseWriter, r *http.Request, id string, rawdistances
 	return
 }
 
+// Returns the aligners and the trimming tools available with the processor
+func availableAlignmentTools() (aligners, trimmers map[string]string) {
+	aligners = make(map[string]string)
+	trimmers = make(map[string]string)
+	for _, t := range aligntools {
+		if model.IsAligner(t) {
+			aligners[t] = model.AlignToolName(t)
+		} else if model.IsTrimmer(t) {
+			trimmers[t] = model.AlignToolName(t)
+		}
+	}
+	return
+}
+
+// Returns the definitions of the workflows available with the processor
+func availableWorkflows() (available []*workflow.Workflow) {
+	available = make([]*workflow.Workflow, 0, len(workflows))
+	for _, id := range workflows {
+		if w, ok := registry.Get(id); ok {
+			available = append(available, w)
+		}
+	}
+	return
+}
+
 func newHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
+	aligners, trimmers := availableAlignmentTools()
 	info := GlobalInformation{
 		GalaxyProcessor:   galaxyprocessor,
+		TreeInference:     treeinference,
 		EmailNotification: emailnotification,
+		Workflows:         availableWorkflows(),
+		Aligners:          aligners,
+		Trimmers:          trimmers,
 	}
 
 	if t, err := getTemplate("inputform"); err != nil {
@@ -227,25 +299,34 @@ func newHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func runHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := submitForm(r)
+	if err != nil {
+		io.LogError(err)
+		errorHandler(w, r, err)
+		//http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/view/"+a.Id, http.StatusSeeOther)
+}
+
+// Creates and launches a new analysis from the input files and options
+// given in the multipart form
+func submitForm(r *http.Request) (a *model.Analysis, err error) {
 	var refalign multipart.File
 	var refalignhandler *multipart.FileHeader
 	var reftree multipart.File
 	var refhandler *multipart.FileHeader
 	var boottree multipart.File
 	var boothandler *multipart.FileHeader
-	var err error
-	var a *model.Analysis
 	var nbootint int64
 	var nbootrep string
 	var workflow string
 	var email string
 	var runname string
 
-	parserr := r.ParseMultipartForm(32 << 20)
-	if parserr != nil {
-		io.LogError(parserr)
-		errorHandler(w, r, parserr)
-		return
+	if err = r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, badRequest(err)
 	}
 
 	if refalign, refalignhandler, err = r.FormFile("refalign"); err != nil || refalignhandler.Size == 0 {
@@ -255,44 +336,112 @@ func runHandler(w http.ResponseWriter, r *http.Request) {
 		// No given sequence file
 		// Then we take tree files
 		if reftree, refhandler, err = r.FormFile("reftree"); err != nil || refhandler.Size == 0 {
-			err = errors.New("No reference tree file given (nor sequence file): ")
-			io.LogError(err)
-			errorHandler(w, r, err)
-			return
+			return nil, badRequest(errors.New("No reference tree file given (nor sequence file)"))
 		}
 		defer reftree.Close()
 
 		if boottree, boothandler, err = r.FormFile("boottrees"); err != nil || boothandler.Size == 0 {
-			err = errors.New("No bootstrap tree file given (nor sequence file): " + err.Error())
-			io.LogError(err)
-			errorHandler(w, r, err)
-			return
+			return nil, badRequest(errors.New("No bootstrap tree file given (nor sequence file)"))
 		}
 		defer boottree.Close()
+	} else {
+		defer refalign.Close()
 	}
 	email = r.FormValue("email")
 	runname = r.FormValue("runname")
 	workflow = r.FormValue("workflow")
 
 	nbootrep = r.FormValue("nboot")
-	if nbootint, err = strconv.ParseInt(nbootrep, 10, 64); err != nil && galaxyprocessor {
-		io.LogError(err)
-		errorHandler(w, r, err)
-		return
+	if nbootint, err = strconv.ParseInt(nbootrep, 10, 64); err != nil && treeinference {
+		return nil, badRequest(fmt.Errorf("Wrong number of bootstrap replicates: %s", nbootrep))
 	}
 	if nbootint > 1000 {
 		nbootint = 1000
 	}
 
-	if a, err = newAnalysis(refalign, refalignhandler, reftree, refhandler, boottree, boothandler, email, runname, int(nbootint), workflow); err != nil {
-		err = errors.New("Error while creating a new analysis: " + err.Error())
-		io.LogError(err)
-		errorHandler(w, r, err)
-		//http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Workflow options are given as <workflow key>.<option name>
+	options := make(map[string]string)
+	if wf, ok := registry.ByName(workflow); ok {
+		for _, o := range wf.Options {
+			options[o.Name] = r.FormValue(wf.Key + "." + o.Name)
+		}
+	}
+
+	if a, err = newAnalysis(refalign, refalignhandler, reftree, refhandler, boottree, boothandler, email, runname, int(nbootint), workflow, options,
+		r.FormValue("aligner"), r.FormValue("trimmer")); err != nil {
+		status, code := errorStatus(err)
+		return nil, newRequestError(status, code, errors.New("Error while creating a new analysis: "+err.Error()))
+	}
+	return a, nil
+}
+
+// Dry run: checks the input files given in the same multipart
+// form as /run, and returns the validation report in json, without
+// launching any analysis.
+func apiValidateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		apiError(w, errors.New("Validation must be requested with POST"))
+		return
+	}
+	report, err := validateForm(r)
+	if err != nil {
+		status, _ := errorStatus(err)
+		w.WriteHeader(status)
+		apiError(w, err)
 		return
 	}
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		io.LogError(err)
+	}
+}
 
-	http.Redirect(w, r, "/view/"+a.Id, http.StatusSeeOther)
+// Checks the input files given in the multipart form, and returns
+// the validation report. Missing or unreadable files give errors.
+func validateForm(r *http.Request) (report *validation.Report, err error) {
+	var refalign, reftree, boottree multipart.File
+	var refalignhandler, refhandler, boothandler *multipart.FileHeader
+	var nboot int
+
+	if err = r.ParseMultipartForm(32 << 20); err != nil {
+		io.LogError(err)
+		return nil, badRequest(err)
+	}
+	if nbootrep := r.FormValue("nboot"); nbootrep != "" {
+		if nboot, err = strconv.Atoi(nbootrep); err != nil {
+			return nil, badRequest(fmt.Errorf("Wrong number of bootstrap replicates: %s", nbootrep))
+		}
+	}
+
+	report = validation.NewReport(nboot)
+	if refalign, refalignhandler, err = r.FormFile("refalign"); err == nil && refalignhandler.Size > 0 {
+		defer refalign.Close()
+		if r.FormValue("aligner") != "" {
+			report.CheckSequences(refalign, autils.GzipExtension(refalignhandler.Filename))
+		} else {
+			report.CheckAlignment(refalign, autils.GzipExtension(refalignhandler.Filename))
+		}
+	} else {
+		if reftree, refhandler, err = r.FormFile("reftree"); err != nil || refhandler.Size == 0 {
+			return nil, badRequest(errors.New("No reference tree file given (nor sequence file)"))
+		}
+		defer reftree.Close()
+		if boottree, boothandler, err = r.FormFile("boottrees"); err != nil || boothandler.Size == 0 {
+			return nil, badRequest(errors.New("No bootstrap tree file given (nor sequence file)"))
+		}
+		defer boottree.Close()
+
+		var refreader, bootreader *bufio.Reader
+		if refreader, err = autils.GetReaderFromReader(autils.GzipExtension(refhandler.Filename), reftree); err != nil {
+			return nil, badRequest(err)
+		}
+		if bootreader, err = autils.GetReaderFromReader(autils.GzipExtension(boothandler.Filename), boottree); err != nil {
+			return nil, badRequest(err)
+		}
+		report.CheckTrees(refreader, bootreader)
+	}
+	return report, nil
 }
 
 func apiAnalysisHandler(w http.ResponseWriter, r *http.Request, id string) {
@@ -309,6 +458,23 @@ func apiAnalysisHandler(w http.ResponseWriter, r *http.Request, id string) {
 	json.NewEncoder(w).Encode(a)
 }
 
+// Resubmits the inputs of an ended analysis in a new analysis,
+// and returns the new analysis
+func apiResubmitHandler(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		apiError(w, errors.New("Analyses must be resubmitted with POST"))
+		return
+	}
+	a, err := resubmitAnalysis(id)
+	if err != nil {
+		io.LogError(err)
+		apiError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(a)
+}
+
 func apiMonitorHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var err error
@@ -319,6 +485,7 @@ func apiMonitorHandler(w http.ResponseWriter, r *http.Request) {
 		apiError(w, err)
 		return
 	}
+	monitorInfo.Histories = historyUsage()
 	json.NewEncoder(w).Encode(monitorInfo)
 }
 
@@ -328,29 +495,50 @@ func apiStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(a)
 }
 
+// Draws the tree of the given analysis.
+//
+// In addition to the parameters given in the path, the following
+// query parameters are accepted:
+// - width & height: Dimensions of the image (default 800x800)
+// - tipnames: true|false, draw tip names (default false)
+// - supports: true|false, draw support values (default true)
+// - branchlengths: true|false, scale branches by their lengths (default true)
+// - root: deepest|midpoint|outgroup|none (default deepest, for unrooted trees)
+// - outgroup: comma separated list of outgroup tips, if root=outgroup
+// - colorsupports: true|false, color branches by support and draw a legend (default false)
+// - highlight: comma separated list of tips to highlight
+//
+// svg and pdf images are drawn by the render package, png images
+// by the gotree drawers, without colored supports nor highlighted tips.
 func apiImageHandler(w http.ResponseWriter, r *http.Request, id string, collapse float64, layout, algorithm, format string) {
+	if err := writeTreeImage(w, r, id, collapse, layout, algorithm, format); err != nil {
+		io.LogError(err)
+		status, _ := errorStatus(err)
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// Draws the tree of the given analysis, with the supports of the
+// given algorithm (tbe|fbp), and the format (svg|png|pdf).
+// See apiImageHandler for the query parameters.
+func writeTreeImage(w http.ResponseWriter, r *http.Request, id string, collapse float64, layout, algorithm, format string) (err error) {
 	var a *model.Analysis
+	var opts render.Options
 
-	a, err := getAnalysis(id)
-	if err != nil {
-		a = model.NewAnalysis()
-		a.Message = err.Error()
-		io.LogError(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if a, err = getAnalysis(id); err != nil {
 		return
 	}
 
-	if a.Status != model.STATUS_FINISHED {
-		e := errors.New(fmt.Sprintf("Cannot draw image for a non finished analysis, status : %s", a.StatusStr()))
-		io.LogError(e)
-		http.Error(w, e.Error(), http.StatusInternalServerError)
-		return
+	// Partial results of timed out analyses can be drawn
+	if a.Status != model.STATUS_FINISHED && a.PartialTrees == 0 {
+		return newRequestError(http.StatusConflict, API_ERROR_CONFLICT, fmt.Errorf("Cannot draw image for a non finished analysis, status : %s", a.StatusStr()))
 	}
 	if a.TbeNormTree == "" {
-		e := errors.New("Cannot draw image for an empty resulting tree")
-		io.LogError(e)
-		http.Error(w, e.Error(), http.StatusInternalServerError)
-		return
+		return newRequestError(http.StatusConflict, API_ERROR_CONFLICT, errors.New("Cannot draw image for an empty resulting tree"))
+	}
+
+	if opts, err = imageOptions(r, layout, collapse); err != nil {
+		return badRequest(err)
 	}
 
 	todraw := a.TbeNormTree
@@ -360,51 +548,241 @@ func apiImageHandler(w http.ResponseWriter, r *http.Request, id string, collapse
 
 	t, err := newick.NewParser(strings.NewReader(todraw)).Parse()
 	if err != nil {
-		io.LogError(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
-	} else {
-		var d draw.TreeDrawer
-		var l draw.TreeLayout
-		encoder := base64.NewEncoder(base64.StdEncoding, w)
-
-		switch format {
-		case "svg":
-			w.Header().Set("Content-Type", "image/svg+xml")
-			d = draw.NewSvgTreeDrawer(w, 800, 800, 30, 30, 30, 30)
-		case "png":
-			w.Header().Set("Content-Type", "image/png;base64")
-			d = draw.NewPngTreeDrawer(encoder, 800, 800, 30, 30, 30, 30)
-		default:
-			err := errors.New("Image format not recognized")
-			io.LogError(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	}
+
+	t.ReinitIndexes()
+	if err = rootImageTree(t, r.FormValue("root"), r.FormValue("outgroup")); err != nil {
+		return badRequest(err)
+	}
+	if r.FormValue("branchlengths") == "false" {
+		for _, e := range t.Edges() {
+			e.SetLength(1.0)
 		}
+	}
 
-		switch layout {
-		case "radial":
-			l = draw.NewRadialLayout(d, false, true, false, true)
-		case "circular":
-			l = draw.NewCircularLayout(d, false, true, false, true)
-		case "normal":
-			l = draw.NewNormalLayout(d, false, true, false, true)
-		default:
-			err := errors.New("Tree layout not recognized")
-			io.LogError(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	switch layout {
+	case render.LAYOUT_NORMAL, render.LAYOUT_CIRCULAR, render.LAYOUT_RADIAL:
+	default:
+		return badRequest(errors.New("Tree layout not recognized"))
+	}
+
+	// svg and pdf images are drawn by the same renderer, whatever the options
+	switch format {
+	case render.FORMAT_SVG:
+		w.Header().Set("Content-Type", "image/svg+xml")
+		return render.Draw(w, t, format, opts)
+	case render.FORMAT_PDF:
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%s.pdf\"", id, algorithm))
+		return render.Draw(w, t, format, opts)
+	case "png":
+		if opts.ColorSupports || len(opts.Highlight) > 0 {
+			return badRequest(errors.New("Colored supports and highlighted tips are only available in svg and pdf"))
+		}
+	default:
+		return badRequest(errors.New("Image format not recognized"))
+	}
+
+	var d draw.TreeDrawer
+	var l draw.TreeLayout
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	width, height := int(opts.Width), int(opts.Height)
+
+	w.Header().Set("Content-Type", "image/png;base64")
+	d = draw.NewPngTreeDrawer(encoder, width, height, 30, 30, 30, 30)
+
+	switch layout {
+	case render.LAYOUT_RADIAL:
+		l = draw.NewRadialLayout(d, opts.TipNames, true, false, opts.Supports)
+	case render.LAYOUT_CIRCULAR:
+		l = draw.NewCircularLayout(d, opts.TipNames, true, false, opts.Supports)
+	default:
+		l = draw.NewNormalLayout(d, opts.TipNames, true, false, opts.Supports)
+	}
+
+	l.SetSupportCutoff(opts.Cutoff)
+	l.DrawTree(t)
+	return encoder.Close()
+}
+
+// Parses drawing options given as query parameters of the image request
+func imageOptions(r *http.Request, layout string, collapse float64) (opts render.Options, err error) {
+	opts = render.Options{
+		Width:    IMAGE_SIZE_DEFAULT,
+		Height:   IMAGE_SIZE_DEFAULT,
+		Layout:   layout,
+		Supports: true,
+		Cutoff:   collapse / 100.0,
+	}
+
+	for _, dim := range []struct {
+		name string
+		val  *float64
+	}{{"width", &opts.Width}, {"height", &opts.Height}} {
+		if v := r.FormValue(dim.name); v != "" {
+			var size int
+			if size, err = strconv.Atoi(v); err != nil || size < IMAGE_SIZE_MIN || size > IMAGE_SIZE_MAX {
+				err = fmt.Errorf("Image %s must be an integer between %d and %d", dim.name, IMAGE_SIZE_MIN, IMAGE_SIZE_MAX)
+				return
+			}
+			*dim.val = float64(size)
+		}
+	}
+
+	for _, flag := range []struct {
+		name string
+		val  *bool
+	}{{"tipnames", &opts.TipNames}, {"supports", &opts.Supports}, {"colorsupports", &opts.ColorSupports}} {
+		if v := r.FormValue(flag.name); v != "" {
+			if *flag.val, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("Wrong value for %s: %s", flag.name, v)
+				return
+			}
+		}
+	}
+
+	if v := r.FormValue("branchlengths"); v != "" && v != "true" && v != "false" {
+		err = fmt.Errorf("Wrong value for branchlengths: %s", v)
+		return
+	}
+
+	if v := r.FormValue("highlight"); v != "" {
+		opts.Highlight = make(map[string]bool)
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.Highlight[name] = true
+			}
 		}
+	}
+	return
+}
 
-		t.ReinitIndexes()
+// Roots the tree to draw with the given method:
+// - "" or "deepest": at the deepest node if the tree is not rooted
+// - "midpoint": at the midpoint
+// - "outgroup": on the branch leading to the given outgroup tips
+// - "none": tree is drawn as is
+func rootImageTree(t *tree.Tree, method, outgroup string) (err error) {
+	switch method {
+	case "", "deepest":
 		if !t.Rooted() {
-			deepest := t.DeepestNode()
-			t.Reroot(deepest)
+			err = t.Reroot(t.DeepestNode())
 		}
-		l.SetSupportCutoff(collapse / 100.0)
-		l.DrawTree(t)
-		encoder.Close()
+	case "midpoint":
+		err = t.RerootMidPoint()
+	case "outgroup":
+		tips := make([]string, 0)
+		for _, name := range strings.Split(outgroup, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				tips = append(tips, name)
+			}
+		}
+		if len(tips) == 0 {
+			return errors.New("No outgroup tips given for outgroup rooting")
+		}
+		err = t.RerootOutGroup(false, tips...)
+	case "none":
+	default:
+		err = fmt.Errorf("Rooting method not recognized: %s", method)
 	}
+	return
+}
+
+// Returns a zip archive with the tree of the given algorithm
+// and the corresponding iTOL annotation datasets.
+//
+// Query parameter cutoff (default 0.7) defines the support
+// threshold of the binary datasets.
+func apiItolHandler(w http.ResponseWriter, r *http.Request, id, algorithm string) {
+	var buf bytes.Buffer
+
+	if err := itolZip(&buf, r, id, algorithm); err != nil {
+		io.LogError(err)
+		apiError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%s_itol.zip\"", id, algorithm))
+	if _, err := buf.WriteTo(w); err != nil {
+		io.LogError(err)
+	}
+}
+
+// Writes the iTOL zip archive of the analysis in buf
+func itolZip(buf *bytes.Buffer, r *http.Request, id, algorithm string) (err error) {
+	var a *model.Analysis
+
+	cutoff := itol.CUTOFF_DEFAULT
+	if c := r.FormValue("cutoff"); c != "" {
+		if cutoff, err = strconv.ParseFloat(c, 64); err != nil || cutoff < 0 || cutoff > 1 {
+			return badRequest(fmt.Errorf("Wrong cutoff value (must be in [0,1]): %s", c))
+		}
+	}
+
+	if a, err = getAnalysis(id); err != nil {
+		return
+	}
+
+	if err = itol.WriteZip(buf, a, algorithm, cutoff); err != nil {
+		return newRequestError(http.StatusConflict, API_ERROR_CONFLICT, err)
+	}
+	return
+}
+
+// Returns the comparison of the two analyses in json, or
+// only the tanglegram if format=svg is given
+func apiCompareHandler(w http.ResponseWriter, r *http.Request, id1, id2 string) {
+	var c *comparison.ComparisonInformation
+	var err error
+
+	if c, err = compareAnalyses(r, id1, id2); err != nil {
+		io.LogError(err)
+		w.Header().Set("Content-Type", "application/json")
+		apiError(w, err)
+		return
+	}
+	if r.FormValue("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(c.TanglegramSvg())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// Compares the two analyses, using the following optional request parameters:
+// algorithm1: tbe|fbp (default tbe): supports of the first analysis
+// algorithm2: tbe|fbp (default tbe): supports of the second analysis
+// cutoff: support cutoff in [0,1] defining well supported branches (default 0.7)
+func compareAnalyses(r *http.Request, id1, id2 string) (c *comparison.ComparisonInformation, err error) {
+	var a1, a2 *model.Analysis
+	algo1, algo2 := comparison.ALGORITHM_TBE, comparison.ALGORITHM_TBE
+	cutoff := comparison.CUTOFF_DEFAULT
+
+	if v := r.FormValue("algorithm1"); v != "" {
+		algo1 = v
+	}
+	if v := r.FormValue("algorithm2"); v != "" {
+		algo2 = v
+	}
+	if v := r.FormValue("cutoff"); v != "" {
+		if cutoff, err = strconv.ParseFloat(v, 64); err != nil || cutoff < 0 || cutoff > 1 {
+			err = badRequest(fmt.Errorf("Support cutoff must be a number in [0,1]: %s", v))
+			return
+		}
+	}
+	if a1, err = getAnalysis(id1); err != nil {
+		return
+	}
+	if a2, err = getAnalysis(id2); err != nil {
+		return
+	}
+	// Analyses not finished or on different trees
+	if c, err = comparison.Compare(a1, a2, algo1, algo2, cutoff); err != nil {
+		err = newRequestError(http.StatusConflict, API_ERROR_CONFLICT, err)
+	}
+	return
 }
 
 func apiRandNameGeneratorHandler(w http.ResponseWriter, r *http.Request) {
@@ -412,7 +790,7 @@ func apiRandNameGeneratorHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", generateRunName())
 }
 
-var validPath = regexp.MustCompile("^/(view|itol)/([-a-zA-Z0-9]+)$")
+var validPath = regexp.MustCompile("^/(view|itol|resubmit)/([-a-zA-Z0-9]+)$")
 
 func makeHandler(fn func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -442,7 +820,7 @@ func makeRawNormHandler(fn func(http.ResponseWriter, *http.Request, string, bool
 	}
 }
 
-var validApiAnalysisPath = regexp.MustCompile("^/api/(analysis)/([-a-zA-Z0-9]+)$")
+var validApiAnalysisPath = regexp.MustCompile("^/api/(analysis|resubmit)/([-a-zA-Z0-9]+)$")
 
 func makeApiAnalysisHandler(fn func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -455,9 +833,24 @@ func makeApiAnalysisHandler(fn func(http.ResponseWriter, *http.Request, string))
 	}
 }
 
+// URL of the form:
+// /compare/analysisid1/analysisid2 or /api/compare/analysisid1/analysisid2
+var validComparePath = regexp.MustCompile("^(/api)?/compare/([-a-zA-Z0-9]+)/([-a-zA-Z0-9]+)$")
+
+func makeCompareHandler(fn func(http.ResponseWriter, *http.Request, string, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := validComparePath.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			http.NotFound(w, r)
+			return
+		}
+		fn(w, r, m[2], m[3])
+	}
+}
+
 // URL of the form:
 // /api/image/analysisid/bootstrapcutoff/treelayout/imageformat
-var validApiImagePath = regexp.MustCompile("^/api/image/([-a-zA-Z0-9]+)/([0-9]+)/(circular|radial|normal)/(fbp|tbe)/(svg|png)$")
+var validApiImagePath = regexp.MustCompile("^/api/image/([-a-zA-Z0-9]+)/([0-9]+)/(circular|radial|normal)/(fbp|tbe)/(svg|png|pdf)$")
 
 func makeApiImageHandler(fn func(http.ResponseWriter, *http.Request, string, float64, string, string, string)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -471,6 +864,21 @@ func makeApiImageHandler(fn func(http.ResponseWriter, *http.Request, string, flo
 	}
 }
 
+// URL of the form:
+// /api/itol/analysisid/algorithm
+var validApiItolPath = regexp.MustCompile("^/api/itol/([-a-zA-Z0-9]+)/(fbp|tbe)$")
+
+func makeApiItolHandler(fn func(http.ResponseWriter, *http.Request, string, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := validApiItolPath.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			http.NotFound(w, r)
+			return
+		}
+		fn(w, r, m[1], m[2])
+	}
+}
+
 // URL of the form:
 // /api/randrunname
 var validApiRandomPath = regexp.MustCompile("^/api/randrunname/{0,1}$")
@@ -508,6 +916,8 @@ func makeApiHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := fmt.Errorf("api endpoint not found %s", r.URL.Path)
 		io.LogError(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
 		apiError(w, err)
 		return
 	}
@@ -0,0 +1,78 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+// Draws the image of the analysis with the given query parameters
+func treeImage(t *testing.T, id, format, query string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/image/"+id+"/0/normal/tbe/"+format+"?"+query, nil)
+	return rec, writeTreeImage(rec, req, id, 0, "normal", "tbe", format)
+}
+
+func TestTreeImageSvg(t *testing.T) {
+	testServer(t)
+	a := storedAnalysis(t, "image", model.STATUS_FINISHED)
+	a.TbeNormTree = "((A:1,B:1)0.9:1,C:1,D:1);"
+	a.FbpTree = a.TbeNormTree
+	if err := db.UpdateAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same renderer draws svg images with or without options
+	var prefix string
+	for _, query := range []string{"", "tipnames=true", "colorsupports=true", "highlight=A,C"} {
+		rec, err := treeImage(t, a.Id, "svg", query)
+		if err != nil {
+			t.Fatalf("Cannot draw svg image with %q: %v", query, err)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "image/svg+xml" {
+			t.Errorf("Wrong content type with %q: %s", query, ct)
+		}
+		head := strings.SplitN(rec.Body.String(), "\n", 3)
+		if len(head) < 3 {
+			t.Fatalf("Wrong svg image with %q: %s", query, rec.Body.String())
+		}
+		if prefix == "" {
+			prefix = head[0] + head[1]
+		} else if head[0]+head[1] != prefix {
+			t.Errorf("svg image with %q not drawn like the default one: %s", query, head[0]+head[1])
+		}
+	}
+
+	if _, err := treeImage(t, a.Id, "png", "colorsupports=true"); err == nil {
+		t.Error("Colored supports should not be available in png")
+	} else if status, _ := errorStatus(err); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, status)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/io"
+)
+
+const MAINTENANCE_RETRY_AFTER = 3600 // Seconds after which clients may submit again, if the end of the maintenance is unknown
+
+// Maintenance window: new analyses are refused from Start to End,
+// running analyses go on and results stay available
+type MaintenanceWindow struct {
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`     // nil: until maintenance is left
+	Message string     `json:"message,omitempty"` // Reason of the maintenance, displayed to the users
+}
+
+// Current and upcoming maintenance windows
+type MaintenanceStatus struct {
+	Active   bool                `json:"active"`            // If new analyses are refused
+	Current  *MaintenanceWindow  `json:"current,omitempty"` // Window in progress
+	Upcoming []MaintenanceWindow `json:"upcoming"`          // Scheduled windows, sorted by start
+}
+
+var maintenanceLock sync.RWMutex
+var maintenanceWindows []MaintenanceWindow
+
+func (w MaintenanceWindow) StartStr() string {
+	return w.Start.Format(time.RFC1123)
+}
+
+func (w MaintenanceWindow) EndStr() string {
+	if w.End == nil {
+		return ""
+	}
+	return w.End.Format(time.RFC1123)
+}
+
+func (w MaintenanceWindow) started(now time.Time) bool {
+	return !w.Start.After(now)
+}
+
+func (w MaintenanceWindow) ended(now time.Time) bool {
+	return w.End != nil && !w.End.After(now)
+}
+
+// Returns the current maintenance window and the upcoming ones,
+// and forgets the ended windows
+func maintenanceStatus() (status MaintenanceStatus) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	now := time.Now()
+	status.Upcoming = make([]MaintenanceWindow, 0)
+	windows := make([]MaintenanceWindow, 0, len(maintenanceWindows))
+	for _, w := range maintenanceWindows {
+		if w.ended(now) {
+			continue
+		}
+		windows = append(windows, w)
+		if !w.started(now) {
+			status.Upcoming = append(status.Upcoming, w)
+		} else if status.Current == nil || laterEnd(w, *status.Current) {
+			cur := w
+			status.Current = &cur
+		}
+	}
+	maintenanceWindows = windows
+	status.Active = status.Current != nil
+	sort.Slice(status.Upcoming, func(i, j int) bool { return status.Upcoming[i].Start.Before(status.Upcoming[j].Start) })
+	return
+}
+
+// If w1 ends after w2 (windows without end last until left)
+func laterEnd(w1, w2 MaintenanceWindow) bool {
+	if w1.End == nil || w2.End == nil {
+		return w1.End == nil && w2.End != nil
+	}
+	return w1.End.After(*w2.End)
+}
+
+// Enters maintenance at w.Start, or now if not given
+func enterMaintenance(w MaintenanceWindow) (err error) {
+	if w.Start.IsZero() {
+		w.Start = time.Now()
+	}
+	if w.End != nil && !w.End.After(w.Start) {
+		return errors.New("The end of the maintenance must be after its start")
+	}
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+	maintenanceWindows = append(maintenanceWindows, w)
+	return
+}
+
+// Leaves the maintenance in progress, and cancels the upcoming ones if all is true.
+// Returns the number of removed windows.
+func leaveMaintenance(all bool) (n int) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	now := time.Now()
+	windows := make([]MaintenanceWindow, 0, len(maintenanceWindows))
+	for _, w := range maintenanceWindows {
+		if all || w.started(now) {
+			n++
+			continue
+		}
+		windows = append(windows, w)
+	}
+	maintenanceWindows = windows
+	return
+}
+
+// Returns the message given to users submitting new analyses, and the
+// number of seconds after which they may try again, if a maintenance is
+// in progress
+func maintenanceRefusal() (message string, retry int, refused bool) {
+	status := maintenanceStatus()
+	if !status.Active {
+		return
+	}
+	cur := status.Current
+	refused = true
+	retry = MAINTENANCE_RETRY_AFTER
+	message = "Booster is under maintenance"
+	if cur.End != nil {
+		message += " until " + cur.EndStr()
+		retry = int(time.Until(*cur.End).Seconds()) + 1
+	}
+	if cur.Message != "" {
+		message += " (" + cur.Message + ")"
+	}
+	message += ", new analyses are not accepted, please try again later"
+	return
+}
+
+// Admin api of the maintenance mode:
+//   - GET: returns the maintenance status
+//   - POST: enters maintenance, json body: {"start": date, "end": date, "message": reason},
+//     start defaults to now, and end to "until left"
+//   - DELETE: leaves the maintenance in progress, and cancels upcoming ones if all=true
+//
+// Dates are given in RFC3339 format.
+func apiMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var win MaintenanceWindow
+		if err := json.NewDecoder(r.Body).Decode(&win); err != nil {
+			io.LogError(err)
+			w.WriteHeader(http.StatusBadRequest)
+			apiError(w, err)
+			return
+		}
+		if err := enterMaintenance(win); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			apiError(w, err)
+			return
+		}
+	case http.MethodDelete:
+		leaveMaintenance(r.FormValue("all") == "true")
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		apiError(w, fmt.Errorf("Method %s not allowed", r.Method))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(maintenanceStatus()); err != nil {
+		io.LogError(err)
+	}
+}
+
+// Sends a maintenance request to the booster-web server at url, with the
+// given admin credentials: method is GET (status), POST (enter, with window)
+// or DELETE (leave, all to cancel upcoming windows)
+func MaintenanceRequest(url, user, pass, method string, window *MaintenanceWindow, all bool) (status MaintenanceStatus, err error) {
+	var token string
+	var body []byte
+	var req *http.Request
+	var resp *http.Response
+
+	url = strings.TrimSuffix(url, "/")
+	if token, err = requestToken(url, user, pass); err != nil {
+		return
+	}
+	if window != nil {
+		if body, err = json.Marshal(window); err != nil {
+			return
+		}
+	}
+	endpoint := url + API_V1_PREFIX + "/maintenance"
+	if all {
+		endpoint += "?all=true"
+	}
+	if req, err = http.NewRequest(method, endpoint, bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Maintenance request failed (%s): %s", resp.Status, responseError(resp))
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return
+}
+
+// Gets an authentication token from the booster-web server at url
+func requestToken(url, user, pass string) (token string, err error) {
+	var body []byte
+	var resp *http.Response
+	var answer struct {
+		Token string `json:"token"`
+	}
+
+	if body, err = json.Marshal(AuthJson{user, pass}); err != nil {
+		return
+	}
+	if resp, err = http.Post(url+API_V1_PREFIX+"/token", "application/json", bytes.NewReader(body)); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("Authentication failed: " + responseError(resp))
+		return
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return
+	}
+	token = answer.Token
+	return
+}
+
+// Returns the message of the json error body of an api v1 response
+func responseError(resp *http.Response) string {
+	var answer ApiErrorResponse
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err.Error()
+	}
+	if err = json.Unmarshal(body, &answer); err != nil || answer.Error.Message == "" {
+		return strings.TrimSpace(string(body))
+	}
+	return answer.Error.Message
+}
@@ -0,0 +1,265 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	goio "io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/io"
+)
+
+const (
+	PROFILE_COOKIE      = "Profile"
+	PROFILE_CSRF_COOKIE = "ProfileCsrf" // Random value from which the csrf token of the profile form is derived
+)
+
+// Key encrypting the profile cookies and signing the csrf tokens of the
+// profile form, derived from itol.profilekey. Profiles are disabled if
+// it is not set, so that they are not lost at each restart, and are the
+// same on all the replicas.
+var profileKey []byte
+
+// User preferences, stored encrypted with profileKey in the Profile
+// cookie of the user: the browser cannot read the iTOL key
+type Profile struct {
+	Username    string `json:"-"`
+	ItolKey     string `json:"itolkey"`     // iTOL API key of the user, never sent back to the browser
+	ItolProject string `json:"itolproject"` // iTOL project in which trees are uploaded
+	HasItolKey  bool   `json:"-"`           // If an iTOL API key is set, displayed instead of the key
+	Enabled     bool   `json:"-"`           // If profiles are enabled (itol.profilekey set)
+	Saved       bool   `json:"-"`
+	CsrfToken   string `json:"-"` // Token of the profile form
+}
+
+// Derives the key of the profile cookies from the secret
+func setProfileKey(secret string) {
+	sum := sha256.Sum256([]byte(secret))
+	profileKey = sum[:]
+}
+
+func profilesEnabled() bool {
+	return len(profileKey) > 0
+}
+
+// Returns the profile of the user making the request.
+//
+// If profiles are disabled, if no profile cookie is set, or if it
+// cannot be decrypted, an empty profile is returned.
+func getProfile(req *http.Request) (p Profile) {
+	p.Enabled = profilesEnabled()
+	if claims, ok := req.Context().Value(MyKey).(Claims); ok {
+		p.Username = claims.Username
+	}
+	if !p.Enabled {
+		return
+	}
+	cookie, err := req.Cookie(PROFILE_COOKIE)
+	if err != nil {
+		return
+	}
+	val, err := decryptProfile(cookie.Value)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(val, &p); err != nil {
+		io.LogError(err)
+	}
+	return
+}
+
+// Encrypts the value with profileKey (AES-GCM), the random
+// nonce being prepended to the encrypted value
+func encryptProfile(val []byte) (string, error) {
+	gcm, err := profileCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = goio.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(gcm.Seal(nonce, nonce, val, []byte(PROFILE_COOKIE))), nil
+}
+
+// Decrypts a value encrypted by encryptProfile
+func decryptProfile(value string) ([]byte, error) {
+	gcm, err := profileCipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Malformed profile cookie")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(PROFILE_COOKIE))
+}
+
+func profileCipher() (cipher.AEAD, error) {
+	if !profilesEnabled() {
+		return nil, errors.New("Profiles are disabled: itol.profilekey is not set")
+	}
+	block, err := aes.NewCipher(profileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the signature of the value with profileKey
+func signProfile(value string) string {
+	mac := hmac.New(sha256.New, profileKey)
+	mac.Write([]byte(value))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the csrf token of the profile form, derived from the random
+// value of the csrf cookie, which is set if missing
+func profileCsrfToken(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(PROFILE_CSRF_COOKIE)
+	if err != nil || cookie.Value == "" {
+		cookie = &http.Cookie{
+			Name:     PROFILE_CSRF_COOKIE,
+			Value:    GenerateRandomString(20),
+			Path:     "/profile",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		}
+		http.SetCookie(w, cookie)
+	}
+	return signProfile("csrf." + cookie.Value)
+}
+
+// Checks that the profile form is posted from a page of this server,
+// with the csrf token of the user
+func checkProfileCsrf(r *http.Request) error {
+	for _, h := range []string{"Origin", "Referer"} {
+		if v := r.Header.Get(h); v != "" {
+			if u, err := url.Parse(v); err != nil || u.Host != r.Host {
+				return errors.New("Profile must be saved from the profile page of this server")
+			}
+			break
+		}
+	}
+	cookie, err := r.Cookie(PROFILE_CSRF_COOKIE)
+	if err != nil || cookie.Value == "" ||
+		!hmac.Equal([]byte(r.FormValue("csrftoken")), []byte(signProfile("csrf."+cookie.Value))) {
+		return errors.New("Invalid profile form, please reload the profile page")
+	}
+	return nil
+}
+
+// iTOL key and project to use for uploads of this user:
+// Those of the user profile if any, the server-wide ones otherwise
+func userItolAccount(req *http.Request) (key, project string) {
+	p := getProfile(req)
+	if p.ItolKey != "" {
+		return p.ItolKey, p.ItolProject
+	}
+	return iTOLKey, iTOLProject
+}
+
+// Shows (GET) or saves (POST) the profile of the user.
+//
+// The iTOL key is never displayed: an empty key field keeps
+// the current key, which is removed with the removekey field.
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	p := getProfile(r)
+	if r.Method == http.MethodPost {
+		err := checkProfileCsrf(r)
+		if err == nil && !p.Enabled {
+			err = errors.New("Profiles are not enabled on this server")
+		}
+		if err != nil {
+			io.LogError(err)
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusForbidden)
+			errorHandler(w, r, err)
+			return
+		}
+		if key := strings.TrimSpace(r.FormValue("itolkey")); key != "" {
+			p.ItolKey = key
+		}
+		if r.FormValue("removekey") != "" {
+			p.ItolKey = ""
+		}
+		p.ItolProject = strings.TrimSpace(r.FormValue("itolproject"))
+		val, err := json.Marshal(p)
+		if err != nil {
+			io.LogError(err)
+			errorHandler(w, r, err)
+			return
+		}
+		value, err := encryptProfile(val)
+		if err != nil {
+			io.LogError(err)
+			errorHandler(w, r, err)
+			return
+		}
+		cookie := http.Cookie{
+			Name:     PROFILE_COOKIE,
+			Value:    value,
+			Path:     "/",
+			Expires:  time.Now().AddDate(1, 0, 0),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if p.ItolKey == "" && p.ItolProject == "" {
+			cookie.Value = "none"
+			cookie.Expires = time.Now()
+		}
+		http.SetCookie(w, &cookie)
+		p.Saved = true
+	}
+	p.HasItolKey = p.ItolKey != ""
+	p.ItolKey = ""
+	if p.Enabled {
+		p.CsrfToken = profileCsrfToken(w, r)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if t, err := getTemplate("profile"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		if err := t.ExecuteTemplate(w, "layout", p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func profileRequest(t *testing.T, p Profile) *http.Request {
+	t.Helper()
+	val, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := encryptProfile(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(value, p.ItolKey) {
+		t.Fatalf("profile cookie contains the iTOL key in clear: %s", value)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	req.AddCookie(&http.Cookie{Name: PROFILE_COOKIE, Value: value})
+	return req
+}
+
+func TestProfileCookie(t *testing.T) {
+	defer func() { profileKey = nil }()
+	setProfileKey("profile-test-secret")
+
+	req := profileRequest(t, Profile{ItolKey: "itolsecretkey", ItolProject: "booster"})
+	p := getProfile(req)
+	if !p.Enabled || p.ItolKey != "itolsecretkey" || p.ItolProject != "booster" {
+		t.Errorf("unexpected profile read from the cookie: %+v", p)
+	}
+
+	// A cookie encrypted with another key is ignored
+	setProfileKey("other-secret")
+	if p = getProfile(req); p.ItolKey != "" || p.ItolProject != "" {
+		t.Errorf("profile encrypted with another key should be ignored: %+v", p)
+	}
+
+	// A tampered cookie is ignored
+	setProfileKey("profile-test-secret")
+	cookie, _ := req.Cookie(PROFILE_COOKIE)
+	tampered := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	first := "A"
+	if cookie.Value[:1] == first {
+		first = "B"
+	}
+	tampered.AddCookie(&http.Cookie{Name: PROFILE_COOKIE, Value: first + cookie.Value[1:]})
+	if p = getProfile(tampered); p.ItolKey != "" {
+		t.Errorf("tampered profile should be ignored: %+v", p)
+	}
+}
+
+func TestProfileDisabled(t *testing.T) {
+	setProfileKey("profile-test-secret")
+	req := profileRequest(t, Profile{ItolKey: "itolsecretkey"})
+	profileKey = nil
+
+	if p := getProfile(req); p.Enabled || p.ItolKey != "" {
+		t.Errorf("profiles should be disabled without itol.profilekey: %+v", p)
+	}
+	if _, err := encryptProfile([]byte("{}")); err == nil {
+		t.Errorf("profiles should not be encrypted without itol.profilekey")
+	}
+}
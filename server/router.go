@@ -0,0 +1,216 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/io"
+)
+
+// Error codes of the json error bodies of the api v1
+const (
+	API_ERROR_BAD_REQUEST  = "bad_request"        // Wrong parameters or input files
+	API_ERROR_UNAUTHORIZED = "unauthorized"       // Missing or wrong authentication token
+	API_ERROR_NOT_FOUND    = "not_found"          // Unknown endpoint or analysis
+	API_ERROR_METHOD       = "method_not_allowed" // Endpoint exists with other methods
+	API_ERROR_CONFLICT     = "conflict"           // Analysis in a state not allowing the request (e.g. not finished)
+	API_ERROR_UNAVAILABLE  = "unavailable"        // Server stopping or under maintenance
+	API_ERROR_INTERNAL     = "internal_error"     // Server side error
+)
+
+const pathParamsKey Key = 1 // Context key of the path parameters of api v1 requests
+
+// Json error body of the api v1
+type ApiErrorResponse struct {
+	Error ApiError `json:"error"`
+}
+
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error of a request, with its http status and api error code
+type requestError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func newRequestError(status int, code string, err error) error {
+	return &requestError{status, code, err}
+}
+
+func badRequest(err error) error {
+	return newRequestError(http.StatusBadRequest, API_ERROR_BAD_REQUEST, err)
+}
+
+// Returns the http status and api error code of the error:
+// unknown analyses are not found, other errors are internal errors
+func errorStatus(err error) (status int, code string) {
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		return rerr.status, rerr.code
+	}
+	if errors.Is(err, database.ErrAnalysisNotFound) {
+		return http.StatusNotFound, API_ERROR_NOT_FOUND
+	}
+	return http.StatusInternalServerError, API_ERROR_INTERNAL
+}
+
+// Writes the json error body of the api v1, with the status of the error
+func apiV1Error(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	if status >= http.StatusInternalServerError {
+		io.LogError(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if e := json.NewEncoder(w).Encode(ApiErrorResponse{ApiError{code, err.Error()}}); e != nil {
+		io.LogError(e)
+	}
+}
+
+// Writes v in json with the given http status
+func apiV1Json(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		io.LogError(err)
+	}
+}
+
+type apiRoute struct {
+	method   string
+	segments []string // Path segments, "{name}" segments are path parameters
+	handler  http.HandlerFunc
+}
+
+// Router of a versioned api: routes are matched on the method and on
+// the path after prefix, e.g. "GET /analyses/{id}".
+// Unknown paths give 404 errors, and paths known with other methods 405
+// errors, with json error bodies.
+type apiRouter struct {
+	prefix string
+	routes []apiRoute
+}
+
+func newApiRouter(prefix string) *apiRouter {
+	return &apiRouter{prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// Adds a route: handlers get path parameters with pathParam
+func (rt *apiRouter) handle(method, pattern string, handler http.HandlerFunc) {
+	rt.routes = append(rt.routes, apiRoute{method, splitPath(pattern), handler})
+}
+
+func (rt *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, rt.prefix+"/") {
+		apiV1Error(w, newRequestError(http.StatusNotFound, API_ERROR_NOT_FOUND, fmt.Errorf("api endpoint not found %s", r.URL.Path)))
+		return
+	}
+	segments := splitPath(strings.TrimPrefix(r.URL.Path, rt.prefix))
+
+	allowed := make([]string, 0)
+	for _, route := range rt.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		route.handler(w, r.WithContext(context.WithValue(r.Context(), pathParamsKey, params)))
+		return
+	}
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		apiV1Error(w, newRequestError(http.StatusMethodNotAllowed, API_ERROR_METHOD, fmt.Errorf("Method %s not allowed on %s", r.Method, r.URL.Path)))
+		return
+	}
+	apiV1Error(w, newRequestError(http.StatusNotFound, API_ERROR_NOT_FOUND, fmt.Errorf("api endpoint not found %s", r.URL.Path)))
+}
+
+// Returns the path parameters if the path segments match the route
+func (route apiRoute) match(segments []string) (params map[string]string, ok bool) {
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	params = make(map[string]string)
+	for i, s := range route.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Splits the path in non empty segments
+func splitPath(path string) (segments []string) {
+	segments = make([]string, 0)
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return
+}
+
+// Returns the value of the path parameter of an api v1 request
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey).(map[string]string)
+	return params[name]
+}
+
+// Checks the authentication token of api v1 requests if authentication
+// is activated, or if force is true: wrong tokens give 401 errors
+func authApiV1(page http.HandlerFunc, force bool) http.HandlerFunc {
+	if !Authent && !force {
+		return page
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := requestClaims(r)
+		if err != nil {
+			apiV1Error(w, newRequestError(http.StatusUnauthorized, API_ERROR_UNAUTHORIZED, err))
+			return
+		}
+		page(w, r.WithContext(context.WithValue(r.Context(), MyKey, *claims)))
+	}
+}
@@ -0,0 +1,310 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/database"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/workflow"
+)
+
+// Processor recording the launched analyses, without running them
+type testProcessor struct {
+	launched []*model.Analysis
+}
+
+func (p *testProcessor) LaunchAnalysis(a *model.Analysis) error {
+	p.launched = append(p.launched, a)
+	return nil
+}
+
+func (p *testProcessor) CancelAnalyses() error { return nil }
+
+func (p *testProcessor) Drain(period time.Duration) error { return nil }
+
+// Sets the server globals used by the handlers: an in memory database,
+// a processor recording the analyses, and the given analysis uuids
+func testServer(t *testing.T, ids ...string) *testProcessor {
+	t.Helper()
+	mem := database.NewMemoryBoosterWebDB()
+	if err := mem.InitDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	p := &testProcessor{}
+	db = mem
+	proc = p
+	registry = &workflow.Registry{}
+	inputdir = t.TempDir()
+	treeinference = false
+	Authent = false
+	uuids = make(chan string, len(ids))
+	for _, id := range ids {
+		uuids <- id
+	}
+	return p
+}
+
+// Stores an analysis in the database of the server
+func storedAnalysis(t *testing.T, id string, status int) *model.Analysis {
+	t.Helper()
+	a := model.NewAnalysis()
+	a.Id = id
+	a.Status = status
+	if err := db.UpdateAnalysis(a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// Multipart form of a booster analysis on the given trees
+func treesForm(t *testing.T, reftree, boottrees string) (body *bytes.Buffer, contentType string) {
+	t.Helper()
+	body = &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for field, content := range map[string]string{"reftree": reftree, "boottrees": boottrees} {
+		fw, err := mw.CreateFormFile(field, field+".nw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.WriteField("runname", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body, mw.FormDataContentType()
+}
+
+// Checks the status and the json error body of the api v1 response
+func checkApiV1Error(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("Expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected a json error body, got content type %q", ct)
+	}
+	var resp ApiErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Wrong json error body: %v", err)
+	}
+	if resp.Error.Code != code {
+		t.Errorf("Expected error code %q, got %q", code, resp.Error.Code)
+	}
+	if resp.Error.Message == "" {
+		t.Error("Empty error message")
+	}
+}
+
+func TestApiRouterNotFound(t *testing.T) {
+	rt := newApiRouter("/api/v1/")
+	rt.handle(http.MethodGet, "/analyses/{id}", func(w http.ResponseWriter, r *http.Request) {
+		apiV1Json(w, http.StatusOK, pathParam(r, "id"))
+	})
+
+	for _, path := range []string{"/api/v1/unknown", "/api/v1/analyses", "/api/v1/analyses/a/b", "/api/v2/analyses/a"} {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		checkApiV1Error(t, rec, http.StatusNotFound, API_ERROR_NOT_FOUND)
+	}
+
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/analyses/abc", nil))
+	var id string
+	if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&id) != nil || id != "abc" {
+		t.Errorf("Expected path parameter abc, got status %d and %q", rec.Code, id)
+	}
+}
+
+func TestApiRouterMethodNotAllowed(t *testing.T) {
+	testServer(t)
+	rt := newApiV1Router()
+
+	for path, allow := range map[string]string{
+		"/api/v1/maintenance":           "DELETE, GET, POST",
+		"/api/v1/analyses":              "POST",
+		"/api/v1/analyses/abc/resubmit": "POST",
+	} {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, path, nil))
+		checkApiV1Error(t, rec, http.StatusMethodNotAllowed, API_ERROR_METHOD)
+		if got := rec.Header().Get("Allow"); got != allow {
+			t.Errorf("%s: expected Allow header %q, got %q", path, allow, got)
+		}
+	}
+}
+
+func TestApiV1ErrorBodies(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{badRequest(errors.New("wrong input")), http.StatusBadRequest, API_ERROR_BAD_REQUEST},
+		{newRequestError(http.StatusUnauthorized, API_ERROR_UNAUTHORIZED, errors.New("wrong token")), http.StatusUnauthorized, API_ERROR_UNAUTHORIZED},
+		{newRequestError(http.StatusNotFound, API_ERROR_NOT_FOUND, errors.New("unknown")), http.StatusNotFound, API_ERROR_NOT_FOUND},
+		{database.ErrAnalysisNotFound, http.StatusNotFound, API_ERROR_NOT_FOUND},
+		{newRequestError(http.StatusMethodNotAllowed, API_ERROR_METHOD, errors.New("wrong method")), http.StatusMethodNotAllowed, API_ERROR_METHOD},
+		{newRequestError(http.StatusConflict, API_ERROR_CONFLICT, errors.New("not finished")), http.StatusConflict, API_ERROR_CONFLICT},
+		{newRequestError(http.StatusServiceUnavailable, API_ERROR_UNAVAILABLE, errors.New("stopping")), http.StatusServiceUnavailable, API_ERROR_UNAVAILABLE},
+		{errors.New("database error"), http.StatusInternalServerError, API_ERROR_INTERNAL},
+	} {
+		rec := httptest.NewRecorder()
+		apiV1Error(rec, test.err)
+		checkApiV1Error(t, rec, test.status, test.code)
+	}
+}
+
+func TestApiV1Errors(t *testing.T) {
+	testServer(t)
+	storedAnalysis(t, "running", model.STATUS_RUNNING)
+	rt := newApiV1Router()
+
+	// Unknown analysis
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/analyses/unknown", nil))
+	checkApiV1Error(t, rec, http.StatusNotFound, API_ERROR_NOT_FOUND)
+
+	// Analysis not finished
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/analyses/running/resubmit", nil))
+	checkApiV1Error(t, rec, http.StatusConflict, API_ERROR_CONFLICT)
+
+	// Admin endpoint without token
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/maintenance", nil))
+	checkApiV1Error(t, rec, http.StatusUnauthorized, API_ERROR_UNAUTHORIZED)
+
+	// Missing input files
+	body, ct := treesForm(t, "", "")
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/analyses", body)
+	req.Header.Set("Content-Type", ct)
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, req)
+	checkApiV1Error(t, rec, http.StatusBadRequest, API_ERROR_BAD_REQUEST)
+
+	// Under maintenance
+	if err := enterMaintenance(MaintenanceWindow{}); err != nil {
+		t.Fatal(err)
+	}
+	defer leaveMaintenance(true)
+	body, ct = treesForm(t, "((A,B),(C,D));", "((A,B),(C,D));\n")
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/analyses", body)
+	req.Header.Set("Content-Type", ct)
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, req)
+	checkApiV1Error(t, rec, http.StatusServiceUnavailable, API_ERROR_UNAVAILABLE)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("No Retry-After header while under maintenance")
+	}
+}
+
+func TestApiV1Submit(t *testing.T) {
+	p := testServer(t, "newanalysis")
+	rt := newApiV1Router()
+
+	body, ct := treesForm(t, "((A,B),(C,D));", "((A,B),(C,D));\n((A,C),(B,D));\n")
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/analyses", body)
+	req.Header.Set("Content-Type", ct)
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	if loc := rec.Header().Get("Location"); loc != "/api/v1/analyses/newanalysis" {
+		t.Errorf("Unexpected Location header %q", loc)
+	}
+	var a model.Analysis
+	if err := json.NewDecoder(rec.Body).Decode(&a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Id != "newanalysis" || a.RunName != "test" || a.BootTrees != 2 {
+		t.Errorf("Unexpected analysis: id %s, run name %s, %d bootstrap trees", a.Id, a.RunName, a.BootTrees)
+	}
+	if len(p.launched) != 1 || p.launched[0].Id != "newanalysis" {
+		t.Error("Analysis not launched by the processor")
+	}
+}
+
+func TestLegacyApiRoutes(t *testing.T) {
+	testServer(t)
+	storedAnalysis(t, "legacy", model.STATUS_FINISHED)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/analysis/", validateApi(makeApiAnalysisHandler(apiAnalysisHandler), false))
+	mux.HandleFunc("/api/validate", validateApi(apiValidateHandler, false))
+	mux.HandleFunc("/status", validateApi(apiStatus, false))
+	mux.HandleFunc("/api/", validateApi(makeApiHandler(), false))
+	mux.Handle(API_V1_PREFIX+"/", newApiV1Router())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/analysis/legacy", nil))
+	var a model.Analysis
+	if err := json.NewDecoder(rec.Body).Decode(&a); err != nil || rec.Code != http.StatusOK || a.Id != "legacy" || a.Status != model.STATUS_FINISHED {
+		t.Errorf("Analysis not returned by the legacy api: status %d, error %v", rec.Code, err)
+	}
+
+	// Legacy error bodies
+	for path, status := range map[string]int{
+		"/api/validate": http.StatusMethodNotAllowed,
+		"/api/unknown":  http.StatusNotFound,
+	} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp GenericResponse
+		if rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, rec.Code)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Status != 1 || resp.Message == "" {
+			t.Errorf("%s: unexpected legacy error body: %s", path, rec.Body.String())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"OK"`) {
+		t.Errorf("Unexpected status response: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// The api v1 is served beside the legacy routes
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/analyses/legacy", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Analysis not returned by the api v1: status %d", rec.Code)
+	}
+}
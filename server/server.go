@@ -35,10 +35,9 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
-	"syscall"
 	"time"
 
 	uuid "github.com/nu7hatch/gouuid"
@@ -51,11 +50,12 @@ import (
 	"github.com/evolbioinfo/booster-web/processor"
 	"github.com/evolbioinfo/booster-web/static"
 	"github.com/evolbioinfo/booster-web/templates"
+	"github.com/evolbioinfo/booster-web/validation"
+	"github.com/evolbioinfo/booster-web/workflow"
 	"github.com/evolbioinfo/goalign/align"
 	"github.com/evolbioinfo/goalign/io/fasta"
 	"github.com/evolbioinfo/goalign/io/phylip"
 	"github.com/evolbioinfo/goalign/io/utils"
-	"github.com/evolbioinfo/gotree/io/newick"
 	tutils "github.com/evolbioinfo/gotree/io/utils"
 	"github.com/evolbioinfo/gotree/tree"
 )
@@ -63,6 +63,10 @@ import (
 const (
 	DATABASE_TYPE_DEFAULT = "memory"
 	HTTP_PORT_DEFAULT     = 8080 // Port 8080
+
+	IMAGE_SIZE_DEFAULT = 800  // Default width & height of tree images
+	IMAGE_SIZE_MIN     = 100  // Min width & height of tree images
+	IMAGE_SIZE_MAX     = 5000 // Max width & height of tree images
 )
 
 var templatePath string
@@ -83,6 +87,15 @@ var iTOLKey string     // Key of iTOL user
 var iTOLProject string // iTOL Project to which upload the trees
 
 var galaxyprocessor bool // if the processor is a galaxyprocessor
+var treeinference bool   // if the processor can infer trees from alignments
+var workflows []int      // Phylogenetic workflows available with the processor
+var aligntools []string  // Alignment and trimming tools available with the processor
+var inputdir string      // Directory of the input files of the analyses (default: system temp directory)
+var registry *workflow.Registry
+
+// Functions available in all templates: maintenance returns the
+// current and upcoming maintenance windows, displayed by the layout
+var layoutFuncs = template.FuncMap{"maintenance": maintenanceStatus}
 var emailnotification bool
 
 // The config should contain following keys:
@@ -90,6 +103,29 @@ var emailnotification bool
 // runners.nbrunners: Max number of parallel running jobs (default 1)
 // runners.timeout for each running job in Seconds (default 0=unlimited)
 // runners.jobthreads : Number of cpus per bootstrap runner
+// runners.memlimit : Max estimated memory of a job in Bytes: larger jobs are refused (default 0=unlimited)
+// runners.localmemory : Memory shared by local runners in Bytes: jobs wait for enough free memory (default: system memory)
+// runners.isolation : worker to compute supports of local jobs in subprocesses limited to runners.memlimit (default: in the server process)
+// runners.worker.cgroup : cgroup v2 directory in which worker subprocesses are limited (optional)
+// runners.tools.fasttree|phyml|iqtree|raxmlng : Path to local tree inference tools (default: looked up in PATH)
+// runners.workflows.<key> : Local tool used for each workflow: phyml, fasttree, iqtree or raxmlng
+// runners.slurm.workdir : Directory shared with the compute nodes (type=slurm)
+// runners.slurm.sbatch|squeue|sacct|scancel|booster : Paths to the slurm commands and to booster on the nodes (type=slurm, default: looked up in PATH)
+// runners.slurm.partition|options|interval : Slurm partition, additional sbatch options and seconds between job checks (type=slurm)
+// runners.slurm.commandtimeout : Seconds after which a slurm command that does not answer is killed (type=slurm)
+// runners.inputs.dir : Directory of the input files of the analyses (default: system temp directory)
+// runners.inputs.keep|keepdays : Keep input files after the analyses, to resubmit them, for keepdays days (default database.keepold)
+// runners.retry.<api|job|timeout>.attempts|backoff : Max attempts and first retry delay in seconds of failed jobs (api and job: galaxy only)
+// runners.distributed.shareddir : Directory of input files, shared with the workers (type=distributed)
+// runners.distributed.lease|heartbeat|poll : Seconds of worker leases, between lease renewals, and between claims of analyses (type=distributed)
+// runners.distributed.capacity|worker : Max number of analyses held by a worker (default nbrunners), and worker name (default host-pid)
+// galaxy.tools.booster : Galaxy id of booster tool (type=galaxy)
+// galaxy.tools.phyml|fasttree|iqtree|raxmlng : Galaxy ids of built-in workflows (type=galaxy)
+// runners.routing.default : Processor of analyses matching no routing rule (type=hybrid: local or galaxy, default galaxy)
+// runners.routing.rules : Routing rules, array of tables with processor, workflows, maxtips, maxboot, maxmemory and maxload (type=hybrid)
+// galaxy.backends.<name>.url|key|capacity : Galaxy servers on which jobs are launched (type=galaxy, default: galaxy.url)
+// galaxy.backends.<name>.tools.<key> : Galaxy ids of the tools on this server (default: galaxy.tools.<key>)
+// workflows.<key> : Definition of workflows (see workflow package)
 // database.type: mysql or memory (default memory)
 // database.user: user to connect to mysql if type is mysql
 // database.host: host to connect to mysql if type is mysql
@@ -104,7 +140,7 @@ func InitServer(cfg config.Provider) {
 
 	templatePath = "webapp" + string(os.PathSeparator) + "templates" + string(os.PathSeparator)
 
-	var formtpl, errtpl, viewtpl, indextpl, layouttpl, helptpl, logintpl, maintenancetpl, monitortpl []byte
+	var formtpl, errtpl, viewtpl, indextpl, layouttpl, helptpl, logintpl, monitortpl, comparetpl, profiletpl []byte
 	var err error
 	var t *template.Template
 
@@ -136,104 +172,136 @@ func InitServer(cfg config.Provider) {
 		log.Fatal(err)
 	}
 
-	if maintenancetpl, err = templates.Asset(templatePath + "maintenance.html"); err != nil {
+	if monitortpl, err = templates.Asset(templatePath + "monitor.html"); err != nil {
 		log.Fatal(err)
 	}
 
-	if monitortpl, err = templates.Asset(templatePath + "monitor.html"); err != nil {
+	if comparetpl, err = templates.Asset(templatePath + "compare.html"); err != nil {
+		log.Fatal(err)
+	}
+	if profiletpl, err = templates.Asset(templatePath + "profile.html"); err != nil {
 		log.Fatal(err)
 	}
 
 	templatesMap = make(map[string]*template.Template)
 
-	if t, err = template.New("inputform").Parse(string(layouttpl) + string(formtpl)); err != nil {
+	if t, err = template.New("inputform").Funcs(layoutFuncs).Parse(string(layouttpl) + string(formtpl)); err != nil {
 		log.Fatal(err)
 	}
 	templatesMap["inputform"] = t
 
-	if t, err = template.New("error").Parse(string(layouttpl) + string(errtpl)); err != nil {
+	if t, err = template.New("error").Funcs(layoutFuncs).Parse(string(layouttpl) + string(errtpl)); err != nil {
 		log.Fatal(err)
 	}
 	templatesMap["error"] = t
 
-	if t, err = template.New("view").Parse(string(layouttpl) + string(viewtpl)); err != nil {
+	if t, err = template.New("view").Funcs(layoutFuncs).Parse(string(layouttpl) + string(viewtpl)); err != nil {
 		log.Fatal(err)
 	}
 	templatesMap["view"] = t
 
-	if t, err = template.New("index").Parse(string(layouttpl) + string(indextpl)); err != nil {
+	if t, err = template.New("index").Funcs(layoutFuncs).Parse(string(layouttpl) + string(indextpl)); err != nil {
 		log.Fatal(err)
 	}
 	templatesMap["index"] = t
 
-	if t, err = template.New("help").Funcs(template.FuncMap{"markDown": markDowner}).Parse(string(layouttpl) + string(helptpl)); err != nil {
+	if t, err = template.New("help").Funcs(layoutFuncs).Funcs(template.FuncMap{"markDown": markDowner}).Parse(string(layouttpl) + string(helptpl)); err != nil {
 		log.Fatal(err)
 	}
 	templatesMap["help"] = t
 
-	if t, err = template.New("login").Parse(string(layouttpl) + string(logintpl)); err != nil {
+	if t, err = template.New("login").Funcs(layoutFuncs).Parse(string(layouttpl) + string(logintpl)); err != nil {
 		log.Fatal(err)
 	}
 	templatesMap["login"] = t
 
-	if t, err = template.New("maintenance").Parse(string(layouttpl) + string(maintenancetpl)); err != nil {
+	if t, err = template.New("monitor").Funcs(layoutFuncs).Parse(string(layouttpl) + string(monitortpl)); err != nil {
 		log.Fatal(err)
 	}
-	templatesMap["maintenance"] = t
+	templatesMap["monitor"] = t
 
-	if t, err = template.New("monitor").Parse(string(layouttpl) + string(monitortpl)); err != nil {
+	if t, err = template.New("compare").Funcs(layoutFuncs).Parse(string(layouttpl) + string(comparetpl)); err != nil {
 		log.Fatal(err)
 	}
-	templatesMap["monitor"] = t
+	templatesMap["compare"] = t
+
+	if t, err = template.New("profile").Funcs(layoutFuncs).Parse(string(layouttpl) + string(profiletpl)); err != nil {
+		log.Fatal(err)
+	}
+	templatesMap["profile"] = t
 
 	/* Static files handlers : js, css, etc. */
 	http.Handle("/static/", http.FileServer(static.AssetFS()))
 	//http.Handle("/", http.RedirectHandler("/new/", http.StatusFound))
 
+	initWorkflows(cfg)
+	// The server starts in maintenance, left with the maintenance api
 	if cfg.GetBool("general.maintenance") {
-		initDB(cfg)
-		initLogin(cfg)
-		http.HandleFunc("/", maintenanceHandler) /* Handler for maintenance page  */
+		if err := enterMaintenance(MaintenanceWindow{}); err != nil {
+			log.Fatal(err)
+		}
+		log.Print("Starting in maintenance: new analyses are refused until maintenance is left")
+	}
+	initUUIDGenerator()
+	initDB(cfg)
+	initEmailNotification(cfg)
+	initProcessor(cfg)
+	initLogin(cfg)
+
+	iTOLKey = cfg.GetString("itol.key")
+	iTOLProject = cfg.GetString("itol.project")
+	if cfg.GetString("itol.profilekey") != "" {
+		setProfileKey(cfg.GetString("itol.profilekey"))
 	} else {
-		initUUIDGenerator()
-		initDB(cfg)
-		initEmailNotification(cfg)
-		initProcessor(cfg)
-		initCleanKill()
-		initLogin(cfg)
-
-		iTOLKey = cfg.GetString("itol.key")
-		iTOLProject = cfg.GetString("itol.project")
-		log.Print(fmt.Sprintf("iTOLKey: %v", iTOLKey))
-		log.Print(fmt.Sprintf("iTOLProject: %v", iTOLProject))
-
-		/* HTML handlers */
-		http.HandleFunc("/new/", validateHtml(newHandler, false))                       /* Handler for input form */
-		http.HandleFunc("/monitor", validateHtml(monitorHandler, true))                 /* Handler for input form */
-		http.HandleFunc("/run", validateHtml(runHandler, false))                        /* Handler for running a new analysis */
-		http.HandleFunc("/view/", validateHtml(makeHandler(viewHandler), false))        /* Handler for viewing analysis results */
-		http.HandleFunc("/itol/", validateHtml(makeRawNormHandler(itolHandler), false)) /* Handler for uploading tree to itol */
-		http.HandleFunc("/help", validateHtml(helpHandler, false))                      /* Handler for the help page */
-		http.HandleFunc("/", validateHtml(indexHandler, false))                         /* Home Page*/
-		http.HandleFunc("/login", loginHandler)                                         /* Handler for login */
-		http.HandleFunc("/settoken", setToken)                                          /* Set token in cookie via form post */
-		http.HandleFunc("/gettoken", getToken)                                          /* get token via api using json post data */
-		http.HandleFunc("/logout", validateHtml(logout, false))                         /* Handler for logout */
-
-		/* Api handlers */
-		http.HandleFunc("/api/analysis/", validateApi(makeApiAnalysisHandler(apiAnalysisHandler), false)) /* Handler for returning an analysis */
-		http.HandleFunc("/api/monitor", validateApi(makeApiMonitorHandler(apiMonitorHandler), true))      /* Handler for monitoring the server */
-		http.HandleFunc("/api/image/", validateApi(makeApiImageHandler(apiImageHandler), false))          /* Handler for returning a tree image */
-		http.HandleFunc("/api/randrunname", validateApi(makeApiRandomHandler(apiRandNameGeneratorHandler), false))
-		http.HandleFunc("/status", validateApi(apiStatus, false))      /* Handler for getting server status */
-		http.HandleFunc("/api/", validateApi(makeApiHandler(), false)) /* Default API handler */
+		log.Print("itol.profilekey is not set: user profiles are disabled")
 	}
+	log.Print(fmt.Sprintf("iTOLKey: %v", iTOLKey))
+	log.Print(fmt.Sprintf("iTOLProject: %v", iTOLProject))
+
+	/* HTML handlers */
+	http.HandleFunc("/new/", validateHtml(newHandler, false))                                                  /* Handler for input form */
+	http.HandleFunc("/monitor", validateHtml(monitorHandler, true))                                            /* Handler for input form */
+	http.HandleFunc("/run", validateHtml(refuseSubmissions(runHandler, false), false))                         /* Handler for running a new analysis */
+	http.HandleFunc("/resubmit/", validateHtml(refuseSubmissions(makeHandler(resubmitHandler), false), false)) /* Handler for resubmitting an analysis */
+	http.HandleFunc("/view/", validateHtml(makeHandler(viewHandler), false))                                   /* Handler for viewing analysis results */
+	http.HandleFunc("/itol/", validateHtml(makeRawNormHandler(itolHandler), false))                            /* Handler for uploading tree to itol */
+	http.HandleFunc("/compare/", validateHtml(makeCompareHandler(compareHandler), false))                      /* Handler for comparing two analyses */
+	http.HandleFunc("/profile", validateHtml(profileHandler, false))                                           /* Handler for the user profile */
+	http.HandleFunc("/help", validateHtml(helpHandler, false))                                                 /* Handler for the help page */
+	http.HandleFunc("/", validateHtml(indexHandler, false))                                                    /* Home Page*/
+	http.HandleFunc("/login", loginHandler)                                                                    /* Handler for login */
+	http.HandleFunc("/settoken", setToken)                                                                     /* Set token in cookie via form post */
+	http.HandleFunc("/gettoken", getToken)                                                                     /* get token via api using json post data */
+	http.HandleFunc("/logout", validateHtml(logout, false))                                                    /* Handler for logout */
+
+	/* Api handlers */
+	http.HandleFunc("/api/analysis/", validateApi(makeApiAnalysisHandler(apiAnalysisHandler), false))                          /* Handler for returning an analysis */
+	http.HandleFunc("/api/resubmit/", validateApi(refuseSubmissions(makeApiAnalysisHandler(apiResubmitHandler), true), false)) /* Handler for resubmitting an analysis */
+	http.HandleFunc("/api/maintenance", validateApi(apiMaintenanceHandler, true))                                              /* Handler for entering and leaving maintenance */
+	http.HandleFunc("/api/monitor", validateApi(makeApiMonitorHandler(apiMonitorHandler), true))                               /* Handler for monitoring the server */
+	http.HandleFunc("/api/image/", validateApi(makeApiImageHandler(apiImageHandler), false))                                   /* Handler for returning a tree image */
+	http.HandleFunc("/api/itol/", validateApi(makeApiItolHandler(apiItolHandler), false))                                      /* Handler for downloading iTOL annotations */
+	http.HandleFunc("/api/compare/", validateApi(makeCompareHandler(apiCompareHandler), false))                                /* Handler for comparing two analyses */
+	http.HandleFunc("/api/validate", validateApi(apiValidateHandler, false))                                                   /* Handler for validating input files */
+	http.HandleFunc("/api/randrunname", validateApi(makeApiRandomHandler(apiRandNameGeneratorHandler), false))
+	http.HandleFunc("/status", validateApi(apiStatus, false))      /* Handler for getting server status */
+	http.HandleFunc("/api/", validateApi(makeApiHandler(), false)) /* Default API handler */
+
+	/* Versioned API handlers, older API handlers are kept for compatibility */
+	http.Handle(API_V1_PREFIX+"/", newApiV1Router())
 	port := cfg.GetInt("http.port")
 	if port == 0 {
 		port = HTTP_PORT_DEFAULT
 	}
 	log.Print(fmt.Sprintf("HTTP port: %d", port))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	stopped := initCleanKill(cfg, srv)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Waits for the running jobs and the database
+	<-stopped
+	log.Print("booster-web stopped")
 }
 
 func initProcessor(cfg config.Provider) {
@@ -247,8 +315,6 @@ func initProcessor(cfg config.Provider) {
 	proctype := cfg.GetString("runners.type")
 	requestattempts := cfg.GetInt("galaxy.requestattempts")
 	boosterid := cfg.GetString("galaxy.tools.booster")
-	phymlid := cfg.GetString("galaxy.tools.phyml")
-	fasttreeid := cfg.GetString("galaxy.tools.fasttree")
 
 	if requestattempts == 0 {
 		requestattempts = 1
@@ -256,8 +322,73 @@ func initProcessor(cfg config.Provider) {
 
 	galaxyprocessor = false
 
+	initInputDir(cfg)
+	initInputCleaner(cfg)
+
 	switch proctype {
 	case "galaxy":
+		galproc := newGalaxyProcessor(cfg, galaxyurl, galaxykey, boosterid, requestattempts, queuesize, timeout, memlimit)
+		galaxyprocessor = true
+		treeinference = true
+		workflows = galproc.Workflows()
+		aligntools = galproc.AlignmentTools()
+		proc = galproc
+	case "local", "":
+		// Local or not set
+		locproc := newLocalProcessor(cfg, nbrunners, queuesize, timeout, memlimit, jobthreads)
+		treeinference = locproc.CanInferTrees()
+		workflows = locproc.Workflows()
+		aligntools = locproc.AlignmentTools()
+		proc = locproc
+	case "hybrid":
+		// Jobs are routed between local and galaxy processors
+		galproc := newGalaxyProcessor(cfg, galaxyurl, galaxykey, boosterid, requestattempts, queuesize, timeout, memlimit)
+		locproc := newLocalProcessor(cfg, nbrunners, queuesize, timeout, memlimit, jobthreads)
+		routproc := &processor.RoutingProcessor{}
+		routproc.AddProcessor(model.PROCESSOR_GALAXY, galproc)
+		routproc.AddProcessor(model.PROCESSOR_LOCAL, locproc)
+		initRoutingRules(cfg, routproc)
+		routproc.InitProcessor(cfg.GetString("runners.routing.default"), registry.All(), db)
+		galaxyprocessor = true
+		treeinference = true
+		workflows = unionInts(galproc.Workflows(), locproc.Workflows())
+		aligntools = unionStrings(galproc.AlignmentTools(), locproc.AlignmentTools())
+		proc = routproc
+	case "distributed":
+		// Analyses are run by booster-web worker processes, with the
+		// local tools of the configuration
+		if cfg.GetString("database.type") != "mysql" {
+			log.Fatal("runners.type=distributed needs a mysql database shared with the workers")
+		}
+		locproc := &processor.LocalProcessor{}
+		initLocalInference(cfg, locproc)
+		initLocalAlignment(cfg, locproc)
+		if inputdir == "" {
+			log.Print("No runners.distributed.shareddir: workers must run on this host")
+		}
+		distproc := &processor.DistributedProcessor{}
+		distproc.InitProcessor(time.Duration(cfg.GetInt("runners.distributed.lease"))*time.Second, db)
+		treeinference = locproc.CanInferTrees()
+		workflows = locproc.Workflows()
+		aligntools = locproc.AlignmentTools()
+		proc = distproc
+	case "slurm":
+		// Booster is run on a slurm cluster, on given trees only
+		proc = newSlurmProcessor(cfg, queuesize, timeout, memlimit, jobthreads)
+		treeinference = false
+		workflows = []int{}
+		aligntools = []string{}
+	default:
+		log.Fatal(errors.New("No processor named " + proctype))
+	}
+
+}
+
+// Initializes the galaxy processor, with its galaxy servers,
+// alignment tools and monitoring
+func newGalaxyProcessor(cfg config.Provider, galaxyurl, galaxykey, boosterid string, requestattempts, queuesize, timeout, memlimit int) *processor.GalaxyProcessor {
+	galproc := &processor.GalaxyProcessor{}
+	if !initGalaxyBackends(cfg, galproc, boosterid) {
 		if galaxyurl == "" {
 			log.Fatal("galaxyurl must be provided in configuration file when type=galaxy")
 		}
@@ -267,61 +398,328 @@ func initProcessor(cfg config.Provider) {
 		if boosterid == "" {
 			log.Fatal("booster tool id  must be provided in configuration file when type=galaxy")
 		}
-		if phymlid == "" {
-			log.Fatal("phyml-sms tool id  must be provided in configuration file when type=galaxy")
-		}
-		if fasttreeid == "" {
-			log.Fatal("fasttree tool id  must be provided in configuration file when type=galaxy")
+	}
+	initGalaxyAlignment(cfg, galproc)
+	initRetryPolicies(cfg, []string{model.FAILURE_API, model.FAILURE_JOB, model.FAILURE_TIMEOUT}, galproc.SetRetryPolicy)
+	galproc.SetMonitorConfig(processor.MonitorConfig{
+		Workers:          cfg.GetInt("galaxy.monitor.workers"),
+		Interval:         time.Duration(cfg.GetInt("galaxy.monitor.interval")) * time.Second,
+		MaxBackoff:       time.Duration(cfg.GetInt("galaxy.monitor.maxbackoff")) * time.Second,
+		GracePeriod:      time.Duration(cfg.GetInt("galaxy.monitor.graceperiod")) * time.Second,
+		BreakerThreshold: cfg.GetInt("galaxy.monitor.breakerthreshold"),
+		BreakerCooldown:  time.Duration(cfg.GetInt("galaxy.monitor.breakercooldown")) * time.Second,
+		CleanupInterval:  time.Duration(cfg.GetInt("galaxy.cleanup.interval")) * time.Second,
+		OrphanAge:        time.Duration(cfg.GetInt("galaxy.cleanup.orphanage")) * time.Second,
+	})
+	galproc.InitProcessor(galaxyurl, galaxykey, boosterid, registry.All(), requestattempts, db, emailNotifier, queuesize, timeout, memlimit)
+	return galproc
+}
+
+// Initializes the local processor, with the tree inference
+// and alignment tools found on the system
+func newLocalProcessor(cfg config.Provider, nbrunners, queuesize, timeout, memlimit, jobthreads int) *processor.LocalProcessor {
+	locproc := &processor.LocalProcessor{}
+	initLocalInference(cfg, locproc)
+	initLocalAlignment(cfg, locproc)
+	locproc.SetMemory(int64(memlimit), int64(cfg.GetInt("runners.localmemory")))
+	initRetryPolicies(cfg, []string{model.FAILURE_TIMEOUT}, locproc.SetRetryPolicy)
+	switch isolation := cfg.GetString("runners.isolation"); isolation {
+	case "worker":
+		// Supports are computed in subprocesses of this executable
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
 		}
-		galproc := &processor.GalaxyProcessor{}
-		galaxyprocessor = true
-		galproc.InitProcessor(galaxyurl, galaxykey, boosterid, phymlid, fasttreeid, requestattempts, db, emailNotifier, queuesize, timeout, memlimit)
-		proc = galproc
-	case "local", "":
-		// Local or not set
-		locproc := &processor.LocalProcessor{}
-		locproc.InitProcessor(nbrunners, queuesize, timeout, jobthreads, db, emailNotifier)
-		proc = locproc
+		locproc.SetWorker(processor.WorkerConfig{
+			Path:     exe,
+			MemLimit: int64(memlimit),
+			Cgroup:   cfg.GetString("runners.worker.cgroup"),
+		})
+	case "":
 	default:
-		log.Fatal(errors.New("No processor named " + proctype))
+		log.Fatal(errors.New("Unknown runners.isolation: " + isolation))
 	}
+	locproc.InitProcessor(nbrunners, queuesize, timeout, jobthreads, db, emailNotifier)
+	return locproc
+}
 
+// Input files of the analyses are written in runners.inputs.dir, or in
+// the directory shared with the workers (type=distributed). If
+// runners.inputs.keep is set, they are kept after the analyses, so that
+// they can be resubmitted.
+func initInputDir(cfg config.Provider) {
+	inputdir = cfg.GetString("runners.inputs.dir")
+	if shared := cfg.GetString("runners.distributed.shareddir"); shared != "" && cfg.GetString("runners.type") == "distributed" {
+		inputdir = shared
+	}
+	model.KeepInputs = cfg.GetBool("runners.inputs.keep")
+	if model.KeepInputs && inputdir == "" {
+		log.Fatal("runners.inputs.dir must be provided in configuration file to keep input files")
+	}
+	if inputdir == "" {
+		return
+	}
+	if err := os.MkdirAll(inputdir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	log.Print("Input files directory: " + inputdir)
 }
 
-func initUUIDGenerator() {
-	uuids = make(chan string, 100)
-	// The uuid generator will put uuids in the channel
-	// When a new analysis is launched, one uuid will be taken
-	// from the channel
+// Deletes the kept input files older than runners.inputs.keepdays
+// (default database.keepold) once a day
+func initInputCleaner(cfg config.Provider) {
+	days := cfg.GetInt("database.keepold")
+	if cfg.IsSet("runners.inputs.keepdays") {
+		days = cfg.GetInt("runners.inputs.keepdays")
+	}
+	if !model.KeepInputs || days <= 0 {
+		return
+	}
 	go func() {
 		for {
-			u, err := uuid.NewV4()
+			entries, err := ioutil.ReadDir(inputdir)
 			if err != nil {
-				log.Print(err)
-			} else {
-				uuids <- u.String()
+				log.Print("Error while deleting old input files: " + err.Error())
+			}
+			for _, e := range entries {
+				if e.IsDir() && time.Since(e.ModTime()) > time.Duration(days*24)*time.Hour {
+					if err = os.RemoveAll(filepath.Join(inputdir, e.Name())); err != nil {
+						log.Print(err)
+					}
+				}
 			}
+			time.Sleep(24 * time.Hour)
 		}
 	}()
 }
 
-func initCleanKill() {
+// Reads the retry policies of the failure classes: runners.retry.<class>.attempts|backoff
+func initRetryPolicies(cfg config.Provider, classes []string, set func(class string, policy processor.RetryPolicy)) {
+	for _, class := range classes {
+		prefix := "runners.retry." + class
+		if attempts := cfg.GetInt(prefix + ".attempts"); attempts > 1 {
+			set(class, processor.RetryPolicy{
+				Attempts: attempts,
+				Backoff:  time.Duration(cfg.GetInt(prefix+".backoff")) * time.Second,
+			})
+			log.Print(fmt.Sprintf("Retry policy %s: %d attempts", class, attempts))
+		}
+	}
+}
+
+// Initializes the slurm processor, with the scheduler
+// commands and the shared directory
+func newSlurmProcessor(cfg config.Provider, queuesize, timeout, memlimit, jobthreads int) *processor.SlurmProcessor {
+	workdir := cfg.GetString("runners.slurm.workdir")
+	if workdir == "" {
+		log.Fatal("runners.slurm.workdir must be provided in configuration file when type=slurm")
+	}
+	slurmproc := &processor.SlurmProcessor{}
+	slurmproc.InitProcessor(processor.SlurmConfig{
+		Sbatch:    cfg.GetString("runners.slurm.sbatch"),
+		Squeue:    cfg.GetString("runners.slurm.squeue"),
+		Sacct:     cfg.GetString("runners.slurm.sacct"),
+		Scancel:   cfg.GetString("runners.slurm.scancel"),
+		Booster:   cfg.GetString("runners.slurm.booster"),
+		WorkDir:   workdir,
+		Partition: cfg.GetString("runners.slurm.partition"),
+		Options:   cfg.GetStringSlice("runners.slurm.options"),
+		Interval:  time.Duration(cfg.GetInt("runners.slurm.interval")) * time.Second,
+		Timeout:   time.Duration(cfg.GetInt("runners.slurm.commandtimeout")) * time.Second,
+	}, queuesize, timeout, memlimit, jobthreads, db, emailNotifier)
+	return slurmproc
+}
+
+// Adds the routing rules given in the runners.routing.rules
+// array of tables to the routing processor
+func initRoutingRules(cfg config.Provider, routproc *processor.RoutingProcessor) {
+	ids := map[string]int{"booster": model.WORKFLOW_NIL}
+	for _, w := range registry.All() {
+		ids[w.Key] = w.Id
+	}
+
+	rules, _ := cfg.Get("runners.routing.rules").([]interface{})
+	for i, r := range rules {
+		fields, ok := r.(map[string]interface{})
+		if !ok {
+			log.Fatal(fmt.Sprintf("Routing rule %d: malformed rule", i+1))
+		}
+		rule := processor.RoutingRule{
+			MaxTips:   int(configNumber(fields["maxtips"])),
+			MaxBoot:   int(configNumber(fields["maxboot"])),
+			MaxMemory: configNumber(fields["maxmemory"]),
+			MaxLoad:   configNumber(fields["maxload"]),
+		}
+		rule.Processor, _ = fields["processor"].(string)
+		wfs, _ := fields["workflows"].([]interface{})
+		for _, key := range wfs {
+			id, ok := ids[fmt.Sprintf("%v", key)]
+			if !ok {
+				log.Fatal(fmt.Sprintf("Routing rule %d: unknown workflow %v", i+1, key))
+			}
+			rule.Workflows = append(rule.Workflows, id)
+		}
+		routproc.AddRule(rule)
+	}
+}
+
+// Returns the numeric value of a configuration field (0 if not a number)
+func configNumber(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT)
+func unionInts(a, b []int) (union []int) {
+	seen := make(map[int]bool)
+	union = make([]int, 0, len(a)+len(b))
+	for _, v := range append(append([]int{}, a...), b...) {
+		if !seen[v] {
+			seen[v] = true
+			union = append(union, v)
+		}
+	}
+	sort.Ints(union)
+	return
+}
 
+func unionStrings(a, b []string) (union []string) {
+	seen := make(map[string]bool)
+	union = make([]string, 0, len(a)+len(b))
+	for _, v := range append(append([]string{}, a...), b...) {
+		if !seen[v] {
+			seen[v] = true
+			union = append(union, v)
+		}
+	}
+	sort.Strings(union)
+	return
+}
+
+// Loads the workflow registry: built-in workflows + configuration
+func initWorkflows(cfg config.Provider) {
+	var err error
+	if registry, err = workflow.NewRegistry(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Registers local tree inference tools found on the system
+// for the workflows of the registry
+func initLocalInference(cfg config.Provider, locproc *processor.LocalProcessor) {
+	inferers := make(map[string]processor.TreeInferer)
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.fasttree"), "FastTreeMP", "FastTree", "fasttree"); err == nil {
+		inferers[processor.TOOL_FASTTREE] = &processor.FastTreeInferer{Path: path}
+	}
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.phyml"), "phyml"); err == nil {
+		inferers[processor.TOOL_PHYML] = &processor.PhyMLInferer{Path: path}
+	}
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.iqtree"), "iqtree2", "iqtree"); err == nil {
+		inferers[processor.TOOL_IQTREE] = &processor.IQTreeInferer{Path: path}
+	}
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.raxmlng"), "raxml-ng"); err == nil {
+		inferers[processor.TOOL_RAXMLNG] = &processor.RAxMLNGInferer{Path: path}
+	}
+
+	for _, w := range registry.All() {
+		tool := cfg.GetString("runners.workflows." + w.Key)
+		if tool == "" {
+			tool = w.LocalTool
+		}
+		if tool == "" {
+			continue
+		}
+		if inferer, ok := inferers[tool]; ok {
+			locproc.SetTreeInferer(w.Id, inferer)
+			log.Print(fmt.Sprintf("Local tree inference for workflow %s: %s", w.Name, inferer.Name()))
+		} else {
+			log.Print(fmt.Sprintf("No local tool %s found for workflow %s", tool, w.Name))
+		}
+	}
+}
+
+// Registers local alignment and trimming tools found on the system
+func initLocalAlignment(cfg config.Provider, locproc *processor.LocalProcessor) {
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.mafft"), "mafft"); err == nil {
+		locproc.SetAlignmentTool(model.ALIGNER_MAFFT, &processor.MafftAligner{Path: path})
+	}
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.muscle"), "muscle"); err == nil {
+		locproc.SetAlignmentTool(model.ALIGNER_MUSCLE, &processor.MuscleAligner{Path: path})
+	}
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.trimal"), "trimal"); err == nil {
+		locproc.SetAlignmentTool(model.TRIMMER_TRIMAL, &processor.TrimAlTrimmer{Path: path})
+	}
+	if path, err := processor.FindTool(cfg.GetString("runners.tools.bmge"), "bmge", "BMGE"); err == nil {
+		locproc.SetAlignmentTool(model.TRIMMER_BMGE, &processor.BMGETrimmer{Path: path})
+	}
+	for _, key := range locproc.AlignmentTools() {
+		log.Print(fmt.Sprintf("Local alignment tool: %s", model.AlignToolName(key)))
+	}
+}
+
+// Registers the galaxy alignment and trimming tools given in the configuration
+// Adds the galaxy servers given in the galaxy.backends section
+// to the galaxy processor. Returns false if there are none.
+func initGalaxyBackends(cfg config.Provider, galproc *processor.GalaxyProcessor, boosterid string) bool {
+	names := make([]string, 0)
+	for name := range cfg.GetStringMap("galaxy.backends") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prefix := "galaxy.backends." + name
+		b := processor.GalaxyBackend{
+			Name:     name,
+			Url:      cfg.GetString(prefix + ".url"),
+			ApiKey:   cfg.GetString(prefix + ".key"),
+			Capacity: cfg.GetInt(prefix + ".capacity"),
+			Tools:    cfg.GetStringMapString(prefix + ".tools"),
+		}
+		if b.Url == "" || b.ApiKey == "" {
+			log.Fatal("url and key must be provided for galaxy server " + name)
+		}
+		if boosterid == "" && b.Tools["booster"] == "" {
+			log.Fatal("booster tool id must be provided for galaxy server " + name)
+		}
+		galproc.AddBackend(b)
+	}
+	return len(names) > 0
+}
+
+func initGalaxyAlignment(cfg config.Provider, galproc *processor.GalaxyProcessor) {
+	for _, key := range []string{model.ALIGNER_MAFFT, model.ALIGNER_MUSCLE, model.TRIMMER_TRIMAL, model.TRIMMER_BMGE} {
+		id := cfg.GetString("galaxy.tools." + key)
+		if id == "" {
+			continue
+		}
+		galproc.SetAlignmentTool(key, processor.GalaxyAlignTool{
+			Id:         id,
+			Input:      cfg.GetString("galaxy.alignment." + key + ".input"),
+			Output:     cfg.GetString("galaxy.alignment." + key + ".output"),
+			Parameters: cfg.GetStringMapString("galaxy.alignment." + key + ".parameters"),
+		})
+	}
+}
+
+func initUUIDGenerator() {
+	uuids = make(chan string, 100)
+	// The uuid generator will put uuids in the channel
+	// When a new analysis is launched, one uuid will be taken
+	// from the channel
 	go func() {
-		for sig := range c {
-			log.Print(sig)
-			//proc.CancelAnalyses()
-			if err := db.Disconnect(); err != nil {
+		for {
+			u, err := uuid.NewV4()
+			if err != nil {
 				log.Print(err)
+			} else {
+				uuids <- u.String()
 			}
-			os.Exit(1)
 		}
 	}()
 }
@@ -410,7 +808,7 @@ func initEmailNotification(cfg config.Provider) {
 		pass := cfg.GetString("notification.pass")
 		sender := cfg.GetString("notification.sender")
 		resultpage := cfg.GetString("notification.resultpage")
-		emailNotifier = notification.NewEmailNotifier(smtp, port, user, pass, sender, resultpage)
+		emailNotifier = notification.NewEmailNotifier(smtp, port, user, pass, sender, resultpage, registry)
 		emailnotification = true
 	} else {
 		emailNotifier = notification.NewNullNotifier()
@@ -423,7 +821,8 @@ func initEmailNotification(cfg config.Provider) {
 func newAnalysis(refalign multipart.File, refalignheader *multipart.FileHeader,
 	reffile multipart.File, refheader *multipart.FileHeader,
 	bootfile multipart.File, bootheader *multipart.FileHeader,
-	email, runname string, nbootrep int, workflow string) (a *model.Analysis, err error) {
+	email, runname string, nbootrep int, workflow string, options map[string]string,
+	aligner, trimmer string) (a *model.Analysis, err error) {
 
 	var uuid string
 	var dir string
@@ -441,68 +840,100 @@ func newAnalysis(refalign multipart.File, refalignheader *multipart.FileHeader,
 	a.StartPending = time.Now().Format(time.RFC1123)
 
 	/* tmp analysis folder */
-	if dir, err = ioutil.TempDir("", uuid); err != nil {
+	if dir, err = ioutil.TempDir(inputdir, uuid); err != nil {
 		log.Printf("Tmp analysis folder error: %v", err)
 		return
 	}
 
-	// Reference sequences if given
-	if refalignheader != nil && refalignheader.Size != 0 {
-		// We parse it while detecting automaticall the format
-		var r *bufio.Reader
-		var al align.Alignment
+	// Unaligned sequences if given: aligned by the processor before inferring the trees
+	if refalignheader != nil && refalignheader.Size != 0 && aligner != "" {
+		var seqs align.SeqBag
 
-		if r, err = utils.GetReaderFromReader(utils.GzipExtension(refalignheader.Filename), refalign); err != nil {
-			log.Printf("GetReaderFromReader: %v", err)
+		if err = checkAlignmentTools(aligner, trimmer); err != nil {
 			log.Print(err)
+			err = badRequest(err)
 			return
 		}
-
-		if al, _, err = utils.ParseAlignmentAuto(r, false); err != nil {
-			log.Printf("ParseAlignmentAuto: %v", err)
-			log.Print(err)
+		report := validation.NewReport(nbootrep)
+		seqs = report.CheckSequences(refalign, utils.GzipExtension(refalignheader.Filename))
+		if err = report.Err(); err != nil {
+			log.Printf("CheckSequences: %v", err)
+			err = badRequest(err)
 			return
 		}
-
-		// Write alignment in fasta or in phylip depending on the workflow to launch: phyml or fasttree
-		if seqalignfile, err = writeAlign(al, dir, refalignheader, workflow); err != nil {
-			log.Print("WriteAlign seq: %v", err)
+		if seqalignfile, a.NameMap, err = writeSequences(seqs, dir, refalignheader); err != nil {
 			log.Print(err)
 			return
 		}
+		a.Aligner = aligner
+		a.Trimmer = trimmer
+		a.AlignAlphabet = seqs.Alphabet()
+		a.AlignNbSeq = seqs.NbSequences()
+		// Length of the longest sequence, until aligned
+		a.AlignLength = report.Alignment.Length
+	}
 
-		a.Alignfile = fasta.WriteAlignment(al)
-		a.AlignAlphabet = al.Alphabet()
-		a.AlignNbSeq = al.NbSequences()
-		a.AlignLength = al.Length()
+	// Reference sequences if given
+	if refalignheader != nil && refalignheader.Size != 0 {
+		if aligner == "" {
+			// We parse and check it while detecting automaticall the format
+			var al align.Alignment
+
+			report := validation.NewReport(nbootrep)
+			al = report.CheckAlignment(refalign, utils.GzipExtension(refalignheader.Filename))
+			if err = report.Err(); err != nil {
+				log.Printf("CheckAlignment: %v", err)
+				err = badRequest(err)
+				return
+			}
+
+			// Write alignment in fasta or in phylip depending on the workflow to launch: phyml or fasttree
+			if seqalignfile, a.NameMap, err = writeAlign(al, dir, refalignheader, workflow); err != nil {
+				log.Print("WriteAlign seq: %v", err)
+				log.Print(err)
+				return
+			}
+			processor.SetAlignment(a, al)
+		}
 
 		// Given workflow to launch does not exist
 		if a.Workflow, err = model.WorkflowConst(workflow); err != nil {
 			log.Print("WorkflowConst: %v", err)
 			log.Print(err)
+			err = badRequest(err)
 			return
 		}
-		log.Print(fmt.Sprintf("New %s (%d boot) + booster analysis submited | id=%s | ", workflow, a.NbootRep, a.Id))
+		// Given options are not valid for the workflow
+		if wf, ok := registry.Get(a.Workflow); ok {
+			if a.Options, err = wf.CheckOptions(options); err != nil {
+				log.Print(err)
+				err = badRequest(err)
+				return
+			}
+		}
+		if a.Aligner != "" {
+			log.Print(fmt.Sprintf("New %s alignment + %s (%d boot) + booster analysis submited | id=%s | ", a.AlignerStr(), workflow, a.NbootRep, a.Id))
+		} else {
+			log.Print(fmt.Sprintf("New %s (%d boot) + booster analysis submited | id=%s | ", workflow, a.NbootRep, a.Id))
+		}
 
 	} else {
 		log.Print(fmt.Sprintf("New booster analysis submited | id=%s | ", a.Id))
 
-		if treefile, err = copyTreeFile(dir, reffile, refheader); err != nil {
+		if treefile, _, a.RefTips, err = copyTreeFile(dir, reffile, refheader); err != nil {
 			err = errors.New("Reference tree : Newick format error (" + err.Error() + ")")
 			log.Print(err)
-			return nil, err
+			return nil, badRequest(err)
 		}
-		if boottreefile, err = copyTreeFile(dir, bootfile, bootheader); err != nil {
+		if boottreefile, a.BootTrees, _, err = copyTreeFile(dir, bootfile, bootheader); err != nil {
 			err = errors.New("Bootstrap trees : Newick format error (" + err.Error() + ")")
 			log.Print(err)
-			return nil, err
+			return nil, badRequest(err)
 		}
 
-		if err = testSameTips(treefile, boottreefile); err != nil {
-			log.Print(err)
-			err = errors.New("Reference and bootstrap trees do not have the same tip names")
+		if err = checkTreeFiles(treefile, boottreefile); err != nil {
 			log.Print(err)
-			return nil, err
+			return nil, badRequest(err)
 		}
 	}
 
@@ -514,6 +945,102 @@ func newAnalysis(refalign multipart.File, refalignheader *multipart.FileHeader,
 	return
 }
 
+// Creates a new analysis with the input files of the ended analysis
+// id, and launches it. Input files are kept only if runners.inputs.keep
+// is set, or if the analysis was not run yet.
+func resubmitAnalysis(id string) (a *model.Analysis, err error) {
+	var orig *model.Analysis
+	var dir string
+	var inputs []string
+
+	if orig, err = getAnalysis(id); err != nil {
+		return
+	}
+	if !orig.Ended() {
+		err = newRequestError(http.StatusConflict, API_ERROR_CONFLICT, errors.New("Only finished, failed, timed out or canceled analyses can be resubmitted"))
+		return
+	}
+	if orig.SeqAlign != "" {
+		inputs = []string{orig.SeqAlign}
+	} else {
+		inputs = []string{orig.Reffile, orig.Bootfile}
+	}
+	for _, f := range inputs {
+		if _, err = os.Stat(f); f == "" || err != nil {
+			err = newRequestError(http.StatusConflict, API_ERROR_CONFLICT, errors.New("The input files of this analysis are not available anymore, please submit them again"))
+			return
+		}
+	}
+
+	uuid := <-uuids
+	if dir, err = ioutil.TempDir(inputdir, uuid); err != nil {
+		log.Printf("Tmp analysis folder error: %v", err)
+		return
+	}
+	for i, f := range inputs {
+		dest := filepath.Join(dir, filepath.Base(f))
+		if err = copyLocalFile(f, dest); err != nil {
+			log.Print(err)
+			os.RemoveAll(dir)
+			return
+		}
+		inputs[i] = dest
+	}
+
+	a = model.NewAnalysis()
+	a.Id = uuid
+	a.EMail = orig.EMail
+	a.RunName = orig.RunName
+	a.NbootRep = orig.NbootRep
+	a.Workflow = orig.Workflow
+	a.Options = orig.Options
+	a.NameMap = orig.NameMap
+	a.Aligner = orig.Aligner
+	a.Trimmer = orig.Trimmer
+	a.AlignAlphabet = orig.AlignAlphabet
+	a.AlignNbSeq = orig.AlignNbSeq
+	a.AlignLength = orig.AlignLength
+	a.AlignRawLength = orig.AlignRawLength
+	a.AlignGaps = orig.AlignGaps
+	a.RefTips = orig.RefTips
+	a.BootTrees = orig.BootTrees
+	a.Status = model.STATUS_PENDING
+	a.Nboot = 0
+	a.StartPending = time.Now().Format(time.RFC1123)
+	a.ResubmittedFrom = orig.Id
+	if orig.SeqAlign != "" {
+		a.SeqAlign = inputs[0]
+	} else {
+		a.Reffile = inputs[0]
+		a.Bootfile = inputs[1]
+	}
+
+	orig.ResubmittedAs = a.Id
+	if err = db.UpdateAnalysis(orig); err != nil {
+		log.Print(err)
+	}
+	log.Print(fmt.Sprintf("Analysis %s resubmitted | id=%s | ", orig.Id, a.Id))
+	err = proc.LaunchAnalysis(a)
+	return
+}
+
+// Copies the local file src to dest
+func copyLocalFile(src, dest string) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.Create(dest); err != nil {
+		return
+	}
+	if _, err = goio.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
+
 func getAnalysis(id string) (a *model.Analysis, err error) {
 	a, err = db.GetAnalysis(id)
 	return
@@ -542,10 +1069,12 @@ func copyFile(tmpdir string, infile multipart.File, infileheader *multipart.File
 }
 
 /*
-Clean tip names (remove spaces before and after tip names) and copy the tree file
-returns an error if the tree file is not in newick format
+Clean tip names (remove spaces before and after tip names) and copy the trees
+to a gzipped file of tmpdir
+returns the number of trees and the number of tips of the first tree, and
+an error if the tree file is not in newick format
 */
-func copyTreeFile(tmpdir string, infile multipart.File, infileheader *multipart.FileHeader) (fpath string, err error) {
+func copyTreeFile(tmpdir string, infile multipart.File, infileheader *multipart.FileHeader) (fpath string, nbtrees, nbtips int, err error) {
 	var treereader *bufio.Reader
 	var gzreader *gzip.Reader
 	var t tree.Trees
@@ -578,9 +1107,14 @@ func copyTreeFile(tmpdir string, infile multipart.File, infileheader *multipart.
 				return
 			}
 			// Clean tip names if needed
-			for _, t := range t.Tree.Tips() {
+			tips := t.Tree.Tips()
+			for _, t := range tips {
 				t.SetName(strings.TrimSpace(t.Name()))
 			}
+			if nbtrees == 0 {
+				nbtips = len(tips)
+			}
+			nbtrees++
 			// Write the to the output file */
 			gw.Write([]byte(t.Tree.Newick() + "\n"))
 		}
@@ -594,22 +1128,30 @@ func copyTreeFile(tmpdir string, infile multipart.File, infileheader *multipart.
 }
 
 // Write alignment in fasta or in phylip depending on the workflow to launch: phyml or fasttree
-func writeAlign(al align.Alignment, tmpdir string, infileheader *multipart.FileHeader, workflow string) (fpath string, err error) {
+//
+// Special characters of sequence names are replaced, and the mapping
+// between original and cleaned names is returned.
+func writeAlign(al align.Alignment, tmpdir string, infileheader *multipart.FileHeader, wfname string) (fpath string, namemap map[string]string, err error) {
 	var f *os.File
-	var wf int
-	if wf, err = model.WorkflowConst(workflow); err != nil {
+	wf, ok := registry.ByName(wfname)
+	if !ok {
+		err = errors.New(fmt.Sprintf("Phylogenetic workflow does not exist: %s", wfname))
 		log.Print(err)
 		return
 	}
 	if infileheader != nil {
+		// replace special characters from sequence names
+		if namemap, err = cleanNames(al); err != nil {
+			log.Print(err)
+			return
+		}
+
 		fname := strings.TrimSuffix(infileheader.Filename, ".gz")
 		fpath = filepath.Join(tmpdir, fname)
 		if f, err = os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, 0666); err != nil {
 			log.Print(err)
 		} else {
-			// replace special characters from sequence names
-			al.CleanNames(nil)
-			if wf == model.WORKFLOW_PHYML_SMS {
+			if wf.InputFormat == workflow.FORMAT_PHYLIP {
 				f.WriteString(phylip.WriteAlignment(al, false, false, false))
 			} else {
 				f.WriteString(fasta.WriteAlignment(al))
@@ -623,43 +1165,89 @@ func writeAlign(al align.Alignment, tmpdir string, infileheader *multipart.FileH
 	return
 }
 
-// Parses the two newick files in input and returns an error if the set of
-// tips are different between tree in ref and all tres in boot.
+// Parses and checks the two newick files in input, and returns an error
+// listing all the problems that prevent the analysis from running
+// (different sets of tips between ref and boot trees, duplicated tips, etc.).
 //
 // ref is considered as a unique tree file
 // boot is a multi newick file (bootstrap trees for example)
-func testSameTips(ref, boot string) (err error) {
-	var treereader *bufio.Reader
-	var treefile goio.Closer
-	var reftree *tree.Tree
-	var boottree tree.Trees
-	var trees <-chan tree.Trees
-
-	if treefile, treereader, err = utils.GetReader(ref); err != nil {
+// Writes the unaligned sequences in fasta, after replacing
+// special characters of their names
+func writeSequences(seqs align.SeqBag, tmpdir string, infileheader *multipart.FileHeader) (fpath string, namemap map[string]string, err error) {
+	if namemap, err = cleanNames(seqs); err != nil {
 		return
 	}
-	if reftree, err = newick.NewParser(treereader).Parse(); err != nil {
-		return
+	fname := strings.TrimSuffix(infileheader.Filename, ".gz")
+	fpath = filepath.Join(tmpdir, fname)
+	err = ioutil.WriteFile(fpath, []byte(fasta.WriteSequences(seqs)), 0666)
+	return
+}
+
+// Replaces special characters from sequence names, and returns the mapping
+// between original and cleaned names. Returns an error if two names are
+// identical once cleaned.
+func cleanNames(seqs align.SeqBag) (namemap map[string]string, err error) {
+	namemap = make(map[string]string)
+	seqs.CleanNames(namemap)
+	cleaned := make(map[string]string)
+	for orig, clean := range namemap {
+		if other, ok := cleaned[clean]; ok {
+			err = fmt.Errorf("Sequence names \"%s\" and \"%s\" are identical once special characters are replaced (%s)", other, orig, clean)
+			return
+		}
+		cleaned[clean] = orig
 	}
-	treefile.Close()
+	return
+}
 
-	/* Read bootstrap trees */
-	/* File reader (plain text or gzip) */
-	if treefile, treereader, err = utils.GetReader(boot); err != nil {
-		return
+// Checks that the given aligner and trimmer are available with the processor
+func checkAlignmentTools(aligner, trimmer string) (err error) {
+	if !model.IsAligner(aligner) {
+		return fmt.Errorf("Unknown aligner: %s", aligner)
 	}
-	defer treefile.Close()
-	trees = tutils.ReadMultiTrees(treereader, tutils.FORMAT_NEWICK)
-	reftree.UpdateTipIndex()
-	for boottree = range trees {
-		if boottree.Err != nil {
-			err = boottree.Err
-			return
+	if trimmer != "" && !model.IsTrimmer(trimmer) {
+		return fmt.Errorf("Unknown trimming tool: %s", trimmer)
+	}
+	for _, tool := range []string{aligner, trimmer} {
+		available := tool == ""
+		for _, t := range aligntools {
+			available = available || t == tool
 		}
-		boottree.Tree.UpdateTipIndex()
-		if err = reftree.CompareTipIndexes(boottree.Tree); err != nil {
-			return
+		if !available {
+			return fmt.Errorf("%s is not available on this server", model.AlignToolName(tool))
 		}
 	}
 	return
 }
+
+func checkTreeFiles(ref, boot string) (err error) {
+	var reffile, bootfile goio.Closer
+	var refreader, bootreader *bufio.Reader
+
+	if reffile, refreader, err = utils.GetReader(ref); err != nil {
+		return
+	}
+	defer reffile.Close()
+	if bootfile, bootreader, err = utils.GetReader(boot); err != nil {
+		return
+	}
+	defer bootfile.Close()
+
+	report := validation.NewReport(0)
+	report.CheckTrees(refreader, bootreader)
+	return report.Err()
+}
+
+// Returns the usage of galaxy histories if the processor
+// is a galaxy processor, nil otherwise
+func historyUsage() *processor.HistoryUsage {
+	p := proc
+	if routproc, ok := p.(*processor.RoutingProcessor); ok {
+		p = routproc.Processors()[model.PROCESSOR_GALAXY]
+	}
+	if galproc, ok := p.(*processor.GalaxyProcessor); ok {
+		u := galproc.HistoryUsage()
+		return &u
+	}
+	return nil
+}
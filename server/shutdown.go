@@ -0,0 +1,157 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/config"
+)
+
+const (
+	DRAIN_PERIOD_DEFAULT     = 60  // Seconds given to running jobs to finish when the server stops
+	SHUTDOWN_TIMEOUT_DEFAULT = 10  // Seconds given to http requests to finish when the server stops
+	STOPPING_RETRY_AFTER     = 120 // Seconds after which clients may submit again when the server stops
+)
+
+var stoppingLock sync.RWMutex
+var stopping bool // If the server is stopping: new analyses are refused
+
+func isStopping() bool {
+	stoppingLock.RLock()
+	defer stoppingLock.RUnlock()
+	return stopping
+}
+
+func setStopping() {
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	stopping = true
+}
+
+// Returns an unavailable error, and the number of seconds after which
+// clients may try again, if new analyses are refused because the server
+// is stopping or under maintenance
+func submissionRefusal() (retry int, err error) {
+	if isStopping() {
+		err = errors.New("Booster server is stopping, please try again in a few minutes")
+		retry = STOPPING_RETRY_AFTER
+	} else if msg, after, refused := maintenanceRefusal(); refused {
+		err = errors.New(msg)
+		retry = after
+	}
+	if err != nil {
+		err = newRequestError(http.StatusServiceUnavailable, API_ERROR_UNAVAILABLE, err)
+	}
+	return
+}
+
+// Refuses new analyses with a 503 status while the server is stopping
+// or under maintenance
+func refuseSubmissions(fn http.HandlerFunc, api bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		retry, err := submissionRefusal()
+		if err == nil {
+			fn(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		if api {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			apiError(w, err)
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			errorHandler(w, r, err)
+		}
+	}
+}
+
+// Stops the server gracefully on SIGTERM (and SIGINT, SIGHUP, SIGQUIT):
+//  1. New analyses are refused;
+//  2. Running jobs have runners.drainperiod seconds to finish, and are
+//     canceled afterwards (see processor Drain);
+//  3. Http requests have http.shutdowntimeout seconds to finish;
+//  4. The database is disconnected.
+//
+// The returned channel is closed when the server is stopped.
+//
+// A second signal stops the server immediately.
+func initCleanKill(cfg config.Provider, srv *http.Server) (stopped chan bool) {
+	drain := DRAIN_PERIOD_DEFAULT
+	if cfg.IsSet("runners.drainperiod") {
+		drain = cfg.GetInt("runners.drainperiod")
+	}
+	shutdown := SHUTDOWN_TIMEOUT_DEFAULT
+	if cfg.IsSet("http.shutdowntimeout") {
+		shutdown = cfg.GetInt("http.shutdowntimeout")
+	}
+	log.Print(fmt.Sprintf("Drain period: %ds", drain))
+	log.Print(fmt.Sprintf("Shutdown timeout: %ds", shutdown))
+
+	stopped = make(chan bool)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+
+	go func() {
+		log.Print(fmt.Sprintf("%v: stopping booster-web", <-c))
+		go func() {
+			log.Print(fmt.Sprintf("%v: booster-web stopped without draining", <-c))
+			os.Exit(1)
+		}()
+
+		setStopping()
+		if proc != nil {
+			if err := proc.Drain(time.Duration(drain) * time.Second); err != nil {
+				log.Print(err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdown)*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+		if err := db.Disconnect(); err != nil {
+			log.Print(err)
+		}
+		close(stopped)
+	}()
+	return
+}
@@ -113,36 +113,40 @@ func getToken(res http.ResponseWriter, req *http.Request) {
 	} else if err2 := json.Unmarshal(body, &authjson); err2 != nil {
 		answer.Status = 1
 		answer.Message = err2.Error()
-	} else {
-		if Username != "" && authjson.Username == Username && Password != "" && authjson.Password == Password {
-			// Expires the token and cookie in 1 hour
-			expireToken := time.Now().Add(time.Hour * 10).Unix()
-
-			// We'll manually assign the claims but in production you'd insert values from a database
-			claims := Claims{
-				Username,
-				jwt.StandardClaims{
-					ExpiresAt: expireToken,
-					Issuer:    "booster.pasteur.fr",
-				},
-			}
-
-			// Create the token using your claims
-			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-			// Signs the token with a secret.
-			signedToken, _ := token.SignedString(mySigningKey)
-			answer.Token = signedToken
-		} else {
-			answer.Status = 1
-			answer.Message = "Wrong Credentials"
-		}
+	} else if answer.Token, err = newApiToken(authjson.Username, authjson.Password); err != nil {
+		answer.Status = 1
+		answer.Message = err.Error()
 	}
 	if err := json.NewEncoder(res).Encode(answer); err != nil {
 		log.Print(err)
 	}
 }
 
+// Returns a new api token, valid 10 hours, if the credentials are right
+func newApiToken(user, pass string) (signedToken string, err error) {
+	if Username == "" || user != Username || Password == "" || pass != Password {
+		err = errors.New("Wrong Credentials")
+		return
+	}
+	// Expires the token in 10 hours
+	expireToken := time.Now().Add(time.Hour * 10).Unix()
+
+	// We'll manually assign the claims but in production you'd insert values from a database
+	claims := Claims{
+		Username,
+		jwt.StandardClaims{
+			ExpiresAt: expireToken,
+			Issuer:    "booster.pasteur.fr",
+		},
+	}
+
+	// Create the token using your claims
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	// Signs the token with a secret.
+	return token.SignedString(mySigningKey)
+}
+
 // Middleware to protect private pages
 func validateHtml(page http.HandlerFunc, force bool) http.HandlerFunc {
 	if Authent || force {
@@ -189,45 +193,14 @@ func validateHtml(page http.HandlerFunc, force bool) http.HandlerFunc {
 func validateApi(page http.HandlerFunc, force bool) http.HandlerFunc {
 	if Authent || force {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-
-			var val string
-			// If no Auth cookie is set then we look at request bearer auth header
-			cookie, err := req.Cookie("Auth")
-			if err != nil {
-				// Get token from the Authorization header
-				// format: Authorization: Bearer
-				tokens, ok := req.Header["Authorization"]
-				if ok && len(tokens) >= 1 {
-					val = tokens[0]
-					val = strings.TrimPrefix(val, "Bearer ")
-				}
-			} else {
-				val = cookie.Value
-			}
-
-			//fmt.Println(val)
-
-			// Return a Token using the value of the cookie or the bearer
-			token, err := jwt.ParseWithClaims(val, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-				// Make sure token's signature wasn't changed
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("Unexpected siging method")
-				}
-				return mySigningKey, nil
-			})
+			claims, err := requestClaims(req)
 			if err != nil {
 				apiError(res, err)
 				return
 			}
-
-			// Grab the tokens claims and pass it into the original request
-			if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-				ctx := context.WithValue(req.Context(), MyKey, *claims)
-				page(res, req.WithContext(ctx))
-			} else {
-				apiError(res, errors.New("Problem with authentication token"))
-				return
-			}
+			// Pass the tokens claims into the original request
+			ctx := context.WithValue(req.Context(), MyKey, *claims)
+			page(res, req.WithContext(ctx))
 		})
 	} else {
 		/* We return a handler without authentication (it does nothing) */
@@ -238,6 +211,44 @@ func validateApi(page http.HandlerFunc, force bool) http.HandlerFunc {
 	}
 }
 
+// Returns the claims of the api token given in the Auth cookie,
+// or in the Authorization header of the request
+func requestClaims(req *http.Request) (claims *Claims, err error) {
+	var val string
+	// If no Auth cookie is set then we look at request bearer auth header
+	cookie, err := req.Cookie("Auth")
+	if err != nil {
+		// Get token from the Authorization header
+		// format: Authorization: Bearer
+		tokens, ok := req.Header["Authorization"]
+		if ok && len(tokens) >= 1 {
+			val = tokens[0]
+			val = strings.TrimPrefix(val, "Bearer ")
+		}
+	} else {
+		val = cookie.Value
+	}
+
+	// Return a Token using the value of the cookie or the bearer
+	token, err := jwt.ParseWithClaims(val, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		// Make sure token's signature wasn't changed
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected siging method")
+		}
+		return mySigningKey, nil
+	})
+	if err != nil {
+		return
+	}
+
+	// Grab the tokens claims
+	var ok bool
+	if claims, ok = token.Claims.(*Claims); !ok || !token.Valid {
+		err = errors.New("Problem with authentication token")
+	}
+	return
+}
+
 func protectedProfile(res http.ResponseWriter, req *http.Request) {
 	claims, ok := req.Context().Value(MyKey).(Claims)
 	if !ok {
@@ -0,0 +1,93 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/evolbioinfo/booster-web/config"
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/booster-web/processor"
+)
+
+// Starts a booster-web worker: the analyses stored by servers with
+// runners.type="distributed" are claimed from the shared database
+// and run with a local processor, until the worker is stopped.
+//
+// The worker uses the runners.* keys of the server configuration, and
+// the runners.distributed.* keys for its leases.
+func InitWorker(cfg config.Provider) {
+	initLog(cfg)
+
+	log.Print("Starting booster-web worker")
+
+	if cfg.GetString("database.type") != "mysql" {
+		log.Fatal("booster-web workers need a mysql database shared with the server")
+	}
+
+	initWorkflows(cfg)
+	initDB(cfg)
+	// Input files are kept by the workers too
+	model.KeepInputs = cfg.GetBool("runners.inputs.keep")
+	initEmailNotification(cfg)
+
+	name := cfg.GetString("runners.distributed.worker")
+	if name == "" {
+		host, _ := os.Hostname()
+		name = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	// Analyses whose lease is lost are not saved by this worker anymore
+	db = processor.NewLeasedDB(db, name)
+
+	nbrunners := cfg.GetInt("runners.nbrunners")
+	locproc := newLocalProcessor(cfg, nbrunners, cfg.GetInt("runners.queuesize"), cfg.GetInt("runners.timeout"), cfg.GetInt("runners.memlimit"), cfg.GetInt("runners.jobthreads"))
+	w := &processor.DistributedWorker{
+		Name:      name,
+		Lease:     time.Duration(cfg.GetInt("runners.distributed.lease")) * time.Second,
+		Heartbeat: time.Duration(cfg.GetInt("runners.distributed.heartbeat")) * time.Second,
+		Poll:      time.Duration(cfg.GetInt("runners.distributed.poll")) * time.Second,
+		Capacity:  cfg.GetInt("runners.distributed.capacity"),
+	}
+	w.InitWorker(locproc, db)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt,
+		syscall.SIGHUP,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+	log.Print(<-c)
+
+	// Other workers take the unfinished analyses
+	if err := w.Stop(); err != nil {
+		log.Print(err)
+	}
+	if err := db.Disconnect(); err != nil {
+		log.Print(err)
+	}
+}
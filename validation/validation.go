@@ -0,0 +1,485 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+// Package validation checks input files of an analysis before it is
+// queued, and reports all the detected problems at once
+package validation
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/evolbioinfo/goalign/align"
+	"github.com/evolbioinfo/goalign/io/fasta"
+	"github.com/evolbioinfo/goalign/io/utils"
+	"github.com/evolbioinfo/gotree/io/newick"
+	tutils "github.com/evolbioinfo/gotree/io/utils"
+	"github.com/evolbioinfo/gotree/tree"
+)
+
+const (
+	NBOOTREP_MAX = 1000 // Max number of bootstrap replicates inferred by workflows
+
+	maxListed    = 10  // Max number of taxa listed in messages
+	ntAmbiguous  = 0.9 // Min proportion of nucleotide characters for a protein alignment to be ambiguous
+	minBootTrees = 10  // Min number of bootstrap trees under which a warning is issued
+)
+
+// Validation report of the input files of an analysis
+type Report struct {
+	Valid     bool             `json:"valid"`               // true if no error has been detected
+	Errors    []string         `json:"errors"`              // Problems that prevent the analysis from running
+	Warnings  []string         `json:"warnings"`            // Problems that may affect the results
+	NbootRep  int              `json:"nbootrep"`            // Expected number of bootstrap trees (0: not checked)
+	RefTree   *TreeReport      `json:"reftree,omitempty"`   // Reference tree report
+	BootTrees *BootReport      `json:"boottrees,omitempty"` // Bootstrap trees report
+	Alignment *AlignmentReport `json:"alignment,omitempty"` // Input alignment report
+}
+
+// Report of a single tree
+type TreeReport struct {
+	Index           int      `json:"index"`           // Index of the tree in its file (starting at 0)
+	NbTips          int      `json:"nbtips"`          // Number of tips
+	Rooted          bool     `json:"rooted"`          // true if the tree is rooted
+	Multifurcations int      `json:"multifurcations"` // Number of multifurcated internal nodes
+	MissingLengths  int      `json:"missinglengths"`  // Number of branches without length
+	ZeroLengths     int      `json:"zerolengths"`     // Number of branches with a length of 0
+	DuplicatedTips  []string `json:"duplicatedtips"`  // Tip names present several times in the tree
+	MissingTips     []string `json:"missingtips"`     // Tips of the reference tree absent from this tree
+	ExtraTips       []string `json:"extratips"`       // Tips of this tree absent from the reference tree
+}
+
+// Summary of the bootstrap trees
+type BootReport struct {
+	NbTrees          int           `json:"nbtrees"`          // Number of bootstrap trees
+	NbRooted         int           `json:"nbrooted"`         // Number of rooted bootstrap trees
+	NbMultifurcated  int           `json:"nbmultifurcated"`  // Number of bootstrap trees with multifurcations
+	NbMissingLengths int           `json:"nbmissinglengths"` // Number of bootstrap trees with branches without length
+	NbZeroLengths    int           `json:"nbzerolengths"`    // Number of bootstrap trees with branches with a length of 0
+	Problems         []*TreeReport `json:"problems"`         // Bootstrap trees with missing, extra or duplicated tips
+}
+
+// Report of the input alignment
+type AlignmentReport struct {
+	NbSequences       int      `json:"nbsequences"`
+	Length            int      `json:"length"`    // Length of the alignment (of the longest sequence if not aligned)
+	Unaligned         bool     `json:"unaligned"` // true if the input sequences are not aligned yet
+	Alphabet          string   `json:"alphabet"`
+	NtProportion      float64  `json:"ntproportion"`      // Proportion of A,C,G,T,U,N among non gap characters
+	AmbiguousAlphabet bool     `json:"ambiguousalphabet"` // true if the alphabet could not be reliably detected
+	DuplicatedNames   []string `json:"duplicatednames"`   // Sequence names present several times
+	GapSequences      []string `json:"gapsequences"`      // Sequences made only of gaps (empty sequences if not aligned)
+}
+
+// Initializes a new report, nbootrep being the expected number
+// of bootstrap trees (0 if it should not be checked)
+func NewReport(nbootrep int) *Report {
+	return &Report{
+		Valid:    true,
+		Errors:   make([]string, 0),
+		Warnings: make([]string, 0),
+		NbootRep: nbootrep,
+	}
+}
+
+// Returns nil if no error has been detected, and an error
+// gathering all the error messages otherwise
+func (r *Report) Err() error {
+	if r.Valid {
+		return nil
+	}
+	return errors.New(strings.Join(r.Errors, "; "))
+}
+
+func (r *Report) addError(format string, args ...interface{}) {
+	r.Valid = false
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) addWarning(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Checks the reference tree and the bootstrap trees (Newick format)
+//
+// The trees are compared to the reference tree: missing, extra and duplicated tips
+// are reported as errors. Multifurcations, rooting and branch lengths are
+// reported as warnings.
+func (r *Report) CheckTrees(ref, boot *bufio.Reader) {
+	var reftree *tree.Tree
+	var err error
+
+	if reftree, err = newick.NewParser(ref).Parse(); err != nil {
+		r.addError("Reference tree: Newick format error (%v)", err)
+		return
+	}
+	r.RefTree = checkTree(reftree, 0, nil)
+	reftips := make(map[string]bool)
+	for _, n := range reftree.AllTipNames() {
+		reftips[strings.TrimSpace(n)] = true
+	}
+	if len(r.RefTree.DuplicatedTips) > 0 {
+		r.addError("Reference tree: duplicated tip names: %s", list(r.RefTree.DuplicatedTips))
+	}
+	if r.RefTree.NbTips < 4 {
+		r.addError("Reference tree: at least 4 tips are needed, %d given", r.RefTree.NbTips)
+	}
+	if r.RefTree.Rooted {
+		r.addWarning("Reference tree is rooted: supports are computed on the unrooted tree")
+	}
+	if r.RefTree.Multifurcations > 0 {
+		r.addWarning("Reference tree: %d multifurcated node(s)", r.RefTree.Multifurcations)
+	}
+	if r.RefTree.MissingLengths > 0 {
+		r.addWarning("Reference tree: %d branch(es) without length", r.RefTree.MissingLengths)
+	}
+	if r.RefTree.ZeroLengths > 0 {
+		r.addWarning("Reference tree: %d branch(es) with a length of 0", r.RefTree.ZeroLengths)
+	}
+
+	r.BootTrees = &BootReport{Problems: make([]*TreeReport, 0)}
+	for t := range tutils.ReadMultiTrees(boot, tutils.FORMAT_NEWICK) {
+		if t.Err != nil {
+			r.addError("Bootstrap tree %d: Newick format error (%v)", r.BootTrees.NbTrees, t.Err)
+			// Remaining trees can not be read
+			return
+		}
+		tr := checkTree(t.Tree, r.BootTrees.NbTrees, reftips)
+		r.BootTrees.NbTrees++
+		if tr.Rooted {
+			r.BootTrees.NbRooted++
+		}
+		if tr.Multifurcations > 0 {
+			r.BootTrees.NbMultifurcated++
+		}
+		if tr.MissingLengths > 0 {
+			r.BootTrees.NbMissingLengths++
+		}
+		if tr.ZeroLengths > 0 {
+			r.BootTrees.NbZeroLengths++
+		}
+		if len(tr.MissingTips) > 0 || len(tr.ExtraTips) > 0 || len(tr.DuplicatedTips) > 0 {
+			r.BootTrees.Problems = append(r.BootTrees.Problems, tr)
+			msg := make([]string, 0, 3)
+			if len(tr.MissingTips) > 0 {
+				msg = append(msg, fmt.Sprintf("missing tips: %s", list(tr.MissingTips)))
+			}
+			if len(tr.ExtraTips) > 0 {
+				msg = append(msg, fmt.Sprintf("extra tips: %s", list(tr.ExtraTips)))
+			}
+			if len(tr.DuplicatedTips) > 0 {
+				msg = append(msg, fmt.Sprintf("duplicated tips: %s", list(tr.DuplicatedTips)))
+			}
+			r.addError("Bootstrap tree %d: %s", tr.Index, strings.Join(msg, ", "))
+		}
+	}
+
+	b := r.BootTrees
+	switch {
+	case b.NbTrees == 0:
+		r.addError("No bootstrap tree given")
+	case b.NbTrees < minBootTrees:
+		r.addWarning("Only %d bootstrap tree(s) given", b.NbTrees)
+	}
+	if r.NbootRep > 0 && b.NbTrees != r.NbootRep {
+		r.addWarning("%d bootstrap tree(s) given, but %d expected", b.NbTrees, r.NbootRep)
+	}
+	if b.NbRooted > 0 {
+		r.addWarning("%d rooted bootstrap tree(s)", b.NbRooted)
+	}
+	if b.NbMultifurcated > 0 {
+		r.addWarning("%d bootstrap tree(s) with multifurcations", b.NbMultifurcated)
+	}
+	if b.NbMissingLengths > 0 {
+		r.addWarning("%d bootstrap tree(s) with branches without length", b.NbMissingLengths)
+	}
+	if b.NbZeroLengths > 0 {
+		r.addWarning("%d bootstrap tree(s) with branches with a length of 0", b.NbZeroLengths)
+	}
+}
+
+// Reads, parses and checks the input alignment (Fasta, Phylip or Nexus).
+//
+// Returns the parsed alignment, or nil if it could not be parsed.
+// Duplicated sequence names, sequences made only of gaps and
+// ambiguous alphabets are reported.
+func (r *Report) CheckAlignment(in io.Reader, gzipped bool) (al align.Alignment) {
+	var br *bufio.Reader
+	var content []byte
+	var err error
+
+	switch {
+	case r.NbootRep <= 0:
+		r.addError("Number of bootstrap replicates must be > 0")
+	case r.NbootRep > NBOOTREP_MAX:
+		r.addWarning("Number of bootstrap replicates will be limited to %d", NBOOTREP_MAX)
+	}
+
+	if br, err = utils.GetReaderFromReader(gzipped, in); err != nil {
+		r.addError("Alignment: %v", err)
+		return nil
+	}
+	if content, err = ioutil.ReadAll(br); err != nil {
+		r.addError("Alignment: %v", err)
+		return nil
+	}
+	if al, _, err = utils.ParseAlignmentAuto(bufio.NewReader(bytes.NewReader(content)), false); err != nil {
+		r.addError("Alignment: format error (%v)", err)
+		// Duplicated names may be the cause of the parsing error
+		if dups := duplicatedFastaNames(content); len(dups) > 0 {
+			r.Alignment = &AlignmentReport{DuplicatedNames: dups}
+			r.addError("Alignment: duplicated sequence names: %s", list(dups))
+		}
+		return nil
+	}
+
+	ar := &AlignmentReport{
+		NbSequences:     al.NbSequences(),
+		Length:          al.Length(),
+		Alphabet:        al.AlphabetStr(),
+		DuplicatedNames: make([]string, 0),
+		GapSequences:    make([]string, 0),
+	}
+	r.Alignment = ar
+
+	names := make(map[string]int)
+	ntchars, chars := 0, 0
+	for i := 0; i < al.NbSequences(); i++ {
+		name, _ := al.GetSequenceNameById(i)
+		seq, _ := al.GetSequenceById(i)
+		names[name]++
+		gaps := 0
+		for _, c := range strings.ToUpper(seq) {
+			switch c {
+			case '-':
+				gaps++
+			case 'A', 'C', 'G', 'T', 'U', 'N':
+				ntchars++
+				chars++
+			default:
+				chars++
+			}
+		}
+		if gaps == len(seq) {
+			ar.GapSequences = append(ar.GapSequences, name)
+		}
+	}
+	for n, c := range names {
+		if c > 1 {
+			ar.DuplicatedNames = append(ar.DuplicatedNames, n)
+		}
+	}
+	sort.Strings(ar.DuplicatedNames)
+	if chars > 0 {
+		ar.NtProportion = float64(ntchars) / float64(chars)
+	}
+	ar.AmbiguousAlphabet = (al.Alphabet() == align.AMINOACIDS && ar.NtProportion >= ntAmbiguous) ||
+		(al.Alphabet() != align.AMINOACIDS && al.Alphabet() != align.NUCLEOTIDS)
+
+	if ar.NbSequences < 4 {
+		r.addError("Alignment: at least 4 sequences are needed, %d given", ar.NbSequences)
+	}
+	if len(ar.DuplicatedNames) > 0 {
+		r.addError("Alignment: duplicated sequence names: %s", list(ar.DuplicatedNames))
+	}
+	if len(ar.GapSequences) > 0 {
+		r.addWarning("Alignment: %d sequence(s) made only of gaps: %s", len(ar.GapSequences), list(ar.GapSequences))
+	}
+	if ar.AmbiguousAlphabet {
+		r.addWarning("Alignment: ambiguous alphabet, detected %s but %.0f%% of characters are nucleotides", ar.Alphabet, ar.NtProportion*100)
+	}
+	return
+}
+
+// Checks the input unaligned sequences (Fasta format), that will be
+// aligned before inferring the trees.
+//
+// Errors and warnings are the same as for an alignment, except that
+// empty sequences are reported instead of sequences made only of gaps
+func (r *Report) CheckSequences(in io.Reader, gzipped bool) (seqs align.SeqBag) {
+	var br *bufio.Reader
+	var content []byte
+	var err error
+
+	switch {
+	case r.NbootRep <= 0:
+		r.addError("Number of bootstrap replicates must be > 0")
+	case r.NbootRep > NBOOTREP_MAX:
+		r.addWarning("Number of bootstrap replicates will be limited to %d", NBOOTREP_MAX)
+	}
+
+	if br, err = utils.GetReaderFromReader(gzipped, in); err != nil {
+		r.addError("Sequences: %v", err)
+		return nil
+	}
+	if content, err = ioutil.ReadAll(br); err != nil {
+		r.addError("Sequences: %v", err)
+		return nil
+	}
+
+	ar := &AlignmentReport{
+		Unaligned:       true,
+		DuplicatedNames: duplicatedFastaNames(content),
+		GapSequences:    make([]string, 0),
+	}
+	r.Alignment = ar
+	if len(ar.DuplicatedNames) > 0 {
+		r.addError("Sequences: duplicated sequence names: %s", list(ar.DuplicatedNames))
+		return nil
+	}
+	if seqs, err = fasta.NewParser(bytes.NewReader(content)).ParseUnalign(); err != nil {
+		r.addError("Sequences: Fasta format error (%v)", err)
+		return nil
+	}
+
+	ar.NbSequences = seqs.NbSequences()
+	ar.Alphabet = seqs.AlphabetStr()
+	ntchars, chars := 0, 0
+	seqs.Iterate(func(name string, seq string) bool {
+		seq = strings.Replace(seq, "-", "", -1)
+		if len(seq) > ar.Length {
+			ar.Length = len(seq)
+		}
+		if len(seq) == 0 {
+			ar.GapSequences = append(ar.GapSequences, name)
+		}
+		for _, c := range strings.ToUpper(seq) {
+			switch c {
+			case 'A', 'C', 'G', 'T', 'U', 'N':
+				ntchars++
+			}
+			chars++
+		}
+		return false
+	})
+	if chars > 0 {
+		ar.NtProportion = float64(ntchars) / float64(chars)
+	}
+	ar.AmbiguousAlphabet = (seqs.Alphabet() == align.AMINOACIDS && ar.NtProportion >= ntAmbiguous) ||
+		(seqs.Alphabet() != align.AMINOACIDS && seqs.Alphabet() != align.NUCLEOTIDS)
+
+	if ar.NbSequences < 4 {
+		r.addError("Sequences: at least 4 sequences are needed, %d given", ar.NbSequences)
+	}
+	if len(ar.GapSequences) > 0 {
+		r.addError("Sequences: %d empty sequence(s): %s", len(ar.GapSequences), list(ar.GapSequences))
+	}
+	if ar.AmbiguousAlphabet {
+		r.addWarning("Sequences: ambiguous alphabet, detected %s but %.0f%% of characters are nucleotides", ar.Alphabet, ar.NtProportion*100)
+	}
+	return
+}
+
+// Computes the report of a single tree. If reftips is not nil, the tips of the tree
+// are compared to the given set
+func checkTree(t *tree.Tree, index int, reftips map[string]bool) (tr *TreeReport) {
+	tr = &TreeReport{
+		Index:          index,
+		Rooted:         t.Rooted(),
+		DuplicatedTips: make([]string, 0),
+		MissingTips:    make([]string, 0),
+		ExtraTips:      make([]string, 0),
+	}
+
+	names := make(map[string]int)
+	for _, n := range t.Tips() {
+		names[strings.TrimSpace(n.Name())]++
+	}
+	tr.NbTips = len(t.Tips())
+	for n, c := range names {
+		if c > 1 {
+			tr.DuplicatedTips = append(tr.DuplicatedTips, n)
+		}
+		if reftips != nil && !reftips[n] {
+			tr.ExtraTips = append(tr.ExtraTips, n)
+		}
+	}
+	for n := range reftips {
+		if _, ok := names[n]; !ok {
+			tr.MissingTips = append(tr.MissingTips, n)
+		}
+	}
+	sort.Strings(tr.DuplicatedTips)
+	sort.Strings(tr.ExtraTips)
+	sort.Strings(tr.MissingTips)
+
+	for _, n := range t.Nodes() {
+		if n.Tip() {
+			continue
+		}
+		// Number of children: all the neighbors of the root,
+		// the neighbors but the parent for other nodes
+		children, max := len(n.Neigh())-1, 2
+		if n == t.Root() {
+			children = len(n.Neigh())
+			// The root of an unrooted newick tree is a trifurcation
+			if !tr.Rooted {
+				max = 3
+			}
+		}
+		if children > max {
+			tr.Multifurcations++
+		}
+	}
+	for _, e := range t.Edges() {
+		switch e.Length() {
+		case tree.NIL_LENGTH:
+			tr.MissingLengths++
+		case 0:
+			tr.ZeroLengths++
+		}
+	}
+	return
+}
+
+// Sequence names present several times in a Fasta file
+func duplicatedFastaNames(content []byte) (dups []string) {
+	dups = make([]string, 0)
+	names := make(map[string]int)
+	sc := bufio.NewScanner(bytes.NewReader(content))
+	sc.Buffer(make([]byte, 0, 64*1024), len(content)+1)
+	for sc.Scan() {
+		if line := sc.Text(); strings.HasPrefix(line, ">") {
+			name := strings.TrimSpace(line[1:])
+			if names[name]++; names[name] == 2 {
+				dups = append(dups, name)
+			}
+		}
+	}
+	sort.Strings(dups)
+	return
+}
+
+// Lists at most maxListed names
+func list(names []string) string {
+	if len(names) > maxListed {
+		return fmt.Sprintf("%s, ... (%d in total)", strings.Join(names[:maxListed], ", "), len(names))
+	}
+	return strings.Join(names, ", ")
+}
@@ -36,8 +36,73 @@ $( document ).ready(function() {
 	    }
 	});
     });
+
+    $("#validatebutton").click(function(event) {
+	event.preventDefault();
+	validateInput();
+    });
+
+    $("#workflow").change(updateWorkflowOptions);
+    updateWorkflowOptions();
+
+    $("#aligner").change(updateTrimmerOptions);
+    updateTrimmerOptions();
 });
 
+/* Trimming is only available for unaligned sequences */
+function updateTrimmerOptions(){
+    var unaligned = $("#aligner").val() != undefined && $("#aligner").val() != '';
+    $("#trimmeroptions").toggle(unaligned);
+    if(!unaligned){
+	$("#trimmer").val('');
+    }
+}
+
+/* Only displays the options of the selected workflow */
+function updateWorkflowOptions(){
+    var workflow = $("#workflow").val();
+    $(".workflow-options").each(function() {
+	$(this).toggle($(this).data("workflow") == workflow);
+    });
+}
+
+/* Checks input files without running the analysis, and displays the report */
+function validateInput(){
+    var data = new FormData($("#runform")[0]);
+    // The number of bootstrap replicates is only relevant for alignments
+    if($("#refalign").val() == undefined || $("#refalign").val() == ''){
+	data.delete("nboot");
+    }
+    $("#validation").html('<div class="alert alert-info">Checking input files...</div>');
+    $.ajax({
+	url: "/api/validate",
+	type: "POST",
+	data: data,
+	processData: false,
+	contentType: false,
+	dataType: 'json',
+	success: function(report) {
+	    if(report.errors == undefined){
+		$("#validation").html($('<div class="alert alert-danger">').text(report.message));
+		return;
+	    }
+	    var div = $("#validation").empty();
+	    if(report.valid){
+		div.append('<div class="alert alert-success">No blocking problem detected.</div>');
+	    }
+	    $.each(report.errors, function(i, e){
+		div.append($('<div class="alert alert-danger">').text(e));
+	    });
+	    $.each(report.warnings, function(i, w){
+		div.append($('<div class="alert alert-warning">').text(w));
+	    });
+	},
+	error: function(resultat, statut, erreur){
+	    $("#validation").html($('<div class="alert alert-danger">').text(erreur));
+	}
+    });
+}
+
 function timerfunc(){
     $("#timeout").text(timer);
     timer=timer-1;
@@ -54,7 +54,7 @@ function updateTreeCanvas(){
 	    dataType: 'text',
 	    async: true,
 	    success: function(data) {
-		elt.find("img").attr('src','data:image/svg+xml,' + data);
+		elt.find("img").attr('src','data:image/svg+xml,' + encodeURIComponent(data));
 	    },
 	    error: function(resultat, statut, erreur){
 		console.log(erreur);
@@ -63,6 +63,11 @@ function updateTreeCanvas(){
     });
 }
 
+/* Downloads the currently displayed tree as a PDF figure */
+function downloadFigure(id){
+    window.location.href = "/api/image/"+id+"/"+collapse+"/"+layout+"/"+algorithm+"/pdf?tipnames=true&colorsupports=true";
+}
+
 function downloadTBENormTree(id){
     $.ajax({
 	url: "/api/analysis/"+id,
@@ -132,3 +137,40 @@ function downloadLogs(id){
 	}
     });
 }
+
+function downloadWorkflowLogs(id){
+    $.ajax({
+	url: "/api/analysis/"+id,
+	dataType: 'json',
+ 	async: true,
+ 	success: function(data) {
+	    var analysis = data;
+	    if(analysis.status == 2 || analysis.status == 5){
+		download(analysis.workflowlogs, "boosterweb_inference_logs.txt", "text/plain");
+	    }
+	}
+    });
+}
+
+function downloadNameMap(id){
+    $.ajax({
+	url: "/api/analysis/"+id,
+	dataType: 'json',
+ 	async: true,
+ 	success: function(data) {
+	    var analysis = data;
+	    var map = "original\tcleaned\n";
+	    $.each(Object.keys(analysis.namemap).sort(), function(i, name){
+		map += name + "\t" + analysis.namemap[name] + "\n";
+	    });
+	    download(map, "boosterweb_name_mapping.txt", "text/plain");
+	}
+    });
+}
+
+function compareAnalysis(id){
+    var other = $("#compareid").val().trim();
+    if(other != ""){
+	window.location.href = "/compare/"+id+"/"+other;
+    }
+}
@@ -0,0 +1,107 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+package workflow
+
+import (
+	"math"
+
+	"github.com/evolbioinfo/booster-web/model"
+	"github.com/evolbioinfo/goalign/align"
+)
+
+// Resource estimators of the workflows: memory and run time
+// (in seconds) of the tree inference, including bootstrap replicates
+var estimators = map[string]func(a *model.Analysis) (mem, time float64){
+	"fasttree": estimateFastTreeRunStats,
+	"phyml":    estimatePhyMLRunStats,
+	"iqtree":   estimateIQTreeRunStats,
+	"raxmlng":  estimateRAxMLNGRunStats,
+}
+
+func estimateFastTreeRunStats(a *model.Analysis) (mem, time float64) {
+	alphabetsize := 4.0
+	if a.AlignAlphabet == align.AMINOACIDS {
+		alphabetsize = 20.0
+	}
+
+	time = 0.5071 +
+		0.00000006141*math.Pow(float64(a.AlignNbSeq), 1.5)*math.Log(float64(a.AlignNbSeq))*float64(a.AlignLength)*alphabetsize
+	mem = 2872 +
+		0.003412*(math.Pow(float64(a.AlignNbSeq), 1.5)+float64(a.AlignNbSeq)*float64(a.AlignLength)*alphabetsize)
+	time *= float64(a.NbootRep)
+	return
+}
+
+func estimatePhyMLRunStats(a *model.Analysis) (mem, time float64) {
+	alphabetweight := 0.0
+	if a.AlignAlphabet == align.AMINOACIDS {
+		alphabetweight = 1.1
+	}
+
+	time = 3.526 + 30.18*alphabetweight +
+		0.00002227*float64(a.AlignNbSeq*a.AlignNbSeq*a.AlignLength) +
+		0.00006672*alphabetweight*float64(a.AlignNbSeq*a.AlignNbSeq*a.AlignLength)
+	mem = 3352.7636 -
+		884.7005*alphabetweight +
+		158.6359*float64(a.AlignNbSeq) -
+		5.0467*float64(a.AlignLength) +
+		81.0603*float64(a.AlignNbSeq)*alphabetweight -
+		51.2838*float64(a.AlignLength)*alphabetweight +
+		0.3754*float64(a.AlignLength*a.AlignNbSeq) +
+		1.7922*float64(a.AlignLength*a.AlignNbSeq)*alphabetweight
+
+	time *= float64(a.NbootRep)
+	return
+}
+
+// Rough estimates based on the size of the partial likelihood
+// vectors (4 gamma categories). ModelFinder tests all models once,
+// on the initial tree, and each bootstrap replicate is a full tree search.
+func estimateIQTreeRunStats(a *model.Analysis) (mem, time float64) {
+	states, nbmodels := 4.0, 88.0
+	if a.AlignAlphabet == align.AMINOACIDS {
+		states, nbmodels = 20.0, 168.0
+	}
+	cells := float64(a.AlignNbSeq) * float64(a.AlignLength) * states
+
+	search := 0.0000015 * cells * states * math.Log(float64(a.AlignNbSeq)+1)
+	time = 10.0 + 0.0000002*cells*states*nbmodels + search*float64(a.NbootRep+1)
+	mem = 20000 + 0.1*cells
+	return
+}
+
+// Same as IQ-TREE, without model selection, and with
+// 20 starting trees (RAxML-NG default) for the best tree search
+func estimateRAxMLNGRunStats(a *model.Analysis) (mem, time float64) {
+	states := 4.0
+	if a.AlignAlphabet == align.AMINOACIDS {
+		states = 20.0
+	}
+	cells := float64(a.AlignNbSeq) * float64(a.AlignLength) * states
+
+	search := 0.000001 * cells * states * math.Log(float64(a.AlignNbSeq)+1)
+	time = 5.0 + search*float64(a.NbootRep+20)
+	mem = 15000 + 0.1*cells
+	return
+}
@@ -0,0 +1,584 @@
+/*
+
+BOOSTER-WEB: Web interface to BOOSTER (https://github.com/evolbioinfo/booster)
+Alternative method to compute bootstrap branch supports in large trees.
+
+Copyright (C) 2017 BOOSTER-WEB dev team
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+
+*/
+
+// Package workflow describes the phylogenetic workflows (tree inference
+// + booster) that can be run from an input alignment.
+//
+// Built-in workflows (PhyML-SMS, FastTree, IQ-TREE and RAxML-NG) may be
+// modified, and new workflows may be added in the configuration file:
+//
+//	[workflows.<key>]
+//	id = 12                       # identifier stored in analyses (required for new workflows)
+//	name = "MyTool"               # name displayed and given in the run form
+//	description = "..."           # description displayed in the run form
+//	galaxytool = "toolshed/..."   # galaxy tool id (empty: not available on galaxy)
+//	galaxyworkflow = "f2db41e1fa" # or galaxy workflow id, invoked instead of a single tool
+//	inputlabel = "input_align"    # name of the tool input / label of the workflow input
+//	localtool = "iqtree"          # local tool: fasttree, phyml, iqtree or raxmlng
+//	inputformat = "fasta"         # phylip or fasta
+//	supportscale = "100"          # divides output tree supports by: "nbootrep", a number, or "" (none)
+//	estimator = "iqtree"          # resource estimator: phyml, fasttree, iqtree, raxmlng or "" (none)
+//	tools = ["MyTool"]
+//	citations = ["Author (2020). MyTool. Journal."]
+//	[workflows.<key>.parameters]  # galaxy tool parameters, values are go templates
+//	"bootstrap|replicates" = "{{.NbootRep}}"
+//	"seqtype" = "{{if .Nucleotides}}nt{{else}}aa{{end}}"
+//	"model" = "{{.Options.model}}"
+//	[[workflows.<key>.options]]   # options the user may choose in the run form
+//	name = "model"
+//	label = "Substitution model"
+//	values = ["GTR", "HKY"]
+//	default = "GTR"
+//	[workflows.<key>.outputs]     # names of the galaxy output datasets (labels of workflow outputs)
+//	fbptree = "out_tree"
+//	tbenormtree = "tbe_norm_tree"
+//	tberawtree = "tbe_raw_tree"
+//	tbelogs = "tbe_log"
+//	alignment = "trimmed_align"   # optional: alignment actually analyzed (e.g. after trimming)
+//
+// Parameters of galaxy workflows are given as "<step index>:<parameter name>".
+package workflow
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/evolbioinfo/booster-web/config"
+	"github.com/evolbioinfo/booster-web/model"
+)
+
+const (
+	FORMAT_PHYLIP = "phylip"
+	FORMAT_FASTA  = "fasta"
+
+	SCALE_NBOOTREP = "nbootrep"
+
+	DEFAULT_INPUT = "input_align"
+)
+
+// Names of the galaxy output datasets of a workflow
+type Outputs struct {
+	FbpTree     string // Tree with FBP supports
+	TbeNormTree string // Tree with normalized TBE supports
+	TbeRawTree  string // Tree with raw transfer distances
+	TbeLogs     string // Booster logs
+	Alignment   string // Alignment analyzed by the workflow (optional)
+}
+
+type Workflow struct {
+	Key            string            // Key of the workflow in the configuration
+	Id             int               // Identifier stored in analyses
+	Name           string            // Name displayed and given in the run form
+	Description    string            // Description displayed in the run form
+	GalaxyTool     string            // Galaxy tool id, empty if not available on galaxy as a tool
+	GalaxyWorkflow string            // Galaxy workflow id, empty if not available on galaxy as a workflow
+	InputLabel     string            // Name of the alignment input of the galaxy tool or workflow
+	LocalTool      string            // Local tree inference tool
+	InputFormat    string            // Format of the alignment given to the tool: phylip or fasta
+	Parameters     map[string]string // Galaxy tool parameters: templates executed with ParameterData
+	Outputs        Outputs           // Names of the galaxy output datasets
+	SupportScale   string            // Output tree supports are divided by: "nbootrep", a number, or nothing if empty
+	Estimator      string            // Name of the resource estimator
+	Tools          []string          // Names of the tools to cite
+	Citations      []string          // References of the tools to cite (same order as Tools)
+	Options        []Option          // Options the user may choose
+}
+
+// Option of a workflow that the user may choose
+type Option struct {
+	Name    string   // Name of the option, given to parameter templates
+	Label   string   // Label displayed in the run form
+	Values  []string // Allowed values
+	Default string   // Default value
+}
+
+// Data given to parameter templates
+type ParameterData struct {
+	NbootRep    int    // Number of bootstrap replicates
+	Alphabet    string // nt or aa
+	Nucleotides bool
+	AminoAcids  bool
+	NbSeqs      int               // Number of sequences
+	Length      int               // Alignment length
+	Options     map[string]string // Options chosen by the user
+}
+
+// Set of available workflows
+type Registry struct {
+	workflows map[int]*Workflow
+}
+
+// Default outputs of the galaxy workflows
+var defaultOutputs = Outputs{
+	FbpTree:     "out_tree",
+	TbeNormTree: "tbe_norm_tree",
+	TbeRawTree:  "tbe_raw_tree",
+	TbeLogs:     "tbe_log",
+}
+
+// Substitution model from the dnamodel, protmodel and gamma options
+// (e.g. GTR+G4), gamma is not added with ModelFinder (MFP)
+const modelTemplate = `{{$m := .Options.dnamodel}}{{if .AminoAcids}}{{$m = .Options.protmodel}}{{end}}{{$m}}` +
+	`{{if and (ne $m "MFP") (ne .Options.gamma "none")}}+G{{.Options.gamma}}{{end}}`
+
+func builtinWorkflows() []*Workflow {
+	return []*Workflow{
+		{
+			Key:         "phymlsms",
+			Id:          model.WORKFLOW_PHYML_SMS,
+			Name:        "PhyML-SMS",
+			Description: "PhyML-SMS (slower, for small/medium datasets)",
+			LocalTool:   "phyml",
+			InputFormat: FORMAT_PHYLIP,
+			Parameters: map[string]string{
+				"sequence|seqtype":     "{{.Alphabet}}",
+				"stat_crit":            "{{.Options.criterion}}",
+				"move":                 "{{.Options.moves}}",
+				"gamma":                "{{.Options.gamma}}",
+				"bootstrap|support":    "{{if eq .Options.bootstrap \"parametric\"}}parametric{{else}}boot{{end}}",
+				"bootstrap|replicates": "{{.NbootRep}}",
+			},
+			Options: []Option{
+				{Name: "criterion", Label: "Model selection criterion", Values: []string{"aic", "bic"}, Default: "aic"},
+				{Name: "moves", Label: "Tree search moves", Values: []string{"SPR", "NNI", "BEST"}, Default: "SPR"},
+				{Name: "gamma", Label: "Gamma rate categories", Values: []string{"4", "6", "8"}, Default: "4"},
+				{Name: "bootstrap", Label: "Bootstrap", Values: []string{"nonparametric", "parametric"}, Default: "nonparametric"},
+			},
+			Outputs:      defaultOutputs,
+			SupportScale: SCALE_NBOOTREP,
+			Estimator:    "phyml",
+			Tools:        []string{"PhyML-SMS"},
+			Citations:    []string{"Lefort, V., Longueville, J. E., & Gascuel, O. (2017). SMS: Smart Model Selection in PhyML. Molecular Biology and Evolution."},
+		},
+		{
+			Key:         "fasttree",
+			Id:          model.WORKFLOW_FASTTREE,
+			Name:        "FastTree",
+			Description: "FastTree (faster, for large datasets)",
+			LocalTool:   "fasttree",
+			InputFormat: FORMAT_FASTA,
+			Parameters: map[string]string{
+				"sequence_type|seqtype":   "{{if .Nucleotides}}-nt{{end}}",
+				"sequence_type|modelprot": "{{if ne .Options.protmodel \"jtt\"}}-{{.Options.protmodel}}{{end}}",
+				"sequence_type|modeldna":  "{{if ne .Options.dnamodel \"jc\"}}-{{.Options.dnamodel}}{{end}}",
+				"gamma":                   "{{if eq .Options.gamma \"true\"}}-gamma{{end}}",
+				"spr":                     "{{if eq .Options.moves \"nni\"}}0{{else}}2{{end}}",
+				"bootstrap|do_bootstrap":  "true",
+				"bootstrap|replicates":    "{{.NbootRep}}",
+			},
+			Options: []Option{
+				{Name: "dnamodel", Label: "Nucleotide model", Values: []string{"gtr", "jc"}, Default: "gtr"},
+				{Name: "protmodel", Label: "Protein model", Values: []string{"lg", "wag", "jtt"}, Default: "lg"},
+				{Name: "gamma", Label: "Gamma rates (20 categories)", Values: []string{"true", "false"}, Default: "true"},
+				{Name: "moves", Label: "Tree search moves", Values: []string{"nni+spr", "nni"}, Default: "nni+spr"},
+			},
+			Outputs:   defaultOutputs,
+			Estimator: "fasttree",
+			Tools:     []string{"FastTree"},
+			Citations: []string{"Price, M. N., Dehal, P. S., & Arkin, A. P. (2009). FastTree: computing large minimum evolution trees with profiles instead of a distance matrix. Molecular biology and evolution, 26(7), 1641-1650."},
+		},
+		{
+			Key:         "iqtree",
+			Id:          model.WORKFLOW_IQTREE,
+			Name:        "IQ-TREE",
+			Description: "IQ-TREE (ModelFinder model selection, for small/medium datasets)",
+			LocalTool:   "iqtree",
+			InputFormat: FORMAT_FASTA,
+			Parameters: map[string]string{
+				"sequence|seqtype":     "{{if .Nucleotides}}DNA{{else}}AA{{end}}",
+				"model":                modelTemplate,
+				"merit":                "{{.Options.criterion}}",
+				"bootstrap|support":    "{{if eq .Options.bootstrap \"parametric\"}}parametric{{else}}boot{{end}}",
+				"bootstrap|replicates": "{{.NbootRep}}",
+			},
+			Options: []Option{
+				{Name: "dnamodel", Label: "Nucleotide model (MFP: ModelFinder)", Values: []string{"MFP", "GTR", "HKY", "K2P", "JC"}, Default: "MFP"},
+				{Name: "protmodel", Label: "Protein model (MFP: ModelFinder)", Values: []string{"MFP", "LG", "WAG", "JTT"}, Default: "MFP"},
+				{Name: "gamma", Label: "Gamma rate categories (if no ModelFinder)", Values: []string{"4", "8", "none"}, Default: "4"},
+				{Name: "criterion", Label: "Model selection criterion", Values: []string{"BIC", "AIC", "AICc"}, Default: "BIC"},
+				{Name: "bootstrap", Label: "Bootstrap", Values: []string{"nonparametric", "parametric"}, Default: "nonparametric"},
+			},
+			Outputs:      defaultOutputs,
+			SupportScale: "100",
+			Estimator:    "iqtree",
+			Tools:        []string{"IQ-TREE", "ModelFinder"},
+			Citations: []string{
+				"Nguyen, L.-T., Schmidt, H. A., von Haeseler, A., & Minh, B. Q. (2015). IQ-TREE: a fast and effective stochastic algorithm for estimating maximum-likelihood phylogenies. Molecular Biology and Evolution, 32(1), 268-274.",
+				"Kalyaanamoorthy, S., Minh, B. Q., Wong, T. K. F., von Haeseler, A., & Jermiin, L. S. (2017). ModelFinder: fast model selection for accurate phylogenetic estimates. Nature Methods, 14(6), 587-589.",
+			},
+		},
+		{
+			Key:         "raxmlng",
+			Id:          model.WORKFLOW_RAXMLNG,
+			Name:        "RAxML-NG",
+			Description: "RAxML-NG (GTR+G / LG+G, for medium datasets)",
+			LocalTool:   "raxmlng",
+			InputFormat: FORMAT_FASTA,
+			Parameters: map[string]string{
+				"sequence|seqtype":     "{{.Alphabet}}",
+				"sequence|model":       modelTemplate,
+				"bootstrap|replicates": "{{.NbootRep}}",
+			},
+			Options: []Option{
+				{Name: "dnamodel", Label: "Nucleotide model", Values: []string{"GTR", "HKY", "JC"}, Default: "GTR"},
+				{Name: "protmodel", Label: "Protein model", Values: []string{"LG", "WAG", "JTT"}, Default: "LG"},
+				{Name: "gamma", Label: "Gamma rate categories", Values: []string{"4", "8", "none"}, Default: "4"},
+			},
+			Outputs:      defaultOutputs,
+			SupportScale: "100",
+			Estimator:    "raxmlng",
+			Tools:        []string{"RAxML-NG"},
+			Citations:    []string{"Kozlov, A. M., Darriba, D., Flouri, T., Morel, B., & Stamatakis, A. (2019). RAxML-NG: a fast, scalable and user-friendly tool for maximum likelihood phylogenetic inference. Bioinformatics, 35(21), 4453-4455."},
+		},
+	}
+}
+
+// Builds the registry with the built-in workflows, modified or completed
+// by the "workflows" section of the configuration.
+//
+// For compatibility, galaxy tool ids of built-in workflows are also
+// read from galaxy.tools.phyml, galaxy.tools.fasttree, galaxy.tools.iqtree
+// and galaxy.tools.raxmlng.
+//
+// Names of the workflows are registered in the model.
+func NewRegistry(cfg config.Provider) (r *Registry, err error) {
+	r = &Registry{workflows: make(map[int]*Workflow)}
+	bykey := make(map[string]*Workflow)
+
+	galaxytools := map[string]string{
+		"phymlsms": cfg.GetString("galaxy.tools.phyml"),
+		"fasttree": cfg.GetString("galaxy.tools.fasttree"),
+		"iqtree":   cfg.GetString("galaxy.tools.iqtree"),
+		"raxmlng":  cfg.GetString("galaxy.tools.raxmlng"),
+	}
+	for _, w := range builtinWorkflows() {
+		w.GalaxyTool = galaxytools[w.Key]
+		w.InputLabel = DEFAULT_INPUT
+		bykey[w.Key] = w
+	}
+
+	keys := make([]string, 0)
+	for key := range cfg.GetStringMap("workflows") {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		w, ok := bykey[key]
+		if !ok {
+			if !cfg.IsSet("workflows." + key + ".id") {
+				err = fmt.Errorf("Workflow %s: id must be given for new workflows", key)
+				return
+			}
+			w = &Workflow{Key: key, Outputs: defaultOutputs, InputFormat: FORMAT_FASTA, InputLabel: DEFAULT_INPUT, Parameters: make(map[string]string)}
+			bykey[key] = w
+		}
+		readWorkflow(cfg, "workflows."+key, w)
+	}
+
+	names := make(map[string]string)
+	for _, w := range bykey {
+		if err = w.check(); err != nil {
+			return
+		}
+		if other, ok := r.workflows[w.Id]; ok {
+			err = fmt.Errorf("Workflows %s and %s have the same id %d", other.Key, w.Key, w.Id)
+			return
+		}
+		if other, ok := names[w.Name]; ok {
+			err = fmt.Errorf("Workflows %s and %s have the same name %s", other, w.Key, w.Name)
+			return
+		}
+		names[w.Name] = w.Key
+		r.workflows[w.Id] = w
+	}
+
+	for _, w := range r.All() {
+		model.RegisterWorkflow(w.Id, w.Name)
+		log.Print(fmt.Sprintf("Workflow %s (id=%d): galaxy tool=%q, galaxy workflow=%q, local tool=%q", w.Name, w.Id, w.GalaxyTool, w.GalaxyWorkflow, w.LocalTool))
+	}
+	return
+}
+
+// Overrides the fields of w that are given in the configuration
+func readWorkflow(cfg config.Provider, prefix string, w *Workflow) {
+	if cfg.IsSet(prefix + ".id") {
+		w.Id = cfg.GetInt(prefix + ".id")
+	}
+	for field, value := range map[string]*string{
+		"name":           &w.Name,
+		"description":    &w.Description,
+		"galaxytool":     &w.GalaxyTool,
+		"galaxyworkflow": &w.GalaxyWorkflow,
+		"inputlabel":     &w.InputLabel,
+		"localtool":      &w.LocalTool,
+		"inputformat":    &w.InputFormat,
+		"supportscale":   &w.SupportScale,
+		"estimator":      &w.Estimator,
+	} {
+		if cfg.IsSet(prefix + "." + field) {
+			*value = cfg.GetString(prefix + "." + field)
+		}
+	}
+	if cfg.IsSet(prefix + ".parameters") {
+		w.Parameters = cfg.GetStringMapString(prefix + ".parameters")
+	}
+	if cfg.IsSet(prefix + ".outputs") {
+		outputs := cfg.GetStringMapString(prefix + ".outputs")
+		for field, value := range map[string]*string{
+			"fbptree":     &w.Outputs.FbpTree,
+			"tbenormtree": &w.Outputs.TbeNormTree,
+			"tberawtree":  &w.Outputs.TbeRawTree,
+			"tbelogs":     &w.Outputs.TbeLogs,
+			"alignment":   &w.Outputs.Alignment,
+		} {
+			if name, ok := outputs[field]; ok {
+				*value = name
+			}
+		}
+	}
+	if cfg.IsSet(prefix + ".tools") {
+		w.Tools = stringList(cfg.Get(prefix + ".tools"))
+	}
+	if cfg.IsSet(prefix + ".citations") {
+		w.Citations = stringList(cfg.Get(prefix + ".citations"))
+	}
+	if cfg.IsSet(prefix + ".options") {
+		w.Options = optionList(cfg.Get(prefix + ".options"))
+	}
+}
+
+// Reads an array of option tables
+func optionList(value interface{}) (options []Option) {
+	options = make([]Option, 0)
+	list, ok := value.([]interface{})
+	if !ok {
+		return
+	}
+	for _, o := range list {
+		var fields map[string]interface{}
+		switch f := o.(type) {
+		case map[string]interface{}:
+			fields = f
+		default:
+			continue
+		}
+		opt := Option{Values: stringList(fields["values"])}
+		opt.Name, _ = fields["name"].(string)
+		opt.Label, _ = fields["label"].(string)
+		opt.Default, _ = fields["default"].(string)
+		options = append(options, opt)
+	}
+	return
+}
+
+func stringList(value interface{}) (list []string) {
+	list = make([]string, 0)
+	switch v := value.(type) {
+	case []string:
+		list = append(list, v...)
+	case []interface{}:
+		for _, s := range v {
+			list = append(list, fmt.Sprintf("%v", s))
+		}
+	case string:
+		list = append(list, v)
+	}
+	return
+}
+
+// Checks that the workflow definition is consistent
+func (w *Workflow) check() (err error) {
+	if w.Id == model.WORKFLOW_NIL {
+		return fmt.Errorf("Workflow %s: id %d is reserved", w.Key, w.Id)
+	}
+	if w.Name == "" {
+		return fmt.Errorf("Workflow %s: no name given", w.Key)
+	}
+	if w.InputFormat != FORMAT_PHYLIP && w.InputFormat != FORMAT_FASTA {
+		return fmt.Errorf("Workflow %s: unknown input format %s", w.Key, w.InputFormat)
+	}
+	if w.SupportScale != "" && w.SupportScale != SCALE_NBOOTREP {
+		if scale, e := strconv.ParseFloat(w.SupportScale, 64); e != nil || scale <= 0 {
+			return fmt.Errorf("Workflow %s: wrong support scale %s", w.Key, w.SupportScale)
+		}
+	}
+	if _, ok := estimators[w.Estimator]; w.Estimator != "" && !ok {
+		return fmt.Errorf("Workflow %s: unknown resource estimator %s", w.Key, w.Estimator)
+	}
+	if w.GalaxyTool != "" && w.GalaxyWorkflow != "" {
+		return fmt.Errorf("Workflow %s: galaxy tool and galaxy workflow cannot be both given", w.Key)
+	}
+	if w.GalaxyWorkflow != "" {
+		for name := range w.Parameters {
+			if !strings.Contains(name, ":") {
+				return fmt.Errorf("Workflow %s: galaxy workflow parameter %s must be given as <step>:<name>", w.Key, name)
+			}
+		}
+	}
+	if w.OnGalaxy() && (w.Outputs.FbpTree == "" || w.Outputs.TbeNormTree == "" || w.Outputs.TbeRawTree == "" || w.Outputs.TbeLogs == "") {
+		return fmt.Errorf("Workflow %s: all galaxy outputs must be given", w.Key)
+	}
+	for _, o := range w.Options {
+		if o.Name == "" || len(o.Values) == 0 {
+			return fmt.Errorf("Workflow %s: options must have a name and values", w.Key)
+		}
+		if !o.Allows(o.Default) {
+			return fmt.Errorf("Workflow %s: default value %s of option %s is not allowed", w.Key, o.Default, o.Name)
+		}
+	}
+	for name, value := range w.Parameters {
+		if _, err = template.New(name).Parse(value); err != nil {
+			return fmt.Errorf("Workflow %s: wrong template for parameter %s: %v", w.Key, name, err)
+		}
+	}
+	return
+}
+
+// Returns the workflow with the given id
+func (r *Registry) Get(id int) (w *Workflow, ok bool) {
+	w, ok = r.workflows[id]
+	return
+}
+
+// Returns the workflow with the given name
+func (r *Registry) ByName(name string) (w *Workflow, ok bool) {
+	for _, w = range r.workflows {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return nil, false
+}
+
+// Returns all the workflows, sorted by id
+func (r *Registry) All() (workflows []*Workflow) {
+	workflows = make([]*Workflow, 0, len(r.workflows))
+	for _, w := range r.workflows {
+		workflows = append(workflows, w)
+	}
+	sort.Slice(workflows, func(i, j int) bool { return workflows[i].Id < workflows[j].Id })
+	return
+}
+
+// Returns true if the workflow may be launched on galaxy (tool or workflow)
+func (w *Workflow) OnGalaxy() bool {
+	return w.GalaxyTool != "" || w.GalaxyWorkflow != ""
+}
+
+// Returns true if the given value is allowed for the option
+func (o Option) Allows(value string) bool {
+	for _, v := range o.Values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates the options given by the user, and returns
+// all the options of the workflow, with default values for
+// options that are not given
+func (w *Workflow) CheckOptions(given map[string]string) (options map[string]string, err error) {
+	options = make(map[string]string)
+	known := make(map[string]bool)
+	for _, o := range w.Options {
+		known[o.Name] = true
+		options[o.Name] = o.Default
+		if v, ok := given[o.Name]; ok && v != "" {
+			if !o.Allows(v) {
+				err = fmt.Errorf("Value %s of option %s is not allowed for %s workflow (allowed: %s)", v, o.Name, w.Name, strings.Join(o.Values, ", "))
+				return
+			}
+			options[o.Name] = v
+		}
+	}
+	for name := range given {
+		if !known[name] {
+			err = fmt.Errorf("Option %s does not exist for %s workflow", name, w.Name)
+			return
+		}
+	}
+	return
+}
+
+// Executes parameter templates for the given analysis
+func (w *Workflow) GalaxyParameters(a *model.Analysis) (params map[string]string, err error) {
+	var t *template.Template
+	data := ParameterData{
+		NbootRep: a.NbootRep,
+		NbSeqs:   a.AlignNbSeq,
+		Length:   a.AlignLength,
+		Options:  a.Options,
+	}
+	switch a.AlignAlphabet {
+	case model.ALIGN_NUCLEOTIDS:
+		data.Alphabet, data.Nucleotides = "nt", true
+	case model.ALIGN_AMINOACIDS:
+		data.Alphabet, data.AminoAcids = "aa", true
+	default:
+		err = errors.New("Unkown sequence alphabet in alignment")
+		return
+	}
+
+	params = make(map[string]string)
+	for name, value := range w.Parameters {
+		var b bytes.Buffer
+		if t, err = template.New(name).Option("missingkey=zero").Parse(value); err != nil {
+			return
+		}
+		if err = t.Execute(&b, data); err != nil {
+			return
+		}
+		params[name] = b.String()
+	}
+	return
+}
+
+// Factor to apply to the supports of the output tree to get FBP supports in [0,1]
+func (w *Workflow) SupportFactor(a *model.Analysis) float64 {
+	switch w.SupportScale {
+	case "":
+		return 1.0
+	case SCALE_NBOOTREP:
+		return 1.0 / float64(a.NbootRep)
+	default:
+		scale, _ := strconv.ParseFloat(w.SupportScale, 64)
+		return 1.0 / scale
+	}
+}
+
+// Estimates the memory and the run time of the workflow, if
+// an estimator is defined
+func (w *Workflow) Estimate(a *model.Analysis) (mem, time float64, ok bool) {
+	var estimator func(a *model.Analysis) (mem, time float64)
+	if estimator, ok = estimators[w.Estimator]; ok {
+		mem, time = estimator(a)
+	}
+	return
+}